@@ -7,7 +7,10 @@ require (
 	github.com/creack/pty v1.1.18
 	github.com/fsnotify/fsnotify v1.6.0
 	github.com/google/uuid v1.3.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
 	golang.org/x/mod v0.5.1
 	golang.org/x/sys v0.10.0
 	mvdan.cc/sh/v3 v3.7.0
 )
+
+require github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
@@ -0,0 +1,32 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// true for a file opened with O_APPEND.  uses SyscallConn (not Fd) so the file stays non-blocking.
+func isAppendFile(fd io.WriteCloser) bool {
+	file, ok := fd.(*os.File)
+	if !ok {
+		return false
+	}
+	rawConn, err := file.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var flags int
+	var flagsErr error
+	err = rawConn.Control(func(sysFd uintptr) {
+		flags, flagsErr = unix.FcntlInt(sysFd, unix.F_GETFL, 0)
+	})
+	if err != nil || flagsErr != nil {
+		return false
+	}
+	return flags&unix.O_APPEND != 0
+}
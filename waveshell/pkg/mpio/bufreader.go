@@ -4,8 +4,12 @@
 package mpio
 
 import (
+	"bytes"
+	"fmt"
 	"io"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
 )
@@ -15,10 +19,67 @@ type FdReader struct {
 	M             *Multiplexer
 	FdNum         int
 	Fd            io.ReadCloser
-	BufSize       int
+	BufSize       int   // bytes sent but not yet acked
+	NumSent       int64 // total (wire) bytes sent in data packets
+	WindowSize    int   // max unacked bytes (defaults to ReadBufSize)
+	MaxPacketSize int   // max data bytes per packet, 0 for no limit (set by the handshake)
 	Closed        bool
+	CloseReason   string
+	StopCh        chan bool // closed by closeWithReason before the fd, ReadLoop checks it before every read
+	Paused        bool
+	MemPaused     bool // paused by session memory pressure (see MemoryBudget)
+	Bulk          bool // acks do not hold back the data (see SetFdBulkMode)
 	ShouldCloseFd bool
 	IsPty         bool
+	ChildExited   bool // see SetPtyChildExited
+	IdleTimeout   time.Duration
+	ReadDeadline  time.Duration
+	AckStallTs    time.Time
+	LineBuffered  bool   // data is held until a newline (or MaxLineBufferSize), see splitLines
+	Encoding      string // data packet encoding (see SetFdEncoding), "" for base64
+	LastReadTs    time.Time
+	Transform     func([]byte) []byte // optional, applied to data before it is encoded into a packet
+	Tee           io.Writer           // optional, gets a copy of the data read (see SetFdTee)
+	TransformAcks []transformAck      // transformed packets not yet (fully) acked
+
+	MaxPacketsInFlight int   // when > 0, max data packets sent but not (fully) acked
+	InFlight           []int // wire lengths of the unacked packets (only tracked with MaxPacketsInFlight)
+
+	NumAcked  int64         // total (wire) bytes acked
+	SentMarks []sentMark    // unacked data packets, for the ack round trip (see MuxStats.AckRtt)
+	AckRtt    time.Duration // moving average (0 until the first full ack)
+
+	NumSegments int          // segment boundaries sent (see FlushPtyReader)
+	FlushReqs   []chan error // pending FlushPtyReader calls
+	Poller      *ptyPoller   // set while the ReadLoop of a pty file runs
+
+	// adaptive ReadLoop buffer (see SetFdAdaptiveReadBuf), ReadBufMin 0 for a fixed buffer
+	ReadBufMin    int
+	ReadBufMax    int
+	ReadBufGrowth int
+	ReadSizeHint  int // see SetFdReadSizeHint
+
+	// ring reader (see SetFdRingBuffer), RingSize 0 for a blocking reader
+	RingSize         int
+	Ring             []byte
+	RingEof          bool
+	RingDropped      int   // discarded since the last data packet (reported in its Dropped)
+	RingDroppedTotal int64 // total bytes discarded
+
+	Quiesced bool // see Multiplexer.Quiesce
+	Sending  bool // a packet is being sent (see sendPacket_unlock)
+}
+
+// a data packet is fully acked once NumAcked reaches End (the NumSent after it)
+type sentMark struct {
+	End int64
+	Ts  time.Time
+}
+
+// the client acks the (transformed) bytes it received, BufSize is tracked in original bytes
+type transformAck struct {
+	WireLen int
+	OrigLen int
 }
 
 func MakeFdReader(m *Multiplexer, fd io.ReadCloser, fdNum int, shouldCloseFd bool, isPty bool) *FdReader {
@@ -28,6 +89,8 @@ func MakeFdReader(m *Multiplexer, fd io.ReadCloser, fdNum int, shouldCloseFd boo
 		FdNum:         fdNum,
 		Fd:            fd,
 		BufSize:       0,
+		StopCh:        make(chan bool),
+		WindowSize:    ReadBufSize,
 		ShouldCloseFd: shouldCloseFd,
 		IsPty:         isPty,
 	}
@@ -35,14 +98,37 @@ func MakeFdReader(m *Multiplexer, fd io.ReadCloser, fdNum int, shouldCloseFd boo
 }
 
 func (r *FdReader) Close() {
+	r.closeWithReason(CloseReasonTeardown)
+}
+
+func (r *FdReader) closeWithReason(reason string) {
 	r.CVar.L.Lock()
 	defer r.CVar.L.Unlock()
 	if r.Closed {
 		return
 	}
+	r.Closed = true
+	r.CloseReason = reason
+	// a loop that is not in a read stops on the channel, only a blocked read needs the fd close
+	close(r.StopCh)
 	if r.Fd != nil && r.ShouldCloseFd {
 		r.Fd.Close()
 	}
+	if r.Poller != nil {
+		r.Poller.wake()
+	}
+	for _, flushCh := range r.FlushReqs {
+		flushCh <- fmt.Errorf("%w (fd:%d) reason=%s", ErrFdClosed, r.FdNum, reason)
+	}
+	r.FlushReqs = nil
+	r.CVar.Broadcast()
+}
+
+// a paused reader does not send any data (ReadLoop blocks before emitting what it read), acks are still processed
+func (r *FdReader) SetPaused(paused bool) {
+	r.CVar.L.Lock()
+	defer r.CVar.L.Unlock()
+	r.Paused = paused
 	r.CVar.Broadcast()
 }
 
@@ -52,26 +138,115 @@ func (r *FdReader) GetBufSize() int {
 	return r.BufSize
 }
 
-func (r *FdReader) NotifyAck(ackLen int) {
+// negative acks are ignored and acks larger than the outstanding bytes are clamped, both return an error
+func (r *FdReader) NotifyAck(ackLen int) error {
 	r.CVar.L.Lock()
 	defer r.CVar.L.Unlock()
 	if r.Closed {
-		return
+		return nil
+	}
+	if ackLen < 0 {
+		return fmt.Errorf("%w: negative ack %d", ErrBadAck, ackLen)
+	}
+	var rtnErr error
+	outstanding := r.wireUnackedBytes()
+	if ackLen > outstanding {
+		rtnErr = fmt.Errorf("%w: ack %d exceeds %d outstanding bytes", ErrBadAck, ackLen, outstanding)
+		ackLen = outstanding
+	}
+	r.ackInFlight(ackLen)
+	r.updateAckRtt(ackLen)
+	if r.Transform != nil || len(r.TransformAcks) > 0 {
+		ackLen = r.origAckLen(ackLen)
 	}
 	r.BufSize -= ackLen
 	if r.BufSize < 0 {
 		r.BufSize = 0
 	}
 	r.CVar.Broadcast()
+	return rtnErr
+}
+
+// removes the fully acked packets from InFlight, must hold lock
+func (r *FdReader) ackInFlight(wireAckLen int) {
+	for wireAckLen > 0 && len(r.InFlight) > 0 {
+		if wireAckLen < r.InFlight[0] {
+			r.InFlight[0] -= wireAckLen
+			return
+		}
+		wireAckLen -= r.InFlight[0]
+		r.InFlight = r.InFlight[1:]
+	}
+}
+
+// one sample per ack, the newest packet it completes (like a cumulative tcp ack), must hold lock
+func (r *FdReader) updateAckRtt(wireAckLen int) {
+	r.NumAcked += int64(wireAckLen)
+	var sampleTs time.Time
+	for len(r.SentMarks) > 0 && r.SentMarks[0].End <= r.NumAcked {
+		sampleTs = r.SentMarks[0].Ts
+		r.SentMarks = r.SentMarks[1:]
+	}
+	if sampleTs.IsZero() {
+		return
+	}
+	sample := r.M.Clock.Now().Sub(sampleTs)
+	if r.AckRtt == 0 {
+		r.AckRtt = sample
+	} else {
+		r.AckRtt += (sample - r.AckRtt) / AckRttSmoothing
+	}
+	r.M.setAckRtt(r.FdNum, r.AckRtt)
+}
+
+func (r *FdReader) packetsInFlightFull() bool {
+	return r.MaxPacketsInFlight > 0 && len(r.InFlight) >= r.MaxPacketsInFlight
+}
+
+// unacked bytes as sent on the wire (after Transform), must hold lock
+func (r *FdReader) wireUnackedBytes() int {
+	if r.Transform == nil && len(r.TransformAcks) == 0 {
+		return r.BufSize
+	}
+	rtn := 0
+	for _, ta := range r.TransformAcks {
+		rtn += ta.WireLen
+	}
+	return rtn
+}
+
+// converts an ack of transformed (wire) bytes to original bytes, must hold lock
+func (r *FdReader) origAckLen(wireAckLen int) int {
+	origAckLen := 0
+	for wireAckLen > 0 && len(r.TransformAcks) > 0 {
+		head := &r.TransformAcks[0]
+		if wireAckLen >= head.WireLen {
+			origAckLen += head.OrigLen
+			wireAckLen -= head.WireLen
+			r.TransformAcks = r.TransformAcks[1:]
+			continue
+		}
+		partialOrig := head.OrigLen * wireAckLen / head.WireLen
+		origAckLen += partialOrig
+		head.OrigLen -= partialOrig
+		head.WireLen -= wireAckLen
+		wireAckLen = 0
+	}
+	return origAckLen
 }
 
 // !! inverse locking.  must already hold the lock when you call this method.
 // will *unlock*, send the packet, and then *relock* once it is done.
 // this can prevent an unlikely deadlock where we are holding r.CVar.L and stuck on sender.SendCh
 func (r *FdReader) sendPacket_unlock(pk packet.PacketType) {
+	r.Sending = true
 	r.CVar.L.Unlock()
-	defer r.CVar.L.Lock()
-	r.M.sendPacket(pk)
+	defer func() {
+		r.CVar.L.Lock()
+		r.Sending = false
+		r.CVar.Broadcast() // wakes Quiesce
+	}()
+	r.M.sendReaderPacket(r.FdNum, pk)
 }
 
 // returns (success)
@@ -79,19 +254,68 @@ func (r *FdReader) WriteWait(data []byte, isEof bool) bool {
 	r.CVar.L.Lock()
 	defer r.CVar.L.Unlock()
 	for {
-		bufAvail := ReadBufSize - r.BufSize
+		bufAvail := r.WindowSize - r.BufSize
+		if r.Bulk {
+			bufAvail = r.WindowSize
+		}
 		if r.Closed {
 			return false
 		}
-		if bufAvail == 0 {
+		// AckStallTs marks how long we have been waiting on the client's acks (SlowConsumerThreshold)
+		ackWait := bufAvail <= 0 || (!r.Bulk && r.packetsInFlightFull())
+		paused := r.Paused || r.MemPaused || r.Quiesced
+		if ackWait || paused {
+			if ackWait && !paused {
+				if r.AckStallTs.IsZero() {
+					r.AckStallTs = r.M.Clock.Now()
+				}
+			} else {
+				r.AckStallTs = time.Time{}
+			}
 			r.CVar.Wait()
 			continue
 		}
+		r.AckStallTs = time.Time{}
 		writeLen := min(bufAvail, len(data))
-		pk := r.M.makeDataPacket(r.FdNum, data[0:writeLen], nil)
-		pk.Eof = isEof && (writeLen == len(data))
-		r.BufSize += writeLen
+		if r.MaxPacketSize > 0 {
+			writeLen = min(writeLen, r.MaxPacketSize)
+		}
+		if wireLimit := r.maxWireDataLen(); wireLimit > 0 {
+			writeLen = min(writeLen, wireLimit)
+		}
+		wireData := data[0:writeLen]
+		pkEof := isEof && (writeLen == len(data))
+		if r.Transform != nil && writeLen > 0 {
+			wireData = r.Transform(wireData)
+			if len(wireData) > 0 {
+				r.TransformAcks = append(r.TransformAcks, transformAck{WireLen: len(wireData), OrigLen: writeLen})
+				r.BufSize += writeLen
+			}
+		} else {
+			r.BufSize += writeLen
+		}
 		data = data[writeLen:]
+		if len(wireData) == 0 && !pkEof && writeLen > 0 {
+			// fully filtered by the transform, nothing to send (or ack)
+			if len(data) == 0 {
+				return true
+			}
+			continue
+		}
+		pk := r.M.makeDataPacket(r.FdNum, wireData, nil)
+		if r.Encoding != "" && r.M.Format != packet.FormatMsgpack {
+			pk.SetData(r.Encoding, wireData)
+		}
+		pk.Eof = pkEof
+		pk.Dropped = r.RingDropped
+		r.RingDropped = 0
+		r.NumSent += int64(len(wireData))
+		if len(wireData) > 0 {
+			r.SentMarks = append(r.SentMarks, sentMark{End: r.NumSent, Ts: r.M.Clock.Now()})
+		}
+		if r.MaxPacketsInFlight > 0 && len(wireData) > 0 {
+			r.InFlight = append(r.InFlight, len(wireData))
+		}
 		r.sendPacket_unlock(pk)
 		if len(data) == 0 {
 			return true
@@ -101,6 +325,19 @@ func (r *FdReader) WriteWait(data []byte, isEof bool) bool {
 	}
 }
 
+// returns the complete lines to send and the partial line to hold.  everything is sent at EOF
+// or once the held data reaches MaxLineBufferSize.
+func splitLines(lineBuf []byte, isEof bool) ([]byte, []byte) {
+	if isEof || len(lineBuf) >= MaxLineBufferSize {
+		return lineBuf, nil
+	}
+	lastNl := bytes.LastIndexByte(lineBuf, '\n')
+	if lastNl == -1 {
+		return nil, lineBuf
+	}
+	return lineBuf[0 : lastNl+1], append([]byte(nil), lineBuf[lastNl+1:]...)
+}
+
 func min(v1 int, v2 int) int {
 	if v1 <= v2 {
 		return v1
@@ -108,39 +345,373 @@ func min(v1 int, v2 int) int {
 	return v2
 }
 
+// waits until fn (called with cvar.L held) returns true, returns false if doneCh is closed first
+func waitCVar(doneCh <-chan struct{}, cvar *sync.Cond, fn func() bool) bool {
+	expired := false // synchronized (cvar.L)
+	stopCh := make(chan bool)
+	defer close(stopCh)
+	go func() {
+		select {
+		case <-doneCh:
+		case <-stopCh:
+			return
+		}
+		cvar.L.Lock()
+		defer cvar.L.Unlock()
+		expired = true
+		cvar.Broadcast()
+	}()
+	cvar.L.Lock()
+	defer cvar.L.Unlock()
+	for !expired && !fn() {
+		cvar.Wait()
+	}
+	return fn()
+}
+
+// returns true once nothing is unacked (or the reader is closed), false if doneCh is closed first
+func (r *FdReader) waitForAcks(doneCh <-chan struct{}) bool {
+	return waitCVar(doneCh, r.CVar, func() bool { return r.Closed || r.BufSize == 0 })
+}
+
+// a failed tee is dropped (with an EventTeeError), it never stops the fd
+func (r *FdReader) writeTee(data []byte) {
+	r.CVar.L.Lock()
+	tee := r.Tee
+	r.CVar.L.Unlock()
+	if tee == nil {
+		return
+	}
+	_, err := tee.Write(data)
+	if err == nil {
+		return
+	}
+	r.CVar.L.Lock()
+	if r.Tee == tee {
+		r.Tee = nil
+	}
+	r.CVar.L.Unlock()
+	r.M.emitEvent(&MuxEvent{Type: EventTeeError, FdNum: r.FdNum, Error: err})
+}
+
 func (r *FdReader) isClosed() bool {
 	r.CVar.L.Lock()
 	defer r.CVar.L.Unlock()
 	return r.Closed
 }
 
+func (r *FdReader) markRead() {
+	r.CVar.L.Lock()
+	defer r.CVar.L.Unlock()
+	r.LastReadTs = r.M.Clock.Now()
+}
+
+// emits an idle event every IdleTimeout that no data has been read (does not close the fd)
+func (r *FdReader) idleLoop(idleTimeout time.Duration, stopCh chan bool) {
+	timer := r.M.Clock.NewTimer(idleTimeout)
+	defer timer.Stop()
+	var lastEventTs time.Time
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-r.StopCh:
+			return
+		case <-timer.C():
+		}
+		r.CVar.L.Lock()
+		lastReadTs := r.LastReadTs
+		closed := r.Closed
+		r.CVar.L.Unlock()
+		if closed {
+			return
+		}
+		now := r.M.Clock.Now()
+		idleSince := lastReadTs
+		if lastEventTs.After(idleSince) {
+			idleSince = lastEventTs
+		}
+		wait := idleTimeout - now.Sub(idleSince)
+		if wait <= 0 {
+			r.M.emitEvent(&MuxEvent{Type: EventIdle, FdNum: r.FdNum, Duration: now.Sub(lastReadTs)})
+			lastEventTs = now
+			wait = idleTimeout
+		}
+		timer.Reset(wait)
+	}
+}
+
+// emits an EventSlowConsumer once a WriteWait has been stalled on acks for threshold (once per stall)
+func (r *FdReader) slowConsumerLoop(threshold time.Duration, stopCh chan bool) {
+	timer := r.M.Clock.NewTimer(threshold)
+	defer timer.Stop()
+	var reportedStall time.Time
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-r.StopCh:
+			return
+		case <-timer.C():
+		}
+		r.CVar.L.Lock()
+		stallTs := r.AckStallTs
+		unacked := r.BufSize
+		r.CVar.L.Unlock()
+		wait := threshold
+		if !stallTs.IsZero() && !stallTs.Equal(reportedStall) {
+			stalled := r.M.Clock.Now().Sub(stallTs)
+			if stalled >= threshold {
+				err := fmt.Errorf("reader fd:%d waiting %v for acks (%d bytes unacked)", r.FdNum, stalled, unacked)
+				r.M.emitEvent(&MuxEvent{Type: EventSlowConsumer, FdNum: r.FdNum, Duration: stalled, Error: err})
+				reportedStall = stallTs
+			} else {
+				wait = threshold - stalled
+			}
+		}
+		timer.Reset(wait)
+	}
+}
+
+// closes the reader once readDeadline has passed, ReadLoop sends the error (see sendDeadlineError)
+func (r *FdReader) deadlineLoop(readDeadline time.Duration, stopCh chan bool) {
+	timer := r.M.Clock.NewTimer(readDeadline)
+	defer timer.Stop()
+	select {
+	case <-stopCh:
+		return
+	case <-r.StopCh:
+		return
+	case <-timer.C():
+	}
+	r.closeWithReason(CloseReasonDeadline)
+}
+
+func (r *FdReader) sendDeadlineError(readDeadline time.Duration) {
+	if r.getCloseReason() != CloseReasonDeadline {
+		return
+	}
+	err := fmt.Errorf("%w (fd:%d) after %v", ErrReadDeadline, r.FdNum, readDeadline)
+	errPk := r.M.makeDataPacket(r.FdNum, nil, err)
+	errPk.ErrPos = r.getNumSent()
+	r.M.sendReaderPacket(r.FdNum, errPk)
+}
+
+func (r *FdReader) getNumSent() int64 {
+	r.CVar.L.Lock()
+	defer r.CVar.L.Unlock()
+	return r.NumSent
+}
+
+func (r *FdReader) getCloseReason() string {
+	r.CVar.L.Lock()
+	defer r.CVar.L.Unlock()
+	return r.CloseReason
+}
+
+// called when the poll of a pty reader is woken (FlushPtyReader) or times out while draining.
+// a wake starts draining: reads continue until no output arrives for PtyFlushDrainTime, then the
+// remaining partial line (LineBuffered) and the segment boundary are sent.  returns the new
+// lineBuf and draining state, false if the reader was closed.
+func (r *FdReader) handleFlushWake(lineBuf []byte, draining bool, woken bool) ([]byte, bool, bool) {
+	r.CVar.L.Lock()
+	hasFlushReqs := len(r.FlushReqs) > 0
+	r.CVar.L.Unlock()
+	if !hasFlushReqs {
+		return lineBuf, false, true
+	}
+	if woken {
+		return lineBuf, true, true
+	}
+	if len(lineBuf) > 0 {
+		if !r.WriteWait(lineBuf, false) {
+			return nil, false, false
+		}
+	}
+	r.CVar.L.Lock()
+	defer r.CVar.L.Unlock()
+	if r.Closed {
+		return nil, false, false
+	}
+	flushReqs := r.FlushReqs
+	r.FlushReqs = nil
+	r.NumSegments++
+	pk := r.M.makeDataPacket(r.FdNum, nil, nil)
+	pk.SegmentEnd = r.NumSegments
+	r.sendPacket_unlock(pk)
+	for _, flushCh := range flushReqs {
+		flushCh <- nil
+	}
+	return nil, false, true
+}
+
+// pty readers that are files get a poller (see ptyPoller), must hold lock
+func (r *FdReader) startPtyPoller() *ptyPoller {
+	f, ok := r.Fd.(*os.File)
+	if !r.IsPty || !ok {
+		return nil
+	}
+	poller, err := makePtyPoller(f)
+	if err != nil {
+		return nil
+	}
+	r.Poller = poller
+	if len(r.FlushReqs) > 0 {
+		poller.wake()
+	}
+	return poller
+}
+
+func (r *FdReader) isChildExited() bool {
+	r.CVar.L.Lock()
+	defer r.CVar.L.Unlock()
+	return r.ChildExited
+}
+
+func (r *FdReader) stopPtyPoller(poller *ptyPoller) {
+	r.CVar.L.Lock()
+	defer r.CVar.L.Unlock()
+	r.Poller = nil
+	poller.close()
+}
+
 func (r *FdReader) ReadLoop(wg *sync.WaitGroup) {
-	defer r.Close()
 	if wg != nil {
 		defer wg.Done()
 	}
-	buf := make([]byte, 4096)
+	defer r.M.trackLoop(FdDirReader, r.FdNum)()
+	defer func() {
+		closeReason := r.getCloseReason()
+		r.M.recordFdClose(r.FdNum, FdDirReader, closeReason)
+		r.M.emitEvent(&MuxEvent{Type: EventFdClosed, FdNum: r.FdNum, Dir: FdDirReader, CloseReason: closeReason})
+	}()
+	defer r.Close()
+	r.markRead()
+	r.CVar.L.Lock()
+	idleTimeout := r.IdleTimeout
+	readDeadline := r.ReadDeadline
+	lineBuffered := r.LineBuffered
+	poller := r.startPtyPoller()
+	bufSizer := makeReadBufSizer(r.ReadBufMin, r.ReadBufMax, r.ReadBufGrowth, r.ReadSizeHint)
+	var ringDoneCh chan bool
+	if r.RingSize > 0 {
+		ringDoneCh = make(chan bool)
+		go r.ringSendLoop(ringDoneCh)
+	}
+	r.CVar.L.Unlock()
+	// a ring reader queues the data (never blocking on the window), the EOF waits for the ring to drain
+	emitData := func(data []byte, isEof bool) bool {
+		if ringDoneCh == nil {
+			return r.WriteWait(data, isEof)
+		}
+		if !r.ringAdd(data, isEof) {
+			return false
+		}
+		if isEof {
+			<-ringDoneCh
+			return !r.isClosed()
+		}
+		return true
+	}
+	if poller != nil {
+		defer r.stopPtyPoller(poller)
+	}
+	if idleTimeout > 0 {
+		stopCh := make(chan bool)
+		defer close(stopCh)
+		go r.idleLoop(idleTimeout, stopCh)
+	}
+	if r.M.SlowConsumerThreshold > 0 {
+		stopCh := make(chan bool)
+		defer close(stopCh)
+		go r.slowConsumerLoop(r.M.SlowConsumerThreshold, stopCh)
+	}
+	if readDeadline > 0 {
+		stopCh := make(chan bool)
+		defer close(stopCh)
+		go r.deadlineLoop(readDeadline, stopCh)
+		// sent from the ReadLoop so it follows any data packet in progress
+		defer r.sendDeadlineError(readDeadline)
+	}
+	var lineBuf []byte // partial line (LineBuffered)
+	draining := false  // FlushPtyReader in progress
 	for {
+		select {
+		case <-r.StopCh:
+			return
+		default:
+		}
+		if poller != nil {
+			timeout := time.Duration(-1)
+			childExited := r.isChildExited()
+			if draining || childExited {
+				timeout = PtyFlushDrainTime
+			}
+			readable, woken, err := poller.wait(timeout)
+			if r.isClosed() {
+				return
+			}
+			if err == nil && (woken || !readable) {
+				var isOpen bool
+				lineBuf, draining, isOpen = r.handleFlushWake(lineBuf, draining, woken)
+				if !isOpen {
+					return
+				}
+				if !readable {
+					if childExited && !woken {
+						// drained, nothing more can be written to the pty
+						emitData(lineBuf, true)
+						r.closeWithReason(CloseReasonEof)
+						r.M.notifyPtyEof(r.FdNum)
+						return
+					}
+					continue
+				}
+			}
+		}
+		buf := bufSizer.Buf
 		nr, err := r.Fd.Read(buf)
 		if r.isClosed() {
 			return // should not send data or error if we already closed the fd
 		}
-		if nr > 0 || err == io.EOF {
-			isOpen := r.WriteWait(buf[0:nr], (err == io.EOF))
+		if nr > 0 {
+			r.markRead()
+		}
+		// data is encoded (copied) before the next read, so the buffer can be replaced here
+		bufSizer.observe(nr, r.M.Clock.Now())
+		data := buf[0:nr]
+		if lineBuffered {
+			data, lineBuf = splitLines(append(lineBuf, data...), err != nil)
+		}
+		if len(data) > 0 {
+			r.writeTee(data)
+		}
+		if len(data) > 0 || err == io.EOF {
+			isOpen := emitData(data, (err == io.EOF))
 			if !isOpen {
 				return
 			}
+			r.M.checkMemory()
 			if err == io.EOF {
+				r.closeWithReason(CloseReasonEof)
+				if r.IsPty {
+					r.M.notifyPtyEof(r.FdNum)
+				}
 				return
 			}
 		}
 		if err != nil {
 			if r.IsPty {
-				r.WriteWait(nil, true)
+				// reading a pty returns EIO once the child side is closed
+				emitData(nil, true)
+				r.closeWithReason(CloseReasonEof)
+				r.M.notifyPtyEof(r.FdNum)
 				return
 			}
 			errPk := r.M.makeDataPacket(r.FdNum, nil, err)
-			r.M.sendPacket(errPk)
+			errPk.ErrPos = r.getNumSent()
+			r.M.sendReaderPacket(r.FdNum, errPk)
+			r.closeWithReason(CloseReasonError)
 			return
 		}
 	}
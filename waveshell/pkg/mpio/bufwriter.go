@@ -4,11 +4,19 @@
 package mpio
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"sync"
+	"syscall"
+	"time"
 )
 
+// a writer closed during a write closes its fd once the write returns, or after this long (which
+// unblocks a write that is stuck on the consumer)
+const CloseWriteGraceTime = 100 * time.Millisecond
+
 type FdWriter struct {
 	CVar          *sync.Cond
 	M             *Multiplexer
@@ -18,8 +26,31 @@ type FdWriter struct {
 	Fd            io.WriteCloser
 	Eof           bool
 	Closed        bool
+	CloseReason   string
+	Paused        bool
+	Pending       bool   // UnknownFdBuffer placeholder, no Fd (data is taken by the registered writer)
+	Resumable     bool   // data packets may set an Offset (see MakeResumableFileWriter)
+	PendingSeek   *int64 // offset for the buffered data, applied by WriteLoop
+	SuppressAcks  bool   // no progress acks (error and EOF acks are still sent), see SetFdSuppressAcks
+	AckHold       bool   // progress acks are held (session memory pressure, see MemoryBudget)
+	HeldAck       int    // bytes written but not acked because of AckHold
+	EofSentinel   []byte // see SetFdEofSentinel
+	SentinelHeld  []byte // partial sentinel match at the end of the data so far
 	ShouldCloseFd bool
+	AppendMode    bool // an O_APPEND file, every batch is a single write (see MakeRawFdWriter)
 	Desc          string
+	NumWrites     int       // number of Fd.Write calls (synchronized)
+	NumAdded      int64     // total bytes buffered by AddData (see Flush)
+	NumWritten    int64     // total bytes written to Fd
+	Writing       bool      // WriteLoop is using Fd (synchronized), see beginWrite
+	WriteDoneCh   chan bool // closed by endWrite when a close is waiting on the write
+	FdClosed      bool
+
+	BulkAckInterval time.Duration // see SetFdBulkAcks, 0 for an ack per write batch
+	BulkPending     int           // bytes written since the last bulk ack
+
+	Quiesced bool // see Multiplexer.Quiesce
+	Parked   bool // WriteLoop is waiting in waitForData (synchronized)
 }
 
 func MakeFdWriter(m *Multiplexer, fd io.WriteCloser, fdNum int, shouldCloseFd bool, desc string) *FdWriter {
@@ -31,37 +62,227 @@ func MakeFdWriter(m *Multiplexer, fd io.WriteCloser, fdNum int, shouldCloseFd bo
 		ShouldCloseFd: shouldCloseFd,
 		Desc:          desc,
 		BufferLimit:   WriteBufSize,
+		AppendMode:    isAppendFile(fd),
 	}
 	return fw
 }
 
+type discardWriteCloser struct{}
+
+func (discardWriteCloser) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (discardWriteCloser) Close() error {
+	return nil
+}
+
+// returns the buffered data of a Pending placeholder and closes it
+func (w *FdWriter) takePending() ([]byte, bool) {
+	w.CVar.L.Lock()
+	defer w.CVar.L.Unlock()
+	data, eof := w.Buffer, w.Eof
+	w.Buffer = nil
+	w.Closed = true
+	w.CloseReason = CloseReasonTeardown
+	return data, eof
+}
+
 func (w *FdWriter) Close() {
+	w.closeWithReason(CloseReasonTeardown)
+}
+
+func (w *FdWriter) closeWithReason(reason string) {
 	w.CVar.L.Lock()
 	defer w.CVar.L.Unlock()
 	if w.Closed {
 		return
 	}
 	w.Closed = true
-	if w.Fd != nil && w.ShouldCloseFd {
-		w.Fd.Close()
+	w.CloseReason = reason
+	if w.Writing {
+		// closing the fd under an in-progress write can fail it with EBADF (or hit a reused fd)
+		w.WriteDoneCh = make(chan bool)
+		go w.closeFdAfterWrite(w.WriteDoneCh)
+	} else {
+		w.closeFd_nolock()
 	}
 	w.Buffer = nil
 	w.CVar.Broadcast()
 }
 
+// must hold w.CVar.L
+func (w *FdWriter) closeFd_nolock() {
+	if w.FdClosed || w.Fd == nil || !w.ShouldCloseFd {
+		return
+	}
+	w.FdClosed = true
+	w.Fd.Close()
+}
+
+func (w *FdWriter) closeFdAfterWrite(writeDoneCh chan bool) {
+	timer := w.M.Clock.NewTimer(CloseWriteGraceTime)
+	defer timer.Stop()
+	select {
+	case <-writeDoneCh:
+		return // closed by endWrite
+	case <-timer.C():
+	}
+	w.CVar.L.Lock()
+	defer w.CVar.L.Unlock()
+	w.closeFd_nolock()
+}
+
+// returns false if the writer is closed (Fd must not be used).  the fd stays open until endWrite.
+func (w *FdWriter) beginWrite() bool {
+	w.CVar.L.Lock()
+	defer w.CVar.L.Unlock()
+	if w.Closed {
+		return false
+	}
+	w.Writing = true
+	return true
+}
+
+// returns true if the writer was closed during the write (the result should be discarded)
+func (w *FdWriter) endWrite() bool {
+	w.CVar.L.Lock()
+	defer w.CVar.L.Unlock()
+	w.Writing = false
+	w.CVar.Broadcast() // wakes retarget
+	if !w.Closed {
+		return false
+	}
+	w.closeFd_nolock()
+	if w.WriteDoneCh != nil {
+		close(w.WriteDoneCh)
+		w.WriteDoneCh = nil
+	}
+	return true
+}
+
+// waits for the write in progress (Fd is only used between beginWrite and endWrite) and swaps in
+// fd, the data not yet written goes to fd.  returns the old fd, which is not closed.
+func (w *FdWriter) retarget(fd io.WriteCloser, shouldCloseFd bool) (io.WriteCloser, error) {
+	w.CVar.L.Lock()
+	defer w.CVar.L.Unlock()
+	for w.Writing && !w.Closed {
+		w.CVar.Wait()
+	}
+	if w.Closed || w.Eof {
+		return nil, fmt.Errorf("cannot retarget %q (fd:%d): %w", w.Desc, w.FdNum, ErrFdClosed)
+	}
+	if w.Fd == nil {
+		return nil, fmt.Errorf("cannot retarget fd:%d, no writer registered: %w", w.FdNum, ErrNoSuchFd)
+	}
+	oldFd := w.Fd
+	w.Fd = fd
+	w.ShouldCloseFd = shouldCloseFd
+	w.AppendMode = isAppendFile(fd)
+	return oldFd, nil
+}
+
+// a paused writer keeps buffering data (up to BufferLimit) but does not write it to the fd
+func (w *FdWriter) SetPaused(paused bool) {
+	w.CVar.L.Lock()
+	defer w.CVar.L.Unlock()
+	w.Paused = paused
+	w.CVar.Broadcast()
+}
+
+// graceful EOF, WriteLoop delivers the buffered data, closes the fd, and sends an EOF ack
+func (w *FdWriter) FlushAndClose() {
+	w.AddData(nil, true)
+}
+
+// discards any buffered data and closes the fd immediately
+func (w *FdWriter) Abort() {
+	w.Close()
+}
+
+func (w *FdWriter) isClosed() bool {
+	w.CVar.L.Lock()
+	defer w.CVar.L.Unlock()
+	return w.Closed
+}
+
+// like AddData, but waits for buffer space instead of failing (returns an error if the writer closes)
+func (w *FdWriter) addDataWait(data []byte, eof bool) error {
+	for {
+		w.CVar.L.Lock()
+		for !w.Closed && len(w.Buffer) > 0 && len(data)+len(w.Buffer) > w.bufferLimit_nolock() {
+			w.CVar.Wait()
+		}
+		w.CVar.L.Unlock()
+		err := w.AddData(data, eof)
+		if errors.Is(err, ErrBufferLimit) && len(w.getBuffer()) > 0 {
+			continue // raced with another AddData, wait for WriteLoop to drain
+		}
+		return err
+	}
+}
+
+func (w *FdWriter) getBuffer() []byte {
+	w.CVar.L.Lock()
+	defer w.CVar.L.Unlock()
+	return w.Buffer
+}
+
+// copies r into the writer's buffer (see MakeStreamWriterPipe)
+func (w *FdWriter) feedFrom(r io.Reader) {
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+	buf := make([]byte, MaxSingleWriteSize)
+	for {
+		nr, err := r.Read(buf)
+		if nr > 0 {
+			if w.addDataWait(buf[0:nr], false) != nil {
+				return
+			}
+		}
+		if err == io.EOF {
+			w.AddData(nil, true)
+			return
+		}
+		if err != nil {
+			w.closeWithReason(CloseReasonError)
+			return
+		}
+	}
+}
+
 func (w *FdWriter) WaitForData() ([]byte, bool) {
+	data, eof, _ := w.waitForData()
+	return data, eof
+}
+
+// also returns the pending seek (resumable writers), which must be applied before writing data
+func (w *FdWriter) waitForData() ([]byte, bool, *int64) {
 	w.CVar.L.Lock()
 	defer w.CVar.L.Unlock()
+	defer func() { w.Parked = false }()
 	for {
-		if len(w.Buffer) > 0 || w.Eof || w.Closed {
+		if w.Closed || (!w.Paused && !w.Quiesced && (len(w.Buffer) > 0 || w.Eof || w.PendingSeek != nil)) {
 			toWrite := w.Buffer
+			seek := w.PendingSeek
 			w.Buffer = nil
-			return toWrite, w.Eof
+			w.PendingSeek = nil
+			w.CVar.Broadcast() // wakes addDataWait
+			return toWrite, w.Eof, seek
+		}
+		if !w.Parked {
+			w.Parked = true
+			w.CVar.Broadcast() // wakes Quiesce
 		}
 		w.CVar.Wait()
 	}
 }
 
+// data and eof can come together (a DataPacket with Eof set): the data is buffered first and WriteLoop
+// only closes the fd (CloseReasonEof) once all of it is written.  the progress acks cover the data,
+// the EOF ack that follows carries no AckLen.  if the data is rejected (closed, BufferLimit) the EOF
+// is not applied either.
 func (w *FdWriter) AddData(data []byte, eof bool) error {
 	w.CVar.L.Lock()
 	defer w.CVar.L.Unlock()
@@ -69,13 +290,24 @@ func (w *FdWriter) AddData(data []byte, eof bool) error {
 		if len(data) == 0 {
 			return nil
 		}
-		return fmt.Errorf("write to closed file %q (fd:%d) eof[%v]", w.Desc, w.FdNum, w.Eof)
+		if w.Fd == nil {
+			// placeholder writer for an fd that does not exist (see WriteDataToFd)
+			return fmt.Errorf("write to closed file (%w) (fd:%d)", ErrNoSuchFd, w.FdNum)
+		}
+		if w.CloseReason == CloseReasonConsumerClosed {
+			return fmt.Errorf("%w %q (fd:%d)", ErrConsumerClosed, w.Desc, w.FdNum)
+		}
+		return fmt.Errorf("%w %q (fd:%d) eof[%v]", ErrFdClosed, w.Desc, w.FdNum, w.Eof)
+	}
+	if w.EofSentinel != nil {
+		data, eof = w.matchEofSentinel_nolock(data, eof)
 	}
 	if len(data) > 0 {
-		if len(data)+len(w.Buffer) > w.BufferLimit {
-			return fmt.Errorf("write exceeds buffer size %q (fd:%d) bufsize=%d (max=%d)", w.Desc, w.FdNum, len(data)+len(w.Buffer), w.BufferLimit)
+		if bufferLimit := w.bufferLimit_nolock(); len(data)+len(w.Buffer) > bufferLimit {
+			return fmt.Errorf("%w %q (fd:%d) bufsize=%d (max=%d)", ErrBufferLimit, w.Desc, w.FdNum, len(data)+len(w.Buffer), bufferLimit)
 		}
 		w.Buffer = append(w.Buffer, data...)
+		w.NumAdded += int64(len(data))
 	}
 	if eof {
 		w.Eof = true
@@ -84,31 +316,165 @@ func (w *FdWriter) AddData(data []byte, eof bool) error {
 	return nil
 }
 
+func (w *FdWriter) incNumWrites() {
+	w.CVar.L.Lock()
+	defer w.CVar.L.Unlock()
+	w.NumWrites++
+}
+
+func (w *FdWriter) addWritten(nw int) {
+	w.CVar.L.Lock()
+	defer w.CVar.L.Unlock()
+	w.NumWritten += int64(nw)
+	w.CVar.Broadcast()
+}
+
+// blocks until WriteLoop has written all the data buffered when Flush was called (data added
+// later is not waited for), e.g. to know a command reached the process before reading its
+// response.  does not close the fd.  returns an error if the writer closes before the data is
+// written, or ctx.Err() if ctx is done first.
+func (w *FdWriter) Flush(ctx context.Context) error {
+	w.CVar.L.Lock()
+	target := w.NumAdded
+	w.CVar.L.Unlock()
+	waitCVar(ctx.Done(), w.CVar, func() bool { return w.Closed || w.NumWritten >= target })
+	w.CVar.L.Lock()
+	defer w.CVar.L.Unlock()
+	if w.NumWritten >= target {
+		return nil
+	}
+	if w.Closed {
+		return fmt.Errorf("%w %q (fd:%d) before flush, %d bytes not written", ErrFdClosed, w.Desc, w.FdNum, target-w.NumWritten)
+	}
+	return ctx.Err()
+}
+
+func (w *FdWriter) GetNumWrites() int {
+	w.CVar.L.Lock()
+	defer w.CVar.L.Unlock()
+	return w.NumWrites
+}
+
+func (w *FdWriter) getCloseReason() string {
+	w.CVar.L.Lock()
+	defer w.CVar.L.Unlock()
+	return w.CloseReason
+}
+
+// writes are coalesced: AddData appends to a single contiguous Buffer and waitForData hands all of it
+// to WriteLoop, so everything queued while a write is in progress goes out in MaxSingleWriteSize
+// chunks (one write per batch in AppendMode) rather than one write per AddData call.  acks are for
+// the bytes actually written (AckWatermark and SetFdBulkAcks coalesce them), so the ack total for
+// the fd always matches the sum of the queued data.
 func (w *FdWriter) WriteLoop(wg *sync.WaitGroup) {
-	defer w.Close()
 	if wg != nil {
 		defer wg.Done()
 	}
+	defer w.M.trackLoop(FdDirWriter, w.FdNum)()
+	defer func() {
+		closeReason := w.getCloseReason()
+		w.M.recordFdClose(w.FdNum, FdDirWriter, closeReason)
+		w.M.emitEvent(&MuxEvent{Type: EventFdClosed, FdNum: w.FdNum, Dir: FdDirWriter, CloseReason: closeReason})
+	}()
+	defer w.Close()
+	w.CVar.L.Lock()
+	suppressAcks := w.SuppressAcks
+	bulkAckInterval := w.BulkAckInterval
+	w.CVar.L.Unlock()
+	sendProgressAck := w.sendProgressAck
+	if bulkAckInterval > 0 && !suppressAcks {
+		stopCh := make(chan bool)
+		defer w.flushBulkAck()
+		defer close(stopCh)
+		go w.bulkAckLoop(bulkAckInterval, stopCh)
+		sendProgressAck = w.addBulkAck
+	}
 	for {
-		data, isEof := w.WaitForData()
+		data, isEof, seek := w.waitForData()
+		if w.isClosed() {
+			return
+		}
+		if seek != nil {
+			if !w.beginWrite() {
+				return
+			}
+			err := w.seekTo(*seek)
+			if w.endWrite() {
+				return
+			}
+			if err != nil {
+				w.M.sendPacket(w.M.makeDataAckPacket(w.FdNum, 0, err))
+				w.closeWithReason(CloseReasonError)
+				return
+			}
+		}
 		// chunk the writes to make sure we send ample ack packets
+		// with an AckWatermark, acks are coalesced until the watermark is reached, anything pending
+		// is acked once the batch is written so the sender's window never waits on a partial ack
+		pendingAck := 0
 		for len(data) > 0 {
-			if w.Closed {
+			if w.requeueIfQuiesced(data) {
+				isEof = false // still set on the writer, applied once the requeued data is written
+				break
+			}
+			if !w.beginWrite() {
 				return
 			}
 			chunkSize := min(len(data), MaxSingleWriteSize)
+			if w.AppendMode {
+				// whole records, a chunk boundary could interleave with another appender
+				chunkSize = len(data)
+			}
 			chunk := data[0:chunkSize]
 			nw, err := w.Fd.Write(chunk)
-			if nw > 0 || err != nil {
-				ack := w.M.makeDataAckPacket(w.FdNum, nw, err)
-				w.M.sendPacket(ack)
+			w.incNumWrites()
+			if w.endWrite() {
+				return // a teardown, not a write error
+			}
+			if errors.Is(err, syscall.EPIPE) {
+				err = fmt.Errorf("%w %q (fd:%d): %v", ErrConsumerClosed, w.Desc, w.FdNum, err)
+			}
+			if nw < 0 || nw > chunkSize {
+				nw = 0
+				err = fmt.Errorf("invalid write count %q (fd:%d)", w.Desc, w.FdNum)
+			} else if err == nil && nw < chunkSize {
+				// the rest of the chunk would be skipped (and a following EOF would close as if it was delivered)
+				err = fmt.Errorf("%w %q (fd:%d) wrote %d of %d bytes", io.ErrShortWrite, w.Desc, w.FdNum, nw, chunkSize)
+			}
+			w.addWritten(nw)
+			pendingAck += nw
+			if err != nil || pendingAck >= w.M.AckWatermark {
+				if err != nil {
+					w.flushBulkAck()
+					ack := w.M.makeDataAckPacket(w.FdNum, pendingAck, err)
+					w.M.sendPacket(ack)
+				} else if pendingAck > 0 && !suppressAcks {
+					sendProgressAck(pendingAck)
+				}
+				pendingAck = 0
+			}
+			if errors.Is(err, ErrConsumerClosed) {
+				w.closeWithReason(CloseReasonConsumerClosed)
+				return
 			}
 			if err != nil {
+				w.closeWithReason(CloseReasonError)
 				return
 			}
 			data = data[chunkSize:]
 		}
+		if pendingAck > 0 && !suppressAcks {
+			sendProgressAck(pendingAck)
+		}
+		w.M.checkMemory()
 		if isEof {
+			// all buffered data has been written, close and let the sender know EOF reached the fd
+			w.closeWithReason(CloseReasonEof)
+			w.setAckHold(false)
+			w.flushBulkAck()
+			ack := w.M.makeDataAckPacket(w.FdNum, 0, nil)
+			ack.EofAck = true
+			w.M.sendPacket(ack)
 			return
 		}
 	}
@@ -0,0 +1,93 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"fmt"
+	"time"
+)
+
+// writer buffer cap with bulk acks, as a multiple of its BufferLimit
+const BulkBufferFactor = 8
+
+// bulk mode is for reliable transports where the ack round trip (not the link) limits throughput.
+// a bulk reader sends as fast as the transport takes the data, acks only report progress.  the
+// receiving writer must be set up with SetFdBulkAcks (otherwise the data beyond its BufferLimit
+// closes it with CloseReasonQuota).  even then it is closed past BulkBufferFactor times the
+// BufferLimit, so a consumer slower than the transport still has a bound on the memory it costs.
+
+// the reader for fdNum no longer waits for acks (WindowSize and MaxPacketsInFlight only size the
+// packets), backpressure comes from the transport alone.  acks are still counted (UnackedBytes,
+// MuxStats), the unacked bytes do not count against MemoryBudget.
+func (m *Multiplexer) SetFdBulkMode(fdNum int, bulk bool) error {
+	fr, err := m.getFdReader(fdNum)
+	if err != nil {
+		return err
+	}
+	fr.CVar.L.Lock()
+	defer fr.CVar.L.Unlock()
+	fr.Bulk = bulk
+	fr.CVar.Broadcast()
+	return nil
+}
+
+// for a sender in bulk mode (see SetFdBulkMode): the writer for fdNum buffers the data past its
+// BufferLimit (MemoryBudget still applies) and sends one cumulative progress ack per interval
+// instead of one per write.  error and EOF acks are sent right away (after the pending progress).
+// the buffer is still capped at BulkBufferFactor times the BufferLimit (see bufferLimit_nolock).
+// 0 turns it off, set before starting IO.
+func (m *Multiplexer) SetFdBulkAcks(fdNum int, interval time.Duration) error {
+	if interval < 0 {
+		return fmt.Errorf("invalid bulk ack interval %v (fd:%d)", interval, fdNum)
+	}
+	fw, err := m.getFdWriter(fdNum)
+	if err != nil {
+		return err
+	}
+	fw.CVar.L.Lock()
+	defer fw.CVar.L.Unlock()
+	fw.BulkAckInterval = interval
+	return nil
+}
+
+// max data a writer buffers, with bulk acks the sender does not wait for the acks so the buffer
+// can run ahead of the BufferLimit (past the cap, AddData fails with ErrBufferLimit)
+func (w *FdWriter) bufferLimit_nolock() int {
+	if w.BulkAckInterval > 0 {
+		return w.BufferLimit * BulkBufferFactor
+	}
+	return w.BufferLimit
+}
+
+func (w *FdWriter) addBulkAck(ackLen int) {
+	w.CVar.L.Lock()
+	defer w.CVar.L.Unlock()
+	w.BulkPending += ackLen
+}
+
+// sends the progress accumulated since the last bulk ack
+func (w *FdWriter) flushBulkAck() {
+	w.CVar.L.Lock()
+	pending := w.BulkPending
+	w.BulkPending = 0
+	w.CVar.L.Unlock()
+	if pending > 0 {
+		w.sendProgressAck(pending)
+	}
+}
+
+// runs alongside WriteLoop until stopCh is closed
+func (w *FdWriter) bulkAckLoop(interval time.Duration, stopCh chan bool) {
+	timer := w.M.Clock.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C():
+		case <-stopCh:
+			return
+		}
+		w.flushBulkAck()
+		timer.Reset(interval)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"time"
+)
+
+// all multiplexer timeouts go through Multiplexer.Clock so tests can control time
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type realClock struct{}
+
+type realTimer struct {
+	Timer *time.Timer
+}
+
+var RealClock Clock = realClock{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{Timer: time.NewTimer(d)}
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.Timer.Stop()
+}
+
+func (t realTimer) Reset(d time.Duration) bool {
+	return t.Timer.Reset(d)
+}
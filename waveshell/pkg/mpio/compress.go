@@ -0,0 +1,74 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
+)
+
+// compression schemes for data packets (see FlowCaps.Compression)
+const CompressionGzip = "gzip"
+
+var ErrDecompressLimit = errors.New("decompressed data exceeds limit")
+
+// the most fdNum can take right now: the space left in its writer's buffer, and in the session
+// MemoryBudget.  anything larger would be rejected by AddData anyway.
+func (m *Multiplexer) inboundDataBudget(fdNum int) int {
+	m.Lock.Lock()
+	fw := m.FdWriters[fdNum]
+	m.Lock.Unlock()
+	budget := WriteBufSize
+	if fw != nil {
+		fw.CVar.L.Lock()
+		budget = fw.bufferLimit_nolock() - len(fw.Buffer)
+		fw.CVar.L.Unlock()
+	}
+	if m.MemoryBudget > 0 {
+		usage, _ := m.memoryUsage()
+		budget = min(budget, m.MemoryBudget-usage)
+	}
+	if budget < 0 {
+		return 0
+	}
+	return budget
+}
+
+// the data is decompressed through a limited reader, so a small payload that expands past
+// maxSize fails (ErrDecompressLimit) after reading at most maxSize+1 bytes
+func decompressData(scheme string, data []byte, maxSize int) ([]byte, error) {
+	var zr io.Reader
+	switch scheme {
+	case CompressionGzip:
+		gzReader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s data: %w", scheme, err)
+		}
+		defer gzReader.Close()
+		zr = gzReader
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", scheme)
+	}
+	rtn, err := io.ReadAll(io.LimitReader(zr, int64(maxSize)+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s data: %w", scheme, err)
+	}
+	if len(rtn) > maxSize {
+		return nil, fmt.Errorf("%w (max %d bytes)", ErrDecompressLimit, maxSize)
+	}
+	return rtn, nil
+}
+
+// compressed data packets are only accepted for the schemes in LocalCaps.Compression
+func (m *Multiplexer) decompressPacketData(dataPacket *packet.DataPacketType, data []byte) ([]byte, error) {
+	if !containsStr(m.LocalCaps.Compression, dataPacket.Compression) {
+		return nil, fmt.Errorf("unsupported compression %q", dataPacket.Compression)
+	}
+	return decompressData(dataPacket.Compression, data, m.inboundDataBudget(dataPacket.FdNum))
+}
@@ -0,0 +1,50 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
+)
+
+// max bytes of the bad data kept in a DecodeError
+const MaxDecodeSnippetSize = 64
+
+// a data packet whose Data64 could not be decoded (a malformed sender), reported with an
+// EventDecodeError and sent back in the error ack
+type DecodeError struct {
+	FdNum    int
+	Encoding string // "" is base64
+	Pos      int64  // offset of the bad input in Data64 (-1 if unknown)
+	DataLen  int    // length of Data64
+	Snippet  string // Data64 starting at Pos (or the start), up to MaxDecodeSnippetSize bytes
+	Err      error
+}
+
+func (e *DecodeError) Error() string {
+	enc := e.Encoding
+	if enc == "" {
+		enc = packet.EncodingBase64
+	}
+	return fmt.Sprintf("decoding %s data (fd:%d) at pos %d of %d, near %q: %v", enc, e.FdNum, e.Pos, e.DataLen, e.Snippet, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+func makeDecodeError(dataPacket *packet.DataPacketType, err error) *DecodeError {
+	decodeErr := &DecodeError{FdNum: dataPacket.FdNum, Encoding: dataPacket.Encoding, Pos: -1, DataLen: len(dataPacket.Data64), Err: err}
+	start := 0
+	var corruptErr base64.CorruptInputError
+	if errors.As(err, &corruptErr) && int(corruptErr) <= len(dataPacket.Data64) {
+		decodeErr.Pos = int64(corruptErr)
+		start = int(corruptErr)
+	}
+	decodeErr.Snippet = dataPacket.Data64[start:min(len(dataPacket.Data64), start+MaxDecodeSnippetSize)]
+	return decodeErr
+}
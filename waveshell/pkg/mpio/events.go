@@ -0,0 +1,83 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/base"
+)
+
+const (
+	EventIdle            = "idle"           // reader has not read any data for Duration (fd is still open)
+	EventSessionTimeout  = "sessiontimeout" // SessionTimeout elapsed, the multiplexer was closed (FdNum=-1)
+	EventSendError       = "senderror"      // Sender failed (transport is gone), the multiplexer was closed (FdNum=-1)
+	EventBadAck          = "badack"         // received a negative ack or an ack for more bytes than are outstanding
+	EventFdClosed        = "fdclosed"       // a reader or writer loop exited (see Dir and CloseReason)
+	EventLivenessTimeout = "liveness"       // nothing received for LivenessTimeout, the multiplexer was closed (FdNum=-1)
+	EventLoopLeak        = "loopleak"       // a loop is still running LeakCheckTimeout after Close (see Dir)
+	EventMemoryPressure  = "mempressure"    // session memory reached MemoryPressurePct of MemoryBudget, reads paused and acks held (FdNum=-1)
+	EventMemoryRelease   = "memrelease"     // session memory dropped below MemoryReleasePct, reads and acks resume (FdNum=-1)
+	EventMemoryShed      = "memshed"        // session memory exceeded MemoryBudget, FdNum is closed
+	EventTeeError        = "teeerror"       // writing to the reader's tee failed, the tee was dropped (the fd keeps streaming)
+
+	EventScheduledInputError = "schedinputerror" // a ScheduleInput entry could not be written, the rest of the sequence is dropped
+	EventSignalError         = "signalerror"     // signaling CmdProc failed (FdNum=-1), if it has exited the session ends
+	EventDecodeError         = "decodeerror"     // a data packet could not be decoded (Error is a *DecodeError), an error ack was sent
+	EventSlowConsumer        = "slowconsumer"    // a reader has waited SlowConsumerThreshold for acks (Duration is the stall so far), the fd stays open
+)
+
+// why a reader or writer was closed (the first reason sticks)
+const (
+	CloseReasonEof            = "eof"            // reader: EOF from the process, writer: EOF from the sender (data flushed)
+	CloseReasonError          = "error"          // read or write error on the fd
+	CloseReasonCloseFd        = "closefd"        // explicit CloseFd
+	CloseReasonConsumerClosed = "consumerclosed" // writer: the process closed its end (EPIPE)
+	CloseReasonTransport      = "transport"      // Sender failed
+	CloseReasonQuota          = "quota"          // writer exceeded its BufferLimit
+	CloseReasonTeardown       = "teardown"       // the session was closed (Close, HandleInputDone, SessionTimeout)
+	CloseReasonMemory         = "memory"         // shed because the session exceeded its MemoryBudget
+	CloseReasonAbort          = "abort"          // urgent abort from the client (UrgentActionAbortFd)
+	CloseReasonDeadline       = "deadline"       // reader: its ReadDeadline passed (see SetFdReadDeadline)
+)
+
+// events are out-of-band notifications for the embedder, they are never sent as packets
+type MuxEvent struct {
+	Type     string
+	CK       base.CommandKey
+	TraceId  string // the multiplexer's TraceId
+	FdNum    int
+	Duration time.Duration
+	Error    error
+
+	Dir         string // EventFdClosed, FdDirReader or FdDirWriter (EventLoopLeak, also FdDirSplice)
+	CloseReason string // EventFdClosed
+}
+
+func (e *MuxEvent) String() string {
+	errStr := ""
+	if e.Error != nil {
+		errStr = fmt.Sprintf(" err=%v", e.Error)
+	}
+	if e.CloseReason != "" {
+		errStr = fmt.Sprintf(" %s reason=%s%s", e.Dir, e.CloseReason, errStr)
+	}
+	if e.TraceId != "" {
+		errStr += fmt.Sprintf(" trace=%s", e.TraceId)
+	}
+	return fmt.Sprintf("event[%s fd=%d dur=%v%s]", e.Type, e.FdNum, e.Duration, errStr)
+}
+
+// EventHandler is called synchronously from the goroutine that generated the event
+func (m *Multiplexer) emitEvent(event *MuxEvent) {
+	event.CK = m.CK
+	event.TraceId = m.TraceId
+	if m.Debug {
+		fmt.Printf("%s %s\n", m.debugPrefix("EV-M"), event.String())
+	}
+	if m.EventHandler != nil {
+		m.EventHandler(event)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
+)
+
+const DefaultMaxBurstPackets = 4
+
+// while a lower priority fd has packets queued, at most this many consecutive batches are sent
+// from higher priority fds before a lower priority fd gets one (no total starvation)
+const MaxPriorityBatches = 8
+
+// when Multiplexer.FairScheduling is set, reader packets are queued here (per fd) and a single
+// dispatcher goroutine round-robins across the fds with pending packets, sending at most MaxBurst
+// consecutive packets from one fd.  each fd's queue holds at most MaxBurst packets, so a noisy reader
+// blocks (like it would on the sender) instead of queueing ahead of quieter fds.
+// fds with a higher priority (see SetFdPriority) are served first, round-robin within a priority.
+type fairDispatcher struct {
+	CVar       *sync.Cond
+	M          *Multiplexer
+	MaxBurst   int
+	Queues     map[int][]packet.PacketType
+	Order      []int // round-robin order
+	NextIdx    int
+	Sending    bool
+	Closed     bool
+	Priorities map[int]int // by fd (default 0)
+	NumSkipped int         // consecutive batches sent while a lower priority fd was waiting
+}
+
+func makeFairDispatcher(m *Multiplexer, maxBurst int, priorities map[int]int) *fairDispatcher {
+	if maxBurst <= 0 {
+		maxBurst = DefaultMaxBurstPackets
+	}
+	d := &fairDispatcher{
+		CVar:       sync.NewCond(&sync.Mutex{}),
+		M:          m,
+		MaxBurst:   maxBurst,
+		Queues:     make(map[int][]packet.PacketType),
+		Priorities: make(map[int]int),
+	}
+	for fdNum, prio := range priorities {
+		d.Priorities[fdNum] = prio
+	}
+	return d
+}
+
+// with FairScheduling, packets from higher priority fds (e.g. an interactive prompt echo) are sent
+// ahead of lower priority bulk fds (default 0).  can be changed while IO is running.
+func (m *Multiplexer) SetFdPriority(fdNum int, prio int) error {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	if m.FdReaders[fdNum] == nil {
+		return fmt.Errorf("no reader for fd:%d: %w", fdNum, ErrNoSuchFd)
+	}
+	if m.FdPriorities == nil {
+		m.FdPriorities = make(map[int]int)
+	}
+	m.FdPriorities[fdNum] = prio
+	if m.dispatcher != nil {
+		m.dispatcher.setPriority(fdNum, prio)
+	}
+	return nil
+}
+
+func (d *fairDispatcher) setPriority(fdNum int, prio int) {
+	d.CVar.L.Lock()
+	defer d.CVar.L.Unlock()
+	d.Priorities[fdNum] = prio
+}
+
+// returns false if the dispatcher is closed (packet is dropped)
+func (d *fairDispatcher) enqueue(fdNum int, pk packet.PacketType) bool {
+	d.CVar.L.Lock()
+	defer d.CVar.L.Unlock()
+	for !d.Closed && len(d.Queues[fdNum]) >= d.MaxBurst {
+		d.CVar.Wait()
+	}
+	if d.Closed {
+		return false
+	}
+	if _, found := d.Queues[fdNum]; !found {
+		d.Order = append(d.Order, fdNum)
+	}
+	d.Queues[fdNum] = append(d.Queues[fdNum], pk)
+	d.CVar.Broadcast()
+	return true
+}
+
+// returns the next batch of packets to send (all from one fd), false when closed
+func (d *fairDispatcher) nextBatch() ([]packet.PacketType, bool) {
+	d.CVar.L.Lock()
+	defer d.CVar.L.Unlock()
+	for {
+		if d.Closed {
+			return nil, false
+		}
+		hasQueued, maxPrio, lowerWaiting := false, 0, false
+		for _, fdNum := range d.Order {
+			if len(d.Queues[fdNum]) == 0 {
+				continue
+			}
+			prio := d.Priorities[fdNum]
+			if !hasQueued || prio > maxPrio {
+				lowerWaiting = hasQueued
+				maxPrio = prio
+			} else if prio < maxPrio {
+				lowerWaiting = true
+			}
+			hasQueued = true
+		}
+		if hasQueued {
+			// after MaxPriorityBatches the next fd in round-robin order is served, whatever its priority
+			ignorePrio := lowerWaiting && d.NumSkipped >= MaxPriorityBatches
+			for i := 0; i < len(d.Order); i++ {
+				idx := (d.NextIdx + i) % len(d.Order)
+				fdNum := d.Order[idx]
+				queue := d.Queues[fdNum]
+				if len(queue) == 0 || (!ignorePrio && d.Priorities[fdNum] != maxPrio) {
+					continue
+				}
+				if lowerWaiting && d.Priorities[fdNum] == maxPrio {
+					d.NumSkipped++
+				} else {
+					d.NumSkipped = 0
+				}
+				batchSize := min(len(queue), d.MaxBurst)
+				batch := make([]packet.PacketType, batchSize)
+				copy(batch, queue)
+				d.Queues[fdNum] = queue[batchSize:]
+				d.NextIdx = idx + 1
+				d.Sending = true
+				d.CVar.Broadcast()
+				return batch, true
+			}
+		}
+		d.Sending = false
+		d.CVar.Broadcast()
+		d.CVar.Wait()
+	}
+}
+
+func (d *fairDispatcher) run() {
+	for {
+		batch, ok := d.nextBatch()
+		if !ok {
+			return
+		}
+		for _, pk := range batch {
+			d.M.sendPacket(pk)
+		}
+	}
+}
+
+// waits until every queued packet has been handed to the sender
+func (d *fairDispatcher) waitEmpty() {
+	d.CVar.L.Lock()
+	defer d.CVar.L.Unlock()
+	for !d.Closed && (d.Sending || d.numQueued() > 0) {
+		d.CVar.Wait()
+	}
+}
+
+// must hold lock
+func (d *fairDispatcher) numQueued() int {
+	rtn := 0
+	for _, queue := range d.Queues {
+		rtn += len(queue)
+	}
+	return rtn
+}
+
+func (d *fairDispatcher) close() {
+	d.CVar.L.Lock()
+	defer d.CVar.L.Unlock()
+	d.Closed = true
+	d.Queues = make(map[int][]packet.PacketType)
+	d.CVar.Broadcast()
+}
@@ -0,0 +1,97 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
+)
+
+// flow-control limits advertised in (and received from) a MuxHelloPacket, 0 for no limit
+type FlowCaps struct {
+	WindowSize    int      // max unacked data bytes per fd this side can buffer
+	MaxPacketSize int      // largest data packet (decoded bytes) this side accepts
+	Compression   []string // supported schemes, in order of preference
+}
+
+func defaultFlowCaps() FlowCaps {
+	return FlowCaps{WindowSize: WriteBufSize, MaxPacketSize: WriteBufSize}
+}
+
+func (m *Multiplexer) makeHelloPacket() *packet.MuxHelloPacketType {
+	pk := packet.MakeMuxHelloPacket(m.CK)
+	pk.WindowSize = m.LocalCaps.WindowSize
+	pk.MaxPacketSize = m.LocalCaps.MaxPacketSize
+	pk.Compression = m.LocalCaps.Compression
+	return pk
+}
+
+// the effective window for each reader is the min of its own and the peer's, same for packet size
+func (m *Multiplexer) processHelloPacket(pk *packet.MuxHelloPacketType) {
+	peerCaps := &FlowCaps{WindowSize: pk.WindowSize, MaxPacketSize: pk.MaxPacketSize, Compression: pk.Compression}
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	m.PeerCaps = peerCaps
+	m.Compression = ""
+	for _, scheme := range m.LocalCaps.Compression {
+		if containsStr(peerCaps.Compression, scheme) {
+			m.Compression = scheme
+			break
+		}
+	}
+	for _, fr := range m.FdReaders {
+		fr.applyPeerCaps(peerCaps)
+	}
+}
+
+func containsStr(arr []string, str string) bool {
+	for _, s := range arr {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *FdReader) applyPeerCaps(peerCaps *FlowCaps) {
+	r.CVar.L.Lock()
+	defer r.CVar.L.Unlock()
+	if peerCaps.WindowSize > 0 && peerCaps.WindowSize < r.WindowSize {
+		r.WindowSize = peerCaps.WindowSize
+	}
+	if peerCaps.MaxPacketSize > 0 && (r.MaxPacketSize == 0 || peerCaps.MaxPacketSize < r.MaxPacketSize) {
+		r.MaxPacketSize = peerCaps.MaxPacketSize
+	}
+	r.CVar.Broadcast()
+}
+
+// must hold m.Lock, readers registered after the handshake get the peer's limits too
+func (m *Multiplexer) addFdReader(fr *FdReader) error {
+	err := m.checkFdLimit_nolock(fr.FdNum)
+	if err != nil {
+		return err
+	}
+	if m.PeerCaps != nil {
+		fr.applyPeerCaps(m.PeerCaps)
+	}
+	m.FdReaders[fr.FdNum] = fr
+	return nil
+}
+
+// the reader's effective window (after the handshake)
+func (m *Multiplexer) FdWindowSize(fdNum int) (int, error) {
+	fr, err := m.getFdReader(fdNum)
+	if err != nil {
+		return 0, err
+	}
+	fr.CVar.L.Lock()
+	defer fr.CVar.L.Unlock()
+	return fr.WindowSize, nil
+}
+
+// the negotiated compression scheme ("" for none, or before the peer's hello)
+func (m *Multiplexer) GetCompression() string {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	return m.Compression
+}
@@ -0,0 +1,75 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
+)
+
+func (m *Multiplexer) markInput() {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	m.LastInputTs = m.Clock.Now()
+}
+
+func (m *Multiplexer) getLastInputTs() time.Time {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	return m.LastInputTs
+}
+
+// sends a keepalive every KeepAliveInterval, and closes the session if nothing is received for
+// LivenessTimeout.  runs until stopCh is closed (the input loop is done) or the session is closed.
+func (m *Multiplexer) runKeepAlive(stopCh chan bool) {
+	now := m.Clock.Now()
+	nextKeepAlive := now.Add(m.KeepAliveInterval)
+	timer := m.Clock.NewTimer(m.nextKeepAliveWait(now, nextKeepAlive))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C():
+		case <-stopCh:
+			return
+		case <-m.closeCh:
+			return
+		}
+		now = m.Clock.Now()
+		if m.LivenessTimeout > 0 {
+			idle := now.Sub(m.getLastInputTs())
+			if idle >= m.LivenessTimeout {
+				err := fmt.Errorf("no input for %v", idle)
+				m.emitEvent(&MuxEvent{Type: EventLivenessTimeout, FdNum: -1, Duration: idle, Error: err})
+				m.closeWithReason(CloseReasonTransport)
+				return
+			}
+		}
+		if m.KeepAliveInterval > 0 && !now.Before(nextKeepAlive) {
+			m.sendPacket(packet.MakeKeepAlivePacket(m.CK))
+			nextKeepAlive = now.Add(m.KeepAliveInterval)
+		}
+		timer.Reset(m.nextKeepAliveWait(now, nextKeepAlive))
+	}
+}
+
+func (m *Multiplexer) nextKeepAliveWait(now time.Time, nextKeepAlive time.Time) time.Duration {
+	var wait time.Duration
+	hasWait := false
+	if m.KeepAliveInterval > 0 {
+		wait = nextKeepAlive.Sub(now)
+		hasWait = true
+	}
+	if m.LivenessTimeout > 0 {
+		livenessWait := m.getLastInputTs().Add(m.LivenessTimeout).Sub(now)
+		if !hasWait || livenessWait < wait {
+			wait = livenessWait
+		}
+	}
+	if wait <= 0 {
+		wait = time.Millisecond
+	}
+	return wait
+}
@@ -0,0 +1,171 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"fmt"
+	"sort"
+)
+
+// with a MemoryBudget, backpressure starts once the session uses MemoryPressurePct of the budget
+// and is released when usage drops below MemoryReleasePct
+const MemoryPressurePct = 80
+const MemoryReleasePct = 50
+
+// session memory is the data buffered by the writers plus, for the readers, the bytes sent but not
+// yet acked (held by the transport) and any ring buffer.  returns the total and the usage per fd.
+func (m *Multiplexer) memoryUsage() (int, map[int]int) {
+	m.Lock.Lock()
+	readers := make([]*FdReader, 0, len(m.FdReaders))
+	for _, fr := range m.FdReaders {
+		readers = append(readers, fr)
+	}
+	writers := make([]*FdWriter, 0, len(m.FdWriters))
+	for _, fw := range m.FdWriters {
+		writers = append(writers, fw)
+	}
+	m.Lock.Unlock()
+	total := 0
+	perFd := make(map[int]int)
+	for _, fr := range readers {
+		size := fr.memSize()
+		perFd[fr.FdNum] += size
+		total += size
+	}
+	for _, fw := range writers {
+		size := len(fw.getBuffer())
+		perFd[fw.FdNum] += size
+		total += size
+	}
+	return total, perFd
+}
+
+// fds in the order they are closed when the session goes over MemoryBudget.  the fds in ShedOrder
+// come first, then the rest from the highest fd number down.  fds without buffered data are skipped.
+func (m *Multiplexer) shedOrder(perFd map[int]int) []int {
+	var rtn []int
+	seen := make(map[int]bool)
+	for _, fdNum := range m.ShedOrder {
+		if perFd[fdNum] > 0 && !seen[fdNum] {
+			rtn = append(rtn, fdNum)
+		}
+		seen[fdNum] = true
+	}
+	var rest []int
+	for fdNum, size := range perFd {
+		if size > 0 && !seen[fdNum] {
+			rest = append(rest, fdNum)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(rest)))
+	return append(rtn, rest...)
+}
+
+// called after the buffered data grows or shrinks.  over MemoryPressurePct the readers are paused
+// and writers hold their acks (so the client stops sending), over the budget fds are closed (see
+// shedOrder) until the usage fits.
+func (m *Multiplexer) checkMemory() {
+	if m.MemoryBudget <= 0 {
+		return
+	}
+	m.memLock.Lock()
+	defer m.memLock.Unlock()
+	usage, perFd := m.memoryUsage()
+	if usage > m.MemoryBudget {
+		for _, fdNum := range m.shedOrder(perFd) {
+			if usage <= m.MemoryBudget {
+				break
+			}
+			err := fmt.Errorf("session memory %d exceeds budget %d, closing fd:%d (%d bytes)", usage, m.MemoryBudget, fdNum, perFd[fdNum])
+			m.emitEvent(&MuxEvent{Type: EventMemoryShed, FdNum: fdNum, Error: err})
+			m.closeFd(fdNum, CloseReasonMemory)
+			usage -= perFd[fdNum]
+		}
+	}
+	if !m.memPressure && usage >= m.MemoryBudget*MemoryPressurePct/100 {
+		m.memPressure = true
+		err := fmt.Errorf("session memory %d of budget %d", usage, m.MemoryBudget)
+		m.emitEvent(&MuxEvent{Type: EventMemoryPressure, FdNum: -1, Error: err})
+	} else if m.memPressure && usage < m.MemoryBudget*MemoryReleasePct/100 {
+		m.memPressure = false
+		m.emitEvent(&MuxEvent{Type: EventMemoryRelease, FdNum: -1})
+	}
+	m.applyMemPressure(m.memPressure)
+}
+
+// idempotent, also covers fds registered since the last check
+func (m *Multiplexer) applyMemPressure(pressure bool) {
+	m.Lock.Lock()
+	readers := make([]*FdReader, 0, len(m.FdReaders))
+	for _, fr := range m.FdReaders {
+		readers = append(readers, fr)
+	}
+	writers := make([]*FdWriter, 0, len(m.FdWriters))
+	for _, fw := range m.FdWriters {
+		writers = append(writers, fw)
+	}
+	m.Lock.Unlock()
+	for _, fr := range readers {
+		fr.setMemPaused(pressure)
+	}
+	for _, fw := range writers {
+		fw.setAckHold(pressure)
+	}
+}
+
+// true while the session is under memory pressure (see MemoryBudget)
+func (m *Multiplexer) InMemoryPressure() bool {
+	m.memLock.Lock()
+	defer m.memLock.Unlock()
+	return m.memPressure
+}
+
+// unacked bytes (not for a bulk reader, they are only progress) plus the ring buffer
+func (r *FdReader) memSize() int {
+	r.CVar.L.Lock()
+	defer r.CVar.L.Unlock()
+	if r.Bulk {
+		return len(r.Ring)
+	}
+	return r.BufSize + len(r.Ring)
+}
+
+func (r *FdReader) setMemPaused(paused bool) {
+	r.CVar.L.Lock()
+	defer r.CVar.L.Unlock()
+	if r.MemPaused == paused {
+		return
+	}
+	r.MemPaused = paused
+	r.CVar.Broadcast()
+}
+
+// releasing the hold sends the acks that were held back
+func (w *FdWriter) setAckHold(hold bool) {
+	w.CVar.L.Lock()
+	w.AckHold = hold
+	heldAck := 0
+	if !hold {
+		heldAck = w.HeldAck
+		w.HeldAck = 0
+	}
+	w.CVar.L.Unlock()
+	if heldAck > 0 {
+		w.M.sendPacket(w.M.makeDataAckPacket(w.FdNum, heldAck, nil))
+	}
+}
+
+func (w *FdWriter) sendProgressAck(ackLen int) {
+	w.CVar.L.Lock()
+	if w.AckHold {
+		w.HeldAck += ackLen
+		w.CVar.L.Unlock()
+		return
+	}
+	w.CVar.L.Unlock()
+	if w.M.holdPiggybackAck(w.FdNum, ackLen) {
+		return
+	}
+	w.M.sendPacket(w.M.makeDataAckPacket(w.FdNum, ackLen, nil))
+}
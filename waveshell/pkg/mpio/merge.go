@@ -0,0 +1,155 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
+)
+
+// readers whose packets share one fd stream (see MergeFdInto)
+type fdMerge struct {
+	Lock     *sync.Mutex
+	DstFd    int
+	Readers  map[int]*FdReader
+	NumOpen  int          // readers that have not sent EOF yet
+	Unacked  []mergedSend // sent on DstFd, not yet (fully) acked, in the order prepareSend saw them
+	Sending  int          // relabeled packets not yet handed to the sender (see endSend)
+	SendCVar *sync.Cond   // on Lock, broadcast as Sending drops
+}
+
+type mergedSend struct {
+	FdNum   int
+	WireLen int
+}
+
+// relabels the packets of reader srcFd as dstFd (another reader), so the client receives one
+// combined stream (the mux-level 2>&1).  ordering between the two sources is best effort (the
+// order their reads complete in).  acks for dstFd are split back to the readers in send order,
+// and dstFd only gets EOF once both readers are done.  call before starting IO.
+func (m *Multiplexer) MergeFdInto(srcFd int, dstFd int) error {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	if m.Started {
+		return fmt.Errorf("cannot merge fds, multiplexer is already running")
+	}
+	if srcFd == dstFd {
+		return fmt.Errorf("cannot merge fd:%d into itself", srcFd)
+	}
+	srcReader := m.FdReaders[srcFd]
+	if srcReader == nil {
+		return fmt.Errorf("cannot merge fd:%d: %w", srcFd, ErrNoSuchFd)
+	}
+	dstReader := m.FdReaders[dstFd]
+	if dstReader == nil {
+		return fmt.Errorf("cannot merge into fd:%d: %w", dstFd, ErrNoSuchFd)
+	}
+	if m.Merges[srcFd] != nil {
+		return fmt.Errorf("fd:%d is already merged", srcFd)
+	}
+	merge := m.Merges[dstFd]
+	if merge == nil {
+		merge = &fdMerge{
+			Lock:    &sync.Mutex{},
+			DstFd:   dstFd,
+			Readers: map[int]*FdReader{dstFd: dstReader},
+			NumOpen: 1,
+		}
+		merge.SendCVar = sync.NewCond(merge.Lock)
+		m.Merges[dstFd] = merge
+	} else if merge.DstFd != dstFd {
+		return fmt.Errorf("cannot merge into fd:%d, it is merged into fd:%d", dstFd, merge.DstFd)
+	}
+	merge.Readers[srcFd] = srcReader
+	merge.NumOpen++
+	m.Merges[srcFd] = merge
+	return nil
+}
+
+// relabels pk for the merged stream, returns false if nothing should be sent (a member's EOF
+// while other members are still open).  no lock is held while the packet is sent, so two members
+// can reach the wire in the other order.  that only moves acks between the members until both
+// are acked (a member is never acked for more than it sent).  the EOF for the merged stream waits
+// until every earlier packet has been handed to the sender, so it is always last.  call endSend
+// once a packet it returned true for is sent.
+func (merge *fdMerge) prepareSend(fdNum int, pk *packet.DataPacketType) bool {
+	merge.Lock.Lock()
+	defer merge.Lock.Unlock()
+	pk.FdNum = merge.DstFd
+	wireLen := pk.DataLen()
+	if wireLen > 0 {
+		merge.Unacked = append(merge.Unacked, mergedSend{FdNum: fdNum, WireLen: wireLen})
+	}
+	if pk.Eof || pk.Error != "" {
+		// a read error ends the member too (the error is passed on)
+		merge.NumOpen--
+		if merge.NumOpen > 0 {
+			pk.Eof = false
+			if wireLen == 0 && pk.Error == "" {
+				return false
+			}
+		}
+	}
+	for pk.Eof && merge.Sending > 0 {
+		merge.SendCVar.Wait()
+	}
+	merge.Sending++
+	return true
+}
+
+func (merge *fdMerge) endSend() {
+	merge.Lock.Lock()
+	defer merge.Lock.Unlock()
+	merge.Sending--
+	merge.SendCVar.Broadcast()
+}
+
+// splits an ack for the merged stream into acks for its readers
+func (merge *fdMerge) splitAck(ackLen int) []mergedSend {
+	merge.Lock.Lock()
+	defer merge.Lock.Unlock()
+	var rtn []mergedSend
+	for ackLen > 0 && len(merge.Unacked) > 0 {
+		head := &merge.Unacked[0]
+		partLen := min(ackLen, head.WireLen)
+		if len(rtn) > 0 && rtn[len(rtn)-1].FdNum == head.FdNum {
+			rtn[len(rtn)-1].WireLen += partLen
+		} else {
+			rtn = append(rtn, mergedSend{FdNum: head.FdNum, WireLen: partLen})
+		}
+		ackLen -= partLen
+		head.WireLen -= partLen
+		if head.WireLen == 0 {
+			merge.Unacked = merge.Unacked[1:]
+		}
+	}
+	if ackLen > 0 {
+		// more than was sent, let the dst reader report the bad ack
+		rtn = append(rtn, mergedSend{FdNum: merge.DstFd, WireLen: ackLen})
+	}
+	return rtn
+}
+
+func (m *Multiplexer) getMerge(fdNum int) *fdMerge {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	return m.Merges[fdNum]
+}
+
+// returns false if the ack was not for a merged stream
+func (m *Multiplexer) processMergedAck(ackPacket *packet.DataAckPacketType) bool {
+	merge := m.getMerge(ackPacket.FdNum)
+	if merge == nil || merge.DstFd != ackPacket.FdNum {
+		return false
+	}
+	for _, part := range merge.splitAck(ackPacket.AckLen) {
+		err := merge.Readers[part.FdNum].NotifyAck(part.WireLen)
+		if err != nil {
+			m.emitEvent(&MuxEvent{Type: EventBadAck, FdNum: part.FdNum, Error: err})
+		}
+	}
+	return true
+}
@@ -0,0 +1,87 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+var errMmapUnsupported = errors.New("mmap not supported")
+
+// like MakeStreamWriterPipe, but a regular file is mmapped and the writer writes straight from the
+// mapping (BufferLimit bytes at a time, in MaxSingleWriteSize chunks), so the file is never copied
+// into the heap.  falls back to streaming f (an empty file, not a regular file, or no mmap on this
+// platform).  f is closed, the mapping is released once the writer is done with it.
+func (m *Multiplexer) MakeMmapWriterPipe(fdNum int, f *os.File) (*os.File, error) {
+	data, unmap, err := mmapFile(f)
+	if err != nil {
+		return m.MakeStreamWriterPipe(fdNum, f)
+	}
+	f.Close()
+	pr, pw, err := makeChildPipe(false)
+	if err != nil {
+		unmap()
+		return nil, err
+	}
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	fdWriter := MakeFdWriter(m, pw, fdNum, true, "mmap")
+	err = m.addFdWriter(fdWriter)
+	if err != nil {
+		unmap()
+		pr.Close()
+		pw.Close()
+		return nil, err
+	}
+	m.CloseAfterStart = append(m.CloseAfterStart, pr)
+	go fdWriter.feedMapped(data, unmap)
+	return pr, nil
+}
+
+// the mapped slices are handed to WriteLoop as the Buffer (capped, so an append copies), each one
+// once the previous is written.  unmap is called when the writer is closed and not writing.
+func (w *FdWriter) feedMapped(data []byte, unmap func()) {
+	defer unmap()
+	defer w.waitForWriteDone()
+	for len(data) > 0 {
+		chunkSize := min(len(data), w.BufferLimit)
+		err := w.addMappedWait(data[0:chunkSize:chunkSize])
+		if err != nil {
+			return
+		}
+		data = data[chunkSize:]
+	}
+	w.AddData(nil, true)
+}
+
+// waits for an empty Buffer, then uses chunk as the Buffer (no copy)
+func (w *FdWriter) addMappedWait(chunk []byte) error {
+	w.CVar.L.Lock()
+	if w.EofSentinel != nil {
+		w.CVar.L.Unlock()
+		return w.addDataWait(chunk, false)
+	}
+	defer w.CVar.L.Unlock()
+	for !w.Closed && len(w.Buffer) > 0 {
+		w.CVar.Wait()
+	}
+	if w.Closed || w.Eof {
+		return fmt.Errorf("%w %q (fd:%d)", ErrFdClosed, w.Desc, w.FdNum)
+	}
+	w.Buffer = chunk
+	w.NumAdded += int64(len(chunk))
+	w.CVar.Broadcast()
+	return nil
+}
+
+// after this WriteLoop no longer touches the data it was given
+func (w *FdWriter) waitForWriteDone() {
+	w.CVar.L.Lock()
+	defer w.CVar.L.Unlock()
+	for !w.Closed || w.Writing {
+		w.CVar.Wait()
+	}
+}
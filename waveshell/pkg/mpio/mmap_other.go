@@ -0,0 +1,15 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !linux && !darwin
+
+package mpio
+
+import (
+	"os"
+)
+
+// MakeMmapWriterPipe streams the file instead
+func mmapFile(f *os.File) ([]byte, func(), error) {
+	return nil, nil, errMmapUnsupported
+}
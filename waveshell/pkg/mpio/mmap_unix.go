@@ -0,0 +1,28 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build linux || darwin
+
+package mpio
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// read-only shared mapping of a (non-empty) regular file
+func mmapFile(f *os.File) ([]byte, func(), error) {
+	finfo, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !finfo.Mode().IsRegular() || finfo.Size() == 0 || int64(int(finfo.Size())) != finfo.Size() {
+		return nil, nil, errMmapUnsupported
+	}
+	data, err := unix.Mmap(int(f.Fd()), 0, int(finfo.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() { unix.Munmap(data) }, nil
+}
@@ -4,11 +4,16 @@
 package mpio
 
 import (
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/wavetermdev/waveterm/waveshell/pkg/base"
 	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
@@ -18,20 +23,194 @@ const ReadBufSize = 128 * 1024
 const WriteBufSize = 128 * 1024
 const MaxSingleWriteSize = 4 * 1024
 const MaxTotalRunDataSize = 10 * ReadBufSize
+const MaxLineBufferSize = 64 * 1024 // max partial line held by a LineBuffered reader
+const DefaultMaxFdNum = 255
+const TransportErrorExitCode = 254 // ExitCode for CmdDonePackets generated because of a transport error
+
+// AllocFdReaderPipe / AllocFdWriterPipe do not hand out 0/1/2
+const FirstAllocFdNum = 3
+
+// use errors.Is() to match, the error text for writes matches the original (untyped) errors
+var ErrNoSuchFd = errors.New("no fd")
+var ErrFdClosed = errors.New("write to closed file")
+var ErrBadAck = errors.New("invalid ack")
+var ErrBufferLimit = errors.New("write exceeds buffer size")
+var ErrConsumerClosed = errors.New("consumer closed")
+var ErrFdNumRange = errors.New("fd number out of range")
+var ErrUnexpectedFd = errors.New("unexpected fd")
+var ErrTooManyFds = errors.New("too many fds")
+var ErrReadDeadline = errors.New("read deadline exceeded")
+
+// UnknownFdPolicy values, handling of data packets for an fd without a writer
+const (
+	UnknownFdError   = "error"   // error ack (once, later packets get ErrNoSuchFd from a closed placeholder), the default
+	UnknownFdDiscard = "discard" // data is acked and dropped
+	UnknownFdBuffer  = "buffer"  // data is buffered (up to WriteBufSize, unacked) until a writer is registered for the fd
+)
+
+// InputClosedPolicy values, the done packet when the input channel closes before a CmdDonePacket
+const (
+	InputClosedNil            = "nil"            // no done packet (RunIOAndWait returns nil), the default
+	InputClosedTransportError = "transporterror" // a done packet with TransportErrorExitCode
+	InputClosedCallback       = "callback"       // the packet returned by OnInputClosed (may be nil)
+)
+
+// outbound packets go through a PacketSender (*packet.PacketSender implements it).  the multiplexer
+// never closes its sender, so one (possibly wrapped) sender can be shared by many multiplexers
+// over a single connection, every packet carries the multiplexer's CK.
+type PacketSender interface {
+	SendPacket(pk packet.PacketType) error
+}
 
 type Multiplexer struct {
 	Lock            *sync.Mutex
 	CK              base.CommandKey
-	FdReaders       map[int]*FdReader // synchronized
-	FdWriters       map[int]*FdWriter // synchronized
-	RunData         map[int]*FdReader // synchronized
-	CloseAfterStart []*os.File        // synchronized
+	TraceId         string                   // correlation id (see MakeTracedMultiplexer), "" for none
+	FdReaders       map[int]*FdReader        // synchronized
+	FdWriters       map[int]*FdWriter        // synchronized
+	RunData         map[int]*FdReader        // synchronized
+	CloseAfterStart []*os.File               // synchronized
+	Splices         []*fdSplice              // synchronized, see SpliceFds
+	Merges          map[int]*fdMerge         // synchronized, by src and dst fd, see MergeFdInto
+	PtyFds          map[int]*os.File         // synchronized
+	DefaultPtyFdNum int                      // synchronized, pty used when a winsize does not specify an fd
+	CmdProc         *os.Process              // synchronized
+	ReapCmdProc     bool                     // wait on CmdProc after IO and report its exit (see reapCmdProc)
+	PtyEofDone      bool                     // EOF on the default pty ends the session (see notifyPtyEof)
+	CloseSignal     syscall.Signal           // sent by CloseAndSignal (defaults to SIGHUP)
+	OnWinSizeNoPty  func(rows int, cols int) // optional, winsize changes when no ptys are registered
+	InitialMeta     *InitialMeta             // synchronized, applied before the IO loops launch
+	cmdExitCh       chan bool                // closed by notifyCmdExit
+	cmdExitOnce     *sync.Once
+
+	reapOnce   *sync.Once
+	reapPacket *packet.CmdDonePacketType // synchronized (reapOnce), see reapCmdProc
 
-	Sender  *packet.PacketSender
+	Sender  PacketSender // synchronized (senderLock) once started, see SwapSender
 	Input   *packet.PacketParser
 	Started bool
+	SendErr error // synchronized, first error from Sender (the multiplexer is closed)
 	UPR     packet.UnknownPacketReporter
 
+	senderLock *sync.RWMutex // held (read) for the duration of every send
+
+	EventHandler func(*MuxEvent) // optional, set before starting IO
+	Clock        Clock
+
+	// optional, set before starting IO.  called from the input loop as soon as a CmdDonePacket is
+	// received, while the writers may still be flushing (RunIOAndWait returns it after the drain)
+	OnCmdDone func(*packet.CmdDonePacketType)
+
+	// optional, set before starting IO.  consulted before a DataPacket is processed, an error
+	// rejects the packet (an error ack is sent and nothing is written)
+	InboundFilter func(*packet.DataPacketType) error
+
+	scheduledInputs []ScheduledInput // synchronized, see ScheduleInput
+
+	// when > 0, the session is closed after this duration (set before starting IO)
+	SessionTimeout time.Duration
+	closeCh        chan bool // closed by Close(), stops the input loop
+	closeOnce      *sync.Once
+
+	// when > 0, Close checks that all reader/writer/splice loops exit within this duration and
+	// emits an EventLoopLeak for each one that does not (set before starting IO)
+	LeakCheckTimeout time.Duration
+	loops            map[int]*loopInfo // synchronized, running loops (see trackLoop)
+	loopCounter      int               // synchronized
+	loopsDoneCh      chan bool         // synchronized, closed when loops becomes empty (checkLoopLeaks)
+
+	// keepalive packets are sent every KeepAliveInterval (when > 0).  when LivenessTimeout > 0 the
+	// session is closed if no packet (of any type) is received for that long.  set before starting IO.
+	KeepAliveInterval time.Duration
+	LivenessTimeout   time.Duration
+	LastInputTs       time.Time // synchronized
+
+	// when > 0, a closed input channel waits this long for ReattachInput before the input is done
+	ReattachTimeout time.Duration
+	reattachCh      chan *packet.PacketParser
+	inputDone       bool      // synchronized, set by HandleInputDone (see InputDone)
+	inputDoneCh     chan bool // closed by the first HandleInputDone
+
+	FairScheduling  bool        // round-robin reader packets across fds (set before starting IO)
+	MaxBurstPackets int         // max consecutive packets from one fd when FairScheduling (0 for default)
+	FdPriorities    map[int]int // synchronized, see SetFdPriority
+	dispatcher      *fairDispatcher
+
+	pktLog *packetLog // RecordTo / ReplayFrom
+
+	statsLock *sync.Mutex
+	stats     MuxStats            // synchronized (statsLock), see Stats
+	fdBytes   map[fdDirKey]int64  // synchronized (statsLock)
+	fdCloses  map[fdDirKey]string // synchronized (statsLock), recorded as the loops exit
+	StartTs   time.Time           // synchronized, set when IO starts
+
+	// optional, set before starting IO.  called once with the end-of-session record (totals, per-fd
+	// counts, close reasons, exit status) just before RunIOAndWait returns
+	SummaryLogger func(*SessionSummary)
+
+	UnknownFdPolicy string // set before starting IO (defaults to UnknownFdError)
+
+	// what RunIOAndWait returns when the input closes (without a reattach) before a done packet
+	// arrives, set before starting IO.  OnInputClosed gets the parser error (nil for a plain close).
+	InputClosedPolicy string
+	OnInputClosed     func(err error) *packet.CmdDonePacketType
+
+	// data, ack, and special input packets for fds outside 0..MaxFdNum are rejected (set before starting IO)
+	MaxFdNum    int
+	ExpectedFds map[int]bool // see ExpectFds
+
+	// when > 0, max distinct fd numbers (readers and writers) in the session.  registering a new fd
+	// past the limit fails with ErrTooManyFds, as do data packets for new fds.  set before starting IO.
+	MaxFds int
+
+	// when > 0, caps the data buffered across all readers (unacked) and writers.  approaching the
+	// budget pauses reads and holds write acks, going over it closes fds (ShedOrder lists the
+	// least important fds first).  set before starting IO.
+	MemoryBudget int
+	ShedOrder    []int
+	memLock      *sync.Mutex
+	memPressure  bool // synchronized (memLock)
+
+	// when set, a MuxHelloPacket advertising LocalCaps is sent as IO starts, and the peer's hello
+	// clamps the reader windows and packet sizes (see processHelloPacket).  set before starting IO.
+	Handshake   bool
+	LocalCaps   FlowCaps
+	PeerCaps    *FlowCaps // synchronized, nil until the peer's hello arrives
+	Compression string    // synchronized, negotiated scheme ("" for none)
+
+	// when > 0, reader data is split so every data packet, encoded and framed, is at most this many
+	// bytes (for transports with a frame size limit).  a Transform that expands the data can still
+	// go over.  set before starting IO.
+	MaxWirePacketSize int
+
+	// the packet format of Sender (packet.FormatJson or FormatMsgpack, "" is json), for the wire
+	// sizes (MaxWirePacketSize, Stats).  msgpack data packets carry the raw bytes
+	// (packet.EncodingBinary, SetFdEncoding only applies to json).  set before starting IO.
+	Format string
+
+	// empty data packets (no data and no EOF, e.g. keepalives) never reach the writer, when set they
+	// are answered with a zero-length ack.  set before starting IO.
+	AckEmptyDataPackets bool
+
+	// when > 0, write acks are coalesced until this many bytes are written (set before starting IO)
+	AckWatermark int
+
+	// when > 0, a reader that has waited this long for acks emits an EventSlowConsumer (once per
+	// stall).  the peer is still sending (or it would hit LivenessTimeout) but not acking, e.g. its
+	// process stopped reading.  set before starting IO.
+	SlowConsumerThreshold time.Duration
+
+	// for half-duplex links, write acks for an fd that also has a reader ride on its next data
+	// packet (DataPacketType.AckLen), see holdPiggybackAck.  set before starting IO.
+	PiggybackAcks bool
+	piggyLock     *sync.Mutex
+	piggyAcks     map[int]int // synchronized (piggyLock), acks waiting for a data packet
+
+	// see Quiesce
+	quiesceCVar *sync.Cond
+	quiesced    bool // synchronized (quiesceCVar.L)
+	inputBusy   bool // synchronized (quiesceCVar.L), processInputPacket is running
+
 	Debug bool
 }
 
@@ -40,99 +219,693 @@ func MakeMultiplexer(ck base.CommandKey, upr packet.UnknownPacketReporter) *Mult
 		upr = packet.DefaultUPR{}
 	}
 	return &Multiplexer{
-		Lock:      &sync.Mutex{},
-		CK:        ck,
-		FdReaders: make(map[int]*FdReader),
-		FdWriters: make(map[int]*FdWriter),
-		UPR:       upr,
+		Lock:        &sync.Mutex{},
+		CK:          ck,
+		FdReaders:   make(map[int]*FdReader),
+		FdWriters:   make(map[int]*FdWriter),
+		PtyFds:      make(map[int]*os.File),
+		Merges:      make(map[int]*fdMerge),
+		UPR:         upr,
+		reattachCh:  make(chan *packet.PacketParser, 1),
+		inputDoneCh: make(chan bool),
+		Clock:       RealClock,
+		CloseSignal: syscall.SIGHUP,
+		MaxFdNum:    DefaultMaxFdNum,
+		closeCh:     make(chan bool),
+		closeOnce:   &sync.Once{},
+		cmdExitCh:   make(chan bool),
+		cmdExitOnce: &sync.Once{},
+		reapOnce:    &sync.Once{},
+		loops:       make(map[int]*loopInfo),
+		statsLock:   &sync.Mutex{},
+		fdBytes:     make(map[fdDirKey]int64),
+		fdCloses:    make(map[fdDirKey]string),
+		memLock:     &sync.Mutex{},
+		piggyLock:   &sync.Mutex{},
+		piggyAcks:   make(map[int]int),
+		quiesceCVar: sync.NewCond(&sync.Mutex{}),
+		senderLock:  &sync.RWMutex{},
+		LocalCaps:   defaultFlowCaps(),
 	}
 }
 
+// traceId is a correlation id beyond the CK (e.g. the id of the request that started the session),
+// it is set on the data, ack, and message packets the multiplexer sends and on its events, debug
+// output, and SessionSummary, so a request can be followed through many sessions.
+func MakeTracedMultiplexer(ck base.CommandKey, traceId string, upr packet.UnknownPacketReporter) *Multiplexer {
+	m := MakeMultiplexer(ck, upr)
+	m.TraceId = traceId
+	return m
+}
+
 func (m *Multiplexer) Close() {
+	m.closeWithReason(CloseReasonTeardown)
+}
+
+// reason is recorded on every fd that is not already closed.  the loops are stopped first: a writer
+// in the middle of a write closes its fd once the write returns (see CloseWriteGraceTime), readers
+// discard anything read after the close.
+func (m *Multiplexer) closeWithReason(reason string) {
 	m.Lock.Lock()
 	defer m.Lock.Unlock()
 
 	for _, fr := range m.FdReaders {
-		fr.Close()
+		fr.closeWithReason(reason)
 	}
 	for _, fw := range m.FdWriters {
-		fw.Close()
+		fw.closeWithReason(reason)
+	}
+	for _, s := range m.Splices {
+		s.closeWithReason(reason)
 	}
 	for _, fd := range m.CloseAfterStart {
 		fd.Close()
 	}
+	if m.dispatcher != nil {
+		m.dispatcher.close()
+	}
+	m.closeOnce.Do(func() {
+		close(m.closeCh)
+		if m.LeakCheckTimeout > 0 {
+			go m.checkLoopLeaks()
+		}
+	})
+	m.quiesceCVar.L.Lock()
+	m.quiesceCVar.Broadcast() // wakes the input loop if quiesced
+	m.quiesceCVar.L.Unlock()
+}
+
+func (m *Multiplexer) runSessionTimeout() {
+	timer := m.Clock.NewTimer(m.SessionTimeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		m.emitEvent(&MuxEvent{Type: EventSessionTimeout, FdNum: -1, Duration: m.SessionTimeout})
+		m.Close()
+	case <-m.closeCh:
+	}
+}
+
+// suspends all IO without tearing anything down, readers stop emitting data (and writers stop
+// writing if pauseWriters is set).  acks and control packets are still processed.
+func (m *Multiplexer) PauseAll(pauseWriters bool) {
+	m.setAllPaused(true, pauseWriters)
+}
+
+func (m *Multiplexer) ResumeAll() {
+	m.setAllPaused(false, true)
+}
+
+func (m *Multiplexer) setAllPaused(paused bool, includeWriters bool) {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	for _, fr := range m.FdReaders {
+		fr.SetPaused(paused)
+	}
+	if includeWriters {
+		for _, fw := range m.FdWriters {
+			fw.SetPaused(paused)
+		}
+	}
+}
+
+// closes a single reader or writer (the rest of the session continues).  a closed reader sends
+// an EOF data packet, a closed writer sends an EOF ack (buffered data is discarded).
+func (m *Multiplexer) CloseFd(fdNum int) error {
+	return m.closeFd(fdNum, CloseReasonCloseFd)
+}
+
+func (m *Multiplexer) closeFd(fdNum int, reason string) error {
+	m.Lock.Lock()
+	fr := m.FdReaders[fdNum]
+	fw := m.FdWriters[fdNum]
+	delete(m.FdReaders, fdNum)
+	delete(m.FdWriters, fdNum)
+	m.Lock.Unlock()
+	if fr == nil && fw == nil {
+		return fmt.Errorf("cannot close fd:%d: %w", fdNum, ErrNoSuchFd)
+	}
+	if fr != nil && !fr.isClosed() {
+		fr.closeWithReason(reason)
+		pk := m.makeDataPacket(fdNum, nil, nil)
+		pk.Eof = true
+		m.sendReaderPacket(fdNum, pk)
+	}
+	if fw != nil && !fw.isClosed() {
+		fw.closeWithReason(reason)
+		ack := m.makeDataAckPacket(fdNum, 0, nil)
+		ack.EofAck = true
+		m.sendPacket(ack)
+	}
+	return nil
+}
+
+// clean teardown of the readers: stops sending new data (readers are paused), waits until every byte
+// sent has been acked, then closes the readers (the client gets an EOF for each).  if ctx expires
+// first the readers are closed anyway and ctx.Err() is returned.  data read but not yet sent is
+// discarded.
+func (m *Multiplexer) CloseReadersAfterAcks(ctx context.Context) error {
+	m.Lock.Lock()
+	readers := make([]*FdReader, 0, len(m.FdReaders))
+	for _, fr := range m.FdReaders {
+		readers = append(readers, fr)
+	}
+	m.Lock.Unlock()
+	for _, fr := range readers {
+		fr.SetPaused(true)
+	}
+	var rtnErr error
+	for _, fr := range readers {
+		if !fr.waitForAcks(ctx.Done()) {
+			rtnErr = ctx.Err()
+			break
+		}
+	}
+	for _, fr := range readers {
+		if fr.isClosed() {
+			continue
+		}
+		fr.closeWithReason(CloseReasonTeardown)
+		pk := m.makeDataPacket(fr.FdNum, nil, nil)
+		pk.Eof = true
+		m.sendReaderPacket(fr.FdNum, pk)
+	}
+	return rtnErr
+}
+
+// true once the input side is done (HandleInputDone ran: done packet, input EOF, or teardown)
+func (m *Multiplexer) InputDone() bool {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	return m.inputDone
+}
+
+// closed (once) when the input side is done, see InputDone
+func (m *Multiplexer) InputDoneCh() <-chan bool {
+	return m.inputDoneCh
 }
 
 func (m *Multiplexer) HandleInputDone() {
 	m.Lock.Lock()
 	defer m.Lock.Unlock()
+	if !m.inputDone {
+		m.inputDone = true
+		close(m.inputDoneCh)
+	}
 
 	// close readers (obviously the done command needs no more input)
 	for _, fr := range m.FdReaders {
 		fr.Close()
 	}
 
-	// ensure EOF on all writers (ignore error)
+	// ensure EOF on all writers.  this is not a hard close, buffered data is still
+	// flushed by WriteLoop before the fd is closed.
 	for _, fw := range m.FdWriters {
-		fw.AddData(nil, true)
+		fw.FlushAndClose()
+	}
+}
+
+// os.Pipe already opens both ends with O_CLOEXEC, but we set FD_CLOEXEC explicitly on the end
+// the parent keeps so it can never leak into the child (or its children).  the child's end is
+// inherited by dup'ing it onto the child's fd in exec (which clears FD_CLOEXEC on the new fd),
+// the parent's copy of the child end is closed in closeTempStartFds after start.
+// uses SyscallConn (not Fd()) so the file stays in non-blocking mode and Close() still interrupts reads.
+func setCloseOnExec(f *os.File) error {
+	rawConn, err := f.SyscallConn()
+	if err != nil {
+		return err
 	}
+	return rawConn.Control(func(fd uintptr) {
+		syscall.CloseOnExec(int(fd))
+	})
+}
+
+// returns (pr, pw, err).  the end the parent keeps (pr if parentReads, otherwise pw) is set close-on-exec
+func makeChildPipe(parentReads bool) (*os.File, *os.File, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	parentEnd := pw
+	if parentReads {
+		parentEnd = pr
+	}
+	err = setCloseOnExec(parentEnd)
+	if err != nil {
+		pr.Close()
+		pw.Close()
+		return nil, nil, fmt.Errorf("cannot set close-on-exec: %w", err)
+	}
+	return pr, pw, nil
 }
 
 // returns the *writer* to connect to process, reader is put in FdReaders
+// the child inherits the write end, the read end stays in the parent (close-on-exec)
 func (m *Multiplexer) MakeReaderPipe(fdNum int) (*os.File, error) {
-	pr, pw, err := os.Pipe()
+	pr, pw, err := makeChildPipe(true)
 	if err != nil {
 		return nil, err
 	}
 	m.Lock.Lock()
 	defer m.Lock.Unlock()
-	m.FdReaders[fdNum] = MakeFdReader(m, pr, fdNum, true, false)
+	err = m.addFdReader(MakeFdReader(m, pr, fdNum, true, false))
+	if err != nil {
+		pr.Close()
+		pw.Close()
+		return nil, err
+	}
 	m.CloseAfterStart = append(m.CloseAfterStart, pw)
 	return pw, nil
 }
 
 // returns the *reader* to connect to process, writer is put in FdWriters
+// the child inherits the read end, the write end stays in the parent (close-on-exec)
 func (m *Multiplexer) MakeWriterPipe(fdNum int, desc string) (*os.File, error) {
-	pr, pw, err := os.Pipe()
+	pr, pw, err := makeChildPipe(false)
 	if err != nil {
 		return nil, err
 	}
 	m.Lock.Lock()
 	defer m.Lock.Unlock()
-	m.FdWriters[fdNum] = MakeFdWriter(m, pw, fdNum, true, desc)
+	err = m.addFdWriter(MakeFdWriter(m, pw, fdNum, true, desc))
+	if err != nil {
+		pr.Close()
+		pw.Close()
+		return nil, err
+	}
 	m.CloseAfterStart = append(m.CloseAfterStart, pr)
 	return pr, nil
 }
 
+// like MakeReaderPipe, but the fd number is allocated, the lowest free one from FirstAllocFdNum
+func (m *Multiplexer) AllocFdReaderPipe() (int, *os.File, error) {
+	pr, pw, err := makeChildPipe(true)
+	if err != nil {
+		return 0, nil, err
+	}
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	fdNum, err := m.allocFdNum_nolock()
+	if err == nil {
+		err = m.addFdReader(MakeFdReader(m, pr, fdNum, true, false))
+	}
+	if err != nil {
+		pr.Close()
+		pw.Close()
+		return 0, nil, err
+	}
+	m.CloseAfterStart = append(m.CloseAfterStart, pw)
+	return fdNum, pw, nil
+}
+
+// like MakeWriterPipe, but the fd number is allocated, the lowest free one from FirstAllocFdNum
+func (m *Multiplexer) AllocFdWriterPipe() (int, *os.File, error) {
+	pr, pw, err := makeChildPipe(false)
+	if err != nil {
+		return 0, nil, err
+	}
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	fdNum, err := m.allocFdNum_nolock()
+	if err == nil {
+		err = m.addFdWriter(MakeFdWriter(m, pw, fdNum, true, fmt.Sprintf("fd:%d", fdNum)))
+	}
+	if err != nil {
+		pr.Close()
+		pw.Close()
+		return 0, nil, err
+	}
+	m.CloseAfterStart = append(m.CloseAfterStart, pr)
+	return fdNum, pr, nil
+}
+
+// lock must be held.  a number is free if it has no reader or writer and is not expected (ExpectFds)
+func (m *Multiplexer) allocFdNum_nolock() (int, error) {
+	for fdNum := FirstAllocFdNum; fdNum <= m.MaxFdNum; fdNum++ {
+		if m.FdReaders[fdNum] == nil && m.FdWriters[fdNum] == nil && !m.ExpectedFds[fdNum] {
+			return fdNum, nil
+		}
+	}
+	return 0, fmt.Errorf("cannot allocate an fd number, all of %d..%d are in use", FirstAllocFdNum, m.MaxFdNum)
+}
+
 // returns the *reader* to connect to process, writer is put in FdWriters
 func (m *Multiplexer) MakeStaticWriterPipe(fdNum int, data []byte, bufferLimit int, desc string) (*os.File, error) {
-	pr, pw, err := os.Pipe()
+	return m.makeSeededWriterPipe(fdNum, [][]byte{data}, bufferLimit, desc, true)
+}
+
+// like MakeStaticWriterPipe, but the writer stays open after data (more can be written with data packets)
+func (m *Multiplexer) MakeSeededWriterPipe(fdNum int, data []byte, bufferLimit int, desc string) (*os.File, error) {
+	return m.makeSeededWriterPipe(fdNum, [][]byte{data}, bufferLimit, desc, false)
+}
+
+// returns the *reader* to connect to process, the chunks are queued in order (e.g. preamble, input,
+// trailer) followed by EOF if eof is set (otherwise the writer stays open for data packets).
+// the buffer limit is raised to fit the chunks.
+func (m *Multiplexer) MakeSequencedWriterPipe(fdNum int, chunks [][]byte, eof bool) (*os.File, error) {
+	totalLen := 0
+	for _, chunk := range chunks {
+		totalLen += len(chunk)
+	}
+	bufferLimit := WriteBufSize
+	if totalLen > bufferLimit {
+		bufferLimit = totalLen
+	}
+	return m.makeSeededWriterPipe(fdNum, chunks, bufferLimit, "sequence", eof)
+}
+
+func (m *Multiplexer) makeSeededWriterPipe(fdNum int, chunks [][]byte, bufferLimit int, desc string, eof bool) (*os.File, error) {
+	pr, pw, err := makeChildPipe(false)
 	if err != nil {
 		return nil, err
 	}
 	m.Lock.Lock()
 	defer m.Lock.Unlock()
+	err = m.checkFdLimit_nolock(fdNum)
+	if err != nil {
+		pr.Close()
+		pw.Close()
+		return nil, err
+	}
 	fdWriter := MakeFdWriter(m, pw, fdNum, true, desc)
 	fdWriter.BufferLimit = bufferLimit
-	err = fdWriter.AddData(data, true)
+	for idx, chunk := range chunks {
+		err = fdWriter.AddData(chunk, eof && idx == len(chunks)-1)
+		if err != nil {
+			pr.Close()
+			pw.Close()
+			return nil, err
+		}
+	}
+	if eof && len(chunks) == 0 {
+		fdWriter.AddData(nil, true)
+	}
+	err = m.addFdWriter(fdWriter)
+	if err != nil {
+		pr.Close()
+		pw.Close()
+		return nil, err
+	}
+	m.CloseAfterStart = append(m.CloseAfterStart, pr)
+	return pr, nil
+}
+
+// sets up fd 0/1/2 pipes and wires them to cmd (stdin is a writer, stdout/stderr are readers).
+// call cmd.Start() and then RunIOAndWait (which closes the child's pipe ends)
+func (m *Multiplexer) AttachCmd(cmd *exec.Cmd) error {
+	stdin, err := m.MakeWriterPipe(0, "stdin")
+	if err != nil {
+		return fmt.Errorf("cannot make stdin pipe: %w", err)
+	}
+	stdout, err := m.MakeReaderPipe(1)
+	if err != nil {
+		m.removeFdPipe(0, true, stdin)
+		return fmt.Errorf("cannot make stdout pipe: %w", err)
+	}
+	stderr, err := m.MakeReaderPipe(2)
+	if err != nil {
+		m.removeFdPipe(1, false, stdout)
+		m.removeFdPipe(0, true, stdin)
+		return fmt.Errorf("cannot make stderr pipe: %w", err)
+	}
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return nil
+}
+
+// undoes a MakeReaderPipe/MakeWriterPipe (a failed AttachCmd), fdNum is unregistered and both
+// ends of its pipe are closed (childFd is the end that was returned)
+func (m *Multiplexer) removeFdPipe(fdNum int, isWriter bool, childFd *os.File) {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	if isWriter {
+		if fw := m.FdWriters[fdNum]; fw != nil {
+			delete(m.FdWriters, fdNum)
+			fw.Close()
+		}
+	} else if fr := m.FdReaders[fdNum]; fr != nil {
+		delete(m.FdReaders, fdNum)
+		fr.Close()
+	}
+	for idx, fd := range m.CloseAfterStart {
+		if fd == childFd {
+			m.CloseAfterStart = append(m.CloseAfterStart[0:idx], m.CloseAfterStart[idx+1:]...)
+			break
+		}
+	}
+	childFd.Close()
+}
+
+// returns the *reader* to connect to process, writer is put in FdWriters and is fed from r
+// incrementally (never more than the writer's BufferLimit in memory).  r is closed (if it is an
+// io.Closer) once it is fully read, or when the writer is closed (after any pending Read returns).
+func (m *Multiplexer) MakeStreamWriterPipe(fdNum int, r io.Reader) (*os.File, error) {
+	pr, pw, err := makeChildPipe(false)
+	if err != nil {
+		return nil, err
+	}
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	fdWriter := MakeFdWriter(m, pw, fdNum, true, "stream")
+	err = m.addFdWriter(fdWriter)
 	if err != nil {
+		pr.Close()
+		pw.Close()
 		return nil, err
 	}
-	m.FdWriters[fdNum] = fdWriter
 	m.CloseAfterStart = append(m.CloseAfterStart, pr)
+	go fdWriter.feedFrom(r)
 	return pr, nil
 }
 
-func (m *Multiplexer) MakeRawFdReader(fdNum int, fd io.ReadCloser, shouldClose bool, isPty bool) {
+// only fails past MaxFds (fd is not closed)
+func (m *Multiplexer) MakeRawFdReader(fdNum int, fd io.ReadCloser, shouldClose bool, isPty bool) error {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	return m.addFdReader(MakeFdReader(m, fd, fdNum, shouldClose, isPty))
+}
+
+// only fails past MaxFds (fd is not closed).  for an O_APPEND *os.File the buffered data packets are
+// written with one write(2) each batch (not MaxSingleWriteSize chunks), so every data packet is appended
+// whole and does not interleave with other processes (or writers) appending to the same file.  send
+// one record per data packet, a record split across data packets can still be interleaved.
+func (m *Multiplexer) MakeRawFdWriter(fdNum int, fd io.WriteCloser, shouldClose bool, desc string) error {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	return m.addFdWriter(MakeFdWriter(m, fd, fdNum, shouldClose, desc))
+}
+
+// switches the writer for fdNum to fd without closing the stream (e.g. stdin follows the foreground
+// command).  data already written stays with the old fd, buffered data that has not been written yet
+// goes to fd.  returns the old fd, which is left open for the caller.
+func (m *Multiplexer) RetargetFdWriter(fdNum int, fd io.WriteCloser, shouldClose bool) (io.WriteCloser, error) {
+	fw, err := m.getFdWriter(fdNum)
+	if err != nil {
+		return nil, err
+	}
+	return fw.retarget(fd, shouldClose)
+}
+
+// lock must be held.  re-registering an fd number never counts against MaxFds.
+func (m *Multiplexer) checkFdLimit_nolock(fdNum int) error {
+	if m.MaxFds <= 0 || m.FdReaders[fdNum] != nil || m.FdWriters[fdNum] != nil {
+		return nil
+	}
+	numFds := len(m.FdReaders)
+	for writerFdNum := range m.FdWriters {
+		if m.FdReaders[writerFdNum] == nil {
+			numFds++
+		}
+	}
+	if numFds >= m.MaxFds {
+		return fmt.Errorf("%w: cannot add fd:%d, the session has %d (max %d)", ErrTooManyFds, fdNum, numFds, m.MaxFds)
+	}
+	return nil
+}
+
+// lock must be held.  a writer registered for an fd buffered by UnknownFdBuffer takes over the
+// buffered data, writers registered after IO has started have their WriteLoop launched here.
+func (m *Multiplexer) addFdWriter(fw *FdWriter) error {
+	err := m.checkFdLimit_nolock(fw.FdNum)
+	if err != nil {
+		return err
+	}
+	pending := m.FdWriters[fw.FdNum]
+	m.FdWriters[fw.FdNum] = fw
+	if pending != nil && pending.Pending {
+		data, eof := pending.takePending()
+		err := fw.AddData(data, eof)
+		if err != nil {
+			fw.closeWithReason(CloseReasonQuota)
+		}
+	}
+	if m.Started {
+		go fw.WriteLoop(nil)
+	}
+	return nil
+}
+
+// reader must exist, call before starting IO
+func (m *Multiplexer) getFdReader(fdNum int) (*FdReader, error) {
 	m.Lock.Lock()
 	defer m.Lock.Unlock()
-	m.FdReaders[fdNum] = MakeFdReader(m, fd, fdNum, shouldClose, isPty)
+	fr := m.FdReaders[fdNum]
+	if fr == nil {
+		return nil, fmt.Errorf("no reader for fd:%d: %w", fdNum, ErrNoSuchFd)
+	}
+	return fr, nil
 }
 
-func (m *Multiplexer) MakeRawFdWriter(fdNum int, fd io.WriteCloser, shouldClose bool, desc string) {
+// a hard cap on how long fdNum streams (regardless of activity), counted from the start of its
+// ReadLoop.  once it passes the reader is closed (CloseReasonDeadline) and an ErrReadDeadline
+// error data packet is sent.  0 to disable, set before starting IO.
+func (m *Multiplexer) SetFdReadDeadline(fdNum int, d time.Duration) error {
+	fr, err := m.getFdReader(fdNum)
+	if err != nil {
+		return err
+	}
+	fr.CVar.L.Lock()
+	defer fr.CVar.L.Unlock()
+	fr.ReadDeadline = d
+	return nil
+}
+
+// emits an EventIdle every idleTimeout while the reader is not receiving any data (0 to disable)
+func (m *Multiplexer) SetFdIdleTimeout(fdNum int, idleTimeout time.Duration) error {
+	fr, err := m.getFdReader(fdNum)
+	if err != nil {
+		return err
+	}
+	fr.CVar.L.Lock()
+	defer fr.CVar.L.Unlock()
+	fr.IdleTimeout = idleTimeout
+	return nil
+}
+
+// sets how many bytes fdNum can send before it must wait for an ack (its window).  small values
+// give low-latency interactive fds, large values minimize ack overhead for bulk fds.
+func (m *Multiplexer) SetFdAckChunk(fdNum int, ackChunk int) error {
+	if ackChunk <= 0 {
+		return fmt.Errorf("invalid ack chunk size %d (fd:%d)", ackChunk, fdNum)
+	}
+	fr, err := m.getFdReader(fdNum)
+	if err != nil {
+		return err
+	}
+	fr.CVar.L.Lock()
+	defer fr.CVar.L.Unlock()
+	fr.WindowSize = ackChunk
+	fr.CVar.Broadcast()
+	return nil
+}
+
+// limits the number of unacked data packets for the fd (in addition to the byte window), 0 for no limit
+func (m *Multiplexer) SetFdMaxPacketsInFlight(fdNum int, maxPackets int) error {
+	if maxPackets < 0 {
+		return fmt.Errorf("invalid max packets in flight %d (fd:%d)", maxPackets, fdNum)
+	}
+	fr, err := m.getFdReader(fdNum)
+	if err != nil {
+		return err
+	}
+	fr.CVar.L.Lock()
+	defer fr.CVar.L.Unlock()
+	fr.MaxPacketsInFlight = maxPackets
+	fr.CVar.Broadcast()
+	return nil
+}
+
+// transformFn rewrites (or filters, by returning a shorter slice) data read from fdNum before it
+// is sent.  the ack window stays in terms of the original bytes read.
+func (m *Multiplexer) SetFdTransform(fdNum int, transformFn func([]byte) []byte) error {
+	fr, err := m.getFdReader(fdNum)
+	if err != nil {
+		return err
+	}
+	fr.CVar.L.Lock()
+	defer fr.CVar.L.Unlock()
+	fr.Transform = transformFn
+	return nil
+}
+
+// every chunk read from fdNum is also written to w (e.g. a session recording), before it is sent
+// (and before any Transform).  a write error drops the tee with an EventTeeError, the fd keeps
+// streaming.  w must not block for long, it is written from the ReadLoop.  nil removes the tee.
+func (m *Multiplexer) SetFdTee(fdNum int, w io.Writer) error {
+	fr, err := m.getFdReader(fdNum)
+	if err != nil {
+		return err
+	}
+	fr.CVar.L.Lock()
+	defer fr.CVar.L.Unlock()
+	fr.Tee = w
+	return nil
+}
+
+// the encoding used for the data packets sent for fdNum (packet.EncodingBase64, EncodingHex or
+// EncodingRaw), e.g. hex or raw to make a text stream readable when inspecting the packets.  msgpack
+// sessions (Format) always send the raw bytes.
+func (m *Multiplexer) SetFdEncoding(fdNum int, enc string) error {
+	if !packet.IsValidDataEncoding(enc) {
+		return fmt.Errorf("invalid data encoding %q", enc)
+	}
+	fr, err := m.getFdReader(fdNum)
+	if err != nil {
+		return err
+	}
+	fr.CVar.L.Lock()
+	defer fr.CVar.L.Unlock()
+	fr.Encoding = enc
+	return nil
+}
+
+// reader packets are aligned to line boundaries (partial lines are held, and flushed at EOF)
+func (m *Multiplexer) SetFdLineBuffered(fdNum int, lineBuffered bool) error {
+	fr, err := m.getFdReader(fdNum)
+	if err != nil {
+		return err
+	}
+	fr.CVar.L.Lock()
+	defer fr.CVar.L.Unlock()
+	fr.LineBuffered = lineBuffered
+	return nil
+}
+
+// writer must exist, call before starting IO
+func (m *Multiplexer) getFdWriter(fdNum int) (*FdWriter, error) {
 	m.Lock.Lock()
 	defer m.Lock.Unlock()
-	m.FdWriters[fdNum] = MakeFdWriter(m, fd, fdNum, shouldClose, desc)
+	fw := m.FdWriters[fdNum]
+	if fw == nil {
+		return nil, fmt.Errorf("no writer for fd:%d: %w", fdNum, ErrNoSuchFd)
+	}
+	return fw, nil
+}
+
+// for a client that feeds fdNum without flow control (it paces the data itself), the writer does
+// not send progress acks.  error and EOF acks are still sent, and data beyond the writer's
+// BufferLimit still closes it (CloseReasonQuota).
+func (m *Multiplexer) SetFdSuppressAcks(fdNum int, suppressAcks bool) error {
+	fw, err := m.getFdWriter(fdNum)
+	if err != nil {
+		return err
+	}
+	fw.CVar.L.Lock()
+	defer fw.CVar.L.Unlock()
+	fw.SuppressAcks = suppressAcks
+	return nil
+}
+
+// returns the number of bytes sent for fdNum that have not been acked yet (0 if there is no reader)
+func (m *Multiplexer) UnackedBytes(fdNum int) int {
+	m.Lock.Lock()
+	fr := m.FdReaders[fdNum]
+	m.Lock.Unlock()
+	if fr == nil {
+		return 0
+	}
+	return fr.GetBufSize()
 }
 
 func (m *Multiplexer) makeDataAckPacket(fdNum int, ackLen int, err error) *packet.DataAckPacketType {
@@ -140,8 +913,10 @@ func (m *Multiplexer) makeDataAckPacket(fdNum int, ackLen int, err error) *packe
 	ack.CK = m.CK
 	ack.FdNum = fdNum
 	ack.AckLen = ackLen
+	ack.TraceId = m.TraceId
 	if err != nil {
 		ack.Error = err.Error()
+		ack.ConsumerClosed = errors.Is(err, ErrConsumerClosed)
 	}
 	return ack
 }
@@ -150,15 +925,108 @@ func (m *Multiplexer) makeDataPacket(fdNum int, data []byte, err error) *packet.
 	pk := packet.MakeDataPacket()
 	pk.CK = m.CK
 	pk.FdNum = fdNum
-	pk.Data64 = base64.StdEncoding.EncodeToString(data)
+	if m.Format == packet.FormatMsgpack {
+		// copied, data is the reader's buffer (reused before the packet is sent)
+		pk.SetData(packet.EncodingBinary, append([]byte(nil), data...))
+	} else {
+		pk.Data64 = base64.StdEncoding.EncodeToString(data)
+	}
+	pk.TraceId = m.TraceId
 	if err != nil {
 		pk.Error = err.Error()
 	}
 	return pk
 }
 
+func (m *Multiplexer) makeMessagePacket(message string) *packet.MessagePacketType {
+	msg := packet.MakeMessagePacket(message)
+	msg.CK = m.CK
+	msg.TraceId = m.TraceId
+	return msg
+}
+
+// "PK-M>" or "PK-M[traceid]>" for the Debug output
+func (m *Multiplexer) debugPrefix(prefix string) string {
+	if m.TraceId == "" {
+		return prefix + ">"
+	}
+	return fmt.Sprintf("%s[%s]>", prefix, m.TraceId)
+}
+
 func (m *Multiplexer) sendPacket(p packet.PacketType) {
-	m.Sender.SendPacket(p)
+	p = m.attachPiggybackAck(p)
+	m.logPacket(RecordDirOut, p)
+	m.senderLock.RLock()
+	err := m.Sender.SendPacket(p)
+	m.senderLock.RUnlock()
+	if err != nil {
+		m.handleSendError(err)
+	}
+}
+
+// replaces the outbound path (e.g. failover to a backup connection) and returns the old sender.
+// waits for the sends in progress to finish on the old sender, once SwapSender returns every
+// packet goes to the new one.  packets already accepted by the old sender are its responsibility.
+func (m *Multiplexer) SwapSender(sender PacketSender) (PacketSender, error) {
+	if sender == nil {
+		return nil, fmt.Errorf("cannot swap in a nil sender")
+	}
+	m.Lock.Lock()
+	started := m.Started
+	m.Lock.Unlock()
+	if !started {
+		return nil, fmt.Errorf("cannot swap sender, multiplexer is not running")
+	}
+	m.senderLock.Lock()
+	defer m.senderLock.Unlock()
+	oldSender := m.Sender
+	m.Sender = sender
+	return oldSender, nil
+}
+
+// a send error means the transport is gone (e.g. EPIPE), so rather than having every reader
+// keep trying to send, the first error closes the whole multiplexer.
+func (m *Multiplexer) handleSendError(err error) {
+	m.Lock.Lock()
+	if m.SendErr != nil {
+		m.Lock.Unlock()
+		return
+	}
+	m.SendErr = err
+	m.Lock.Unlock()
+	m.emitEvent(&MuxEvent{Type: EventSendError, FdNum: -1, Error: err})
+	m.closeWithReason(CloseReasonTransport)
+}
+
+func (m *Multiplexer) makeTransportErrorDonePacket(err error) *packet.CmdDonePacketType {
+	donePacket := packet.MakeCmdDonePacket(m.CK)
+	donePacket.Ts = m.Clock.Now().UnixMilli()
+	donePacket.ExitCode = TransportErrorExitCode
+	donePacket.Error = fmt.Sprintf("transport error: %v", err)
+	return donePacket
+}
+
+// data packets from readers, goes through the fair dispatcher when FairScheduling is set
+func (m *Multiplexer) sendReaderPacket(fdNum int, p packet.PacketType) {
+	m.Lock.Lock()
+	dispatcher := m.dispatcher
+	merge := m.Merges[fdNum]
+	m.Lock.Unlock()
+	if dataPk, ok := p.(*packet.DataPacketType); ok {
+		if merge != nil {
+			if !merge.prepareSend(fdNum, dataPk) {
+				return
+			}
+			defer merge.endSend()
+			fdNum = merge.DstFd
+		}
+		m.addDataPacketStats(dataPk)
+	}
+	if dispatcher == nil {
+		m.sendPacket(p)
+		return
+	}
+	dispatcher.enqueue(fdNum, p)
 }
 
 func (m *Multiplexer) launchWriters(wg *sync.WaitGroup) {
@@ -183,7 +1051,7 @@ func (m *Multiplexer) launchReaders(wg *sync.WaitGroup) {
 	}
 }
 
-func (m *Multiplexer) startIO(packetParser *packet.PacketParser, sender *packet.PacketSender) {
+func (m *Multiplexer) startIO(packetParser *packet.PacketParser, sender PacketSender) {
 	m.Lock.Lock()
 	defer m.Lock.Unlock()
 	if m.Started {
@@ -192,72 +1060,380 @@ func (m *Multiplexer) startIO(packetParser *packet.PacketParser, sender *packet.
 	m.Input = packetParser
 	m.Sender = sender
 	m.Started = true
+	m.StartTs = m.Clock.Now()
+	if m.FairScheduling {
+		m.dispatcher = makeFairDispatcher(m, m.MaxBurstPackets, m.FdPriorities)
+		go m.dispatcher.run()
+	}
+}
+
+func (m *Multiplexer) waitForDispatcher() {
+	m.Lock.Lock()
+	dispatcher := m.dispatcher
+	m.Lock.Unlock()
+	if dispatcher != nil {
+		dispatcher.waitEmpty()
+	}
+}
+
+// returns the fd targeted by a data, ack, or special input packet
+func (m *Multiplexer) packetFdNum(pk packet.PacketType) (int, bool) {
+	switch tpk := pk.(type) {
+	case *packet.DataPacketType:
+		return tpk.FdNum, true
+	case *packet.DataAckPacketType:
+		return tpk.FdNum, true
+	case *packet.UrgentPacketType:
+		return tpk.FdNum, true
+	case *packet.SpecialInputPacketType:
+		if tpk.FdNum != nil {
+			return *tpk.FdNum, true
+		}
+	}
+	return 0, false
+}
+
+func (m *Multiplexer) checkFdNum(fdNum int) error {
+	if fdNum < 0 || fdNum > m.MaxFdNum {
+		return fmt.Errorf("%w: fd:%d (max=%d)", ErrFdNumRange, fdNum, m.MaxFdNum)
+	}
+	if m.ExpectedFds != nil && !m.ExpectedFds[fdNum] {
+		return fmt.Errorf("%w: fd:%d was not declared (protocol violation)", ErrUnexpectedFd, fdNum)
+	}
+	return nil
+}
+
+// declares the complete set of fds for the session (set before starting IO).  packets for any
+// other fd are rejected (error ack and UPR report), UnknownFdPolicy does not apply to them.
+func (m *Multiplexer) ExpectFds(fdNums []int) {
+	expected := make(map[int]bool)
+	for _, fdNum := range fdNums {
+		expected[fdNum] = true
+	}
+	m.ExpectedFds = expected
+}
+
+// returns a non-nil CmdDonePacket when the input is done
+func (m *Multiplexer) processInputPacket(pk packet.PacketType) *packet.CmdDonePacketType {
+	m.beginInput()
+	defer m.endInput()
+	if m.Debug {
+		fmt.Printf("%s %s\n", m.debugPrefix("PK-M"), packet.AsString(pk))
+	}
+	m.logPacket(RecordDirIn, pk)
+	m.markInput()
+	if pk.GetType() == packet.KeepAlivePacketStr {
+		return nil
+	}
+	if fdNum, ok := m.packetFdNum(pk); ok {
+		// rejected before any map lookup, so bad fd numbers never create placeholders
+		err := m.checkFdNum(fdNum)
+		if err != nil {
+			m.sendPacket(m.makeDataAckPacket(fdNum, 0, err))
+			m.UPR.UnknownPacket(pk)
+			return nil
+		}
+	}
+	if pk.GetType() == packet.DataPacketStr {
+		dataPacket := pk.(*packet.DataPacketType)
+		err := m.processDataPacket(dataPacket)
+		if err != nil {
+			errPacket := m.makeDataAckPacket(dataPacket.FdNum, 0, err)
+			m.sendPacket(errPacket)
+		}
+		return nil
+	}
+	if pk.GetType() == packet.DataAckPacketStr {
+		ackPacket := pk.(*packet.DataAckPacketType)
+		m.processAckPacket(ackPacket)
+		return nil
+	}
+	if pk.GetType() == packet.UrgentPacketStr {
+		m.processUrgentPacket(pk.(*packet.UrgentPacketType))
+		return nil
+	}
+	if pk.GetType() == packet.MuxHelloPacketStr && m.Handshake {
+		m.processHelloPacket(pk.(*packet.MuxHelloPacketType))
+		return nil
+	}
+	if pk.GetType() == packet.SpecialInputPacketStr {
+		inputPacket := pk.(*packet.SpecialInputPacketType)
+		fwdPacket, err := m.processSpecialInputPacket(inputPacket)
+		if err != nil {
+			m.sendPacket(m.makeMessagePacket(err.Error()))
+		}
+		if fwdPacket != nil {
+			m.UPR.UnknownPacket(fwdPacket)
+		}
+		return nil
+	}
+	if pk.GetType() == packet.CmdDonePacketStr {
+		donePacket := pk.(*packet.CmdDonePacketType)
+		if m.OnCmdDone != nil {
+			m.OnCmdDone(donePacket)
+		}
+		return donePacket
+	}
+	m.UPR.UnknownPacket(pk)
+	return nil
+}
+
+// packets can already be queued behind the done packet (e.g. with CombinePacketParsers there is no
+// ordering between the two inputs).  process anything that is immediately available (non-blocking) so
+// queued data lands in the writers before HandleInputDone EOFs them instead of being dropped.
+func (m *Multiplexer) drainPendingInput(inputCh chan packet.PacketType) {
+	for {
+		select {
+		case pk, ok := <-inputCh:
+			if !ok {
+				return
+			}
+			if pk.GetType() == packet.CmdDonePacketStr {
+				continue
+			}
+			m.processInputPacket(pk)
+		default:
+			return
+		}
+	}
+}
+
+// swaps in a new input parser (e.g. after a transport reconnect), the session continues with the
+// new parser's packets.  the old parser is abandoned (it does not need to be closed first).
+func (m *Multiplexer) ReattachInput(packetParser *packet.PacketParser) error {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	if !m.Started {
+		return fmt.Errorf("cannot reattach input, multiplexer is not running")
+	}
+	// only the latest reattach matters
+	select {
+	case <-m.reattachCh:
+	default:
+	}
+	m.reattachCh <- packetParser
+	return nil
+}
+
+func (m *Multiplexer) setInput(packetParser *packet.PacketParser) {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	m.Input = packetParser
+}
+
+func (m *Multiplexer) getInput() *packet.PacketParser {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	return m.Input
+}
+
+// the done packet for a premature input close, see InputClosedPolicy
+func (m *Multiplexer) makeInputClosedDonePacket() *packet.CmdDonePacketType {
+	parserErr := m.getInput().GetErr()
+	switch m.InputClosedPolicy {
+	case InputClosedTransportError:
+		err := parserErr
+		if err == nil {
+			err = errors.New("input closed before the cmd was done")
+		}
+		return m.makeTransportErrorDonePacket(err)
+	case InputClosedCallback:
+		if m.OnInputClosed == nil {
+			return nil
+		}
+		return m.OnInputClosed(parserErr)
+	default:
+		return nil
+	}
+}
+
+// called when the input channel closes, returns nil if the input is done (no reattach)
+func (m *Multiplexer) waitForReattach() *packet.PacketParser {
+	if m.ReattachTimeout <= 0 {
+		return nil
+	}
+	timer := m.Clock.NewTimer(m.ReattachTimeout)
+	defer timer.Stop()
+	select {
+	case packetParser := <-m.reattachCh:
+		return packetParser
+	case <-timer.C():
+		return nil
+	case <-m.closeCh:
+		return nil
+	}
 }
 
 func (m *Multiplexer) runPacketInputLoop() *packet.CmdDonePacketType {
 	defer m.HandleInputDone()
-	for pk := range m.Input.MainCh {
-		if m.Debug {
-			fmt.Printf("PK-M> %s\n", packet.AsString(pk))
-		}
-		if pk.GetType() == packet.DataPacketStr {
-			dataPacket := pk.(*packet.DataPacketType)
-			err := m.processDataPacket(dataPacket)
-			if err != nil {
-				errPacket := m.makeDataAckPacket(dataPacket.FdNum, 0, err)
-				m.sendPacket(errPacket)
+	input := m.getInput()
+	inputCh, urgentCh := input.MainCh, input.UrgentCh
+	for {
+		// urgent packets are handled before anything already queued on the main channel
+		select {
+		case pk, ok := <-urgentCh:
+			if !ok {
+				urgentCh = nil
+			} else {
+				m.processInputPacket(pk)
 			}
 			continue
+		default:
 		}
-		if pk.GetType() == packet.DataAckPacketStr {
-			ackPacket := pk.(*packet.DataAckPacketType)
-			m.processAckPacket(ackPacket)
-			continue
-		}
-		if pk.GetType() == packet.CmdDonePacketStr {
-			donePacket := pk.(*packet.CmdDonePacketType)
-			return donePacket
+		select {
+		case pk, ok := <-urgentCh:
+			if !ok {
+				urgentCh = nil
+				continue
+			}
+			m.processInputPacket(pk)
+		case pk, ok := <-inputCh:
+			if !ok {
+				newParser := m.waitForReattach()
+				if newParser == nil {
+					return m.makeInputClosedDonePacket()
+				}
+				m.setInput(newParser)
+				inputCh, urgentCh = newParser.MainCh, newParser.UrgentCh
+				continue
+			}
+			donePacket := m.processInputPacket(pk)
+			if donePacket != nil {
+				m.drainPendingInput(inputCh)
+				return donePacket
+			}
+		case newParser := <-m.reattachCh:
+			m.setInput(newParser)
+			inputCh, urgentCh = newParser.MainCh, newParser.UrgentCh
+		case <-m.cmdExitCh:
+			m.drainPendingInput(inputCh)
+			return m.makeCmdExitDonePacket()
+		case <-m.closeCh:
+			return nil
 		}
-		m.UPR.UnknownPacket(pk)
 	}
-	return nil
 }
 
 func (m *Multiplexer) WriteDataToFd(fdNum int, data []byte, isEof bool) error {
+	return m.writeDataToFd(fdNum, data, isEof, nil)
+}
+
+// offset is nil, or the file offset for a resumable writer
+func (m *Multiplexer) writeDataToFd(fdNum int, data []byte, isEof bool, offset *int64) error {
 	m.Lock.Lock()
 	defer m.Lock.Unlock()
 	fw := m.FdWriters[fdNum]
 	if fw == nil {
-		// add a closed FdWriter as a placeholder so we only send one error
-		fw := MakeFdWriter(m, nil, fdNum, false, "invalid-fd")
-		fw.Close()
-		m.FdWriters[fdNum] = fw
-		return fmt.Errorf("write to closed file (no fd)")
+		err := m.checkFdLimit_nolock(fdNum)
+		if err != nil {
+			return err
+		}
+		switch m.UnknownFdPolicy {
+		case UnknownFdDiscard:
+			fw = MakeFdWriter(m, discardWriteCloser{}, fdNum, false, "discard")
+			m.FdWriters[fdNum] = fw
+			go fw.WriteLoop(nil)
+		case UnknownFdBuffer:
+			// no WriteLoop (and no acks) until the real fd is registered
+			fw = MakeFdWriter(m, nil, fdNum, false, "pending")
+			fw.Pending = true
+			m.FdWriters[fdNum] = fw
+		default:
+			// add a closed FdWriter as a placeholder so we only send one error
+			fw := MakeFdWriter(m, nil, fdNum, false, "invalid-fd")
+			fw.Close()
+			m.FdWriters[fdNum] = fw
+			return fmt.Errorf("write to closed file (%w)", ErrNoSuchFd)
+		}
+	}
+	var err error
+	if offset != nil {
+		err = fw.addDataAt(*offset, data, isEof)
+	} else {
+		err = fw.AddData(data, isEof)
 	}
-	err := fw.AddData(data, isEof)
 	if err != nil {
-		fw.Close()
+		if errors.Is(err, ErrBufferLimit) {
+			fw.closeWithReason(CloseReasonQuota)
+		} else {
+			fw.Close()
+		}
 		return err
 	}
 	return nil
 }
 
 func (m *Multiplexer) processDataPacket(dataPacket *packet.DataPacketType) error {
-	realData, err := base64.StdEncoding.DecodeString(dataPacket.Data64)
+	// the piggybacked ack is for our reader, it counts even if the data is rejected or corrupt
+	// (otherwise the reader never gets its window back)
+	if dataPacket.AckLen > 0 {
+		m.processPiggybackAck(dataPacket)
+	}
+	if m.InboundFilter != nil {
+		err := m.InboundFilter(dataPacket)
+		if err != nil {
+			return fmt.Errorf("data packet rejected: %w", err)
+		}
+	}
+	if isEmptyDataPacket(dataPacket) {
+		m.processEmptyDataPacket(dataPacket)
+		return nil
+	}
+	realData, err := dataPacket.GetData()
 	if err != nil {
-		return fmt.Errorf("decoding base64 data: %w", err)
+		decodeErr := makeDecodeError(dataPacket, err)
+		m.emitEvent(&MuxEvent{Type: EventDecodeError, FdNum: dataPacket.FdNum, Error: decodeErr})
+		return decodeErr
+	}
+	if dataPacket.Compression != "" {
+		realData, err = m.decompressPacketData(dataPacket, realData)
+		if err != nil {
+			return err
+		}
+	}
+	m.addInDataStats(dataPacket.FdNum, len(realData))
+	err = m.writeDataToFd(dataPacket.FdNum, realData, dataPacket.Eof, dataPacket.Offset)
+	m.checkMemory()
+	return err
+}
+
+// no data, no EOF, and nothing else for the writer (a keepalive)
+func isEmptyDataPacket(dataPacket *packet.DataPacketType) bool {
+	return dataPacket.Data64 == "" && len(dataPacket.Data) == 0 && !dataPacket.Eof && dataPacket.Offset == nil
+}
+
+// the writer is not involved (no write, no placeholder for an unknown fd), only a piggybacked ack
+// is processed.  with AckEmptyDataPackets a zero-length ack is sent back.
+func (m *Multiplexer) processEmptyDataPacket(dataPacket *packet.DataPacketType) {
+	m.addInDataStats(dataPacket.FdNum, 0)
+	if m.AckEmptyDataPackets {
+		m.sendPacket(m.makeDataAckPacket(dataPacket.FdNum, 0, nil))
 	}
-	return m.WriteDataToFd(dataPacket.FdNum, realData, dataPacket.Eof)
+}
+
+func (m *Multiplexer) processPiggybackAck(dataPacket *packet.DataPacketType) {
+	ackPacket := packet.MakeDataAckPacket()
+	ackPacket.CK = dataPacket.CK
+	ackPacket.FdNum = dataPacket.FdNum
+	ackPacket.AckLen = dataPacket.AckLen
+	m.processAckPacket(ackPacket)
 }
 
 func (m *Multiplexer) processAckPacket(ackPacket *packet.DataAckPacketType) {
+	defer m.checkMemory()
+	if m.processMergedAck(ackPacket) {
+		return
+	}
 	m.Lock.Lock()
-	defer m.Lock.Unlock()
 	fr := m.FdReaders[ackPacket.FdNum]
+	m.Lock.Unlock()
 	if fr == nil {
 		return
 	}
-	fr.NotifyAck(ackPacket.AckLen)
+	err := fr.NotifyAck(ackPacket.AckLen)
+	if err != nil {
+		m.emitEvent(&MuxEvent{Type: EventBadAck, FdNum: ackPacket.FdNum, Error: err})
+	}
 }
 
 func (m *Multiplexer) closeTempStartFds() {
@@ -269,28 +1445,53 @@ func (m *Multiplexer) closeTempStartFds() {
 	m.CloseAfterStart = nil
 }
 
-func (m *Multiplexer) RunIOAndWait(packetParser *packet.PacketParser, sender *packet.PacketSender, waitOnReaders bool, waitOnWriters bool, waitForInputLoop bool) *packet.CmdDonePacketType {
+func (m *Multiplexer) RunIOAndWait(packetParser *packet.PacketParser, sender PacketSender, waitOnReaders bool, waitOnWriters bool, waitForInputLoop bool) *packet.CmdDonePacketType {
+	return <-m.RunIOAndWaitAsync(packetParser, sender, waitOnReaders, waitOnWriters, waitForInputLoop)
+}
+
+// starts IO (the multiplexer is running when this returns) and returns a channel that delivers
+// the done packet (nil if there is none) once RunIOAndWait would have returned, and is then closed
+func (m *Multiplexer) RunIOAndWaitAsync(packetParser *packet.PacketParser, sender PacketSender, waitOnReaders bool, waitOnWriters bool, waitForInputLoop bool) <-chan *packet.CmdDonePacketType {
 	m.startIO(packetParser, sender)
+	if m.Handshake {
+		m.sendPacket(m.makeHelloPacket())
+	}
 	m.closeTempStartFds()
+	err := m.applyInitialMeta()
+	if err != nil {
+		m.sendPacket(m.makeMessagePacket(err.Error()))
+	}
+	if m.SessionTimeout > 0 {
+		go m.runSessionTimeout()
+	}
 	var wg sync.WaitGroup
 	if waitOnReaders {
 		m.launchReaders(&wg)
+		m.launchSplices(&wg)
 	} else {
 		m.launchReaders(nil)
+		m.launchSplices(nil)
 	}
 	if waitOnWriters {
 		m.launchWriters(&wg)
 	} else {
 		m.launchWriters(nil)
 	}
+	m.startScheduledInput()
 	var donePacket *packet.CmdDonePacketType
 	if waitForInputLoop {
 		wg.Add(1)
 	}
+	inputDoneCh := make(chan bool)
+	if m.KeepAliveInterval > 0 || m.LivenessTimeout > 0 {
+		m.markInput()
+		go m.runKeepAlive(inputDoneCh)
+	}
 	go func() {
 		if waitForInputLoop {
 			defer wg.Done()
 		}
+		defer close(inputDoneCh)
 		pkRtn := m.runPacketInputLoop()
 		if pkRtn != nil {
 			m.Lock.Lock()
@@ -298,9 +1499,29 @@ func (m *Multiplexer) RunIOAndWait(packetParser *packet.PacketParser, sender *pa
 			m.Lock.Unlock()
 		}
 	}()
-	wg.Wait()
+	rtnCh := make(chan *packet.CmdDonePacketType, 1)
+	go func() {
+		defer close(rtnCh)
+		wg.Wait()
+		m.waitForDispatcher()
+		var exitPacket *packet.CmdDonePacketType
+		if m.ReapCmdProc {
+			exitPacket = m.reapCmdProc()
+		}
 
-	m.Lock.Lock()
-	defer m.Lock.Unlock()
-	return donePacket
+		m.Lock.Lock()
+		if donePacket == nil {
+			donePacket = exitPacket
+		}
+		if donePacket == nil && m.SendErr != nil {
+			donePacket = m.makeTransportErrorDonePacket(m.SendErr)
+		}
+		rtnPacket := donePacket
+		m.Lock.Unlock()
+		if m.SummaryLogger != nil {
+			m.SummaryLogger(m.makeSessionSummary(rtnPacket))
+		}
+		rtnCh <- rtnPacket
+	}()
+	return rtnCh
 }
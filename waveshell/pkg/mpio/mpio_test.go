@@ -0,0 +1,5339 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/creack/pty"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/base"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/mpio/mpiotest"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
+)
+
+const testTimeout = 5 * time.Second
+
+type testMux struct {
+	M        *Multiplexer
+	InputCh  chan packet.PacketType // packets into the multiplexer
+	OutputCh chan packet.PacketType // packets sent by the multiplexer
+	DoneCh   chan *packet.CmdDonePacketType
+}
+
+func makeTestMux() *testMux {
+	ck := base.MakeCommandKey("testsession", "testcmd")
+	return &testMux{
+		M:        MakeMultiplexer(ck, nil),
+		InputCh:  make(chan packet.PacketType, 100),
+		OutputCh: make(chan packet.PacketType, 1000),
+		DoneCh:   make(chan *packet.CmdDonePacketType, 1),
+	}
+}
+
+func (tm *testMux) start(waitOnReaders bool, waitOnWriters bool, waitForInputLoop bool) {
+	parser := makeTestParser(tm.InputCh)
+	sender := packet.MakeChannelPacketSender(tm.OutputCh)
+	go func() {
+		tm.DoneCh <- tm.M.RunIOAndWait(parser, sender, waitOnReaders, waitOnWriters, waitForInputLoop)
+	}()
+	for !tm.isStarted() {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (tm *testMux) isStarted() bool {
+	tm.M.Lock.Lock()
+	defer tm.M.Lock.Unlock()
+	return tm.M.Started
+}
+
+func (tm *testMux) sendData(fdNum int, data []byte, eof bool) {
+	pk := packet.MakeDataPacket()
+	pk.CK = tm.M.CK
+	pk.FdNum = fdNum
+	pk.Data64 = base64.StdEncoding.EncodeToString(data)
+	pk.Eof = eof
+	tm.InputCh <- pk
+}
+
+func (tm *testMux) sendDone() {
+	pk := packet.MakeCmdDonePacket(tm.M.CK)
+	tm.InputCh <- pk
+}
+
+// returns the first output packet matching fn, other packets are appended to skipped (if not nil)
+func (tm *testMux) waitForPacket(t *testing.T, fn func(packet.PacketType) bool, skipped *[]packet.PacketType) packet.PacketType {
+	t.Helper()
+	timer := time.NewTimer(testTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case pk := <-tm.OutputCh:
+			if fn(pk) {
+				return pk
+			}
+			if skipped != nil {
+				*skipped = append(*skipped, pk)
+			}
+		case <-timer.C:
+			t.Fatalf("timeout waiting for packet")
+			return nil
+		}
+	}
+}
+
+func isEofAck(fdNum int) func(packet.PacketType) bool {
+	return func(pk packet.PacketType) bool {
+		ack, ok := pk.(*packet.DataAckPacketType)
+		return ok && ack.FdNum == fdNum && ack.EofAck
+	}
+}
+
+// WriteCloser that blocks writes until Release() is called
+type gatedWriter struct {
+	Lock     *sync.Mutex
+	Gate     chan bool
+	Data     []byte
+	IsClosed bool
+}
+
+func makeGatedWriter() *gatedWriter {
+	return &gatedWriter{Lock: &sync.Mutex{}, Gate: make(chan bool)}
+}
+
+func (w *gatedWriter) Release() {
+	close(w.Gate)
+}
+
+func (w *gatedWriter) Write(data []byte) (int, error) {
+	<-w.Gate
+	w.Lock.Lock()
+	defer w.Lock.Unlock()
+	w.Data = append(w.Data, data...)
+	return len(data), nil
+}
+
+func (w *gatedWriter) Close() error {
+	w.Lock.Lock()
+	defer w.Lock.Unlock()
+	w.IsClosed = true
+	return nil
+}
+
+func (w *gatedWriter) getData() ([]byte, bool) {
+	w.Lock.Lock()
+	defer w.Lock.Unlock()
+	return w.Data, w.IsClosed
+}
+
+func TestEofAck(t *testing.T) {
+	tm := makeTestMux()
+	gw := makeGatedWriter()
+	tm.M.MakeRawFdWriter(0, gw, true, "test")
+	tm.start(false, true, false)
+	payload := make([]byte, 3*MaxSingleWriteSize+100)
+	for i := range payload {
+		payload[i] = byte('a' + i%26)
+	}
+	tm.sendData(0, payload, true)
+	// nothing can be written until the gate is released, so no EOF ack may arrive
+	select {
+	case pk := <-tm.OutputCh:
+		if isEofAck(0)(pk) {
+			t.Fatalf("got eof ack before data was flushed")
+		}
+	case <-time.After(50 * time.Millisecond):
+	}
+	gw.Release()
+	var skipped []packet.PacketType
+	tm.waitForPacket(t, isEofAck(0), &skipped)
+	data, closed := gw.getData()
+	if string(data) != string(payload) || !closed {
+		t.Fatalf("eof ack arrived before buffer was flushed and closed (len=%d closed=%v)", len(data), closed)
+	}
+	ackTotal := 0
+	for _, pk := range skipped {
+		if ack, ok := pk.(*packet.DataAckPacketType); ok && ack.FdNum == 0 {
+			ackTotal += ack.AckLen
+		}
+	}
+	if ackTotal != len(payload) {
+		t.Fatalf("data acks should precede the eof ack, acked %d of %d", ackTotal, len(payload))
+	}
+	tm.sendDone()
+}
+
+func TestParentPipeEndNotInherited(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("requires /proc")
+	}
+	tm := makeTestMux()
+	childStdout, err := tm.M.MakeReaderPipe(1)
+	if err != nil {
+		t.Fatalf("error making reader pipe: %v", err)
+	}
+	childStdin, err := tm.M.MakeWriterPipe(0, "test")
+	if err != nil {
+		t.Fatalf("error making writer pipe: %v", err)
+	}
+	var parentFds []int
+	for _, f := range []*os.File{tm.M.FdReaders[1].Fd.(*os.File), tm.M.FdWriters[0].Fd.(*os.File)} {
+		rawConn, _ := f.SyscallConn()
+		rawConn.Control(func(fd uintptr) { parentFds = append(parentFds, int(fd)) })
+	}
+	// the child only has its own pipe ends (0, 1) and stderr, check the parent fds are not open in the child
+	var script string
+	for _, fd := range parentFds {
+		script += fmt.Sprintf("if [ -e /proc/$$/fd/%d ]; then echo leaked-%d >&2; fi; ", fd, fd)
+	}
+	var stderrBuf bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", script)
+	cmd.Stdin = childStdin
+	cmd.Stdout = childStdout
+	cmd.Stderr = &stderrBuf
+	err = cmd.Run()
+	if err != nil {
+		t.Fatalf("error running child: %v", err)
+	}
+	tm.M.Close()
+	if stderrBuf.Len() > 0 {
+		t.Fatalf("parent pipe ends leaked into child (parent fds %v): %s", parentFds, stderrBuf.String())
+	}
+}
+
+func TestMultiplePtyResize(t *testing.T) {
+	tm := makeTestMux()
+	var ptys []*os.File
+	for i := 0; i < 2; i++ {
+		ptmx, tty, err := pty.Open()
+		if err != nil {
+			t.Skipf("cannot open pty: %v", err)
+		}
+		defer ptmx.Close()
+		defer tty.Close()
+		ptys = append(ptys, ptmx)
+	}
+	tm.M.SetPtyFd(1, ptys[0])
+	tm.M.SetPtyFd(5, ptys[1])
+	tm.start(false, false, true)
+	checkSize := func(ptyFd *os.File, rows int, cols int) {
+		t.Helper()
+		deadline := time.Now().Add(testTimeout)
+		for {
+			ws, err := pty.GetsizeFull(ptyFd)
+			if err != nil {
+				t.Fatalf("error getting pty size: %v", err)
+			}
+			if int(ws.Rows) == rows && int(ws.Cols) == cols {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("pty size mismatch, expected %dx%d got %dx%d", rows, cols, ws.Rows, ws.Cols)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	secondFd := 5
+	tm.sendResize(&secondFd, 30, 100)
+	checkSize(ptys[1], 30, 100)
+	tm.sendResize(nil, 40, 120) // default pty (first registered)
+	checkSize(ptys[0], 40, 120)
+	checkSize(ptys[1], 30, 100)
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+func TestReaderIdleEvent(t *testing.T) {
+	tm := makeTestMux()
+	eventCh := make(chan *MuxEvent, 10)
+	tm.M.EventHandler = func(event *MuxEvent) {
+		if event.Type == EventIdle {
+			eventCh <- event
+		}
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("error creating pipe: %v", err)
+	}
+	defer pw.Close()
+	tm.M.MakeRawFdReader(1, pr, true, false)
+	idleTimeout := 50 * time.Millisecond
+	err = tm.M.SetFdIdleTimeout(1, idleTimeout)
+	if err != nil {
+		t.Fatalf("error setting idle timeout: %v", err)
+	}
+	startTs := time.Now()
+	tm.start(false, false, true)
+	lastTs := startTs
+	for i := 0; i < 3; i++ {
+		select {
+		case event := <-eventCh:
+			now := time.Now()
+			interval := now.Sub(lastTs)
+			if interval < idleTimeout-10*time.Millisecond || interval > 3*idleTimeout {
+				t.Fatalf("idle event %d fired at a bad interval: %v", i, interval)
+			}
+			if event.FdNum != 1 || event.Duration < idleTimeout {
+				t.Fatalf("bad idle event: %s", event.String())
+			}
+			lastTs = now
+		case <-time.After(testTimeout):
+			t.Fatalf("timeout waiting for idle event")
+		}
+	}
+	if tm.M.FdReaders[1].isClosed() {
+		t.Fatalf("idle timeout should not close the reader")
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+func (tm *testMux) sendAck(fdNum int, ackLen int) {
+	ack := packet.MakeDataAckPacket()
+	ack.CK = tm.M.CK
+	ack.FdNum = fdNum
+	ack.AckLen = ackLen
+	tm.InputCh <- ack
+}
+
+func isDataPacket(fdNum int) func(packet.PacketType) bool {
+	return func(pk packet.PacketType) bool {
+		dataPk, ok := pk.(*packet.DataPacketType)
+		return ok && dataPk.FdNum == fdNum
+	}
+}
+
+// waits for data packets on fdNum until size bytes have been received
+func (tm *testMux) readData(t *testing.T, fdNum int, size int) []byte {
+	t.Helper()
+	var rtn []byte
+	for len(rtn) < size {
+		pk := tm.waitForPacket(t, isDataPacket(fdNum), nil).(*packet.DataPacketType)
+		data, err := base64.StdEncoding.DecodeString(pk.Data64)
+		if err != nil {
+			t.Fatalf("bad data packet: %v", err)
+		}
+		rtn = append(rtn, data...)
+	}
+	return rtn
+}
+
+func waitForCond(t *testing.T, desc string, fn func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", desc)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+func TestUnackedBytes(t *testing.T) {
+	tm := makeTestMux()
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("error creating pipe: %v", err)
+	}
+	defer pw.Close()
+	tm.M.MakeRawFdReader(1, pr, true, false)
+	tm.start(false, false, true)
+	pw.Write(make([]byte, 1000))
+	tm.readData(t, 1, 1000)
+	if tm.M.UnackedBytes(1) != 1000 {
+		t.Fatalf("expected 1000 unacked bytes, got %d", tm.M.UnackedBytes(1))
+	}
+	pw.Write(make([]byte, 500))
+	tm.readData(t, 1, 500)
+	if tm.M.UnackedBytes(1) != 1500 {
+		t.Fatalf("expected 1500 unacked bytes, got %d", tm.M.UnackedBytes(1))
+	}
+	tm.sendAck(1, 1000)
+	waitForCond(t, "unacked=500", func() bool { return tm.M.UnackedBytes(1) == 500 })
+	tm.sendAck(1, 500)
+	waitForCond(t, "unacked=0", func() bool { return tm.M.UnackedBytes(1) == 0 })
+	if tm.M.UnackedBytes(7) != 0 {
+		t.Fatalf("unknown fd should have 0 unacked bytes")
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+func makeTestPipe(t *testing.T) (*os.File, *os.File) {
+	t.Helper()
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("error creating pipe: %v", err)
+	}
+	t.Cleanup(func() {
+		pr.Close()
+		pw.Close()
+	})
+	return pr, pw
+}
+
+func isEofDataPacket(fdNum int) func(packet.PacketType) bool {
+	return func(pk packet.PacketType) bool {
+		dataPk, ok := pk.(*packet.DataPacketType)
+		return ok && dataPk.FdNum == fdNum && dataPk.Eof
+	}
+}
+
+func TestCloseFd(t *testing.T) {
+	tm := makeTestMux()
+	outR1, outW1 := makeTestPipe(t)
+	outR3, outW3 := makeTestPipe(t)
+	inR0, inW0 := makeTestPipe(t)
+	inR4, inW4 := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, outR1, true, false)
+	tm.M.MakeRawFdReader(3, outR3, true, false)
+	tm.M.MakeRawFdWriter(0, inW0, true, "test")
+	tm.M.MakeRawFdWriter(4, inW4, true, "test")
+	tm.start(false, false, true)
+
+	err := tm.M.CloseFd(3)
+	if err != nil {
+		t.Fatalf("error closing fd 3: %v", err)
+	}
+	tm.waitForPacket(t, isEofDataPacket(3), nil)
+	err = tm.M.CloseFd(4)
+	if err != nil {
+		t.Fatalf("error closing fd 4: %v", err)
+	}
+	tm.waitForPacket(t, isEofAck(4), nil)
+	if tm.M.CloseFd(4) == nil {
+		t.Fatalf("closing an already closed fd should return an error")
+	}
+
+	// closed fds are released (EPIPE on the reader side, EOF on the writer side)
+	_, err = outW3.Write([]byte("x"))
+	if err == nil {
+		t.Fatalf("write to closed reader pipe should fail")
+	}
+	buf := make([]byte, 10)
+	nr, err := inR4.Read(buf)
+	if nr != 0 || err != io.EOF {
+		t.Fatalf("closed writer should EOF, got nr=%d err=%v", nr, err)
+	}
+
+	// other fds keep working
+	outW1.Write([]byte("hello"))
+	data := tm.readData(t, 1, 5)
+	if string(data) != "hello" {
+		t.Fatalf("bad data on fd 1: %q", data)
+	}
+	tm.sendData(0, []byte("world"), false)
+	nr, err = io.ReadFull(inR0, buf[0:5])
+	if err != nil || string(buf[0:nr]) != "world" {
+		t.Fatalf("bad data on fd 0: %q err=%v", buf[0:nr], err)
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+func TestWriteCoalescing(t *testing.T) {
+	tm := makeTestMux()
+	gw := makeGatedWriter()
+	tm.M.MakeRawFdWriter(0, gw, true, "test")
+	fw := tm.M.FdWriters[0]
+	tm.start(false, true, false)
+	var expected []byte
+	for i := 0; i < 100; i++ {
+		chunk := []byte(fmt.Sprintf("chunk-%03d;", i))
+		expected = append(expected, chunk...)
+		err := tm.M.WriteDataToFd(0, chunk, i == 99)
+		if err != nil {
+			t.Fatalf("error adding data: %v", err)
+		}
+	}
+	gw.Release()
+	var skipped []packet.PacketType
+	tm.waitForPacket(t, isEofAck(0), &skipped)
+	data, _ := gw.getData()
+	if string(data) != string(expected) {
+		t.Fatalf("data mismatch/reordered")
+	}
+	ackTotal := 0
+	for _, pk := range skipped {
+		if ack, ok := pk.(*packet.DataAckPacketType); ok && ack.FdNum == 0 {
+			ackTotal += ack.AckLen
+		}
+	}
+	if ackTotal != len(expected) {
+		t.Fatalf("ack total mismatch, expected %d got %d", len(expected), ackTotal)
+	}
+	// first write may only get the first chunk (it blocks on the gate), the rest coalesce
+	if fw.GetNumWrites() > 2 {
+		t.Fatalf("expected queued chunks to coalesce, got %d writes", fw.GetNumWrites())
+	}
+	tm.sendDone()
+}
+
+func BenchmarkWriteLoopSmallChunks(b *testing.B) {
+	chunk := make([]byte, 64)
+	totalWrites := 0
+	for i := 0; i < b.N; i++ {
+		m := MakeMultiplexer(base.MakeCommandKey("bench", "bench"), nil)
+		m.Sender = packet.MakeChannelPacketSender(make(chan packet.PacketType, 10000))
+		fw := MakeFdWriter(m, nopWriteCloser{io.Discard}, 0, false, "bench")
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go fw.WriteLoop(&wg)
+		for j := 0; j < 1000; j++ {
+			for fw.AddData(chunk, false) != nil {
+				runtime.Gosched() // buffer full
+			}
+		}
+		fw.AddData(nil, true)
+		wg.Wait()
+		totalWrites += fw.GetNumWrites()
+	}
+	b.ReportMetric(float64(totalWrites)/float64(b.N), "writes/op")
+	b.ReportMetric(1000, "chunks/op")
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func isErrorAck(pk packet.PacketType) bool {
+	ack, ok := pk.(*packet.DataAckPacketType)
+	return ok && ack.Error != ""
+}
+
+func TestInputQueuedBehindDone(t *testing.T) {
+	tm := makeTestMux()
+	inR, inW := makeTestPipe(t)
+	tm.M.MakeRawFdWriter(0, inW, true, "test")
+	// done packet arrives before the last data packet (interleaved inputs)
+	tm.sendData(0, []byte("first;"), false)
+	tm.sendDone()
+	tm.sendData(0, []byte("second;"), false)
+	tm.sendData(0, []byte("third"), true)
+	tm.start(false, true, true)
+	data, err := io.ReadAll(inR)
+	if err != nil {
+		t.Fatalf("error reading writer pipe: %v", err)
+	}
+	if string(data) != "first;second;third" {
+		t.Fatalf("queued data was not delivered before input done: %q", data)
+	}
+	donePk := <-tm.DoneCh
+	if donePk == nil {
+		t.Fatalf("expected done packet")
+	}
+	for len(tm.OutputCh) > 0 {
+		pk := <-tm.OutputCh
+		if isErrorAck(pk) {
+			t.Fatalf("spurious error ack: %s", packet.AsString(pk))
+		}
+	}
+}
+
+func TestTypedWriteErrors(t *testing.T) {
+	m := MakeMultiplexer(base.MakeCommandKey("testsession", "testcmd"), nil)
+	_, inW := makeTestPipe(t)
+	m.MakeRawFdWriter(0, inW, true, "test")
+	err := m.WriteDataToFd(5, []byte("data"), false)
+	if !errors.Is(err, ErrNoSuchFd) || err.Error() != "write to closed file (no fd)" {
+		t.Fatalf("expected ErrNoSuchFd, got %v", err)
+	}
+	// placeholder writer for fd 5 now exists, still reports no such fd
+	err = m.WriteDataToFd(5, []byte("data"), false)
+	if !errors.Is(err, ErrNoSuchFd) {
+		t.Fatalf("expected ErrNoSuchFd from placeholder, got %v", err)
+	}
+	err = m.WriteDataToFd(0, []byte("data"), true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = m.WriteDataToFd(0, []byte("more"), false)
+	if !errors.Is(err, ErrFdClosed) || errors.Is(err, ErrNoSuchFd) {
+		t.Fatalf("expected ErrFdClosed, got %v", err)
+	}
+	if !errors.Is(m.CloseFd(9), ErrNoSuchFd) {
+		t.Fatalf("expected ErrNoSuchFd from CloseFd")
+	}
+}
+
+func makeTestParser(inputCh chan packet.PacketType) *packet.PacketParser {
+	return &packet.PacketParser{
+		Lock:   &sync.Mutex{},
+		MainCh: inputCh,
+		RpcMap: make(map[string]*packet.RpcEntry),
+	}
+}
+
+func TestReattachInput(t *testing.T) {
+	tm := makeTestMux()
+	inR, inW := makeTestPipe(t)
+	tm.M.MakeRawFdWriter(0, inW, true, "test")
+	tm.M.ReattachTimeout = testTimeout
+	tm.start(false, false, true)
+	tm.sendData(0, []byte("before;"), false)
+	buf := make([]byte, 100)
+	nr, _ := io.ReadFull(inR, buf[0:7])
+	if string(buf[0:nr]) != "before;" {
+		t.Fatalf("bad data before reconnect: %q", buf[0:nr])
+	}
+	close(tm.InputCh) // transport dropped
+	tm.InputCh = make(chan packet.PacketType, 100)
+	err := tm.M.ReattachInput(makeTestParser(tm.InputCh))
+	if err != nil {
+		t.Fatalf("error reattaching: %v", err)
+	}
+	tm.sendData(0, []byte("after"), false)
+	nr, _ = io.ReadFull(inR, buf[0:5])
+	if string(buf[0:nr]) != "after" {
+		t.Fatalf("bad data after reconnect: %q", buf[0:nr])
+	}
+	tm.sendDone()
+	donePk := <-tm.DoneCh
+	if donePk == nil {
+		t.Fatalf("expected done packet from reattached input")
+	}
+}
+
+func TestNoReattachInput(t *testing.T) {
+	tm := makeTestMux()
+	tm.M.ReattachTimeout = 20 * time.Millisecond
+	tm.start(false, false, true)
+	close(tm.InputCh)
+	select {
+	case donePk := <-tm.DoneCh:
+		if donePk != nil {
+			t.Fatalf("expected nil done packet")
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("session should end after the reattach timeout")
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	setupFds := func(m *Multiplexer) {
+		outR, _ := makeTestPipe(t)
+		_, inW := makeTestPipe(t)
+		m.MakeRawFdReader(1, outR, true, false)
+		m.MakeRawFdWriter(0, inW, true, "stdin")
+	}
+	m1 := MakeMultiplexer(base.MakeCommandKey("testsession", "testcmd"), nil)
+	setupFds(m1)
+	m1.FdReaders[1].BufSize = 1234
+	m1.FdWriters[0].AddData([]byte("pending-data"), true)
+	snap := m1.SnapshotState()
+	barr, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatalf("error marshaling snapshot: %v", err)
+	}
+	var snap2 MuxSnapshot
+	err = json.Unmarshal(barr, &snap2)
+	if err != nil {
+		t.Fatalf("error unmarshaling snapshot: %v", err)
+	}
+	m2 := MakeMultiplexer(snap2.CK, nil)
+	if m2.RestoreState(&snap2) == nil {
+		t.Fatalf("restore without fds should fail")
+	}
+	setupFds(m2)
+	err = m2.RestoreState(&snap2)
+	if err != nil {
+		t.Fatalf("error restoring: %v", err)
+	}
+	if m2.UnackedBytes(1) != 1234 {
+		t.Fatalf("ack position not restored: %d", m2.UnackedBytes(1))
+	}
+	wsnap := m2.SnapshotState().GetFd(0, FdDirWriter)
+	if wsnap == nil || string(wsnap.Buffered) != "pending-data" || !wsnap.Eof {
+		t.Fatalf("writer buffer not restored: %#v", wsnap)
+	}
+}
+
+func TestFairScheduling(t *testing.T) {
+	tm := makeTestMux()
+	tm.OutputCh = make(chan packet.PacketType) // unbuffered so the consumer is the bottleneck
+	tm.M.FairScheduling = true
+	tm.M.MaxBurstPackets = 2
+	outR1, outW1 := makeTestPipe(t)
+	outR2, outW2 := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, outR1, true, false)
+	tm.M.MakeRawFdReader(2, outR2, true, false)
+	tm.start(false, false, true)
+	stopNoise := make(chan bool)
+	defer close(stopNoise)
+	go func() {
+		noise := make([]byte, 4096)
+		for {
+			select {
+			case <-stopNoise:
+				return
+			default:
+			}
+			outW1.Write(noise)
+		}
+	}()
+	// let the noisy fd saturate the sender queue
+	for i := 0; i < 3*packet.PacketSenderQueueSize; i++ {
+		pk := tm.waitForPacket(t, isDataPacket(1), nil).(*packet.DataPacketType)
+		data, _ := base64.StdEncoding.DecodeString(pk.Data64)
+		tm.sendAck(1, len(data))
+	}
+	outW2.Write([]byte("quiet"))
+	numNoisy := 0
+	for {
+		pk := tm.waitForPacket(t, func(packet.PacketType) bool { return true }, nil)
+		dataPk, ok := pk.(*packet.DataPacketType)
+		if !ok {
+			continue
+		}
+		data, _ := base64.StdEncoding.DecodeString(dataPk.Data64)
+		if dataPk.FdNum == 2 {
+			if string(data) != "quiet" {
+				t.Fatalf("bad fd 2 data: %q", data)
+			}
+			break
+		}
+		numNoisy++
+		tm.sendAck(1, len(data))
+	}
+	// queued in the sender + queued in the dispatcher + one burst
+	maxAhead := packet.PacketSenderQueueSize + 2*tm.M.MaxBurstPackets + 2
+	if numNoisy > maxAhead {
+		t.Fatalf("quiet fd delayed by %d noisy packets (max %d)", numNoisy, maxAhead)
+	}
+	tm.M.Close()
+}
+
+func TestFdTransform(t *testing.T) {
+	tm := makeTestMux()
+	outR, outW := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, outR, true, false)
+	err := tm.M.SetFdTransform(1, func(data []byte) []byte {
+		return bytes.ReplaceAll(data, []byte("hunter2"), []byte("***"))
+	})
+	if err != nil {
+		t.Fatalf("error setting transform: %v", err)
+	}
+	tm.start(false, false, true)
+	input := "user=mike password=hunter2\n"
+	outW.Write([]byte(input))
+	expected := "user=mike password=***\n"
+	wireData := tm.readData(t, 1, len(expected))
+	if string(wireData) != expected {
+		t.Fatalf("transform not applied: %q", wireData)
+	}
+	if tm.M.UnackedBytes(1) != len(input) {
+		t.Fatalf("unacked bytes should track original size %d, got %d", len(input), tm.M.UnackedBytes(1))
+	}
+	// client acks what it received
+	tm.sendAck(1, 10)
+	waitForCond(t, "partial ack", func() bool { return tm.M.UnackedBytes(1) < len(input) })
+	tm.sendAck(1, len(wireData)-10)
+	waitForCond(t, "full ack", func() bool { return tm.M.UnackedBytes(1) == 0 })
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+func (tm *testMux) sendResize(fdNum *int, rows int, cols int) {
+	pk := packet.MakeSpecialInputPacket()
+	pk.CK = tm.M.CK
+	pk.FdNum = fdNum
+	pk.WinSize = &packet.WinSize{Rows: rows, Cols: cols}
+	tm.InputCh <- pk
+}
+
+type testUPR struct {
+	Ch chan packet.PacketType
+}
+
+func (upr testUPR) UnknownPacket(pk packet.PacketType) {
+	upr.Ch <- pk
+}
+
+func TestWinSizeNoPtyHook(t *testing.T) {
+	tm := makeTestMux()
+	upr := testUPR{Ch: make(chan packet.PacketType, 10)}
+	tm.M.UPR = upr
+	sizeCh := make(chan [2]int, 1)
+	tm.M.OnWinSizeNoPty = func(rows int, cols int) {
+		sizeCh <- [2]int{rows, cols}
+	}
+	tm.start(false, false, true)
+	tm.sendResize(nil, 33, 111)
+	select {
+	case size := <-sizeCh:
+		if size[0] != 33 || size[1] != 111 {
+			t.Fatalf("bad winsize in hook: %v", size)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("OnWinSizeNoPty was not called")
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+	if len(upr.Ch) != 0 {
+		t.Fatalf("handled winsize should not be forwarded to the UPR")
+	}
+}
+
+func TestWriterFlushAndCloseVsAbort(t *testing.T) {
+	tm := makeTestMux()
+	flushW := makeGatedWriter()
+	abortW := makeGatedWriter()
+	tm.M.MakeRawFdWriter(0, flushW, true, "flush")
+	tm.M.MakeRawFdWriter(3, abortW, true, "abort")
+	tm.M.FdWriters[0].AddData([]byte("pending-0"), false)
+	tm.M.FdWriters[3].AddData([]byte("pending-3"), false)
+	tm.M.FdWriters[0].FlushAndClose()
+	tm.M.FdWriters[3].Abort()
+	flushW.Release()
+	abortW.Release()
+	tm.start(false, true, false)
+	tm.waitForPacket(t, isEofAck(0), nil)
+	data, closed := flushW.getData()
+	if string(data) != "pending-0" || !closed {
+		t.Fatalf("FlushAndClose should deliver pending data, got %q closed=%v", data, closed)
+	}
+	<-tm.DoneCh
+	data, closed = abortW.getData()
+	if len(data) != 0 || !closed {
+		t.Fatalf("Abort should drop pending data, got %q closed=%v", data, closed)
+	}
+}
+
+// deterministic Clock for tests, timers only fire from Advance()
+type fakeClock struct {
+	Lock   *sync.Mutex
+	NowTs  time.Time
+	Timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	Clock    *fakeClock
+	Ch       chan time.Time
+	FireTs   time.Time
+	IsActive bool
+}
+
+func makeFakeClock() *fakeClock {
+	return &fakeClock{Lock: &sync.Mutex{}, NowTs: time.Unix(1700000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	return c.NowTs
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	timer := &fakeTimer{Clock: c, Ch: make(chan time.Time, 1), FireTs: c.NowTs.Add(d), IsActive: true}
+	c.Timers = append(c.Timers, timer)
+	return timer
+}
+
+func (c *fakeClock) numActiveTimers() int {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	rtn := 0
+	for _, timer := range c.Timers {
+		if timer.IsActive {
+			rtn++
+		}
+	}
+	return rtn
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	c.NowTs = c.NowTs.Add(d)
+	for _, timer := range c.Timers {
+		if timer.IsActive && !timer.FireTs.After(c.NowTs) {
+			timer.IsActive = false
+			timer.Ch <- c.NowTs
+		}
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.Ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.Clock.Lock.Lock()
+	defer t.Clock.Lock.Unlock()
+	wasActive := t.IsActive
+	t.IsActive = false
+	return wasActive
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.Clock.Lock.Lock()
+	defer t.Clock.Lock.Unlock()
+	wasActive := t.IsActive
+	t.IsActive = true
+	t.FireTs = t.Clock.NowTs.Add(d)
+	return wasActive
+}
+
+func TestSessionTimeoutFakeClock(t *testing.T) {
+	tm := makeTestMux()
+	clock := makeFakeClock()
+	tm.M.Clock = clock
+	tm.M.SessionTimeout = time.Hour
+	eventCh := make(chan *MuxEvent, 10)
+	tm.M.EventHandler = func(event *MuxEvent) { eventCh <- event }
+	outR, _ := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, outR, true, false)
+	tm.start(true, false, true)
+	waitForCond(t, "session timer", func() bool { return clock.numActiveTimers() == 1 })
+	select {
+	case <-tm.DoneCh:
+		t.Fatalf("session ended before the deadline")
+	default:
+	}
+	clock.Advance(time.Hour)
+	select {
+	case donePk := <-tm.DoneCh:
+		if donePk != nil {
+			t.Fatalf("expected no done packet on timeout")
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("session did not end at the deadline")
+	}
+	event := <-eventCh
+	if event.Type != EventSessionTimeout {
+		t.Fatalf("expected session timeout event, got %s", event.String())
+	}
+}
+
+// fails with EPIPE after N writes
+type failingWriter struct {
+	Lock      *sync.Mutex
+	NumWrites int
+	FailAfter int
+}
+
+func (w *failingWriter) Write(data []byte) (int, error) {
+	w.Lock.Lock()
+	defer w.Lock.Unlock()
+	w.NumWrites++
+	if w.NumWrites > w.FailAfter {
+		return 0, syscall.EPIPE
+	}
+	return len(data), nil
+}
+
+func TestSenderErrorShutdown(t *testing.T) {
+	m := MakeMultiplexer(base.MakeCommandKey("testsession", "testcmd"), nil)
+	eventCh := make(chan *MuxEvent, 10)
+	m.EventHandler = func(event *MuxEvent) { eventCh <- event }
+	outR, outW := makeTestPipe(t)
+	m.MakeRawFdReader(1, outR, true, false)
+	_, inW := makeTestPipe(t)
+	m.MakeRawFdWriter(0, inW, true, "test")
+	go func() {
+		buf := make([]byte, 100)
+		for {
+			_, err := outW.Write(buf)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	sender := packet.MakePacketSender(&failingWriter{Lock: &sync.Mutex{}, FailAfter: 5}, nil)
+	inputCh := make(chan packet.PacketType)
+	doneCh := make(chan *packet.CmdDonePacketType, 1)
+	go func() {
+		doneCh <- m.RunIOAndWait(makeTestParser(inputCh), sender, true, true, true)
+	}()
+	select {
+	case donePk := <-doneCh:
+		if donePk == nil || donePk.Error == "" || donePk.ExitCode != TransportErrorExitCode {
+			t.Fatalf("expected transport error done packet, got %#v", donePk)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("multiplexer did not shut down after send error")
+	}
+	numSendErrors := 0
+	for len(eventCh) > 0 {
+		if event := <-eventCh; event.Type == EventSendError {
+			numSendErrors++
+		}
+	}
+	if numSendErrors != 1 {
+		t.Fatalf("expected one send error event, got %d", numSendErrors)
+	}
+}
+
+func TestFdAckChunk(t *testing.T) {
+	tm := makeTestMux()
+	smallR, smallW := makeTestPipe(t)
+	largeR, largeW := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, smallR, true, false)
+	tm.M.MakeRawFdReader(3, largeR, true, false)
+	if tm.M.SetFdAckChunk(1, 512) != nil || tm.M.SetFdAckChunk(3, 64*1024) != nil {
+		t.Fatalf("error setting ack chunk")
+	}
+	tm.start(false, false, true)
+	payload := make([]byte, 8192)
+	go smallW.Write(payload)
+	go largeW.Write(payload)
+	numPackets := make(map[int]int)
+	received := make(map[int]int)
+	for received[1] < len(payload) || received[3] < len(payload) {
+		pk := tm.waitForPacket(t, func(pk packet.PacketType) bool { return pk.GetType() == packet.DataPacketStr }, nil).(*packet.DataPacketType)
+		data, _ := base64.StdEncoding.DecodeString(pk.Data64)
+		if pk.FdNum == 1 && len(data) > 512 {
+			t.Fatalf("small-chunk fd sent %d bytes without an ack", len(data))
+		}
+		numPackets[pk.FdNum]++
+		received[pk.FdNum] += len(data)
+		tm.sendAck(pk.FdNum, len(data))
+	}
+	if numPackets[1] < len(payload)/512 || numPackets[1] <= numPackets[3] {
+		t.Fatalf("small-chunk fd should have more data/ack cycles: small=%d large=%d", numPackets[1], numPackets[3])
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+func TestPauseResumeAll(t *testing.T) {
+	tm := makeTestMux()
+	outR, outW := makeTestPipe(t)
+	inR, inW := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, outR, true, false)
+	tm.M.MakeRawFdWriter(0, inW, true, "test")
+	tm.start(false, false, true)
+	tm.M.PauseAll(true)
+	var expected []byte
+	for i := 0; i < 20; i++ {
+		chunk := []byte(fmt.Sprintf("out-%02d;", i))
+		expected = append(expected, chunk...)
+		outW.Write(chunk)
+	}
+	tm.sendData(0, []byte("stdin-data"), false)
+	// let the input loop process the data packet, acks still flow while paused
+	tm.sendAck(1, 0)
+	select {
+	case pk := <-tm.OutputCh:
+		if pk.GetType() == packet.DataPacketStr {
+			t.Fatalf("data sent while paused: %s", packet.AsString(pk))
+		}
+		if ack, ok := pk.(*packet.DataAckPacketType); ok && ack.AckLen > 0 {
+			t.Fatalf("writer wrote while paused")
+		}
+	case <-time.After(50 * time.Millisecond):
+	}
+	tm.M.ResumeAll()
+	data := tm.readData(t, 1, len(expected))
+	if string(data) != string(expected) {
+		t.Fatalf("data lost or reordered after resume: %q", data)
+	}
+	buf := make([]byte, 10)
+	nr, err := io.ReadFull(inR, buf)
+	if err != nil || string(buf[0:nr]) != "stdin-data" {
+		t.Fatalf("writer data not delivered after resume: %q err=%v", buf[0:nr], err)
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+func TestQuiesce(t *testing.T) {
+	tm := makeTestMux()
+	outR, outW := makeTestPipe(t)
+	inR, inW := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, outR, true, false)
+	tm.M.MakeRawFdWriter(0, inW, true, "test")
+	if err := tm.M.Quiesce(context.Background()); err == nil {
+		t.Fatalf("quiesce should fail before IO starts")
+	}
+	tm.start(false, false, true)
+	payload := make([]byte, 120*1024)
+	for i := range payload {
+		payload[i] = byte('a' + (i/7)%26)
+	}
+	for i := 0; i < len(payload); i += 30 * 1024 {
+		tm.sendData(0, payload[i:i+30*1024], false)
+	}
+	fw := tm.M.FdWriters[0]
+	// the pipe fills up, so a write is in progress when Quiesce is called
+	waitForCond(t, "pipe full", func() bool {
+		fw.CVar.L.Lock()
+		defer fw.CVar.L.Unlock()
+		return fw.NumAdded == int64(len(payload)) && fw.NumWritten >= 60*1024 && fw.Writing
+	})
+	outData := []byte(strings.Repeat("0123456789", 2048))
+	outW.Write(outData)
+	tm.readData(t, 1, len(outData))
+	quiesceErrCh := make(chan error, 1)
+	go func() {
+		ctx, cancelFn := context.WithTimeout(context.Background(), testTimeout)
+		defer cancelFn()
+		quiesceErrCh <- tm.M.Quiesce(ctx)
+	}()
+	select {
+	case err := <-quiesceErrCh:
+		t.Fatalf("quiesce returned during a write: %v", err)
+	case <-time.After(30 * time.Millisecond):
+	}
+	got := make([]byte, 16*1024)
+	if _, err := io.ReadFull(inR, got); err != nil {
+		t.Fatalf("error reading pipe: %v", err)
+	}
+	if err := <-quiesceErrCh; err != nil {
+		t.Fatalf("quiesce error: %v", err)
+	}
+	// nothing moves while quiesced: more output, acks, and input are all held
+	outW.Write([]byte("after-quiesce"))
+	inR.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	buf := make([]byte, 64*1024)
+	for {
+		nr, err := inR.Read(buf)
+		got = append(got, buf[0:nr]...)
+		if err != nil {
+			break
+		}
+	}
+	inR.SetReadDeadline(time.Time{})
+	snap := tm.M.SnapshotState()
+	wsnap := snap.GetFd(0, FdDirWriter)
+	if string(got) != string(payload[0:len(got)]) || string(wsnap.Buffered) != string(payload[len(got):]) {
+		t.Fatalf("inconsistent snapshot, %d bytes written + %d buffered, expected %d", len(got), len(wsnap.Buffered), len(payload))
+	}
+	if rsnap := snap.GetFd(1, FdDirReader); rsnap.UnackedBytes != len(outData) {
+		t.Fatalf("expected %d unacked bytes, got %d", len(outData), rsnap.UnackedBytes)
+	}
+	for len(tm.OutputCh) > 0 {
+		<-tm.OutputCh
+	}
+	tm.sendAck(1, len(outData))
+	tm.sendData(0, []byte("-end"), true)
+	select {
+	case pk := <-tm.OutputCh:
+		t.Fatalf("packet sent while quiesced: %s", packet.AsString(pk))
+	case <-time.After(50 * time.Millisecond):
+	}
+	snapJson, _ := json.Marshal(snap)
+	snapJson2, _ := json.Marshal(tm.M.SnapshotState())
+	if string(snapJson) != string(snapJson2) {
+		t.Fatalf("state changed while quiesced:\n%s\n%s", snapJson, snapJson2)
+	}
+	tm.M.Resume()
+	if tm.M.IsQuiesced() {
+		t.Fatalf("still quiesced after resume")
+	}
+	rest, err := io.ReadAll(inR)
+	if err != nil {
+		t.Fatalf("error reading pipe: %v", err)
+	}
+	if string(append(got, rest...)) != string(payload)+"-end" {
+		t.Fatalf("writer data corrupted across quiesce (%d bytes)", len(got)+len(rest))
+	}
+	if data := tm.readData(t, 1, len("after-quiesce")); string(data) != "after-quiesce" {
+		t.Fatalf("reader data corrupted across quiesce: %q", data)
+	}
+	waitForCond(t, "ack applied", func() bool { return tm.M.UnackedBytes(1) == len("after-quiesce") })
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+func TestQuiesceFairScheduling(t *testing.T) {
+	tm := makeTestMux()
+	tm.OutputCh = make(chan packet.PacketType) // unbuffered, packets back up into the dispatcher
+	tm.M.FairScheduling = true
+	tm.M.MaxBurstPackets = 2
+	outR, outW := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, outR, true, false)
+	fr := tm.M.FdReaders[1]
+	fr.MaxPacketSize = 1024
+	tm.start(false, false, true)
+	outW.Write(make([]byte, 64*1024))
+	dispatcherQueued := func() bool {
+		d := tm.M.dispatcher
+		d.CVar.L.Lock()
+		defer d.CVar.L.Unlock()
+		return d.Sending || d.numQueued() > 0
+	}
+	waitForCond(t, "packets queued in the dispatcher", func() bool {
+		d := tm.M.dispatcher
+		d.CVar.L.Lock()
+		defer d.CVar.L.Unlock()
+		return d.numQueued() == tm.M.MaxBurstPackets
+	})
+	quiesceErrCh := make(chan error, 1)
+	go func() {
+		ctx, cancelFn := context.WithTimeout(context.Background(), testTimeout)
+		defer cancelFn()
+		quiesceErrCh <- tm.M.Quiesce(ctx)
+	}()
+	select {
+	case err := <-quiesceErrCh:
+		t.Fatalf("quiesce returned with packets queued in the dispatcher: %v", err)
+	case <-time.After(30 * time.Millisecond):
+	}
+	numReceived := 0
+	var receivedLock sync.Mutex
+	stopCh := make(chan bool)
+	defer close(stopCh)
+	go func() {
+		for {
+			select {
+			case pk := <-tm.OutputCh:
+				if dataPk, ok := pk.(*packet.DataPacketType); ok {
+					receivedLock.Lock()
+					numReceived += dataPk.DataLen()
+					receivedLock.Unlock()
+				}
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	if err := <-quiesceErrCh; err != nil {
+		t.Fatalf("quiesce error: %v", err)
+	}
+	if dispatcherQueued() {
+		t.Fatalf("dispatcher still sending after quiesce")
+	}
+	fr.CVar.L.Lock()
+	numSent := fr.NumSent
+	fr.CVar.L.Unlock()
+	// everything the reader sent is out of the multiplexer (what is left is in the Sender's queue)
+	waitForCond(t, "sender queue drained", func() bool {
+		receivedLock.Lock()
+		defer receivedLock.Unlock()
+		return int64(numReceived) == numSent
+	})
+	time.Sleep(30 * time.Millisecond)
+	receivedLock.Lock()
+	if int64(numReceived) != numSent {
+		t.Fatalf("data sent while quiesced, received %d bytes, %d sent at quiesce", numReceived, numSent)
+	}
+	receivedLock.Unlock()
+	tm.M.Resume()
+	tm.M.Close()
+}
+func TestAttachCmd(t *testing.T) {
+	tm := makeTestMux()
+	cmd := exec.Command("echo", "hello")
+	err := tm.M.AttachCmd(cmd)
+	if err != nil {
+		t.Fatalf("error attaching cmd: %v", err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatalf("error starting cmd: %v", err)
+	}
+	tm.start(true, false, false)
+	var output []byte
+	for {
+		pk := tm.waitForPacket(t, isDataPacket(1), nil).(*packet.DataPacketType)
+		data, _ := base64.StdEncoding.DecodeString(pk.Data64)
+		output = append(output, data...)
+		if pk.Eof {
+			break
+		}
+	}
+	if !bytes.Contains(output, []byte("hello")) {
+		t.Fatalf("expected hello in output, got %q", output)
+	}
+	cmd.Wait()
+	select {
+	case <-tm.DoneCh:
+	case <-time.After(testTimeout):
+		t.Fatalf("timeout waiting for RunIOAndWait")
+	}
+}
+
+func TestInvalidAcks(t *testing.T) {
+	tm := makeTestMux()
+	eventCh := make(chan *MuxEvent, 10)
+	tm.M.EventHandler = func(event *MuxEvent) {
+		if event.Type == EventBadAck {
+			eventCh <- event
+		}
+	}
+	pr, pw := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, pr, true, false)
+	tm.start(false, false, true)
+	pw.Write(make([]byte, 1000))
+	tm.readData(t, 1, 1000)
+	waitForBadAck := func(desc string) {
+		t.Helper()
+		select {
+		case event := <-eventCh:
+			if event.FdNum != 1 || !errors.Is(event.Error, ErrBadAck) {
+				t.Fatalf("bad event for %s: %s", desc, event.String())
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("timeout waiting for badack event (%s)", desc)
+		}
+	}
+	tm.sendAck(1, -500)
+	waitForBadAck("negative ack")
+	if tm.M.UnackedBytes(1) != 1000 {
+		t.Fatalf("negative ack changed the window, unacked=%d", tm.M.UnackedBytes(1))
+	}
+	tm.sendAck(1, 5000)
+	waitForBadAck("oversized ack")
+	if tm.M.UnackedBytes(1) != 0 {
+		t.Fatalf("oversized ack should clamp to 0 unacked, got %d", tm.M.UnackedBytes(1))
+	}
+	// the window must still work normally after the bad acks
+	pw.Write(make([]byte, 300))
+	tm.readData(t, 1, 300)
+	if tm.M.UnackedBytes(1) != 300 {
+		t.Fatalf("expected 300 unacked bytes after bad acks, got %d", tm.M.UnackedBytes(1))
+	}
+	tm.sendAck(1, 300)
+	waitForCond(t, "unacked=0", func() bool { return tm.M.UnackedBytes(1) == 0 })
+	select {
+	case event := <-eventCh:
+		t.Fatalf("unexpected event for valid ack: %s", event.String())
+	default:
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+func TestAckWatermark(t *testing.T) {
+	tm := makeTestMux()
+	tm.M.AckWatermark = 32 * 1024
+	tm.M.MakeRawFdWriter(0, nopWriteCloser{io.Discard}, false, "test")
+	tm.start(false, false, true)
+	const packetSize = 1024
+	const numPackets = 1024
+	// act like a flow-controlled sender, never more than WriteBufSize outstanding
+	outstanding := 0
+	numAcks := 0
+	totalAcked := 0
+	readAck := func() {
+		t.Helper()
+		pk := tm.waitForPacket(t, func(pk packet.PacketType) bool {
+			ack, ok := pk.(*packet.DataAckPacketType)
+			return ok && ack.FdNum == 0
+		}, nil).(*packet.DataAckPacketType)
+		if pk.Error != "" {
+			t.Fatalf("unexpected ack error: %s", pk.Error)
+		}
+		numAcks++
+		totalAcked += pk.AckLen
+		outstanding -= pk.AckLen
+	}
+	chunk := bytes.Repeat([]byte("x"), packetSize)
+	for i := 0; i < numPackets; i++ {
+		for outstanding+packetSize > WriteBufSize {
+			readAck()
+		}
+		tm.sendData(0, chunk, false)
+		outstanding += packetSize
+	}
+	for totalAcked < packetSize*numPackets {
+		readAck()
+	}
+	if totalAcked != packetSize*numPackets {
+		t.Fatalf("acked %d bytes, expected %d", totalAcked, packetSize*numPackets)
+	}
+	if numAcks >= numPackets/2 {
+		t.Fatalf("acks were not coalesced, got %d acks for %d packets", numAcks, numPackets)
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+// records the pty size at the time of the first Read
+type sizeCheckReader struct {
+	io.ReadCloser
+	PtyFd     *os.File
+	Once      *sync.Once
+	FirstSize *pty.Winsize
+}
+
+func (r *sizeCheckReader) Read(buf []byte) (int, error) {
+	r.Once.Do(func() {
+		r.FirstSize, _ = pty.GetsizeFull(r.PtyFd)
+	})
+	return r.ReadCloser.Read(buf)
+}
+
+func TestInitialMetaWinSize(t *testing.T) {
+	tm := makeTestMux()
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		t.Skipf("cannot open pty: %v", err)
+	}
+	defer ptmx.Close()
+	defer tty.Close()
+	pty.Setsize(ptmx, &pty.Winsize{Rows: 24, Cols: 80})
+	pr, pw := makeTestPipe(t)
+	scr := &sizeCheckReader{ReadCloser: pr, PtyFd: ptmx, Once: &sync.Once{}}
+	tm.M.SetPtyFd(5, ptmx)
+	tm.M.MakeRawFdReader(1, scr, true, false)
+	tm.M.SetInitialMeta(&InitialMeta{
+		WinSize: &packet.WinSize{Rows: 50, Cols: 132},
+		Values:  map[string]string{"TERM": "xterm-256color"},
+	})
+	tm.start(false, false, true)
+	pw.Write([]byte("prompt$ "))
+	tm.readData(t, 1, 8)
+	if scr.FirstSize == nil || scr.FirstSize.Rows != 50 || scr.FirstSize.Cols != 132 {
+		t.Fatalf("initial size was not applied before the first read: %v", scr.FirstSize)
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+func TestCloseReasons(t *testing.T) {
+	tm := makeTestMux()
+	eventCh := make(chan *MuxEvent, 20)
+	tm.M.EventHandler = func(event *MuxEvent) {
+		if event.Type == EventFdClosed {
+			eventCh <- event
+		}
+	}
+	eofR, eofW := makeTestPipe(t)
+	closeFdR, _ := makeTestPipe(t)
+	teardownR, _ := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, eofR, true, false)
+	tm.M.MakeRawFdReader(3, closeFdR, true, false)
+	tm.M.MakeRawFdReader(4, teardownR, true, false)
+	tm.M.MakeRawFdWriter(0, nopWriteCloser{io.Discard}, false, "eof")
+	tm.M.MakeRawFdWriter(5, nopWriteCloser{io.Discard}, false, "quota")
+	tm.M.FdWriters[5].BufferLimit = 10
+	_, errW := makeTestPipe(t)
+	errW.Close() // write on a closed file (EPIPE would be consumerclosed)
+	tm.M.MakeRawFdWriter(6, errW, false, "error")
+	readers := map[int]*FdReader{}
+	for fdNum, fr := range tm.M.FdReaders {
+		readers[fdNum] = fr
+	}
+	writers := map[int]*FdWriter{}
+	for fdNum, fw := range tm.M.FdWriters {
+		writers[fdNum] = fw
+	}
+	tm.start(false, false, true)
+	waitForClose := func(fdNum int, dir string, reason string) {
+		t.Helper()
+		timer := time.NewTimer(testTimeout)
+		defer timer.Stop()
+		for {
+			select {
+			case event := <-eventCh:
+				if event.FdNum != fdNum || event.Dir != dir {
+					eventCh <- event // not ours, requeue
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				if event.CloseReason != reason {
+					t.Fatalf("fd:%d %s expected close reason %q, got %q", fdNum, dir, reason, event.CloseReason)
+				}
+				return
+			case <-timer.C:
+				t.Fatalf("timeout waiting for fd:%d %s to close (%s)", fdNum, dir, reason)
+			}
+		}
+	}
+	eofW.Close()
+	waitForClose(1, FdDirReader, CloseReasonEof)
+	tm.sendData(0, []byte("data"), true)
+	waitForClose(0, FdDirWriter, CloseReasonEof)
+	tm.M.CloseFd(3)
+	waitForClose(3, FdDirReader, CloseReasonCloseFd)
+	tm.sendData(5, []byte("more than ten bytes"), false)
+	waitForClose(5, FdDirWriter, CloseReasonQuota)
+	tm.sendData(6, []byte("data"), false)
+	waitForClose(6, FdDirWriter, CloseReasonError)
+	tm.M.Close()
+	waitForClose(4, FdDirReader, CloseReasonTeardown)
+	<-tm.DoneCh
+	expected := map[int]string{1: CloseReasonEof, 3: CloseReasonCloseFd, 4: CloseReasonTeardown}
+	for fdNum, reason := range expected {
+		if readers[fdNum].CloseReason != reason {
+			t.Fatalf("reader fd:%d recorded close reason %q, expected %q", fdNum, readers[fdNum].CloseReason, reason)
+		}
+	}
+	expected = map[int]string{0: CloseReasonEof, 5: CloseReasonQuota, 6: CloseReasonError}
+	for fdNum, reason := range expected {
+		if writers[fdNum].CloseReason != reason {
+			t.Fatalf("writer fd:%d recorded close reason %q, expected %q", fdNum, writers[fdNum].CloseReason, reason)
+		}
+	}
+	snap := tm.M.SnapshotState()
+	if fdSnap := snap.GetFd(4, FdDirReader); fdSnap == nil || fdSnap.CloseReason != CloseReasonTeardown {
+		t.Fatalf("snapshot missing close reason: %#v", fdSnap)
+	}
+}
+
+func TestCloseReasonTransport(t *testing.T) {
+	m := MakeMultiplexer(base.MakeCommandKey("testsession", "testcmd"), nil)
+	outR, outW := makeTestPipe(t)
+	m.MakeRawFdReader(1, outR, true, false)
+	fr := m.FdReaders[1]
+	go func() {
+		buf := make([]byte, 100)
+		for {
+			_, err := outW.Write(buf)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	sender := packet.MakePacketSender(&failingWriter{Lock: &sync.Mutex{}, FailAfter: 2}, nil)
+	inputCh := make(chan packet.PacketType)
+	doneCh := make(chan *packet.CmdDonePacketType, 1)
+	go func() {
+		doneCh <- m.RunIOAndWait(makeTestParser(inputCh), sender, true, false, true)
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(testTimeout):
+		t.Fatalf("multiplexer did not shut down after send error")
+	}
+	if fr.getCloseReason() != CloseReasonTransport {
+		t.Fatalf("expected transport close reason, got %q", fr.getCloseReason())
+	}
+}
+
+// RunIOAndWait closes the child's end of a pipe after start, keep a copy (as an exec'd child would)
+func dupChildFile(t *testing.T, f *os.File) *os.File {
+	t.Helper()
+	childFd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatalf("cannot dup child fd: %v", err)
+	}
+	rtn := os.NewFile(uintptr(childFd), "child-"+f.Name())
+	t.Cleanup(func() { rtn.Close() })
+	return rtn
+}
+
+// generates Size bytes, checks the writer never buffers more than its limit
+type checkedStreamReader struct {
+	Size      int
+	Pos       int
+	Writer    *FdWriter
+	MaxBuffer int
+	IsClosed  bool
+}
+
+func (r *checkedStreamReader) Read(buf []byte) (int, error) {
+	if bufLen := len(r.Writer.getBuffer()); bufLen > r.MaxBuffer {
+		r.MaxBuffer = bufLen
+	}
+	if r.Pos >= r.Size {
+		return 0, io.EOF
+	}
+	nr := min(len(buf), r.Size-r.Pos)
+	for i := 0; i < nr; i++ {
+		buf[i] = byte((r.Pos + i) % 251)
+	}
+	r.Pos += nr
+	return nr, nil
+}
+
+func (r *checkedStreamReader) Close() error {
+	r.IsClosed = true
+	return nil
+}
+
+func TestStreamWriterPipe(t *testing.T) {
+	tm := makeTestMux()
+	const size = 2 * 1024 * 1024 // one ack per 4k write, stays under OutputCh capacity
+	csr := &checkedStreamReader{Size: size}
+	// the feeder starts immediately, gate it until csr.Writer is set
+	gatedR, gatedW := io.Pipe()
+	childIn, err := tm.M.MakeStreamWriterPipe(0, gatedR)
+	if err != nil {
+		t.Fatalf("error making stream writer pipe: %v", err)
+	}
+	childIn = dupChildFile(t, childIn)
+	csr.Writer = tm.M.FdWriters[0]
+	go func() {
+		_, err := io.Copy(gatedW, io.NopCloser(csr))
+		csr.Close()
+		gatedW.CloseWithError(err)
+	}()
+	// the "process" side
+	readDoneCh := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(childIn)
+		readDoneCh <- data
+	}()
+	tm.start(false, true, false)
+	var data []byte
+	select {
+	case data = <-readDoneCh:
+	case <-time.After(testTimeout):
+		t.Fatalf("timeout reading stream")
+	}
+	if len(data) != size {
+		t.Fatalf("expected %d bytes, got %d", size, len(data))
+	}
+	for i := range data {
+		if data[i] != byte(i%251) {
+			t.Fatalf("data mismatch at %d", i)
+		}
+	}
+	if csr.MaxBuffer > WriteBufSize {
+		t.Fatalf("writer buffered %d bytes (limit %d)", csr.MaxBuffer, WriteBufSize)
+	}
+	<-tm.DoneCh
+}
+
+func TestInboundFilter(t *testing.T) {
+	tm := makeTestMux()
+	errTooLarge := errors.New("packet too large")
+	tm.M.InboundFilter = func(pk *packet.DataPacketType) error {
+		if base64.StdEncoding.DecodedLen(len(pk.Data64)) > 16 {
+			return errTooLarge
+		}
+		return nil
+	}
+	gw := makeGatedWriter()
+	gw.Release()
+	tm.M.MakeRawFdWriter(0, gw, true, "test")
+	tm.start(false, false, true)
+	tm.sendData(0, bytes.Repeat([]byte("x"), 100), false)
+	pk := tm.waitForPacket(t, isErrorAck, nil).(*packet.DataAckPacketType)
+	if pk.FdNum != 0 || !strings.Contains(pk.Error, errTooLarge.Error()) {
+		t.Fatalf("bad reject ack: %s", packet.AsString(pk))
+	}
+	tm.sendData(0, []byte("small"), true)
+	tm.waitForPacket(t, isEofAck(0), nil)
+	data, _ := gw.getData()
+	if string(data) != "small" {
+		t.Fatalf("rejected data was written, got %q", data)
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+func TestSeededWriterPipe(t *testing.T) {
+	tm := makeTestMux()
+	childIn, err := tm.M.MakeSeededWriterPipe(0, []byte("seed;"), WriteBufSize, "test")
+	if err != nil {
+		t.Fatalf("error making seeded writer pipe: %v", err)
+	}
+	childIn = dupChildFile(t, childIn)
+	tm.start(false, false, true)
+	tm.sendData(0, []byte("more;"), false)
+	tm.sendData(0, []byte("last"), true)
+	tm.waitForPacket(t, isEofAck(0), nil)
+	data, err := io.ReadAll(childIn)
+	if err != nil || string(data) != "seed;more;last" {
+		t.Fatalf("expected seeded data followed by written data, got %q (err=%v)", data, err)
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+// data packets (fdnum, data, eof) from a RecordTo log or an output channel
+func dataPacketStrs(pks []packet.PacketType) []string {
+	var rtn []string
+	for _, pk := range pks {
+		if dataPk, ok := pk.(*packet.DataPacketType); ok {
+			rtn = append(rtn, fmt.Sprintf("%d:%s:%v", dataPk.FdNum, dataPk.Data64, dataPk.Eof))
+		}
+	}
+	return rtn
+}
+
+func TestRecordReplay(t *testing.T) {
+	var logBuf bytes.Buffer
+	tm := makeTestMux()
+	tm.M.RecordTo(&logBuf)
+	loopR, loopW := makeTestPipe(t)
+	tm.M.MakeRawFdWriter(0, loopW, true, "loop")
+	tm.M.MakeRawFdReader(1, loopR, true, false)
+	tm.start(true, true, true)
+	tm.sendData(0, []byte("hello"), false)
+	tm.waitForPacket(t, isDataPacket(1), nil)
+	tm.sendAck(1, 5)
+	tm.sendData(0, []byte("world"), true)
+	tm.waitForPacket(t, isEofDataPacket(1), nil)
+	tm.sendDone()
+	<-tm.DoneCh
+
+	var recordedOut []packet.PacketType
+	numIn := 0
+	for _, line := range bytes.Split(logBuf.Bytes(), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var entry RecordEntry
+		err := json.Unmarshal(line, &entry)
+		if err != nil || entry.Ts == 0 {
+			t.Fatalf("bad record entry %q: %v", line, err)
+		}
+		if entry.Dir == RecordDirIn {
+			numIn++
+			continue
+		}
+		pk, err := packet.ParseJsonPacket(entry.Packet)
+		if err != nil {
+			t.Fatalf("bad recorded packet: %v", err)
+		}
+		recordedOut = append(recordedOut, pk)
+	}
+	if numIn != 4 {
+		t.Fatalf("expected 4 recorded input packets, got %d", numIn)
+	}
+
+	replayMux := makeTestMux()
+	replayR, replayW := makeTestPipe(t)
+	replayMux.M.MakeRawFdWriter(0, replayW, true, "loop")
+	replayMux.M.MakeRawFdReader(1, replayR, true, false)
+	sender := packet.MakeChannelPacketSender(replayMux.OutputCh)
+	donePk := replayMux.M.RunIOAndWait(replayMux.M.ReplayFrom(bytes.NewReader(logBuf.Bytes())), sender, true, true, true)
+	if donePk == nil {
+		t.Fatalf("replay did not reproduce the done packet")
+	}
+	sender.Close()
+	sender.WaitForDone()
+	var replayOut []packet.PacketType
+	for len(replayMux.OutputCh) > 0 {
+		replayOut = append(replayOut, <-replayMux.OutputCh)
+	}
+	expected := dataPacketStrs(recordedOut)
+	actual := dataPacketStrs(replayOut)
+	if len(expected) == 0 || fmt.Sprint(expected) != fmt.Sprint(actual) {
+		t.Fatalf("replayed data packets differ\nrecorded: %v\nreplayed: %v", expected, actual)
+	}
+}
+
+func TestLineBufferedReader(t *testing.T) {
+	tm := makeTestMux()
+	pr, pw := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, pr, true, false)
+	err := tm.M.SetFdLineBuffered(1, true)
+	if err != nil {
+		t.Fatalf("error setting line buffered: %v", err)
+	}
+	tm.start(false, false, true)
+	for _, chunk := range []string{"ab", "c\nde", "f\ng\n", "tail"} {
+		pw.Write([]byte(chunk))
+		time.Sleep(10 * time.Millisecond)
+	}
+	pw.Close()
+	var packets []string
+	for {
+		pk := tm.waitForPacket(t, isDataPacket(1), nil).(*packet.DataPacketType)
+		data, _ := base64.StdEncoding.DecodeString(pk.Data64)
+		if pk.Eof {
+			if string(data) != "tail" {
+				t.Fatalf("trailing partial line should be flushed with eof, got %q", data)
+			}
+			break
+		}
+		if len(data) == 0 || data[len(data)-1] != '\n' {
+			t.Fatalf("packet does not end on a line boundary: %q", data)
+		}
+		packets = append(packets, string(data))
+	}
+	if strings.Join(packets, "") != "abc\ndef\ng\n" {
+		t.Fatalf("bad line data: %q", packets)
+	}
+	if len(packets) < 2 {
+		t.Fatalf("expected separate packets for separately written lines, got %q", packets)
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+func TestCloseAndSignal(t *testing.T) {
+	tm := makeTestMux()
+	// the child never reads stdin, so closing its fds alone does not end it
+	cmd := exec.Command("sh", "-c", "sleep 30; true")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err := tm.M.AttachCmd(cmd)
+	if err != nil {
+		t.Fatalf("error attaching cmd: %v", err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatalf("error starting cmd: %v", err)
+	}
+	tm.M.SetCmdProc(cmd.Process)
+	tm.start(false, false, true)
+	err = tm.M.CloseAndSignal()
+	if err != nil {
+		t.Fatalf("error from CloseAndSignal: %v", err)
+	}
+	waitCh := make(chan error, 1)
+	go func() { waitCh <- cmd.Wait() }()
+	select {
+	case <-waitCh:
+	case <-time.After(testTimeout):
+		cmd.Process.Kill()
+		t.Fatalf("child was not signaled on close")
+	}
+	ws := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ws.Signaled() || ws.Signal() != syscall.SIGHUP {
+		t.Fatalf("expected child to exit from SIGHUP, got %v", cmd.ProcessState)
+	}
+	<-tm.DoneCh
+	// already exited, must not signal (or fail)
+	err = tm.M.CloseAndSignal()
+	if err != nil {
+		t.Fatalf("CloseAndSignal on an exited process: %v", err)
+	}
+}
+
+func TestKeepAliveLiveness(t *testing.T) {
+	tm := makeTestMux()
+	clock := makeFakeClock()
+	tm.M.Clock = clock
+	tm.M.KeepAliveInterval = 20 * time.Second
+	tm.M.LivenessTimeout = time.Minute
+	upr := testUPR{Ch: make(chan packet.PacketType, 10)}
+	tm.M.UPR = upr
+	eventCh := make(chan *MuxEvent, 10)
+	tm.M.EventHandler = func(event *MuxEvent) {
+		if event.Type == EventLivenessTimeout {
+			eventCh <- event
+		}
+	}
+	outR, _ := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, outR, true, false)
+	tm.start(false, false, true)
+	isKeepAlive := func(pk packet.PacketType) bool { return pk.GetType() == packet.KeepAlivePacketStr }
+	var skipped []packet.PacketType
+	advance := func() {
+		t.Helper()
+		waitForCond(t, "keepalive timer", func() bool { return clock.numActiveTimers() == 1 })
+		clock.Advance(20 * time.Second)
+	}
+	advance() // t=20s
+	tm.waitForPacket(t, isKeepAlive, &skipped)
+	// the peer's keepalive counts as activity (and is not data or an unknown packet)
+	tm.InputCh <- packet.MakeKeepAlivePacket(tm.M.CK)
+	waitForCond(t, "input activity", func() bool { return tm.M.getLastInputTs().Equal(clock.Now()) })
+	advance() // t=40s
+	tm.waitForPacket(t, isKeepAlive, &skipped)
+	advance() // t=60s, 40s since the last input
+	tm.waitForPacket(t, isKeepAlive, &skipped)
+	select {
+	case <-eventCh:
+		t.Fatalf("liveness timeout fired early")
+	case <-tm.DoneCh:
+		t.Fatalf("session ended early")
+	default:
+	}
+	advance() // t=80s, 60s since the last input
+	select {
+	case event := <-eventCh:
+		if event.Duration != time.Minute {
+			t.Fatalf("bad liveness event: %s", event.String())
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("liveness timeout did not fire")
+	}
+	select {
+	case <-tm.DoneCh:
+	case <-time.After(testTimeout):
+		t.Fatalf("session not closed after liveness timeout")
+	}
+	if len(skipped) > 0 {
+		t.Fatalf("unexpected packets: %s", packet.AsString(skipped[0]))
+	}
+	if len(upr.Ch) > 0 {
+		t.Fatalf("keepalive was passed to the upr")
+	}
+}
+
+// wraps a shared sender, counts the packets sent per CK
+type countingSender struct {
+	Lock   *sync.Mutex
+	Sender *packet.PacketSender
+	Counts map[base.CommandKey]int
+}
+
+func (s *countingSender) SendPacket(pk packet.PacketType) error {
+	if cmdPk, ok := pk.(packet.CommandPacketType); ok {
+		s.Lock.Lock()
+		s.Counts[cmdPk.GetCK()]++
+		s.Lock.Unlock()
+	}
+	return s.Sender.SendPacket(pk)
+}
+
+func TestSharedSender(t *testing.T) {
+	outputCh := make(chan packet.PacketType, 100)
+	shared := &countingSender{Lock: &sync.Mutex{}, Sender: packet.MakeChannelPacketSender(outputCh), Counts: make(map[base.CommandKey]int)}
+	var muxes []*Multiplexer
+	var writers []*os.File
+	var inputChs []chan packet.PacketType
+	doneCh := make(chan *packet.CmdDonePacketType, 2)
+	for _, cmdId := range []string{"cmd1", "cmd2"} {
+		m := MakeMultiplexer(base.MakeCommandKey("testsession", cmdId), nil)
+		pr, pw := makeTestPipe(t)
+		m.MakeRawFdReader(1, pr, true, false)
+		inputCh := make(chan packet.PacketType, 10)
+		go func() {
+			doneCh <- m.RunIOAndWait(makeTestParser(inputCh), shared, false, false, true)
+		}()
+		muxes = append(muxes, m)
+		writers = append(writers, pw)
+		inputChs = append(inputChs, inputCh)
+	}
+	readFrom := func(ck base.CommandKey) string {
+		t.Helper()
+		timer := time.NewTimer(testTimeout)
+		defer timer.Stop()
+		for {
+			select {
+			case pk := <-outputCh:
+				dataPk, ok := pk.(*packet.DataPacketType)
+				if !ok {
+					continue
+				}
+				if dataPk.CK != ck {
+					t.Fatalf("expected a packet for %s, got %s", ck, dataPk.CK)
+				}
+				data, _ := base64.StdEncoding.DecodeString(dataPk.Data64)
+				return string(data)
+			case <-timer.C:
+				t.Fatalf("timeout waiting for %s", ck)
+				return ""
+			}
+		}
+	}
+	writers[0].Write([]byte("from-cmd1"))
+	if data := readFrom(muxes[0].CK); data != "from-cmd1" {
+		t.Fatalf("bad data for cmd1: %q", data)
+	}
+	writers[1].Write([]byte("from-cmd2"))
+	if data := readFrom(muxes[1].CK); data != "from-cmd2" {
+		t.Fatalf("bad data for cmd2: %q", data)
+	}
+	// closing one multiplexer must not close the shared sender
+	muxes[0].Close()
+	<-doneCh
+	writers[1].Write([]byte("still-open"))
+	if data := readFrom(muxes[1].CK); data != "still-open" {
+		t.Fatalf("bad data for cmd2 after cmd1 closed: %q", data)
+	}
+	inputChs[1] <- packet.MakeCmdDonePacket(muxes[1].CK)
+	<-doneCh
+	shared.Lock.Lock()
+	defer shared.Lock.Unlock()
+	if shared.Counts[muxes[0].CK] == 0 || shared.Counts[muxes[1].CK] < 2 {
+		t.Fatalf("bad per-session counts: %v", shared.Counts)
+	}
+}
+
+func TestRunIOAndWaitAsync(t *testing.T) {
+	tm := makeTestMux()
+	inR, inW := makeTestPipe(t)
+	tm.M.MakeRawFdWriter(0, inW, true, "test")
+	doneCh := tm.M.RunIOAndWaitAsync(makeTestParser(tm.InputCh), packet.MakeChannelPacketSender(tm.OutputCh), false, true, true)
+	if !tm.isStarted() {
+		t.Fatalf("multiplexer should be running when RunIOAndWaitAsync returns")
+	}
+	select {
+	case <-doneCh:
+		t.Fatalf("done before the input finished")
+	case <-time.After(20 * time.Millisecond):
+	}
+	tm.sendData(0, []byte("data"), true)
+	buf := make([]byte, 4)
+	io.ReadFull(inR, buf)
+	donePk := packet.MakeCmdDonePacket(tm.M.CK)
+	donePk.ExitCode = 3
+	tm.InputCh <- donePk
+	select {
+	case rtnPk, ok := <-doneCh:
+		if !ok || rtnPk == nil || rtnPk.ExitCode != 3 {
+			t.Fatalf("expected the done packet, got %v (ok=%v)", rtnPk, ok)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("timeout waiting for done")
+	}
+	if _, ok := <-doneCh; ok {
+		t.Fatalf("done channel should be closed after delivering the done packet")
+	}
+}
+
+// returns the chunks in order, then Err
+type chunkErrReader struct {
+	Chunks [][]byte
+	Err    error
+}
+
+func (r *chunkErrReader) Read(buf []byte) (int, error) {
+	if len(r.Chunks) == 0 {
+		return 0, r.Err
+	}
+	nr := copy(buf, r.Chunks[0])
+	r.Chunks[0] = r.Chunks[0][nr:]
+	if len(r.Chunks[0]) == 0 {
+		r.Chunks = r.Chunks[1:]
+	}
+	return nr, nil
+}
+
+func (r *chunkErrReader) Close() error {
+	return nil
+}
+
+func TestReadErrorPosition(t *testing.T) {
+	tm := makeTestMux()
+	reader := &chunkErrReader{Chunks: [][]byte{[]byte("partial "), bytes.Repeat([]byte("x"), 5000)}, Err: errors.New("injected read error")}
+	tm.M.MakeRawFdReader(1, reader, true, false)
+	tm.start(false, false, true)
+	received := 0
+	for {
+		pk := tm.waitForPacket(t, isDataPacket(1), nil).(*packet.DataPacketType)
+		if pk.Error != "" {
+			if pk.ErrPos != int64(received) {
+				t.Fatalf("error position %d does not match received length %d", pk.ErrPos, received)
+			}
+			break
+		}
+		received += packet.B64DecodedLen(pk.Data64)
+	}
+	if received != 5008 {
+		t.Fatalf("expected 5008 bytes before the error, got %d", received)
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+func TestSpliceFds(t *testing.T) {
+	tm := makeTestMux()
+	srcR, srcW := makeTestPipe(t)
+	dstR, dstW := makeTestPipe(t)
+	tm.M.MakeRawFdReader(3, srcR, true, false)
+	tm.M.MakeRawFdWriter(4, dstW, true, "splice")
+	err := tm.M.SpliceFds(3, 4)
+	if err != nil {
+		t.Fatalf("error splicing fds: %v", err)
+	}
+	if err := tm.M.SpliceFds(3, 4); !errors.Is(err, ErrNoSuchFd) {
+		t.Fatalf("spliced fds should be removed from the packet streams, got %v", err)
+	}
+	tm.start(true, false, false)
+	payload := make([]byte, 1024*1024+123)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	go func() {
+		srcW.Write(payload)
+		srcW.Close()
+	}()
+	readCh := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(dstR)
+		readCh <- data
+	}()
+	select {
+	case data := <-readCh:
+		if !bytes.Equal(data, payload) {
+			t.Fatalf("spliced data does not match the source (len %d vs %d)", len(data), len(payload))
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("timeout waiting for spliced data")
+	}
+	<-tm.DoneCh
+	select {
+	case pk := <-tm.OutputCh:
+		t.Fatalf("spliced fds should not send packets, got %s", packet.AsString(pk))
+	default:
+	}
+}
+
+func benchmarkSpliceCopy(b *testing.B, hideFiles bool) {
+	chunk := make([]byte, 64*1024)
+	const totalSize = 16 * 1024 * 1024
+	b.SetBytes(totalSize)
+	for i := 0; i < b.N; i++ {
+		srcR, srcW, _ := os.Pipe()
+		dstR, dstW, _ := os.Pipe()
+		go func() {
+			for written := 0; written < totalSize; written += len(chunk) {
+				srcW.Write(chunk)
+			}
+			srcW.Close()
+		}()
+		go io.Copy(io.Discard, dstR)
+		if hideFiles {
+			spliceCopy(struct{ io.Writer }{dstW}, struct{ io.Reader }{srcR})
+		} else {
+			spliceCopy(dstW, srcR)
+		}
+		srcR.Close()
+		dstW.Close()
+		dstR.Close()
+	}
+}
+
+func BenchmarkSpliceFds(b *testing.B) {
+	benchmarkSpliceCopy(b, false)
+}
+
+func BenchmarkSpliceUserspaceCopy(b *testing.B) {
+	benchmarkSpliceCopy(b, true)
+}
+
+func TestMaxPacketsInFlight(t *testing.T) {
+	tm := makeTestMux()
+	const numChunks = 50
+	reader := &chunkErrReader{Err: io.EOF}
+	for i := 0; i < numChunks; i++ {
+		reader.Chunks = append(reader.Chunks, []byte{byte('a' + i%26)})
+	}
+	tm.M.MakeRawFdReader(1, reader, true, false)
+	err := tm.M.SetFdMaxPacketsInFlight(1, 3)
+	if err != nil {
+		t.Fatalf("error setting max packets in flight: %v", err)
+	}
+	tm.start(false, false, true)
+	countPending := func() int {
+		time.Sleep(30 * time.Millisecond)
+		rtn := 0
+		for len(tm.OutputCh) > 0 {
+			pk := <-tm.OutputCh
+			if isDataPacket(1)(pk) {
+				rtn++
+			}
+		}
+		return rtn
+	}
+	if n := countPending(); n != 3 {
+		t.Fatalf("expected 3 packets in flight, got %d", n)
+	}
+	tm.sendAck(1, 1)
+	if n := countPending(); n != 1 {
+		t.Fatalf("expected 1 packet after acking 1, got %d", n)
+	}
+	// ack packet by packet, each ack lets exactly one more packet through
+	for received := 4; received < numChunks; received++ {
+		tm.sendAck(1, 1)
+		tm.waitForPacket(t, isDataPacket(1), nil)
+		if len(tm.OutputCh) > 0 {
+			t.Fatalf("more than 3 packets in flight after %d packets", received)
+		}
+	}
+	tm.sendAck(1, 3)
+	tm.waitForPacket(t, isEofDataPacket(1), nil)
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+func TestConsumerClosed(t *testing.T) {
+	tm := makeTestMux()
+	childIn, err := tm.M.MakeWriterPipe(0, "stdin")
+	if err != nil {
+		t.Fatalf("error making writer pipe: %v", err)
+	}
+	childIn = dupChildFile(t, childIn)
+	tm.start(false, false, true)
+	// the child closes its stdin before reading anything
+	childIn.Close()
+	tm.sendData(0, []byte("hello"), false)
+	pk := tm.waitForPacket(t, isErrorAck, nil).(*packet.DataAckPacketType)
+	if !pk.ConsumerClosed {
+		t.Fatalf("expected consumer-closed ack, got %s", packet.AsString(pk))
+	}
+	if reason := tm.M.FdWriters[0].getCloseReason(); reason != CloseReasonConsumerClosed {
+		t.Fatalf("expected consumerclosed close reason, got %q", reason)
+	}
+	// later stdin is rejected with the same signal
+	tm.sendData(0, []byte("more"), false)
+	pk = tm.waitForPacket(t, isErrorAck, nil).(*packet.DataAckPacketType)
+	if !pk.ConsumerClosed || pk.AckLen != 0 {
+		t.Fatalf("expected consumer-closed reject, got %s", packet.AsString(pk))
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+func TestMemPipeReader(t *testing.T) {
+	tm := makeTestMux()
+	outR, outW := mpiotest.MemPipe()
+	ptyR, ptyW := mpiotest.MemPipe()
+	tm.M.MakeRawFdReader(1, outR, true, false)
+	tm.M.MakeRawFdReader(3, ptyR, true, true)
+	tm.start(true, false, false)
+	outW.Write([]byte("hello "))
+	outW.Write([]byte("world"))
+	outW.Close()
+	data := tm.readData(t, 1, len("hello world"))
+	if string(data) != "hello world" {
+		t.Fatalf("expected data from mempipe, got %q", data)
+	}
+	tm.waitForPacket(t, isEofDataPacket(1), nil)
+	// a pty returns EIO once the child side is closed, which is reported as a normal EOF
+	ptyW.Write([]byte("pty"))
+	ptyW.CloseWithError(syscall.EIO)
+	tm.waitForPacket(t, isEofDataPacket(3), nil)
+	<-tm.DoneCh
+	if n := outR.Buffered(); n != 0 {
+		t.Fatalf("expected mempipe to be drained, %d bytes left", n)
+	}
+}
+
+func TestMemPipeWriter(t *testing.T) {
+	tm := makeTestMux()
+	inR, inW := mpiotest.MemPipe()
+	closedR, closedW := mpiotest.MemPipe()
+	tm.M.MakeRawFdWriter(0, inW, true, "stdin")
+	tm.M.MakeRawFdWriter(4, closedW, true, "closed")
+	tm.start(false, false, true)
+	tm.sendData(0, []byte("input"), true)
+	tm.waitForPacket(t, isEofAck(0), nil)
+	data, err := io.ReadAll(inR)
+	if err != nil || string(data) != "input" {
+		t.Fatalf("expected written data followed by EOF, got %q (err=%v)", data, err)
+	}
+	closedR.Close()
+	tm.sendData(4, []byte("data"), false)
+	pk := tm.waitForPacket(t, isErrorAck, nil).(*packet.DataAckPacketType)
+	if pk.FdNum != 4 || !pk.ConsumerClosed {
+		t.Fatalf("expected consumer-closed ack from mempipe, got %s", packet.AsString(pk))
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+func TestReapCmdProcSignal(t *testing.T) {
+	tm := makeTestMux()
+	cmd := exec.Command("sleep", "30")
+	err := tm.M.AttachCmd(cmd)
+	if err != nil {
+		t.Fatalf("error attaching cmd: %v", err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatalf("error starting cmd: %v", err)
+	}
+	tm.M.SetCmdProc(cmd.Process)
+	tm.M.ReapCmdProc = true
+	tm.start(true, false, false)
+	cmd.Process.Signal(syscall.SIGTERM)
+	var donePk *packet.CmdDonePacketType
+	select {
+	case donePk = <-tm.DoneCh:
+	case <-time.After(testTimeout):
+		cmd.Process.Kill()
+		t.Fatalf("timeout waiting for done packet")
+	}
+	if donePk == nil || !donePk.Signaled || donePk.ExitSignal != int(syscall.SIGTERM) || donePk.ExitCode != -1 {
+		t.Fatalf("expected done packet for SIGTERM, got %#v", donePk)
+	}
+	if donePk.CoreDumped {
+		t.Fatalf("SIGTERM should not dump core")
+	}
+}
+
+func TestUnknownFdPolicy(t *testing.T) {
+	// error (default)
+	tm := makeTestMux()
+	tm.start(false, false, true)
+	tm.sendData(7, []byte("data"), false)
+	pk := tm.waitForPacket(t, isErrorAck, nil).(*packet.DataAckPacketType)
+	if pk.FdNum != 7 || !strings.Contains(pk.Error, ErrNoSuchFd.Error()) {
+		t.Fatalf("expected no-fd error ack, got %s", packet.AsString(pk))
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+
+	// discard: acked and dropped
+	tm = makeTestMux()
+	tm.M.UnknownFdPolicy = UnknownFdDiscard
+	tm.start(false, false, true)
+	tm.sendData(7, []byte("data"), true)
+	var skipped []packet.PacketType
+	tm.waitForPacket(t, isEofAck(7), &skipped)
+	ackLen := 0
+	for _, skippedPk := range skipped {
+		if ack, ok := skippedPk.(*packet.DataAckPacketType); ok && ack.FdNum == 7 {
+			if ack.Error != "" {
+				t.Fatalf("unexpected error ack for discard policy: %s", packet.AsString(ack))
+			}
+			ackLen += ack.AckLen
+		}
+	}
+	if ackLen != 4 {
+		t.Fatalf("expected discarded data to be acked, got acklen=%d", ackLen)
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+
+	// buffer: held until the fd is registered, then flushed
+	tm = makeTestMux()
+	tm.M.UnknownFdPolicy = UnknownFdBuffer
+	tm.start(false, false, true)
+	tm.sendData(7, []byte("early;"), false)
+	tm.sendData(7, []byte("data"), true)
+	waitForCond(t, "data buffered", func() bool {
+		tm.M.Lock.Lock()
+		defer tm.M.Lock.Unlock()
+		fw := tm.M.FdWriters[7]
+		return fw != nil && string(fw.getBuffer()) == "early;data"
+	})
+	gw := makeGatedWriter()
+	gw.Release()
+	tm.M.MakeRawFdWriter(7, gw, true, "late")
+	tm.waitForPacket(t, isEofAck(7), nil)
+	data, _ := gw.getData()
+	if string(data) != "early;data" {
+		t.Fatalf("expected buffered data to be flushed to the late writer, got %q", data)
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+func TestFlushPtyReader(t *testing.T) {
+	tm := makeTestMux()
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		t.Skipf("cannot open pty: %v", err)
+	}
+	defer ptmx.Close()
+	defer tty.Close()
+	tm.M.MakeRawFdReader(1, ptmx, false, true)
+	tm.M.SetFdLineBuffered(1, true)
+	tm.start(false, false, true)
+	tty.Write([]byte("segment one"))
+	err = tm.M.FlushPtyReader(1)
+	if err != nil {
+		t.Fatalf("error flushing pty reader: %v", err)
+	}
+	tty.Write([]byte("segment two"))
+	err = tm.M.FlushPtyReader(1)
+	if err != nil {
+		t.Fatalf("error flushing pty reader: %v", err)
+	}
+	var segments []string
+	var cur []byte
+	for len(segments) < 2 {
+		pk := tm.waitForPacket(t, isDataPacket(1), nil).(*packet.DataPacketType)
+		data, _ := base64.StdEncoding.DecodeString(pk.Data64)
+		if pk.SegmentEnd > 0 {
+			if len(data) != 0 || pk.SegmentEnd != len(segments)+1 {
+				t.Fatalf("bad segment boundary: %s", packet.AsString(pk))
+			}
+			segments = append(segments, string(cur))
+			cur = nil
+			continue
+		}
+		cur = append(cur, data...)
+	}
+	if segments[0] != "segment one" || segments[1] != "segment two" {
+		t.Fatalf("expected one segment per flush, got %q", segments)
+	}
+	if tm.M.FdReaders[1].isClosed() {
+		t.Fatalf("flush closed the pty reader")
+	}
+	err = tm.M.FlushPtyReader(5)
+	if !errors.Is(err, ErrNoSuchFd) {
+		t.Fatalf("expected ErrNoSuchFd flushing an unknown fd, got %v", err)
+	}
+	tm.M.Close()
+	<-tm.DoneCh
+}
+
+func TestFdNumBounds(t *testing.T) {
+	tm := makeTestMux()
+	upr := testUPR{Ch: make(chan packet.PacketType, 10)}
+	tm.M.UPR = upr
+	tm.M.MaxFdNum = 16
+	tm.start(false, false, true)
+	badFd := 1000
+	tm.sendData(-1, []byte("data"), false)
+	tm.sendData(badFd, []byte("data"), false)
+	tm.sendAck(badFd, 10)
+	tm.sendResize(&badFd, 24, 80)
+	for i := 0; i < 4; i++ {
+		pk := tm.waitForPacket(t, isErrorAck, nil).(*packet.DataAckPacketType)
+		if !strings.Contains(pk.Error, ErrFdNumRange.Error()) {
+			t.Fatalf("expected fd range error, got %s", packet.AsString(pk))
+		}
+		select {
+		case <-upr.Ch:
+		case <-time.After(testTimeout):
+			t.Fatalf("rejected packet was not reported to the UPR")
+		}
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+	if len(tm.M.FdWriters) != 0 || len(tm.M.FdReaders) != 0 {
+		t.Fatalf("out of range fds created entries: writers=%d readers=%d", len(tm.M.FdWriters), len(tm.M.FdReaders))
+	}
+}
+
+func TestExpectFds(t *testing.T) {
+	tm := makeTestMux()
+	upr := testUPR{Ch: make(chan packet.PacketType, 10)}
+	tm.M.UPR = upr
+	tm.M.UnknownFdPolicy = UnknownFdBuffer // does not apply to undeclared fds
+	tm.M.ExpectFds([]int{0, 1})
+	gw := makeGatedWriter()
+	gw.Release()
+	tm.M.MakeRawFdWriter(0, gw, true, "stdin")
+	tm.start(false, false, true)
+	undeclaredFd := 7
+	tm.sendData(3, []byte("data"), false)
+	tm.sendAck(5, 10)
+	tm.sendResize(&undeclaredFd, 24, 80)
+	for i := 0; i < 3; i++ {
+		pk := tm.waitForPacket(t, isErrorAck, nil).(*packet.DataAckPacketType)
+		if !strings.Contains(pk.Error, ErrUnexpectedFd.Error()) {
+			t.Fatalf("expected unexpected-fd error, got %s", packet.AsString(pk))
+		}
+	}
+	waitForCond(t, "undeclared fds reported to the UPR", func() bool { return len(upr.Ch) == 3 })
+	tm.sendData(0, []byte("ok"), true)
+	tm.waitForPacket(t, isEofAck(0), nil)
+	tm.sendDone()
+	<-tm.DoneCh
+	if tm.M.FdWriters[3] != nil {
+		t.Fatalf("undeclared fd created a placeholder writer")
+	}
+	if data, _ := gw.getData(); string(data) != "ok" {
+		t.Fatalf("declared fd did not get its data, got %q", data)
+	}
+}
+
+func TestStatsOverhead(t *testing.T) {
+	tm := makeTestMux()
+	outR, outW := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, outR, true, false)
+	tm.start(false, false, true)
+	const dataSize = 256 * 1024
+	go func() {
+		outW.Write(bytes.Repeat([]byte("0123456789"), dataSize/10))
+		outW.Close()
+	}()
+	var total int
+	for {
+		pk := tm.waitForPacket(t, isDataPacket(1), nil).(*packet.DataPacketType)
+		pkLen := packet.B64DecodedLen(pk.Data64)
+		total += pkLen
+		tm.sendAck(1, pkLen)
+		if pk.Eof {
+			break
+		}
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+	stats := tm.M.Stats()
+	if stats.RawBytes != int64(total) || total != dataSize/10*10 {
+		t.Fatalf("expected %d raw bytes, stats=%#v (received %d)", total, stats, total)
+	}
+	ratio := stats.OverheadRatio()
+	if ratio < 1.33 || ratio > 1.36 {
+		t.Fatalf("expected wire/raw ratio ~1.33 for base64, got %.4f (%#v)", ratio, stats)
+	}
+	pk := tm.M.makeDataPacket(1, []byte("hello"), nil)
+	pk.Eof = true
+	wireBytes, _ := packet.MarshalPacket(pk)
+	if dataPacketWireSize(packet.FormatJson, pk) != len(wireBytes) {
+		t.Fatalf("wire size %d does not match marshaled packet size %d", dataPacketWireSize(packet.FormatJson, pk), len(wireBytes))
+	}
+}
+
+func (tm *testMux) sendDataAt(fdNum int, offset int64, data []byte, eof bool) {
+	pk := packet.MakeDataPacket()
+	pk.CK = tm.M.CK
+	pk.FdNum = fdNum
+	pk.Data64 = base64.StdEncoding.EncodeToString(data)
+	pk.Eof = eof
+	pk.Offset = &offset
+	tm.InputCh <- pk
+}
+
+func TestResumableFileWriter(t *testing.T) {
+	fileName := t.TempDir() + "/transfer.dat"
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	openFile := func() *os.File {
+		f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatalf("cannot open file: %v", err)
+		}
+		return f
+	}
+	// first session writes two chunks, only the first one is known to the sender when it breaks
+	tm := makeTestMux()
+	err := tm.M.MakeResumableFileWriter(0, openFile(), "transfer")
+	if err != nil {
+		t.Fatalf("error making resumable writer: %v", err)
+	}
+	tm.start(false, false, true)
+	tm.sendDataAt(0, 0, content[0:10], false)
+	tm.sendData(0, []byte("GARBAGE-PARTIAL"), false)
+	waitForCond(t, "chunks written", func() bool {
+		finfo, _ := os.Stat(fileName)
+		return finfo != nil && finfo.Size() == 25
+	})
+	tm.M.Close() // interruption
+	<-tm.DoneCh
+
+	tm = makeTestMux()
+	err = tm.M.MakeResumableFileWriter(0, openFile(), "transfer")
+	if err != nil {
+		t.Fatalf("error making resumable writer: %v", err)
+	}
+	tm.start(false, false, true)
+	tm.sendDataAt(0, 10, content[10:20], false)
+	tm.sendData(0, content[20:], true)
+	tm.waitForPacket(t, isEofAck(0), nil)
+	tm.sendDone()
+	<-tm.DoneCh
+	data, err := os.ReadFile(fileName)
+	if err != nil || string(data) != string(content) {
+		t.Fatalf("expected resumed file %q, got %q (err=%v)", content, data, err)
+	}
+
+	// offsets past the end of the file and offsets on regular writers are rejected
+	tm = makeTestMux()
+	tm.M.MakeResumableFileWriter(0, openFile(), "transfer")
+	tm.M.MakeRawFdWriter(3, nopWriteCloser{io.Discard}, false, "plain")
+	tm.start(false, false, true)
+	tm.sendDataAt(3, 0, []byte("data"), false)
+	pk := tm.waitForPacket(t, isErrorAck, nil).(*packet.DataAckPacketType)
+	if pk.FdNum != 3 || !strings.Contains(pk.Error, "not resumable") {
+		t.Fatalf("expected not-resumable error, got %s", packet.AsString(pk))
+	}
+	tm.sendDataAt(0, 1000, []byte("data"), false)
+	pk = tm.waitForPacket(t, isErrorAck, nil).(*packet.DataAckPacketType)
+	if pk.FdNum != 0 || !strings.Contains(pk.Error, "file size is") {
+		t.Fatalf("expected offset past end error, got %s", packet.AsString(pk))
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+// Read blocks until Unblock, Close does not interrupt it
+type stuckReader struct {
+	UnblockCh chan bool
+}
+
+func (r stuckReader) Read(buf []byte) (int, error) {
+	<-r.UnblockCh
+	return 0, io.EOF
+}
+
+func (r stuckReader) Close() error {
+	return nil
+}
+
+func TestLoopLeakWatchdog(t *testing.T) {
+	tm := makeTestMux()
+	clock := makeFakeClock()
+	tm.M.Clock = clock
+	tm.M.LeakCheckTimeout = time.Second
+	eventCh := make(chan *MuxEvent, 10)
+	tm.M.EventHandler = func(event *MuxEvent) {
+		if event.Type == EventLoopLeak {
+			eventCh <- event
+		}
+	}
+	stuck := stuckReader{UnblockCh: make(chan bool)}
+	defer close(stuck.UnblockCh)
+	okR, _ := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, okR, true, false)
+	tm.M.MakeRawFdReader(3, stuck, true, false)
+	tm.start(false, false, true)
+	waitForCond(t, "loops running", func() bool { return len(tm.M.runningLoops()) == 2 })
+	tm.M.Close()
+	waitForCond(t, "leak check timer", func() bool { return clock.numActiveTimers() > 0 })
+	waitForCond(t, "closed reader exited", func() bool { return len(tm.M.runningLoops()) == 1 })
+	clock.Advance(2 * time.Second)
+	select {
+	case event := <-eventCh:
+		if event.FdNum != 3 || event.Dir != FdDirReader {
+			t.Fatalf("expected leak for the stuck fd:3 reader, got %s", event)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("watchdog did not report the stuck loop")
+	}
+	<-tm.DoneCh
+	if len(eventCh) != 0 {
+		t.Fatalf("unexpected extra leak event: %s", <-eventCh)
+	}
+}
+
+func TestSuppressAcks(t *testing.T) {
+	tm := makeTestMux()
+	quietW := makeGatedWriter()
+	quietW.Release()
+	normalW := makeGatedWriter()
+	normalW.Release()
+	tm.M.MakeRawFdWriter(0, quietW, true, "quiet")
+	tm.M.MakeRawFdWriter(3, normalW, true, "normal")
+	err := tm.M.SetFdSuppressAcks(0, true)
+	if err != nil {
+		t.Fatalf("error setting suppress acks: %v", err)
+	}
+	if !errors.Is(tm.M.SetFdSuppressAcks(5, true), ErrNoSuchFd) {
+		t.Fatalf("expected ErrNoSuchFd for a missing writer")
+	}
+	tm.start(false, false, true)
+	for i := 0; i < 5; i++ {
+		tm.sendData(0, []byte("quiet"), false)
+		tm.sendData(3, []byte("normal"), false)
+	}
+	tm.sendData(0, nil, true)
+	tm.sendData(3, nil, true)
+	ackLens := map[int]int{}
+	for numEof := 0; numEof < 2; {
+		ack := tm.waitForPacket(t, func(pk packet.PacketType) bool {
+			_, ok := pk.(*packet.DataAckPacketType)
+			return ok
+		}, nil).(*packet.DataAckPacketType)
+		ackLens[ack.FdNum] += ack.AckLen
+		if ack.EofAck {
+			numEof++
+		}
+	}
+	if ackLens[0] != 0 || ackLens[3] != 30 {
+		t.Fatalf("expected acks only for fd:3, got %v", ackLens)
+	}
+	if data, _ := quietW.getData(); string(data) != strings.Repeat("quiet", 5) {
+		t.Fatalf("suppressed fd did not get its data, got %q", data)
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+func TestGetSetWinSize(t *testing.T) {
+	m := MakeMultiplexer(base.MakeCommandKey("testsession", "testcmd"), nil)
+	if _, _, err := m.GetWinSize(); err == nil {
+		t.Fatalf("expected error getting winsize without a pty")
+	}
+	if err := m.SetWinSize(24, 80); err == nil {
+		t.Fatalf("expected error setting winsize without a pty")
+	}
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		t.Skipf("cannot open pty: %v", err)
+	}
+	defer ptmx.Close()
+	defer tty.Close()
+	m.SetPtyFd(1, ptmx)
+	err = m.SetWinSize(45, 150)
+	if err != nil {
+		t.Fatalf("error setting winsize: %v", err)
+	}
+	rows, cols, err := m.GetWinSize()
+	if err != nil || rows != 45 || cols != 150 {
+		t.Fatalf("expected 45x150, got %dx%d (err=%v)", rows, cols, err)
+	}
+	// bounded like winsize packets
+	m.SetWinSize(1, 100000)
+	rows, cols, _ = m.GetWinSize()
+	if rows != MinTermRows || cols != MaxTermCols {
+		t.Fatalf("expected bounded winsize %dx%d, got %dx%d", MinTermRows, MaxTermCols, rows, cols)
+	}
+}
+
+// acks every data packet as it is sent (keeps a reader's window open without a client)
+type autoAckSender struct {
+	Reader     *FdReader
+	NumPackets int
+	AckDelay   time.Duration // simulated round trip
+}
+
+func (s *autoAckSender) SendPacket(pk packet.PacketType) error {
+	if dataPk, ok := pk.(*packet.DataPacketType); ok {
+		s.NumPackets++
+		ackLen := packet.B64DecodedLen(dataPk.Data64)
+		if s.AckDelay > 0 {
+			time.AfterFunc(s.AckDelay, func() { s.Reader.NotifyAck(ackLen) })
+			return nil
+		}
+		go s.Reader.NotifyAck(ackLen)
+	}
+	return nil
+}
+
+func TestAdaptiveReadBuf(t *testing.T) {
+	sizer := makeReadBufSizer(1024, 16*1024, 4, 0)
+	now := time.Now()
+	sizer.observe(1024, now)
+	sizer.observe(4096, now)
+	if len(sizer.Buf) != 16*1024 {
+		t.Fatalf("expected buffer to grow to max, got %d", len(sizer.Buf))
+	}
+	sizer.observe(16*1024, now)
+	if len(sizer.Buf) != 16*1024 {
+		t.Fatalf("buffer grew past max: %d", len(sizer.Buf))
+	}
+	sizer.observe(10, now.Add(time.Second))
+	if len(sizer.Buf) != 16*1024 {
+		t.Fatalf("buffer shrank before ReadBufShrinkIdle: %d", len(sizer.Buf))
+	}
+	sizer.observe(10, now.Add(ReadBufShrinkIdle))
+	if len(sizer.Buf) != 1024 {
+		t.Fatalf("expected buffer to shrink back to min after idle, got %d", len(sizer.Buf))
+	}
+	if err := MakeMultiplexer(base.MakeCommandKey("testsession", "testcmd"), nil).SetFdAdaptiveReadBuf(1, 1024, 512, 2); err == nil {
+		t.Fatalf("expected error for max < min")
+	}
+
+	// data is intact across buffer resizes
+	tm := makeTestMux()
+	outR, outW := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, outR, true, false)
+	err := tm.M.SetFdAdaptiveReadBuf(1, 256, 64*1024, 2)
+	if err != nil {
+		t.Fatalf("error setting adaptive read buffer: %v", err)
+	}
+	tm.start(false, false, true)
+	var expected []byte
+	for i := 0; i < 20000; i++ {
+		expected = append(expected, []byte(fmt.Sprintf("line %d\n", i))...)
+	}
+	go func() {
+		outW.Write(expected)
+		outW.Close()
+	}()
+	var received []byte
+	for {
+		pk := tm.waitForPacket(t, isDataPacket(1), nil).(*packet.DataPacketType)
+		data, _ := base64.StdEncoding.DecodeString(pk.Data64)
+		received = append(received, data...)
+		tm.sendAck(1, len(data))
+		if pk.Eof {
+			break
+		}
+	}
+	if !bytes.Equal(received, expected) {
+		t.Fatalf("data mismatch with adaptive buffer (received %d bytes, expected %d)", len(received), len(expected))
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+func benchmarkReadLoopBuf(b *testing.B, minSize int, maxSize int) {
+	chunk := make([]byte, 64*1024)
+	const totalSize = 8 * 1024 * 1024
+	b.SetBytes(totalSize)
+	b.ReportAllocs()
+	numPackets := 0
+	for i := 0; i < b.N; i++ {
+		m := MakeMultiplexer(base.MakeCommandKey("bench", "bench"), nil)
+		srcR, srcW, _ := os.Pipe()
+		fr := MakeFdReader(m, srcR, 1, true, false)
+		fr.ReadBufMin, fr.ReadBufMax, fr.ReadBufGrowth = minSize, maxSize, 2
+		sender := &autoAckSender{Reader: fr}
+		m.Sender = sender
+		go func() {
+			for written := 0; written < totalSize; written += len(chunk) {
+				srcW.Write(chunk)
+			}
+			srcW.Close()
+		}()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		fr.ReadLoop(&wg)
+		numPackets += sender.NumPackets
+	}
+	b.ReportMetric(float64(numPackets)/float64(b.N), "packets/op")
+}
+
+func BenchmarkReadLoopFixedBuf(b *testing.B) {
+	benchmarkReadLoopBuf(b, 0, 0)
+}
+
+func BenchmarkReadLoopAdaptiveBuf(b *testing.B) {
+	benchmarkReadLoopBuf(b, 1024, 64*1024)
+}
+
+// acks arrive after a 1ms round trip, a windowed reader waits for them, a bulk reader does not
+func benchmarkBulkMode(b *testing.B, bulk bool) {
+	chunk := make([]byte, 64*1024)
+	const totalSize = 8 * 1024 * 1024
+	b.SetBytes(totalSize)
+	for i := 0; i < b.N; i++ {
+		m := MakeMultiplexer(base.MakeCommandKey("bench", "bench"), nil)
+		srcR, srcW, _ := os.Pipe()
+		fr := MakeFdReader(m, srcR, 1, true, false)
+		fr.WindowSize = 64 * 1024
+		fr.Bulk = bulk
+		m.Sender = &autoAckSender{Reader: fr, AckDelay: time.Millisecond}
+		go func() {
+			for written := 0; written < totalSize; written += len(chunk) {
+				srcW.Write(chunk)
+			}
+			srcW.Close()
+		}()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		fr.ReadLoop(&wg)
+	}
+}
+
+func BenchmarkReaderWindowed(b *testing.B) {
+	benchmarkBulkMode(b, false)
+}
+
+func BenchmarkReaderBulk(b *testing.B) {
+	benchmarkBulkMode(b, true)
+}
+
+func TestMergeFdInto(t *testing.T) {
+	tm := makeTestMux()
+	cmd := exec.Command("sh", "-c", "for i in 1 2 3 4 5; do echo out$i; echo err$i >&2; done")
+	err := tm.M.AttachCmd(cmd)
+	if err != nil {
+		t.Fatalf("error attaching cmd: %v", err)
+	}
+	err = tm.M.MergeFdInto(2, 1)
+	if err != nil {
+		t.Fatalf("error merging fds: %v", err)
+	}
+	if err := tm.M.MergeFdInto(2, 1); err == nil {
+		t.Fatalf("expected error merging fd:2 twice")
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatalf("error starting cmd: %v", err)
+	}
+	defer cmd.Wait()
+	tm.start(true, false, false)
+	var output []byte
+	for {
+		pk := tm.waitForPacket(t, func(pk packet.PacketType) bool {
+			_, ok := pk.(*packet.DataPacketType)
+			return ok
+		}, nil).(*packet.DataPacketType)
+		if pk.FdNum != 1 {
+			t.Fatalf("expected all data on the merged fd:1, got %s", packet.AsString(pk))
+		}
+		data, _ := base64.StdEncoding.DecodeString(pk.Data64)
+		output = append(output, data...)
+		tm.sendAck(1, len(data))
+		if pk.Eof {
+			break
+		}
+	}
+	for i := 1; i <= 5; i++ {
+		for _, name := range []string{"out", "err"} {
+			line := fmt.Sprintf("%s%d\n", name, i)
+			if !strings.Contains(string(output), line) {
+				t.Fatalf("merged output is missing %q: %q", line, output)
+			}
+		}
+	}
+	if len(output) != 50 {
+		t.Fatalf("expected 50 bytes of merged output, got %d: %q", len(output), output)
+	}
+	<-tm.DoneCh
+	merge := tm.M.getMerge(1)
+	waitForCond(t, "merged stream fully acked", func() bool {
+		merge.Lock.Lock()
+		defer merge.Lock.Unlock()
+		return len(merge.Unacked) == 0
+	})
+	// acks are split back to the readers in send order
+	merge = &fdMerge{Lock: &sync.Mutex{}, DstFd: 1, Unacked: []mergedSend{{1, 10}, {2, 5}, {2, 5}, {1, 10}}}
+	parts := merge.splitAck(22)
+	if fmt.Sprint(parts) != "[{1 10} {2 10} {1 2}]" || merge.Unacked[0].WireLen != 8 {
+		t.Fatalf("bad ack split: %v (unacked %v)", parts, merge.Unacked)
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	tm := makeTestMux()
+	tm.M.MemoryBudget = 1000
+	tm.M.ShedOrder = []int{3}
+	eventCh := make(chan *MuxEvent, 100)
+	tm.M.EventHandler = func(e *MuxEvent) {
+		if e.Type == EventMemoryPressure || e.Type == EventMemoryRelease || e.Type == EventMemoryShed {
+			eventCh <- e
+		}
+	}
+	waitForEvent := func(evType string) *MuxEvent {
+		t.Helper()
+		select {
+		case e := <-eventCh:
+			if e.Type != evType {
+				t.Fatalf("expected %s event, got %s", evType, e.String())
+			}
+			return e
+		case <-time.After(testTimeout):
+			t.Fatalf("timeout waiting for %s event", evType)
+		}
+		return nil
+	}
+	stdinW := makeGatedWriter()
+	stdinW.Release()
+	extraW := makeGatedWriter()
+	extraW.Release()
+	tm.M.MakeRawFdWriter(0, stdinW, true, "stdin")
+	tm.M.MakeRawFdWriter(3, extraW, true, "extra")
+	pr, pw := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, pr, false, false)
+	stdinFw, _ := tm.M.getFdWriter(0)
+	extraFw, _ := tm.M.getFdWriter(3)
+	stdinFw.SetPaused(true)
+	extraFw.SetPaused(true)
+	tm.start(false, false, false)
+	defer tm.M.Close()
+
+	// 850 buffered bytes crosses the pressure mark (80%)
+	tm.sendData(0, bytes.Repeat([]byte("a"), 300), false)
+	tm.sendData(3, bytes.Repeat([]byte("b"), 550), false)
+	waitForEvent(EventMemoryPressure)
+	if !tm.M.InMemoryPressure() {
+		t.Fatalf("expected memory pressure")
+	}
+	fr, _ := tm.M.getFdReader(1)
+	waitForCond(t, "reader paused", func() bool {
+		fr.CVar.L.Lock()
+		defer fr.CVar.L.Unlock()
+		return fr.MemPaused
+	})
+	pw.Write([]byte("hello"))
+	// stdin drains, but its acks are held while under pressure (550 bytes is still over 50%)
+	stdinFw.SetPaused(false)
+	waitForCond(t, "held ack", func() bool {
+		stdinFw.CVar.L.Lock()
+		defer stdinFw.CVar.L.Unlock()
+		return stdinFw.HeldAck == 300
+	})
+
+	// going over the budget sheds fd 3 (first in ShedOrder), which releases the pressure
+	tm.sendData(3, bytes.Repeat([]byte("c"), 500), false)
+	shedEvent := waitForEvent(EventMemoryShed)
+	if shedEvent.FdNum != 3 {
+		t.Fatalf("expected fd 3 to be shed, got %s", shedEvent.String())
+	}
+	waitForEvent(EventMemoryRelease)
+	var skipped []packet.PacketType
+	tm.waitForPacket(t, isEofAck(3), &skipped)
+	ackPk := tm.waitForPacket(t, func(pk packet.PacketType) bool {
+		ack, ok := pk.(*packet.DataAckPacketType)
+		return ok && ack.FdNum == 0
+	}, &skipped).(*packet.DataAckPacketType)
+	if ackPk.AckLen != 300 {
+		t.Fatalf("expected the held ack (300 bytes), got %s", ackPk.String())
+	}
+	for _, pk := range skipped {
+		if ack, ok := pk.(*packet.DataAckPacketType); ok && ack.FdNum == 0 {
+			t.Fatalf("ack sent under memory pressure: %s", ack.String())
+		}
+	}
+	if string(tm.readData(t, 1, 5)) != "hello" {
+		t.Fatalf("bad reader data after release")
+	}
+	if extraFw.getCloseReason() != CloseReasonMemory {
+		t.Fatalf("expected close reason %q, got %q", CloseReasonMemory, extraFw.getCloseReason())
+	}
+	if stdinData, _ := stdinW.getData(); string(stdinData) != strings.Repeat("a", 300) {
+		t.Fatalf("bad stdin data")
+	}
+
+	// default order: highest fd first, fds without buffered data are never shed
+	m := MakeMultiplexer(tm.M.CK, nil)
+	perFd := map[int]int{0: 5, 1: 0, 2: 7, 4: 3}
+	if order := fmt.Sprint(m.shedOrder(perFd)); order != "[4 2 0]" {
+		t.Fatalf("bad default shed order %s", order)
+	}
+	m.ShedOrder = []int{0, 1}
+	if order := fmt.Sprint(m.shedOrder(perFd)); order != "[0 4 2]" {
+		t.Fatalf("bad shed order %s", order)
+	}
+}
+
+func TestOnCmdDone(t *testing.T) {
+	tm := makeTestMux()
+	slowW := makeGatedWriter()
+	tm.M.MakeRawFdWriter(1, slowW, true, "stdout")
+	doneCbCh := make(chan *packet.CmdDonePacketType, 2)
+	tm.M.OnCmdDone = func(pk *packet.CmdDonePacketType) {
+		doneCbCh <- pk
+	}
+	tm.start(false, true, true)
+	tm.sendData(1, []byte("out1\n"), false)
+	tm.sendData(1, []byte("out2\n"), false)
+	tm.sendDone()
+	var cbPk *packet.CmdDonePacketType
+	select {
+	case cbPk = <-doneCbCh:
+	case <-time.After(testTimeout):
+		t.Fatalf("timeout waiting for done callback")
+	}
+	// the output has not drained yet (the writer is blocked), RunIOAndWait has not returned
+	if data, _ := slowW.getData(); len(data) != 0 {
+		t.Fatalf("output written before the done callback: %q", data)
+	}
+	select {
+	case <-tm.DoneCh:
+		t.Fatalf("RunIOAndWait returned before the output drained")
+	default:
+	}
+	slowW.Release()
+	var donePk *packet.CmdDonePacketType
+	select {
+	case donePk = <-tm.DoneCh:
+	case <-time.After(testTimeout):
+		t.Fatalf("timeout waiting for RunIOAndWait")
+	}
+	if donePk != cbPk {
+		t.Fatalf("callback and RunIOAndWait returned different done packets")
+	}
+	if data, _ := slowW.getData(); string(data) != "out1\nout2\n" {
+		t.Fatalf("bad output %q", data)
+	}
+	if len(doneCbCh) != 0 {
+		t.Fatalf("expected one done callback, got %d", 1+len(doneCbCh))
+	}
+}
+
+// WriteCloser on a raw fd, unlike os.File a write racing Close can fail with EBADF
+type rawFdWriter struct {
+	Fd       int
+	Lock     *sync.Mutex
+	NumEbadf int
+}
+
+func (w *rawFdWriter) Write(data []byte) (int, error) {
+	time.Sleep(50 * time.Microsecond) // widens the window for a racing Close
+	nw, err := syscall.Write(w.Fd, data)
+	if err == syscall.EBADF {
+		w.Lock.Lock()
+		w.NumEbadf++
+		w.Lock.Unlock()
+	}
+	if nw < 0 {
+		nw = 0
+	}
+	return nw, err
+}
+
+func (w *rawFdWriter) Close() error {
+	return syscall.Close(w.Fd)
+}
+
+func TestCloseDuringIO(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		tm := makeTestMux()
+		pr, pw := makeTestPipe(t)
+		wfd, err := syscall.Dup(int(pw.Fd()))
+		if err != nil {
+			t.Fatalf("cannot dup pipe fd: %v", err)
+		}
+		pw.Close()
+		syscall.SetNonblock(wfd, false)
+		rawW := &rawFdWriter{Fd: wfd, Lock: &sync.Mutex{}}
+		tm.M.MakeRawFdWriter(0, rawW, true, "stdin")
+		drainDoneCh := make(chan bool)
+		go func() {
+			io.Copy(io.Discard, pr)
+			close(drainDoneCh)
+		}()
+		outR, outW := makeTestPipe(t)
+		tm.M.MakeRawFdReader(1, outR, true, false)
+		go func() {
+			line := []byte(strings.Repeat("x", 100) + "\n")
+			for {
+				if _, err := outW.Write(line); err != nil {
+					return
+				}
+			}
+		}()
+		stopCh := make(chan bool)
+		sendInput := func(pk packet.PacketType) {
+			select {
+			case tm.InputCh <- pk:
+			case <-stopCh:
+			}
+		}
+		inputData := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("in"), 2000))
+		makeInputPacket := func() packet.PacketType {
+			pk := packet.MakeDataPacket()
+			pk.CK = tm.M.CK
+			pk.FdNum = 0
+			pk.Data64 = inputData
+			return pk
+		}
+		var badAcks []string
+		outputDoneCh := make(chan bool)
+		go func() {
+			defer close(outputDoneCh)
+			for {
+				select {
+				case pk := <-tm.OutputCh:
+					// keep both directions streaming, new input for each write ack, acks for the output
+					// error acks for input that arrives after the close are expected
+					ack, ok := pk.(*packet.DataAckPacketType)
+					if ok && (strings.Contains(ack.Error, syscall.EBADF.Error()) || strings.Contains(ack.Error, os.ErrClosed.Error())) {
+						badAcks = append(badAcks, ack.Error)
+					} else if ok && ack.FdNum == 0 && ack.AckLen > 0 {
+						sendInput(makeInputPacket())
+					}
+					if dataPk, ok := pk.(*packet.DataPacketType); ok && dataPk.FdNum == 1 {
+						ack := packet.MakeDataAckPacket()
+						ack.CK = tm.M.CK
+						ack.FdNum = 1
+						ack.AckLen = base64.StdEncoding.DecodedLen(len(dataPk.Data64))
+						sendInput(ack)
+					}
+				case <-stopCh:
+					return
+				}
+			}
+		}()
+		tm.start(false, false, false)
+		for j := 0; j < 4; j++ {
+			sendInput(makeInputPacket())
+		}
+		time.Sleep(time.Duration(i%5) * time.Millisecond)
+		tm.M.Close()
+		select {
+		case <-drainDoneCh:
+		case <-time.After(testTimeout):
+			t.Fatalf("iteration %d: writer fd was not closed", i)
+		}
+		close(stopCh)
+		<-outputDoneCh
+		rawW.Lock.Lock()
+		numEbadf := rawW.NumEbadf
+		rawW.Lock.Unlock()
+		if numEbadf > 0 || len(badAcks) > 0 {
+			t.Fatalf("iteration %d: unclean close, ebadf=%d error acks=%v", i, numEbadf, badAcks)
+		}
+	}
+}
+
+func TestRingBufferReader(t *testing.T) {
+	tm := makeTestMux()
+	pr, pw := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, pr, false, false)
+	fr, _ := tm.M.getFdReader(1)
+	fr.WindowSize = 10
+	if tm.M.SetFdRingBuffer(1, -1) == nil {
+		t.Fatalf("expected an error for a negative ring size")
+	}
+	err := tm.M.SetFdRingBuffer(1, 20)
+	if err != nil {
+		t.Fatalf("error setting ring buffer: %v", err)
+	}
+	tm.start(false, false, false)
+	defer tm.M.Close()
+	pw.Write([]byte("0123456789"))
+	first := tm.readData(t, 1, 10)
+	if string(first) != "0123456789" {
+		t.Fatalf("bad first packet %q", first)
+	}
+	// the window is full (nothing acked), the reader keeps reading and only the newest 20 bytes survive
+	pw.Write([]byte(strings.Repeat("x", 30)))
+	pw.Write([]byte("NEWEST-ABCDEFGHIJKLM"))
+	waitForCond(t, "ring to fill", func() bool {
+		fr.CVar.L.Lock()
+		defer fr.CVar.L.Unlock()
+		return fr.RingDroppedTotal == 30 && len(fr.Ring) == 20
+	})
+	tm.sendAck(1, 10)
+	pk := tm.waitForPacket(t, isDataPacket(1), nil).(*packet.DataPacketType)
+	data, _ := base64.StdEncoding.DecodeString(pk.Data64)
+	if string(data) != "NEWEST-ABC" || pk.Dropped != 30 {
+		t.Fatalf("expected the newest data with dropped=30, got %q (%s)", data, pk.String())
+	}
+	pw.Close()
+	tm.sendAck(1, 10)
+	pk = tm.waitForPacket(t, isDataPacket(1), nil).(*packet.DataPacketType)
+	data, _ = base64.StdEncoding.DecodeString(pk.Data64)
+	if string(data) != "DEFGHIJKLM" || pk.Dropped != 0 {
+		t.Fatalf("bad ring data %q (%s)", data, pk.String())
+	}
+	if !pk.Eof {
+		tm.sendAck(1, 10)
+		tm.waitForPacket(t, isEofDataPacket(1), nil)
+	}
+}
+
+// records the data bytes it was sent, and any packet sent after it was retired (swapped out)
+type swapTestSender struct {
+	Lock      *sync.Mutex
+	Retired   bool
+	DataBytes int
+	NumStale  int
+}
+
+func (s *swapTestSender) SendPacket(pk packet.PacketType) error {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if s.Retired {
+		s.NumStale++
+	}
+	if dataPk, ok := pk.(*packet.DataPacketType); ok {
+		data, _ := base64.StdEncoding.DecodeString(dataPk.Data64)
+		s.DataBytes += len(data)
+	}
+	return nil
+}
+
+func TestSwapSender(t *testing.T) {
+	tm := makeTestMux()
+	pr, pw := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, pr, true, false)
+	if _, err := tm.M.SwapSender(&swapTestSender{Lock: &sync.Mutex{}}); err == nil {
+		t.Fatalf("expected an error swapping before start")
+	}
+	senders := []*swapTestSender{{Lock: &sync.Mutex{}}}
+	doneCh := tm.M.RunIOAndWaitAsync(makeTestParser(tm.InputCh), senders[0], true, false, false)
+	const numWrites = 2000
+	const writeSize = 50
+	go func() {
+		chunk := bytes.Repeat([]byte("d"), writeSize)
+		for i := 0; i < numWrites; i++ {
+			pw.Write(chunk)
+		}
+		pw.Close()
+	}()
+	for i := 0; i < 20; i++ {
+		time.Sleep(time.Millisecond)
+		newSender := &swapTestSender{Lock: &sync.Mutex{}}
+		oldSender, err := tm.M.SwapSender(newSender)
+		if err != nil {
+			t.Fatalf("error swapping sender: %v", err)
+		}
+		if oldSender != senders[len(senders)-1] {
+			t.Fatalf("SwapSender returned the wrong old sender")
+		}
+		senders = append(senders, newSender)
+		oldTs := oldSender.(*swapTestSender)
+		oldTs.Lock.Lock()
+		oldTs.Retired = true
+		oldTs.Lock.Unlock()
+	}
+	select {
+	case <-doneCh:
+	case <-time.After(testTimeout):
+		t.Fatalf("timeout waiting for the reader")
+	}
+	totalBytes := 0
+	for idx, s := range senders {
+		s.Lock.Lock()
+		totalBytes += s.DataBytes
+		if s.NumStale > 0 {
+			t.Errorf("sender %d got %d packets after it was swapped out", idx, s.NumStale)
+		}
+		s.Lock.Unlock()
+	}
+	if totalBytes != numWrites*writeSize {
+		t.Fatalf("expected %d data bytes across the senders, got %d", numWrites*writeSize, totalBytes)
+	}
+}
+
+func TestSessionSummary(t *testing.T) {
+	tm := makeTestMux()
+	clock := makeFakeClock()
+	tm.M.Clock = clock
+	summaryCh := make(chan *SessionSummary, 1)
+	tm.M.SummaryLogger = func(summary *SessionSummary) {
+		summaryCh <- summary
+	}
+	pr, pw := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, pr, true, false)
+	stdinW := makeGatedWriter()
+	stdinW.Release()
+	tm.M.MakeRawFdWriter(0, stdinW, true, "stdin")
+	tm.start(true, true, true)
+	pw.Write([]byte(strings.Repeat("o", 32)))
+	pw.Close()
+	tm.sendData(0, []byte(strings.Repeat("i", 12)), false)
+	tm.sendData(0, []byte(strings.Repeat("i", 8)), true)
+	gotEof, gotEofAck := false, false
+	for !gotEof || !gotEofAck {
+		pk := tm.waitForPacket(t, func(pk packet.PacketType) bool {
+			return isEofDataPacket(1)(pk) || isEofAck(0)(pk)
+		}, nil)
+		gotEof = gotEof || isEofDataPacket(1)(pk)
+		gotEofAck = gotEofAck || isEofAck(0)(pk)
+	}
+	clock.Advance(5 * time.Second)
+	donePk := packet.MakeCmdDonePacket(tm.M.CK)
+	donePk.ExitCode = 3
+	tm.InputCh <- donePk
+	var summary *SessionSummary
+	select {
+	case summary = <-summaryCh:
+	case <-time.After(testTimeout):
+		t.Fatalf("timeout waiting for the session summary")
+	}
+	<-tm.DoneCh
+	if summary.BytesOut != 32 || summary.BytesIn != 20 || summary.PacketsIn != 2 || summary.PacketsOut < 1 {
+		t.Fatalf("bad summary totals %s", summary.String())
+	}
+	if summary.WireBytes != tm.M.Stats().WireBytes || summary.Duration != 5*time.Second {
+		t.Fatalf("bad summary %s", summary.String())
+	}
+	if summary.ExitCode == nil || *summary.ExitCode != 3 || summary.ClosedEarly {
+		t.Fatalf("bad summary exit status %s", summary.String())
+	}
+	expectedFds := []FdSummary{
+		{FdNum: 0, Dir: FdDirWriter, Bytes: 20, CloseReason: CloseReasonEof},
+		{FdNum: 1, Dir: FdDirReader, Bytes: 32, CloseReason: CloseReasonEof},
+	}
+	if fmt.Sprint(summary.Fds) != fmt.Sprint(expectedFds) {
+		t.Fatalf("bad per-fd summary %v", summary.Fds)
+	}
+	if !strings.Contains(summary.String(), "fds=[0:writer:20:eof 1:reader:32:eof] exit=3") {
+		t.Fatalf("bad summary string %s", summary.String())
+	}
+}
+
+func TestHandshakeWindow(t *testing.T) {
+	tm := makeTestMux()
+	tm.M.Handshake = true
+	tm.M.LocalCaps = FlowCaps{WindowSize: 700, MaxPacketSize: 4096, Compression: []string{"gzip", "zstd"}}
+	pr, pw := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, pr, false, false)
+	smallR, _ := makeTestPipe(t)
+	tm.M.MakeRawFdReader(3, smallR, false, false)
+	fr, _ := tm.M.getFdReader(1)
+	fr.WindowSize = 1000
+	smallFr, _ := tm.M.getFdReader(3)
+	smallFr.WindowSize = 200
+	tm.start(false, false, false)
+	defer tm.M.Close()
+	helloPk, ok := tm.waitForPacket(t, func(pk packet.PacketType) bool { return true }, nil).(*packet.MuxHelloPacketType)
+	if !ok || helloPk.WindowSize != 700 || helloPk.MaxPacketSize != 4096 || fmt.Sprint(helloPk.Compression) != "[gzip zstd]" {
+		t.Fatalf("expected our hello as the first packet, got %v", helloPk)
+	}
+	peerHello := packet.MakeMuxHelloPacket(tm.M.CK)
+	peerHello.WindowSize = 300
+	peerHello.MaxPacketSize = 100
+	peerHello.Compression = []string{"zstd"}
+	tm.InputCh <- peerHello
+	waitForCond(t, "peer window", func() bool {
+		windowSize, _ := tm.M.FdWindowSize(1)
+		return windowSize == 300
+	})
+	if windowSize, _ := tm.M.FdWindowSize(3); windowSize != 200 {
+		t.Fatalf("expected the smaller local window (200) to stay, got %d", windowSize)
+	}
+	if tm.M.GetCompression() != "zstd" {
+		t.Fatalf("bad negotiated compression %q", tm.M.GetCompression())
+	}
+	// a reader registered after the handshake gets the peer's limits
+	lateR, _ := makeTestPipe(t)
+	tm.M.MakeRawFdReader(4, lateR, false, false)
+	if windowSize, _ := tm.M.FdWindowSize(4); windowSize != 300 {
+		t.Fatalf("expected late reader window 300, got %d", windowSize)
+	}
+
+	pw.Write(bytes.Repeat([]byte("w"), 1000))
+	numSent := 0
+	for numSent < 300 {
+		pk := tm.waitForPacket(t, isDataPacket(1), nil).(*packet.DataPacketType)
+		pkLen := packet.B64DecodedLen(pk.Data64)
+		if pkLen > 100 {
+			t.Fatalf("data packet larger than the peer's max packet size: %d", pkLen)
+		}
+		numSent += pkLen
+	}
+	waitForCond(t, "window to fill", func() bool { return fr.GetBufSize() == 300 })
+	select {
+	case pk := <-tm.OutputCh:
+		t.Fatalf("packet sent past the effective window: %s", packet.AsString(pk))
+	case <-time.After(20 * time.Millisecond):
+	}
+	tm.sendAck(1, 300)
+	if len(tm.readData(t, 1, 300)) != 300 {
+		t.Fatalf("expected the next window after the ack")
+	}
+}
+
+func TestFdPriority(t *testing.T) {
+	tm := makeTestMux()
+	tm.OutputCh = make(chan packet.PacketType) // unbuffered so the consumer is the bottleneck
+	tm.M.FairScheduling = true
+	tm.M.MaxBurstPackets = 4
+	noisyWriters := make(map[int]*os.File)
+	for _, fdNum := range []int{3, 4, 5, 6, 7, 8, 9, 10} {
+		outR, outW := makeTestPipe(t)
+		tm.M.MakeRawFdReader(fdNum, outR, true, false)
+		noisyWriters[fdNum] = outW
+	}
+	echoR, echoW := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, echoR, true, false)
+	if !errors.Is(tm.M.SetFdPriority(20, 1), ErrNoSuchFd) {
+		t.Fatalf("expected ErrNoSuchFd for an unknown fd")
+	}
+	err := tm.M.SetFdPriority(1, 10)
+	if err != nil {
+		t.Fatalf("error setting priority: %v", err)
+	}
+	tm.start(false, false, true)
+	defer tm.M.Close()
+	stopNoise := make(chan bool)
+	defer close(stopNoise)
+	for _, outW := range noisyWriters {
+		go func(outW *os.File) {
+			noise := make([]byte, 4096)
+			for {
+				select {
+				case <-stopNoise:
+					return
+				default:
+				}
+				outW.Write(noise)
+			}
+		}(outW)
+	}
+	consume := func() *packet.DataPacketType {
+		for {
+			pk := tm.waitForPacket(t, func(packet.PacketType) bool { return true }, nil)
+			if dataPk, ok := pk.(*packet.DataPacketType); ok {
+				if dataPk.FdNum != 1 {
+					tm.sendAck(dataPk.FdNum, packet.B64DecodedLen(dataPk.Data64))
+				}
+				return dataPk
+			}
+		}
+	}
+	// saturate the sender queue and the dispatcher with bulk data
+	for i := 0; i < 3*packet.PacketSenderQueueSize; i++ {
+		consume()
+	}
+	echoW.Write([]byte("echo"))
+	time.Sleep(10 * time.Millisecond) // the echo is queued before anything else is consumed
+	numAhead := 0
+	for {
+		dataPk := consume()
+		if dataPk.FdNum == 1 {
+			break
+		}
+		numAhead++
+	}
+	// round-robin alone would also serve a burst from each of the 8 bulk fds first
+	maxAhead := packet.PacketSenderQueueSize + tm.M.MaxBurstPackets + 2
+	if numAhead > maxAhead {
+		t.Fatalf("high priority fd delayed by %d bulk packets (max %d)", numAhead, maxAhead)
+	}
+}
+
+func TestFdPriorityStarvation(t *testing.T) {
+	m := MakeMultiplexer(base.MakeCommandKey("testsession", "testcmd"), nil)
+	d := makeFairDispatcher(m, 1, map[int]int{2: 10})
+	var served []string
+	for i := 0; i < 2*(MaxPriorityBatches+1); i++ {
+		// both fds always have a packet queued
+		for _, fdNum := range []int{1, 2} {
+			d.CVar.L.Lock()
+			numQueued := len(d.Queues[fdNum])
+			d.CVar.L.Unlock()
+			if numQueued == 0 {
+				d.enqueue(fdNum, m.makeDataPacket(fdNum, []byte("x"), nil))
+			}
+		}
+		batch, ok := d.nextBatch()
+		if !ok || len(batch) != 1 {
+			t.Fatalf("bad batch %v", batch)
+		}
+		served = append(served, fmt.Sprint(batch[0].(*packet.DataPacketType).FdNum))
+	}
+	expected := strings.Repeat("2", MaxPriorityBatches) + "1"
+	if strings.Join(served, "") != expected+expected {
+		t.Fatalf("bad service order %s (expected %s)", strings.Join(served, ""), expected+expected)
+	}
+}
+
+func TestInputDone(t *testing.T) {
+	tm := makeTestMux()
+	tm.start(false, false, true)
+	if tm.M.InputDone() {
+		t.Fatalf("input done before the done packet")
+	}
+	select {
+	case <-tm.M.InputDoneCh():
+		t.Fatalf("input done channel closed early")
+	default:
+	}
+	tm.sendDone()
+	select {
+	case <-tm.M.InputDoneCh():
+	case <-time.After(testTimeout):
+		t.Fatalf("timeout waiting for the input done channel")
+	}
+	if !tm.M.InputDone() {
+		t.Fatalf("expected InputDone after the done packet")
+	}
+	<-tm.DoneCh
+	// the channel is only closed once, later calls (e.g. Close) do not panic
+	tm.M.HandleInputDone()
+	tm.M.Close()
+	if _, ok := <-tm.M.InputDoneCh(); ok || !tm.M.InputDone() {
+		t.Fatalf("bad input done state after a second HandleInputDone")
+	}
+}
+
+func TestUrgentAbort(t *testing.T) {
+	tm := makeTestMux()
+	stdinW := makeGatedWriter()
+	tm.M.MakeRawFdWriter(0, stdinW, true, "stdin")
+	parser := makeTestParser(make(chan packet.PacketType, 100))
+	parser.UrgentCh = make(chan packet.PacketType, 1)
+	const numBulk = 50
+	for i := 0; i < numBulk; i++ {
+		pk := packet.MakeDataPacket()
+		pk.CK = tm.M.CK
+		pk.FdNum = 0
+		pk.Data64 = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("b"), 1000))
+		parser.MainCh <- pk
+	}
+	// queued behind all of the bulk data, but handled first
+	parser.UrgentCh <- packet.MakeUrgentPacket(tm.M.CK, packet.UrgentActionAbortFd, 0)
+	doneCh := tm.M.RunIOAndWaitAsync(parser, packet.MakeChannelPacketSender(tm.OutputCh), false, false, false)
+	defer func() {
+		tm.M.Close()
+		<-doneCh
+	}()
+	var skipped []packet.PacketType
+	tm.waitForPacket(t, isEofAck(0), &skipped)
+	numRejected := 0
+	for numRejected < numBulk {
+		tm.waitForPacket(t, isErrorAck, nil)
+		numRejected++
+	}
+	for _, pk := range skipped {
+		if ack, ok := pk.(*packet.DataAckPacketType); ok && ack.Error != "" {
+			t.Fatalf("bulk data processed before the urgent abort: %s", ack.String())
+		}
+	}
+	stdinW.Release()
+	if data, isClosed := stdinW.getData(); len(data) != 0 || !isClosed {
+		t.Fatalf("expected the aborted writer closed with no data, got %d bytes (closed=%v)", len(data), isClosed)
+	}
+
+	// the parser routes urgent packets to UrgentCh only when enabled
+	var input bytes.Buffer
+	for _, pk := range []packet.PacketType{tm.M.makeDataPacket(0, []byte("x"), nil), packet.MakeUrgentPacket(tm.M.CK, packet.UrgentActionAbortFd, 0)} {
+		pkBytes, _ := packet.MarshalPacket(pk)
+		input.Write(pkBytes)
+	}
+	urgentParser := packet.MakePacketParser(bytes.NewReader(input.Bytes()), &packet.PacketParserOpts{ReadAhead: 2, UrgentQueueSize: 1})
+	if pk := <-urgentParser.UrgentCh; pk == nil || pk.GetType() != packet.UrgentPacketStr {
+		t.Fatalf("expected the urgent packet on UrgentCh, got %v", pk)
+	}
+	if pk := <-urgentParser.MainCh; pk == nil || pk.GetType() != packet.DataPacketStr {
+		t.Fatalf("expected the data packet on MainCh, got %v", pk)
+	}
+}
+
+// WriteCloser that reports one byte less than it was given (without an error)
+type shortWriter struct {
+	Lock     *sync.Mutex
+	IsClosed bool
+}
+
+func (w *shortWriter) Write(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	return len(data) - 1, nil
+}
+
+func (w *shortWriter) Close() error {
+	w.Lock.Lock()
+	defer w.Lock.Unlock()
+	w.IsClosed = true
+	return nil
+}
+
+func TestDataWithEof(t *testing.T) {
+	tm := makeTestMux()
+	gw := makeGatedWriter()
+	tm.M.MakeRawFdWriter(0, gw, true, "stdin")
+	sw := &shortWriter{Lock: &sync.Mutex{}}
+	tm.M.MakeRawFdWriter(3, sw, true, "short")
+	tm.start(false, false, false)
+	defer tm.M.Close()
+	// more than one write chunk, all of it must reach the fd before the EOF close
+	input := bytes.Repeat([]byte("0123456789"), 1000)
+	tm.sendData(0, input, true)
+	gw.Release()
+	ackTotal := 0
+	for {
+		pk := tm.waitForPacket(t, func(pk packet.PacketType) bool {
+			ack, ok := pk.(*packet.DataAckPacketType)
+			return ok && ack.FdNum == 0
+		}, nil)
+		ack := pk.(*packet.DataAckPacketType)
+		if ack.Error != "" {
+			t.Fatalf("unexpected error ack: %s", ack.Error)
+		}
+		if ack.EofAck {
+			if ack.AckLen != 0 {
+				t.Fatalf("eof ack should not carry data, acklen=%d", ack.AckLen)
+			}
+			break
+		}
+		ackTotal += ack.AckLen
+	}
+	if ackTotal != len(input) {
+		t.Fatalf("expected %d bytes acked before the eof ack, got %d", len(input), ackTotal)
+	}
+	data, isClosed := gw.getData()
+	if !bytes.Equal(data, input) || !isClosed {
+		t.Fatalf("expected all data written before close, got %d bytes closed[%v]", len(data), isClosed)
+	}
+	fw, _ := tm.M.getFdWriter(0)
+	if fw.getCloseReason() != CloseReasonEof {
+		t.Fatalf("expected close reason %q, got %q", CloseReasonEof, fw.getCloseReason())
+	}
+	// a short write is an error, never an eof close
+	tm.sendData(3, []byte("partial"), true)
+	var skipped []packet.PacketType
+	pk := tm.waitForPacket(t, func(pk packet.PacketType) bool {
+		ack, ok := pk.(*packet.DataAckPacketType)
+		return ok && ack.FdNum == 3 && (ack.Error != "" || ack.EofAck)
+	}, &skipped)
+	ack := pk.(*packet.DataAckPacketType)
+	if ack.EofAck || !strings.Contains(ack.Error, io.ErrShortWrite.Error()) {
+		t.Fatalf("expected a short write error ack, got %s", ack.String())
+	}
+	fw, _ = tm.M.getFdWriter(3)
+	if fw.getCloseReason() != CloseReasonError {
+		t.Fatalf("expected close reason %q, got %q", CloseReasonError, fw.getCloseReason())
+	}
+}
+
+func TestAckRtt(t *testing.T) {
+	tm := makeTestMux()
+	clock := makeFakeClock()
+	tm.M.Clock = clock
+	pr, pw := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, pr, true, false)
+	tm.start(false, false, false)
+	defer tm.M.Close()
+	ackRtt := func() time.Duration {
+		return tm.M.Stats().AckRtt[1]
+	}
+	// the ack path is delayed by advancing the clock before each ack
+	pw.Write([]byte("first"))
+	tm.readData(t, 1, 5)
+	clock.Advance(40 * time.Millisecond)
+	tm.sendAck(1, 3)
+	clock.Advance(10 * time.Millisecond)
+	tm.sendAck(1, 2)
+	waitForCond(t, "first rtt sample", func() bool { return ackRtt() != 0 })
+	if ackRtt() != 50*time.Millisecond {
+		t.Fatalf("expected rtt 50ms (a partial ack is not a sample), got %v", ackRtt())
+	}
+	pw.Write([]byte("second"))
+	tm.readData(t, 1, 6)
+	clock.Advance(130 * time.Millisecond)
+	tm.sendAck(1, 6)
+	// moving average, 1/AckRttSmoothing of the way from 50ms to 130ms
+	waitForCond(t, "second rtt sample", func() bool { return ackRtt() != 50*time.Millisecond })
+	if ackRtt() != 60*time.Millisecond {
+		t.Fatalf("expected rtt 60ms, got %v", ackRtt())
+	}
+}
+
+// ReadCloser that never blocks (no data), records if StopCh was already closed when it was closed
+type pollingReader struct {
+	Lock           *sync.Mutex
+	Reader         *FdReader
+	NumReads       int
+	NumCloses      int
+	StoppedAtClose bool
+}
+
+func (r *pollingReader) Read(buf []byte) (int, error) {
+	time.Sleep(100 * time.Microsecond)
+	r.Lock.Lock()
+	defer r.Lock.Unlock()
+	r.NumReads++
+	return 0, nil
+}
+
+func (r *pollingReader) Close() error {
+	r.Lock.Lock()
+	defer r.Lock.Unlock()
+	r.NumCloses++
+	select {
+	case <-r.Reader.StopCh:
+		r.StoppedAtClose = true
+	default:
+	}
+	return nil
+}
+
+func (r *pollingReader) getCounts() (int, int) {
+	r.Lock.Lock()
+	defer r.Lock.Unlock()
+	return r.NumReads, r.NumCloses
+}
+
+func TestReaderStopCh(t *testing.T) {
+	tm := makeTestMux()
+	closedCh := make(chan int, 10)
+	tm.M.EventHandler = func(event *MuxEvent) {
+		if event.Type == EventFdClosed && event.Dir == FdDirReader {
+			closedCh <- event.FdNum
+		}
+	}
+	keepFd := &pollingReader{Lock: &sync.Mutex{}}
+	tm.M.MakeRawFdReader(1, keepFd, false, false)
+	closeFd := &pollingReader{Lock: &sync.Mutex{}}
+	tm.M.MakeRawFdReader(2, closeFd, true, false)
+	keepFd.Reader, _ = tm.M.getFdReader(1)
+	closeFd.Reader, _ = tm.M.getFdReader(2)
+	tm.start(false, false, false)
+	defer tm.M.Close()
+	waitForCond(t, "reads", func() bool {
+		numReads, _ := keepFd.getCounts()
+		return numReads > 5
+	})
+	// the fd is not closed (ShouldCloseFd false), the loop has to stop on the channel
+	keepFd.Reader.Close()
+	select {
+	case fdNum := <-closedCh:
+		if fdNum != 1 {
+			t.Fatalf("expected fd:1 to close, got fd:%d", fdNum)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("timeout waiting for the read loop to exit")
+	}
+	numReads, numCloses := keepFd.getCounts()
+	time.Sleep(5 * time.Millisecond)
+	if afterReads, _ := keepFd.getCounts(); afterReads != numReads || numCloses != 0 {
+		t.Fatalf("loop kept reading after stop (%d -> %d reads), closes=%d", numReads, afterReads, numCloses)
+	}
+	closeFd.Reader.Close()
+	<-closedCh
+	_, numCloses = closeFd.getCounts()
+	closeFd.Lock.Lock()
+	stoppedAtClose := closeFd.StoppedAtClose
+	closeFd.Lock.Unlock()
+	if numCloses != 1 || !stoppedAtClose {
+		t.Fatalf("expected the stop channel closed before the fd, closes=%d stopped=%v", numCloses, stoppedAtClose)
+	}
+}
+
+func TestSequencedWriterPipe(t *testing.T) {
+	tm := makeTestMux()
+	chunks := [][]byte{[]byte("preamble;"), []byte("user input;"), []byte("trailer")}
+	childIn, err := tm.M.MakeSequencedWriterPipe(0, chunks, true)
+	if err != nil {
+		t.Fatalf("error making sequenced writer pipe: %v", err)
+	}
+	childIn = dupChildFile(t, childIn)
+	tm.start(false, false, true)
+	tm.waitForPacket(t, isEofAck(0), nil)
+	data, err := io.ReadAll(childIn)
+	if err != nil || string(data) != "preamble;user input;trailer" {
+		t.Fatalf("expected the chunks in order followed by eof, got %q (err=%v)", data, err)
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+func TestAnsiFilter(t *testing.T) {
+	input := "red:\x1b[31mtext\x1b[0m;title:\x1b]0;my title\x07;st:\x1b]8;;url\x1b\\link;charset:\x1b(B;end\n"
+	stripped := "red:text;title:;st:link;charset:;end\n"
+	translated := "red:<sgr>text<sgr>;title:;st:link;charset:;end\n"
+	translateFn := func(seq []byte) []byte {
+		if seq[1] == '[' && seq[len(seq)-1] == 'm' {
+			return []byte("<sgr>")
+		}
+		return nil
+	}
+	// every split point, the sequence state carries across the reads
+	for split := 0; split <= len(input); split++ {
+		stripFn := MakeAnsiFilter(nil)
+		out := string(stripFn([]byte(input[:split]))) + string(stripFn([]byte(input[split:])))
+		if out != stripped {
+			t.Fatalf("split %d: bad stripped output %q", split, out)
+		}
+		translate := MakeAnsiFilter(translateFn)
+		out = string(translate([]byte(input[:split]))) + string(translate([]byte(input[split:])))
+		if out != translated {
+			t.Fatalf("split %d: bad translated output %q", split, out)
+		}
+	}
+	tm := makeTestMux()
+	pr, pw := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, pr, true, false)
+	if err := tm.M.SetFdSanitizer(1, nil); err != nil {
+		t.Fatalf("error setting sanitizer: %v", err)
+	}
+	tm.start(true, false, false)
+	for idx := 0; idx < len(input); idx += 3 {
+		pw.Write([]byte(input[idx:min(idx+3, len(input))]))
+		time.Sleep(time.Millisecond)
+	}
+	pw.Close()
+	var out []byte
+	for {
+		pk := tm.waitForPacket(t, isDataPacket(1), nil).(*packet.DataPacketType)
+		data, _ := base64.StdEncoding.DecodeString(pk.Data64)
+		out = append(out, data...)
+		tm.sendAck(1, len(data))
+		if pk.Eof {
+			break
+		}
+	}
+	if string(out) != stripped {
+		t.Fatalf("bad sanitized output %q", out)
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+func TestPiggybackAcks(t *testing.T) {
+	tm := makeTestMux()
+	clock := makeFakeClock()
+	tm.M.Clock = clock
+	tm.M.PiggybackAcks = true
+	tm.M.InboundFilter = func(pk *packet.DataPacketType) error {
+		if data, _ := pk.GetData(); string(data) == "bad" {
+			return fmt.Errorf("rejected")
+		}
+		return nil
+	}
+	// fd 3 is bidirectional, a writer (input to the process) and a reader (its output)
+	procIn, inW := makeTestPipe(t)
+	tm.M.MakeRawFdWriter(3, inW, true, "bidir")
+	outR, procOut := makeTestPipe(t)
+	tm.M.MakeRawFdReader(3, outR, true, false)
+	tm.start(false, false, false)
+	defer tm.M.Close()
+	pendingAck := func() int {
+		tm.M.piggyLock.Lock()
+		defer tm.M.piggyLock.Unlock()
+		return tm.M.piggyAcks[3]
+	}
+	tm.sendData(3, []byte("input"), false)
+	buf := make([]byte, 5)
+	io.ReadFull(procIn, buf)
+	waitForCond(t, "held ack", func() bool { return pendingAck() == 5 })
+	procOut.Write([]byte("output"))
+	var skipped []packet.PacketType
+	dataPk := tm.waitForPacket(t, isDataPacket(3), &skipped).(*packet.DataPacketType)
+	if dataPk.AckLen != 5 {
+		t.Fatalf("expected the ack to ride on the data packet, got %s", dataPk.String())
+	}
+	for _, pk := range skipped {
+		if ack, ok := pk.(*packet.DataAckPacketType); ok && ack.FdNum == 3 {
+			t.Fatalf("unexpected separate ack %s", ack.String())
+		}
+	}
+	// the piggybacked ack in an inbound data packet is processed like a DataAckPacket
+	fr, _ := tm.M.getFdReader(3)
+	if fr.GetBufSize() != 6 {
+		t.Fatalf("expected 6 unacked bytes, got %d", fr.GetBufSize())
+	}
+	pk := packet.MakeDataPacket()
+	pk.CK = tm.M.CK
+	pk.FdNum = 3
+	pk.Data64 = base64.StdEncoding.EncodeToString([]byte("more"))
+	pk.AckLen = 6
+	tm.InputCh <- pk
+	waitForCond(t, "piggybacked ack", func() bool { return fr.GetBufSize() == 0 })
+	// no outbound data, the held ack is sent on its own after PiggybackAckDelay
+	io.ReadFull(procIn, buf[0:4])
+	waitForCond(t, "held ack", func() bool { return pendingAck() == 4 })
+	// flush timers for the first (taken by the data packet) and the second held ack
+	waitForCond(t, "flush timers", func() bool { return clock.numActiveTimers() == 2 })
+	clock.Advance(PiggybackAckDelay)
+	ack := tm.waitForPacket(t, func(pk packet.PacketType) bool {
+		ack, ok := pk.(*packet.DataAckPacketType)
+		return ok && ack.FdNum == 3
+	}, nil).(*packet.DataAckPacketType)
+	if ack.AckLen != 4 {
+		t.Fatalf("expected a separate ack of 4 bytes, got %s", ack.String())
+	}
+	// a packet the InboundFilter rejects still delivers its ack
+	procOut.Write([]byte("again"))
+	tm.waitForPacket(t, isDataPacket(3), nil)
+	waitForCond(t, "unacked output", func() bool { return fr.GetBufSize() == 5 })
+	badPk := packet.MakeDataPacket()
+	badPk.CK = tm.M.CK
+	badPk.FdNum = 3
+	badPk.Data64 = base64.StdEncoding.EncodeToString([]byte("bad"))
+	badPk.AckLen = 5
+	tm.InputCh <- badPk
+	waitForCond(t, "piggybacked ack on a rejected packet", func() bool { return fr.GetBufSize() == 0 })
+}
+
+func TestAllocFdPipes(t *testing.T) {
+	tm := makeTestMux()
+	outR, _ := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, outR, false, false)
+	tm.M.MakeRawFdWriter(4, nopWriteCloser{io.Discard}, false, "test")
+	tm.M.ExpectFds([]int{6})
+	var fdNums []int
+	for i := 0; i < 3; i++ {
+		fdNum, childFd, err := tm.M.AllocFdReaderPipe()
+		if err != nil {
+			t.Fatalf("error allocating reader pipe: %v", err)
+		}
+		childFd.Close()
+		fdNums = append(fdNums, fdNum)
+		fdNum, childFd, err = tm.M.AllocFdWriterPipe()
+		if err != nil {
+			t.Fatalf("error allocating writer pipe: %v", err)
+		}
+		childFd.Close()
+		fdNums = append(fdNums, fdNum)
+	}
+	// 4 and 6 are taken (registered writer, expected fd)
+	expected := []int{3, 5, 7, 8, 9, 10}
+	if fmt.Sprint(fdNums) != fmt.Sprint(expected) {
+		t.Fatalf("expected fds %v, got %v", expected, fdNums)
+	}
+	if _, err := tm.M.getFdReader(3); err != nil {
+		t.Fatalf("allocated reader not registered: %v", err)
+	}
+	if _, err := tm.M.getFdWriter(5); err != nil {
+		t.Fatalf("allocated writer not registered: %v", err)
+	}
+	tm.M.MaxFdNum = 10
+	if _, _, err := tm.M.AllocFdReaderPipe(); err == nil {
+		t.Fatalf("expected an error with every fd number in use")
+	}
+}
+
+func TestMaxFds(t *testing.T) {
+	tm := makeTestMux()
+	tm.M.MaxFds = 3
+	tm.M.UnknownFdPolicy = UnknownFdDiscard
+	if _, err := tm.M.MakeWriterPipe(0, "stdin"); err != nil {
+		t.Fatalf("error registering fd 0: %v", err)
+	}
+	if _, err := tm.M.MakeReaderPipe(1); err != nil {
+		t.Fatalf("error registering fd 1: %v", err)
+	}
+	outR, _ := makeTestPipe(t)
+	if err := tm.M.MakeRawFdReader(2, outR, true, false); err != nil {
+		t.Fatalf("error registering fd 2: %v", err)
+	}
+	// a writer for an fd that already has a reader is not a new fd
+	if err := tm.M.MakeRawFdWriter(2, nopWriteCloser{io.Discard}, false, "bidir"); err != nil {
+		t.Fatalf("error adding a writer to fd 2: %v", err)
+	}
+	if _, err := tm.M.MakeReaderPipe(3); !errors.Is(err, ErrTooManyFds) {
+		t.Fatalf("expected ErrTooManyFds registering a 4th fd, got %v", err)
+	}
+	if _, _, err := tm.M.AllocFdWriterPipe(); !errors.Is(err, ErrTooManyFds) {
+		t.Fatalf("expected ErrTooManyFds allocating a 4th fd, got %v", err)
+	}
+	tm.start(false, false, false)
+	defer tm.M.Close()
+	// a data packet for a new fd is rejected too (UnknownFdDiscard would otherwise add a writer)
+	tm.sendData(7, []byte("data"), false)
+	ack := tm.waitForPacket(t, isErrorAck, nil).(*packet.DataAckPacketType)
+	if ack.FdNum != 7 || !strings.Contains(ack.Error, ErrTooManyFds.Error()) {
+		t.Fatalf("expected a too many fds error ack for fd 7, got %s", ack.String())
+	}
+	if _, err := tm.M.getFdWriter(7); err == nil {
+		t.Fatalf("no writer should be registered for fd 7")
+	}
+}
+
+func TestAttachCmdMaxFds(t *testing.T) {
+	for _, maxFds := range []int{1, 2} {
+		m := makeTestMux().M
+		m.MaxFds = maxFds
+		cmd := exec.Command("true")
+		if err := m.AttachCmd(cmd); !errors.Is(err, ErrTooManyFds) {
+			t.Fatalf("maxfds=%d: expected ErrTooManyFds, got %v", maxFds, err)
+		}
+		if len(m.FdWriters) != 0 || len(m.FdReaders) != 0 || len(m.CloseAfterStart) != 0 {
+			t.Fatalf("maxfds=%d: fds left registered after a failed AttachCmd: %d writers, %d readers, %d child fds", maxFds, len(m.FdWriters), len(m.FdReaders), len(m.CloseAfterStart))
+		}
+		if cmd.Stdin != nil || cmd.Stdout != nil || cmd.Stderr != nil {
+			t.Fatalf("maxfds=%d: cmd should not be wired after a failed AttachCmd", maxFds)
+		}
+		// all the fds are free again
+		m.MaxFds = 3
+		if err := m.AttachCmd(cmd); err != nil {
+			t.Fatalf("maxfds=%d: error attaching after a failed attach: %v", maxFds, err)
+		}
+		for _, fd := range m.CloseAfterStart {
+			fd.Close()
+		}
+		m.Close()
+	}
+}
+
+// ReadCloser that records the buffer size of each Read (returns EOF after the first)
+type sizeRecordingReader struct {
+	Lock      *sync.Mutex
+	ReadSizes []int
+}
+
+func (r *sizeRecordingReader) Read(buf []byte) (int, error) {
+	r.Lock.Lock()
+	defer r.Lock.Unlock()
+	r.ReadSizes = append(r.ReadSizes, len(buf))
+	return 0, io.EOF
+}
+
+func (r *sizeRecordingReader) Close() error {
+	return nil
+}
+
+func TestReadSizeHint(t *testing.T) {
+	if sizer := makeReadBufSizer(1024, 16*1024, 4, 64*1024); len(sizer.Buf) != 16*1024 {
+		t.Fatalf("an adaptive buffer hint is capped at the max, got %d", len(sizer.Buf))
+	}
+	if sizer := makeReadBufSizer(1024, 16*1024, 4, 8*1024); len(sizer.Buf) != 8*1024 || sizer.Min != 1024 {
+		t.Fatalf("expected an 8k initial adaptive buffer, got %d (min %d)", len(sizer.Buf), sizer.Min)
+	}
+	tm := makeTestMux()
+	readers := make(map[int]*sizeRecordingReader)
+	hints := map[int]int{1: ReadSizeInteractive, 2: ReadSizeBulk, 3: 0}
+	for fdNum, hint := range hints {
+		readers[fdNum] = &sizeRecordingReader{Lock: &sync.Mutex{}}
+		tm.M.MakeRawFdReader(fdNum, readers[fdNum], false, false)
+		if err := tm.M.SetFdReadSizeHint(fdNum, hint); err != nil {
+			t.Fatalf("error setting read size hint: %v", err)
+		}
+	}
+	if tm.M.SetFdReadSizeHint(1, ReadBufSize+1) == nil || tm.M.SetFdReadSizeHint(1, 1) == nil {
+		t.Fatalf("expected an error for an out of range hint")
+	}
+	tm.start(true, false, false)
+	for i := 0; i < len(hints); i++ {
+		tm.waitForPacket(t, func(pk packet.PacketType) bool {
+			dataPk, ok := pk.(*packet.DataPacketType)
+			return ok && dataPk.Eof
+		}, nil)
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+	expected := map[int]int{1: ReadSizeInteractive, 2: ReadSizeBulk, 3: DefaultReadSize}
+	for fdNum, size := range expected {
+		if len(readers[fdNum].ReadSizes) == 0 || readers[fdNum].ReadSizes[0] != size {
+			t.Fatalf("fd:%d expected a %d byte read, got %v", fdNum, size, readers[fdNum].ReadSizes)
+		}
+	}
+}
+
+func TestAppendWriters(t *testing.T) {
+	path := t.TempDir() + "/append.log"
+	tm := makeTestMux()
+	const numRecords = 8 // within the writers' BufferLimit
+	const recordSize = 3 * MaxSingleWriteSize
+	letters := map[int]byte{3: 'a', 4: 'b'}
+	for fdNum := range letters {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			t.Fatalf("cannot open append file: %v", err)
+		}
+		tm.M.MakeRawFdWriter(fdNum, f, true, "append")
+		fw, _ := tm.M.getFdWriter(fdNum)
+		if !fw.AppendMode {
+			t.Fatalf("expected an O_APPEND file to be detected")
+		}
+	}
+	tm.start(false, false, false)
+	defer tm.M.Close()
+	// both writers append records larger than MaxSingleWriteSize at the same time
+	for i := 0; i < numRecords; i++ {
+		for fdNum, letter := range letters {
+			record := append(bytes.Repeat([]byte{letter}, recordSize-1), '\n')
+			tm.sendData(fdNum, record, i == numRecords-1)
+		}
+	}
+	eofFds := make(map[int]bool)
+	for len(eofFds) < 2 {
+		ack := tm.waitForPacket(t, func(pk packet.PacketType) bool {
+			ack, ok := pk.(*packet.DataAckPacketType)
+			return ok && (ack.EofAck || ack.Error != "")
+		}, nil).(*packet.DataAckPacketType)
+		if ack.Error != "" {
+			t.Fatalf("unexpected error ack %s", ack.String())
+		}
+		eofFds[ack.FdNum] = true
+	}
+	for fdNum := range letters {
+		// never split into MaxSingleWriteSize chunks (batches can hold several records)
+		fw, _ := tm.M.getFdWriter(fdNum)
+		if fw.GetNumWrites() > numRecords {
+			t.Fatalf("fd:%d expected at most one write per record, got %d writes", fdNum, fw.GetNumWrites())
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("cannot read append file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2*numRecords {
+		t.Fatalf("expected %d records, got %d", 2*numRecords, len(lines))
+	}
+	for idx, line := range lines {
+		if len(line) != recordSize-1 || strings.Trim(line, line[0:1]) != "" {
+			t.Fatalf("torn record %d (len=%d)", idx, len(line))
+		}
+	}
+	// pipes are not O_APPEND
+	_, pw := makeTestPipe(t)
+	if isAppendFile(pw) {
+		t.Fatalf("a pipe should not be an append file")
+	}
+}
+
+func TestFdTee(t *testing.T) {
+	tm := makeTestMux()
+	eventCh := make(chan *MuxEvent, 10)
+	tm.M.EventHandler = func(event *MuxEvent) {
+		if event.Type == EventTeeError {
+			eventCh <- event
+		}
+	}
+	pr1, pw1 := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, pr1, true, false)
+	pr2, pw2 := makeTestPipe(t)
+	tm.M.MakeRawFdReader(2, pr2, true, false)
+	var teeBuf bytes.Buffer
+	if err := tm.M.SetFdTee(1, &teeBuf); err != nil {
+		t.Fatalf("error setting tee: %v", err)
+	}
+	teeW := &failingWriter{Lock: &sync.Mutex{}, FailAfter: 0}
+	tm.M.SetFdTee(2, teeW)
+	tm.start(true, false, false)
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(pw1, "line %d\n", i)
+		fmt.Fprintf(pw2, "line %d\n", i)
+	}
+	pw1.Close()
+	pw2.Close()
+	outputs := make(map[int][]byte)
+	numEof := 0
+	for numEof < 2 {
+		pk := tm.waitForPacket(t, func(pk packet.PacketType) bool {
+			_, ok := pk.(*packet.DataPacketType)
+			return ok
+		}, nil).(*packet.DataPacketType)
+		data, _ := base64.StdEncoding.DecodeString(pk.Data64)
+		outputs[pk.FdNum] = append(outputs[pk.FdNum], data...)
+		tm.sendAck(pk.FdNum, len(data))
+		if pk.Eof {
+			numEof++
+		}
+	}
+	if len(outputs[1]) == 0 || !bytes.Equal(teeBuf.Bytes(), outputs[1]) {
+		t.Fatalf("tee does not match the sent data:\n%q\n%q", teeBuf.Bytes(), outputs[1])
+	}
+	// the failing tee is dropped after one error, the fd still streams everything
+	if !bytes.Equal(outputs[2], outputs[1]) {
+		t.Fatalf("fd:2 output incomplete after the tee failed: %q", outputs[2])
+	}
+	if len(eventCh) != 1 || teeW.NumWrites != 1 {
+		t.Fatalf("expected one tee error event, got %d (%d writes)", len(eventCh), teeW.NumWrites)
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+func TestCloseReadersAfterAcks(t *testing.T) {
+	tm := makeTestMux()
+	pr, pw := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, pr, true, false)
+	tm.start(true, false, false)
+	pw.Write([]byte("hello"))
+	tm.readData(t, 1, 5)
+	doneCh := make(chan error, 1)
+	go func() {
+		doneCh <- tm.M.CloseReadersAfterAcks(context.Background())
+	}()
+	fr, _ := tm.M.getFdReader(1)
+	waitForCond(t, "reader paused", func() bool {
+		fr.CVar.L.Lock()
+		defer fr.CVar.L.Unlock()
+		return fr.Paused
+	})
+	// no new data is sent, and the close waits for the outstanding ack
+	pw.Write([]byte("more"))
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case err := <-doneCh:
+		t.Fatalf("close completed before the ack arrived (err=%v)", err)
+	default:
+	}
+	if fr.isClosed() {
+		t.Fatalf("reader closed before the ack arrived")
+	}
+	tm.sendAck(1, 5)
+	select {
+	case err := <-doneCh:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("close did not complete after the ack")
+	}
+	var skipped []packet.PacketType
+	eofPk := tm.waitForPacket(t, isEofDataPacket(1), &skipped).(*packet.DataPacketType)
+	if packet.B64DecodedLen(eofPk.Data64) != 0 || len(dataPacketStrs(skipped)) != 0 {
+		t.Fatalf("no data should be sent after the close started, got %v", dataPacketStrs(skipped))
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+	// withheld acks, the context expires and the readers are closed anyway
+	tm = makeTestMux()
+	pr, pw = makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, pr, true, false)
+	tm.start(false, false, false)
+	defer tm.M.Close()
+	pw.Write([]byte("unacked"))
+	tm.readData(t, 1, 7)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancelFn()
+	if err := tm.M.CloseReadersAfterAcks(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+	fr, _ = tm.M.getFdReader(1)
+	if !fr.isClosed() {
+		t.Fatalf("reader should be closed after the deadline")
+	}
+}
+
+func gzipData(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func (tm *testMux) sendCompressedData(t *testing.T, fdNum int, data []byte) {
+	pk := packet.MakeDataPacket()
+	pk.CK = tm.M.CK
+	pk.FdNum = fdNum
+	pk.Compression = CompressionGzip
+	pk.Data64 = base64.StdEncoding.EncodeToString(gzipData(t, data))
+	tm.InputCh <- pk
+}
+
+func TestDecompressLimit(t *testing.T) {
+	tm := makeTestMux()
+	tm.M.LocalCaps.Compression = []string{CompressionGzip}
+	gw := makeGatedWriter()
+	gw.Release()
+	tm.M.MakeRawFdWriter(0, gw, true, "test")
+	tm.start(false, false, false)
+	defer tm.M.Close()
+	tm.sendCompressedData(t, 0, []byte("hello compressed"))
+	waitForCond(t, "decompressed data", func() bool {
+		data, _ := gw.getData()
+		return string(data) == "hello compressed"
+	})
+	// 64MB of zeros compresses to ~64KB, it is rejected without being expanded
+	bomb := gzipData(t, make([]byte, 64*1024*1024))
+	dataPk := packet.MakeDataPacket()
+	dataPk.FdNum = 0
+	dataPk.Compression = CompressionGzip
+	var memStart, memEnd runtime.MemStats
+	runtime.ReadMemStats(&memStart)
+	_, err := tm.M.decompressPacketData(dataPk, bomb)
+	runtime.ReadMemStats(&memEnd)
+	if !errors.Is(err, ErrDecompressLimit) {
+		t.Fatalf("expected a decompress limit error, got %v", err)
+	}
+	if allocated := memEnd.TotalAlloc - memStart.TotalAlloc; allocated > 16*1024*1024 {
+		t.Fatalf("decompression allocated %d bytes before being rejected", allocated)
+	}
+	dataPk.CK = tm.M.CK
+	dataPk.Data64 = base64.StdEncoding.EncodeToString(bomb)
+	tm.InputCh <- dataPk
+	ack := tm.waitForPacket(t, isErrorAck, nil).(*packet.DataAckPacketType)
+	if !strings.Contains(ack.Error, ErrDecompressLimit.Error()) {
+		t.Fatalf("unexpected error ack: %q", ack.Error)
+	}
+	if data, _ := gw.getData(); string(data) != "hello compressed" {
+		t.Fatalf("no data should be written for the rejected packet, got %d bytes", len(data))
+	}
+	// schemes that were not advertised are rejected
+	tm.M.LocalCaps.Compression = nil
+	if _, err := tm.M.decompressPacketData(dataPk, gzipData(t, []byte("x"))); err == nil {
+		t.Fatalf("expected an error for an unsupported scheme")
+	}
+}
+
+func TestFdEncoding(t *testing.T) {
+	binaryData := []byte{0x00, 0xff, 0xfe, 'a', 0x80, '\n', 0x1b}
+	textData := []byte("hello \"world\"\n")
+	for _, enc := range []string{packet.EncodingBase64, packet.EncodingHex, packet.EncodingRaw} {
+		tm := makeTestMux()
+		pr, pw := makeTestPipe(t)
+		tm.M.MakeRawFdReader(1, pr, true, false)
+		if err := tm.M.SetFdEncoding(1, enc); err != nil {
+			t.Fatalf("SetFdEncoding(%s): %v", enc, err)
+		}
+		gw := makeGatedWriter()
+		gw.Release()
+		tm.M.MakeRawFdWriter(0, gw, true, "test")
+		tm.start(false, false, false)
+		for _, data := range [][]byte{textData, binaryData} {
+			pw.Write(data)
+			pk := tm.waitForPacket(t, isDataPacket(1), nil).(*packet.DataPacketType)
+			wantEnc := enc
+			if enc == packet.EncodingBase64 || (enc == packet.EncodingRaw && !utf8.Valid(data)) {
+				wantEnc = ""
+			}
+			if pk.Encoding != wantEnc {
+				t.Fatalf("%s: expected packet encoding %q, got %q", enc, wantEnc, pk.Encoding)
+			}
+			// through json (the wire) and into a writer
+			pkJson, err := json.Marshal(pk)
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			var wirePk packet.DataPacketType
+			if err := json.Unmarshal(pkJson, &wirePk); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			if wirePk.DataLen() != len(data) {
+				t.Fatalf("%s: expected data len %d, got %d", enc, len(data), wirePk.DataLen())
+			}
+			tm.sendAck(1, len(data))
+			wirePk.FdNum = 0
+			tm.InputCh <- &wirePk
+		}
+		want := string(textData) + string(binaryData)
+		waitForCond(t, "encoded data", func() bool {
+			data, _ := gw.getData()
+			return string(data) == want
+		})
+		tm.M.Close()
+	}
+	tm := makeTestMux()
+	pr, _ := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, pr, true, false)
+	if err := tm.M.SetFdEncoding(1, "rot13"); err == nil {
+		t.Fatalf("expected an error for an unknown encoding")
+	}
+	badPk := packet.MakeDataPacket()
+	badPk.Encoding = packet.EncodingHex
+	badPk.Data64 = "zz"
+	if _, err := badPk.GetData(); err == nil {
+		t.Fatalf("expected a decode error for bad hex data")
+	}
+}
+
+func TestWriterFlush(t *testing.T) {
+	tm := makeTestMux()
+	gw := makeGatedWriter()
+	tm.M.MakeRawFdWriter(0, gw, true, "test")
+	pr, pw := makeTestPipe(t)
+	tm.M.MakeRawFdWriter(3, pw, true, "pipe")
+	tm.start(false, false, false)
+	defer tm.M.Close()
+	fw, _ := tm.M.getFdWriter(0)
+	fw.AddData([]byte("command\n"), false)
+	flushCh := make(chan error, 1)
+	go func() {
+		flushCh <- fw.Flush(context.Background())
+	}()
+	select {
+	case err := <-flushCh:
+		t.Fatalf("flush returned before the data was written (err=%v)", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	gw.Release()
+	select {
+	case err := <-flushCh:
+		if err != nil {
+			t.Fatalf("unexpected flush error: %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("flush did not return")
+	}
+	if data, isClosed := gw.getData(); string(data) != "command\n" || isClosed {
+		t.Fatalf("expected the data to be written (and the writer open), got %q closed=%v", data, isClosed)
+	}
+	// all flushed bytes can be read from the pipe without waiting
+	pipeW, _ := tm.M.getFdWriter(3)
+	payload := bytes.Repeat([]byte("x"), 3*MaxSingleWriteSize)
+	readCh := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, len(payload))
+		n, _ := io.ReadFull(pr, buf)
+		readCh <- buf[:n]
+	}()
+	pipeW.AddData(payload, false)
+	if err := pipeW.Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected flush error: %v", err)
+	}
+	if written := numWritten(pipeW); written != int64(len(payload)) {
+		t.Fatalf("expected %d bytes written at flush, got %d", len(payload), written)
+	}
+	if data := <-readCh; len(data) != len(payload) {
+		t.Fatalf("expected %d bytes at the reader, got %d", len(payload), len(data))
+	}
+	// a writer that cannot make progress, and one that is closed
+	stuck := makeGatedWriter()
+	tm.M.MakeRawFdWriter(4, stuck, true, "stuck")
+	stuckW, _ := tm.M.getFdWriter(4)
+	stuckW.AddData([]byte("blocked"), false)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancelFn()
+	if err := stuckW.Flush(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+	stuckW.Close()
+	stuck.Release()
+	if err := stuckW.Flush(context.Background()); !errors.Is(err, ErrFdClosed) {
+		t.Fatalf("expected a closed error, got %v", err)
+	}
+}
+
+func numWritten(w *FdWriter) int64 {
+	w.CVar.L.Lock()
+	defer w.CVar.L.Unlock()
+	return w.NumWritten
+}
+
+func TestPtyEofDone(t *testing.T) {
+	tm := makeTestMux()
+	cmd := exec.Command("sh", "-c", "echo pty-output; exit 3")
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		t.Skipf("cannot start pty cmd: %v", err)
+	}
+	tm.M.SetPtyFd(1, ptmx)
+	tm.M.MakeRawFdReader(1, ptmx, true, true)
+	tm.M.SetCmdProc(cmd.Process)
+	tm.M.PtyEofDone = true
+	tm.M.ReapCmdProc = true
+	// no done packet is ever sent, the pty EOF must end the session (and the input loop)
+	tm.start(true, false, true)
+	var output []byte
+	var donePk *packet.CmdDonePacketType
+	sawEof := false
+	timer := time.NewTimer(testTimeout)
+	defer timer.Stop()
+	// the sender goroutine can still be forwarding the data packets after the done packet, so read
+	// until the fd 1 EOF data packet too
+	for donePk == nil || !sawEof {
+		select {
+		case pk := <-tm.OutputCh:
+			if dataPk, ok := pk.(*packet.DataPacketType); ok && dataPk.FdNum == 1 {
+				data, _ := dataPk.GetData()
+				output = append(output, data...)
+				sawEof = sawEof || dataPk.Eof
+			}
+		case donePk = <-tm.DoneCh:
+			if donePk == nil {
+				t.Fatalf("expected a done packet")
+			}
+		case <-timer.C:
+			cmd.Process.Kill()
+			t.Fatalf("session did not end on pty eof (done:%v eof:%v)", donePk != nil, sawEof)
+		}
+	}
+	if donePk.ExitCode != 3 {
+		t.Fatalf("expected the reaped exit code 3, got %#v", donePk)
+	}
+	if !strings.Contains(string(output), "pty-output") {
+		t.Fatalf("expected the pty output before the session end, got %q", output)
+	}
+}
+
+func TestScheduleInput(t *testing.T) {
+	tm := makeTestMux()
+	clock := makeFakeClock()
+	tm.M.Clock = clock
+	gw := makeGatedWriter()
+	gw.Release()
+	tm.M.MakeRawFdWriter(0, gw, true, "stdin")
+	tm.M.ScheduleInput([]ScheduledInput{
+		{FdNum: 0, Delay: 100 * time.Millisecond, Data: []byte("yes\n")},
+		{FdNum: 0, Delay: 50 * time.Millisecond, Data: []byte("quit\n")},
+	})
+	tm.start(false, false, false)
+	defer tm.M.Close()
+	expectData := func(want string) {
+		t.Helper()
+		waitForCond(t, fmt.Sprintf("input %q", want), func() bool {
+			data, _ := gw.getData()
+			return string(data) == want
+		})
+	}
+	waitForCond(t, "first delay", func() bool { return clock.numActiveTimers() == 1 })
+	clock.Advance(99 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	if data, _ := gw.getData(); len(data) != 0 {
+		t.Fatalf("input delivered early: %q", data)
+	}
+	clock.Advance(time.Millisecond)
+	expectData("yes\n")
+	waitForCond(t, "second delay", func() bool { return clock.numActiveTimers() == 1 })
+	clock.Advance(49 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	if data, _ := gw.getData(); string(data) != "yes\n" {
+		t.Fatalf("second input delivered early: %q", data)
+	}
+	clock.Advance(time.Millisecond)
+	expectData("yes\nquit\n")
+	// an input for an fd without a writer is reported
+	eventCh := make(chan *MuxEvent, 10)
+	tm2 := makeTestMux()
+	tm2.M.EventHandler = func(event *MuxEvent) { eventCh <- event }
+	tm2.start(false, false, false)
+	defer tm2.M.Close()
+	tm2.M.ScheduleInput([]ScheduledInput{{FdNum: 5, Data: []byte("lost")}})
+	select {
+	case event := <-eventCh:
+		if event.Type != EventScheduledInputError || !errors.Is(event.Error, ErrNoSuchFd) {
+			t.Fatalf("unexpected event %s", event.String())
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("no event for the failed input")
+	}
+}
+
+func TestMaxWirePacketSize(t *testing.T) {
+	payload := make([]byte, 4000)
+	for i := range payload {
+		payload[i] = byte(i % 32) // control characters, the worst case for raw (json escapes)
+	}
+	for _, enc := range []string{"", packet.EncodingHex, packet.EncodingRaw} {
+		tm := makeTestMux()
+		tm.M.MaxWirePacketSize = 300
+		pr, pw := makeTestPipe(t)
+		tm.M.MakeRawFdReader(1, pr, true, false)
+		tm.M.SetFdEncoding(1, enc)
+		tm.start(false, false, false)
+		pw.Write(payload)
+		var received []byte
+		numPackets := 0
+		for len(received) < len(payload) {
+			pk := tm.waitForPacket(t, isDataPacket(1), nil).(*packet.DataPacketType)
+			wireBytes, err := packet.MarshalPacket(pk)
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			if len(wireBytes) > tm.M.MaxWirePacketSize {
+				t.Fatalf("enc=%q: packet is %d bytes on the wire (max %d)", enc, len(wireBytes), tm.M.MaxWirePacketSize)
+			}
+			data, _ := pk.GetData()
+			received = append(received, data...)
+			numPackets++
+			tm.sendAck(1, len(data))
+		}
+		if !bytes.Equal(received, payload) {
+			t.Fatalf("enc=%q: data mismatch", enc)
+		}
+		if numPackets < len(payload)/300 {
+			t.Fatalf("enc=%q: expected the data to be split, got %d packets", enc, numPackets)
+		}
+		tm.M.Close()
+	}
+}
+
+func TestSignalExitedProc(t *testing.T) {
+	tm := makeTestMux()
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		t.Skipf("cannot open pty: %v", err)
+	}
+	defer ptmx.Close()
+	defer tty.Close()
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("cannot run cmd: %v", err)
+	}
+	tm.M.SetPtyFd(1, ptmx)
+	tm.M.SetCmdProc(cmd.Process)
+	eventCh := make(chan *MuxEvent, 10)
+	tm.M.EventHandler = func(event *MuxEvent) { eventCh <- event }
+	tm.start(false, false, true)
+	tm.sendResize(nil, 30, 100)
+	select {
+	case event := <-eventCh:
+		if event.Type != EventSignalError || !errors.Is(event.Error, os.ErrProcessDone) {
+			t.Fatalf("unexpected event %s", event.String())
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("no event for the failed signal")
+	}
+	var skipped []packet.PacketType
+	msgPk := tm.waitForPacket(t, func(pk packet.PacketType) bool {
+		_, ok := pk.(*packet.MessagePacketType)
+		return ok
+	}, &skipped).(*packet.MessagePacketType)
+	if !strings.Contains(msgPk.Message, "cannot signal cmd") {
+		t.Fatalf("unexpected message %q", msgPk.Message)
+	}
+	// the process is gone, the session ends without a done packet from the client
+	select {
+	case donePk := <-tm.DoneCh:
+		if donePk == nil {
+			t.Fatalf("expected a done packet")
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("session did not end after signaling an exited process")
+	}
+}
+
+func TestRetargetFdWriter(t *testing.T) {
+	tm := makeTestMux()
+	firstW := makeGatedWriter()
+	firstW.Release()
+	tm.M.MakeRawFdWriter(0, firstW, true, "stdin")
+	tm.start(false, false, false)
+	defer tm.M.Close()
+	tm.sendData(0, []byte("to-first;"), false)
+	waitForCond(t, "first data", func() bool {
+		data, _ := firstW.getData()
+		return string(data) == "to-first;"
+	})
+	// data queued (not yet written) when the target changes follows the new target
+	fw, _ := tm.M.getFdWriter(0)
+	fw.SetPaused(true)
+	tm.sendData(0, []byte("queued;"), false)
+	waitForCond(t, "queued data", func() bool { return string(fw.getBuffer()) == "queued;" })
+	secondW := makeGatedWriter()
+	secondW.Release()
+	oldFd, err := tm.M.RetargetFdWriter(0, secondW, true)
+	if err != nil {
+		t.Fatalf("retarget: %v", err)
+	}
+	if oldFd != firstW {
+		t.Fatalf("expected the old fd to be returned")
+	}
+	fw.SetPaused(false)
+	tm.sendData(0, []byte("to-second"), true)
+	tm.waitForPacket(t, isEofAck(0), nil)
+	if data, isClosed := firstW.getData(); string(data) != "to-first;" || isClosed {
+		t.Fatalf("old target should keep only its data (and stay open), got %q closed=%v", data, isClosed)
+	}
+	if data, isClosed := secondW.getData(); string(data) != "queued;to-second" || !isClosed {
+		t.Fatalf("new target should get the rest, got %q closed=%v", data, isClosed)
+	}
+	if _, err := tm.M.RetargetFdWriter(0, firstW, true); !errors.Is(err, ErrNoSuchFd) && !errors.Is(err, ErrFdClosed) {
+		t.Fatalf("expected an error retargeting a closed writer, got %v", err)
+	}
+}
+
+func TestDecodeErrorReport(t *testing.T) {
+	tm := makeTestMux()
+	gw := makeGatedWriter()
+	gw.Release()
+	tm.M.MakeRawFdWriter(0, gw, true, "test")
+	eventCh := make(chan *MuxEvent, 10)
+	tm.M.EventHandler = func(event *MuxEvent) {
+		if event.Type == EventDecodeError {
+			eventCh <- event
+		}
+	}
+	tm.start(false, false, false)
+	defer tm.M.Close()
+	pk := packet.MakeDataPacket()
+	pk.CK = tm.M.CK
+	pk.FdNum = 0
+	pk.Data64 = "aGVsbG8=" + "!!not-base64!!" + strings.Repeat("A", 200)
+	tm.InputCh <- pk
+	var decodeErr *DecodeError
+	select {
+	case event := <-eventCh:
+		if !errors.As(event.Error, &decodeErr) || event.FdNum != 0 {
+			t.Fatalf("expected a DecodeError for fd:0, got %s", event.String())
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("no decode error event")
+	}
+	if decodeErr.Pos != 8 || decodeErr.DataLen != len(pk.Data64) {
+		t.Fatalf("unexpected decode error position %d (len %d)", decodeErr.Pos, decodeErr.DataLen)
+	}
+	if !strings.HasPrefix(decodeErr.Snippet, "!!not-base64!!") || len(decodeErr.Snippet) != MaxDecodeSnippetSize {
+		t.Fatalf("unexpected snippet %q", decodeErr.Snippet)
+	}
+	ack := tm.waitForPacket(t, isErrorAck, nil).(*packet.DataAckPacketType)
+	if ack.FdNum != 0 || !strings.Contains(ack.Error, "decoding base64 data (fd:0) at pos 8") {
+		t.Fatalf("unexpected error ack %s", packet.AsString(ack))
+	}
+	if data, _ := gw.getData(); len(data) != 0 {
+		t.Fatalf("nothing should be written, got %q", data)
+	}
+}
+
+func TestEmptyDataPackets(t *testing.T) {
+	tm := makeTestMux()
+	gw := makeGatedWriter()
+	gw.Release()
+	tm.M.MakeRawFdWriter(0, gw, true, "stdin")
+	tm.start(false, false, false)
+	defer tm.M.Close()
+	for i := 0; i < 5; i++ {
+		tm.sendData(0, nil, false)
+	}
+	tm.sendData(7, nil, false) // unknown fd, no placeholder and no error ack
+	tm.sendData(0, []byte("real"), false)
+	var skipped []packet.PacketType
+	ack := tm.waitForPacket(t, func(pk packet.PacketType) bool {
+		ack, ok := pk.(*packet.DataAckPacketType)
+		return ok && ack.FdNum == 0 && ack.AckLen > 0
+	}, &skipped).(*packet.DataAckPacketType)
+	if ack.AckLen != 4 || len(skipped) != 0 {
+		t.Fatalf("expected only the ack for the real data, got %s (skipped %d)", packet.AsString(ack), len(skipped))
+	}
+	fw, _ := tm.M.getFdWriter(0)
+	if data, _ := gw.getData(); string(data) != "real" || fw.GetNumWrites() != 1 {
+		t.Fatalf("expected a single write of the real data, got %q in %d writes", data, fw.GetNumWrites())
+	}
+	if _, err := tm.M.getFdWriter(7); err == nil {
+		t.Fatalf("an empty packet should not create a writer for an unknown fd")
+	}
+	// optionally acked
+	tm2 := makeTestMux()
+	tm2.M.AckEmptyDataPackets = true
+	tm2.start(false, false, false)
+	defer tm2.M.Close()
+	tm2.sendData(3, nil, false)
+	ack = tm2.waitForPacket(t, func(pk packet.PacketType) bool {
+		_, ok := pk.(*packet.DataAckPacketType)
+		return ok
+	}, nil).(*packet.DataAckPacketType)
+	if ack.FdNum != 3 || ack.AckLen != 0 || ack.Error != "" {
+		t.Fatalf("expected an empty ack for fd:3, got %s", packet.AsString(ack))
+	}
+}
+
+func TestInputClosedPolicy(t *testing.T) {
+	runClosed := func(policy string, onClosed func(error) *packet.CmdDonePacketType) *packet.CmdDonePacketType {
+		t.Helper()
+		tm := makeTestMux()
+		tm.M.InputClosedPolicy = policy
+		tm.M.OnInputClosed = onClosed
+		tm.start(false, false, true)
+		tm.sendData(0, nil, false)
+		close(tm.InputCh)
+		select {
+		case donePk := <-tm.DoneCh:
+			return donePk
+		case <-time.After(testTimeout):
+			t.Fatalf("policy %q: session did not end after the input closed", policy)
+			return nil
+		}
+	}
+	if donePk := runClosed("", nil); donePk != nil {
+		t.Fatalf("default policy: expected no done packet, got %#v", donePk)
+	}
+	if donePk := runClosed(InputClosedNil, nil); donePk != nil {
+		t.Fatalf("nil policy: expected no done packet, got %#v", donePk)
+	}
+	donePk := runClosed(InputClosedTransportError, nil)
+	if donePk == nil || donePk.ExitCode != TransportErrorExitCode || !strings.Contains(donePk.Error, "input closed") {
+		t.Fatalf("transporterror policy: unexpected done packet %#v", donePk)
+	}
+	numCalls := 0
+	donePk = runClosed(InputClosedCallback, func(err error) *packet.CmdDonePacketType {
+		numCalls++
+		if err != nil {
+			t.Errorf("unexpected parser error: %v", err)
+		}
+		pk := packet.MakeCmdDonePacket(base.MakeCommandKey("testsession", "testcmd"))
+		pk.ExitCode = 77
+		return pk
+	})
+	if donePk == nil || donePk.ExitCode != 77 || numCalls != 1 {
+		t.Fatalf("callback policy: unexpected done packet %#v (calls=%d)", donePk, numCalls)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	runActive := func(desc string, r *os.File, w *os.File, isPty bool) {
+		t.Helper()
+		tm := makeTestMux()
+		clock := makeFakeClock()
+		tm.M.Clock = clock
+		tm.M.MakeRawFdReader(1, r, true, isPty)
+		tm.M.SetFdReadDeadline(1, 5*time.Minute)
+		tm.start(false, false, false)
+		defer tm.M.Close()
+		stopCh := make(chan bool)
+		defer close(stopCh)
+		go func() {
+			for {
+				select {
+				case <-stopCh:
+					return
+				case <-time.After(time.Millisecond):
+				}
+				if _, err := w.Write([]byte("chunk\n")); err != nil {
+					return
+				}
+			}
+		}()
+		waitForCond(t, desc+" deadline timer", func() bool { return clock.numActiveTimers() == 1 })
+		// returns the packet that ends the reader, nil for a data packet (which is acked)
+		readAndAck := func() *packet.DataPacketType {
+			t.Helper()
+			pk := tm.waitForPacket(t, isDataPacket(1), nil).(*packet.DataPacketType)
+			if pk.Error != "" || pk.Eof {
+				return pk
+			}
+			tm.sendAck(1, pk.DataLen())
+			return nil
+		}
+		for i := 0; i < 3; i++ {
+			if pk := readAndAck(); pk != nil {
+				t.Fatalf("%s: reader ended before the deadline: %s", desc, pk.String())
+			}
+		}
+		clock.Advance(5*time.Minute - time.Second)
+		if pk := readAndAck(); pk != nil {
+			t.Fatalf("%s: reader ended before the deadline: %s", desc, pk.String())
+		}
+		clock.Advance(time.Second)
+		var errPk *packet.DataPacketType
+		for errPk == nil {
+			errPk = readAndAck()
+		}
+		if !strings.Contains(errPk.Error, ErrReadDeadline.Error()) {
+			t.Fatalf("%s: expected a deadline error, got %s", desc, errPk.String())
+		}
+		fr, _ := tm.M.getFdReader(1)
+		waitForCond(t, desc+" reader closed", fr.isClosed)
+		if reason := fr.getCloseReason(); reason != CloseReasonDeadline {
+			t.Fatalf("%s: expected close reason %q, got %q", desc, CloseReasonDeadline, reason)
+		}
+	}
+	pr, pw := makeTestPipe(t)
+	runActive("pipe", pr, pw, false)
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		t.Skipf("cannot open pty: %v", err)
+	}
+	defer tty.Close()
+	runActive("pty", ptmx, tty, true)
+}
+
+func TestEofSentinel(t *testing.T) {
+	sentinel := []byte("\x04END\x04")
+	runSentinel := func(desc string, chunks []string, want string) {
+		t.Helper()
+		tm := makeTestMux()
+		gw := makeGatedWriter()
+		gw.Release()
+		tm.M.MakeRawFdWriter(0, gw, true, "stdin")
+		if err := tm.M.SetFdEofSentinel(0, sentinel); err != nil {
+			t.Fatalf("SetFdEofSentinel: %v", err)
+		}
+		tm.start(false, false, false)
+		defer tm.M.Close()
+		for _, chunk := range chunks {
+			tm.sendData(0, []byte(chunk), false)
+		}
+		tm.waitForPacket(t, isEofAck(0), nil)
+		if data, isClosed := gw.getData(); string(data) != want || !isClosed {
+			t.Fatalf("%s: expected %q (and closed), got %q closed=%v", desc, want, data, isClosed)
+		}
+	}
+	runSentinel("single packet", []string{"hello\x04END\x04dropped"}, "hello")
+	runSentinel("split", []string{"hello\x04EN", "D\x04dropped"}, "hello")
+	runSentinel("split three ways", []string{"abc\x04", "E", "ND\x04"}, "abc")
+	runSentinel("false partial match", []string{"one\x04E", "Xtwo\x04", "\x04END\x04"}, "one\x04EXtwo\x04")
+	// a held partial match is written when the Eof flag arrives
+	tm := makeTestMux()
+	gw := makeGatedWriter()
+	gw.Release()
+	tm.M.MakeRawFdWriter(0, gw, true, "stdin")
+	tm.M.SetFdEofSentinel(0, sentinel)
+	tm.start(false, false, false)
+	defer tm.M.Close()
+	tm.sendData(0, []byte("tail\x04EN"), false)
+	tm.sendData(0, nil, true)
+	tm.waitForPacket(t, isEofAck(0), nil)
+	if data, _ := gw.getData(); string(data) != "tail\x04EN" {
+		t.Fatalf("expected the held bytes to be written at eof, got %q", data)
+	}
+}
+
+func TestBulkModeReader(t *testing.T) {
+	tm := makeTestMux()
+	pr, pw := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, pr, true, false)
+	tm.M.SetFdAckChunk(1, 4096)
+	if err := tm.M.SetFdBulkMode(1, true); err != nil {
+		t.Fatalf("SetFdBulkMode: %v", err)
+	}
+	tm.start(false, false, true)
+	expected := make([]byte, 256*1024)
+	for i := range expected {
+		expected[i] = byte(i % 251)
+	}
+	go func() {
+		pw.Write(expected)
+		pw.Close()
+	}()
+	// no acks are sent, all of the data still has to arrive
+	var received []byte
+	for {
+		pk := tm.waitForPacket(t, isDataPacket(1), nil).(*packet.DataPacketType)
+		data, _ := base64.StdEncoding.DecodeString(pk.Data64)
+		if len(data) > 4096 {
+			t.Fatalf("bulk packet larger than the window: %d bytes", len(data))
+		}
+		received = append(received, data...)
+		if pk.Eof {
+			break
+		}
+	}
+	if !bytes.Equal(received, expected) {
+		t.Fatalf("data mismatch in bulk mode (received %d bytes, expected %d)", len(received), len(expected))
+	}
+	if unacked := tm.M.UnackedBytes(1); unacked != len(expected) {
+		t.Fatalf("expected %d unacked bytes, got %d", len(expected), unacked)
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+}
+
+func TestBulkAcks(t *testing.T) {
+	tm := makeTestMux()
+	clock := makeFakeClock()
+	tm.M.Clock = clock
+	gw := makeGatedWriter()
+	tm.M.MakeRawFdWriter(0, gw, true, "stdin")
+	if err := tm.M.SetFdBulkAcks(0, time.Second); err != nil {
+		t.Fatalf("SetFdBulkAcks: %v", err)
+	}
+	tm.start(false, false, false)
+	defer tm.M.Close()
+	// past the BufferLimit while the writer is blocked
+	chunk := make([]byte, 64*1024)
+	const numChunks = 4
+	for i := 0; i < numChunks; i++ {
+		tm.sendData(0, chunk, false)
+	}
+	fw, _ := tm.M.getFdWriter(0)
+	waitForCond(t, "buffered data", func() bool {
+		fw.CVar.L.Lock()
+		defer fw.CVar.L.Unlock()
+		return int(fw.NumAdded) == numChunks*len(chunk)
+	})
+	gw.Release()
+	waitForCond(t, "written data", func() bool {
+		data, _ := gw.getData()
+		return len(data) == numChunks*len(chunk)
+	})
+	select {
+	case pk := <-tm.OutputCh:
+		t.Fatalf("expected no packets before the bulk ack interval, got %s", packet.AsString(pk))
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	ack := tm.waitForPacket(t, func(pk packet.PacketType) bool {
+		_, ok := pk.(*packet.DataAckPacketType)
+		return ok
+	}, nil).(*packet.DataAckPacketType)
+	if ack.FdNum != 0 || ack.AckLen != numChunks*len(chunk) || ack.Error != "" {
+		t.Fatalf("expected one cumulative ack, got %s", packet.AsString(ack))
+	}
+	tm.sendData(0, []byte("tail"), true)
+	ack = tm.waitForPacket(t, func(pk packet.PacketType) bool {
+		_, ok := pk.(*packet.DataAckPacketType)
+		return ok
+	}, nil).(*packet.DataAckPacketType)
+	if ack.AckLen != 4 || ack.EofAck {
+		t.Fatalf("expected the pending progress before the eof ack, got %s", packet.AsString(ack))
+	}
+	tm.waitForPacket(t, isEofAck(0), nil)
+}
+
+func TestBulkAcksBufferCap(t *testing.T) {
+	tm := makeTestMux()
+	tm.M.MakeRawFdWriter(0, makeGatedWriter(), true, "stdin")
+	fw, _ := tm.M.getFdWriter(0)
+	if err := tm.M.SetFdBulkAcks(0, time.Second); err != nil {
+		t.Fatalf("SetFdBulkAcks: %v", err)
+	}
+	chunk := make([]byte, fw.BufferLimit)
+	for i := 0; i < BulkBufferFactor; i++ {
+		if err := fw.AddData(chunk, false); err != nil {
+			t.Fatalf("data within the bulk cap rejected: %v", err)
+		}
+	}
+	// compressed data is budgeted against the same cap
+	if budget := tm.M.inboundDataBudget(0); budget != 0 {
+		t.Fatalf("expected no inbound budget at the cap, got %d", budget)
+	}
+	if err := fw.AddData([]byte("x"), false); !errors.Is(err, ErrBufferLimit) {
+		t.Fatalf("expected ErrBufferLimit past the bulk cap, got %v", err)
+	}
+	tm.M.MakeRawFdWriter(2, makeGatedWriter(), true, "other")
+	fw2, _ := tm.M.getFdWriter(2)
+	tm.M.SetFdBulkAcks(2, time.Second)
+	fw2.AddData(chunk, false)
+	if budget := tm.M.inboundDataBudget(2); budget != (BulkBufferFactor-1)*fw2.BufferLimit {
+		t.Fatalf("expected the inbound budget past the BufferLimit, got %d", budget)
+	}
+}
+
+func TestMmapWriterPipe(t *testing.T) {
+	const size = 32 * 1024 * 1024
+	f, err := os.CreateTemp(t.TempDir(), "mmap")
+	if err != nil {
+		t.Fatalf("error creating temp file: %v", err)
+	}
+	block := make([]byte, 251*1024)
+	for i := range block {
+		block[i] = byte(i % 251)
+	}
+	for written := 0; written < size; written += len(block) {
+		f.Write(block[0:min(len(block), size-written)])
+	}
+	f.Seek(0, io.SeekStart)
+	tm := makeTestMux()
+	childIn, err := tm.M.MakeMmapWriterPipe(0, f)
+	if err != nil {
+		t.Fatalf("error making mmap writer pipe: %v", err)
+	}
+	childIn = dupChildFile(t, childIn)
+	// the acks go nowhere
+	stopCh := make(chan bool)
+	defer close(stopCh)
+	go func() {
+		for {
+			select {
+			case <-tm.OutputCh:
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	var memStart, memEnd runtime.MemStats
+	runtime.ReadMemStats(&memStart)
+	readDoneCh := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 64*1024)
+		pos := 0
+		for {
+			nr, err := childIn.Read(buf)
+			for i := 0; i < nr; i++ {
+				if buf[i] != byte((pos+i)%251) {
+					readDoneCh <- fmt.Errorf("data mismatch at %d", pos+i)
+					return
+				}
+			}
+			pos += nr
+			if err != nil {
+				if pos != size {
+					err = fmt.Errorf("expected %d bytes, got %d (%v)", size, pos, err)
+				} else {
+					err = nil
+				}
+				readDoneCh <- err
+				return
+			}
+		}
+	}()
+	tm.start(false, true, false)
+	select {
+	case err = <-readDoneCh:
+	case <-time.After(testTimeout):
+		t.Fatalf("timeout reading the mmapped file")
+	}
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	<-tm.DoneCh
+	runtime.ReadMemStats(&memEnd)
+	if allocated := memEnd.TotalAlloc - memStart.TotalAlloc; allocated > size/4 {
+		t.Fatalf("mmap writer allocated %d bytes for a %d byte file", allocated, size)
+	}
+}
+
+func TestSlowConsumer(t *testing.T) {
+	tm := makeTestMux()
+	clock := makeFakeClock()
+	tm.M.Clock = clock
+	tm.M.SlowConsumerThreshold = 10 * time.Second
+	eventCh := make(chan *MuxEvent, 10)
+	tm.M.EventHandler = func(event *MuxEvent) {
+		if event.Type == EventSlowConsumer {
+			eventCh <- event
+		}
+	}
+	pr, pw := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, pr, true, false)
+	tm.M.SetFdAckChunk(1, 1000)
+	tm.start(false, false, true)
+	defer tm.M.Close()
+	pw.Write(make([]byte, 3000))
+	tm.readData(t, 1, 1000)
+	fr, _ := tm.M.getFdReader(1)
+	waitForCond(t, "ack stall", func() bool {
+		fr.CVar.L.Lock()
+		defer fr.CVar.L.Unlock()
+		return !fr.AckStallTs.IsZero()
+	})
+	waitForCond(t, "slow consumer timer", func() bool { return clock.numActiveTimers() == 1 })
+	clock.Advance(5 * time.Second)
+	select {
+	case event := <-eventCh:
+		t.Fatalf("slow consumer reported before the threshold: %s", event.String())
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.Advance(5 * time.Second)
+	select {
+	case event := <-eventCh:
+		if event.FdNum != 1 || event.Duration != 10*time.Second {
+			t.Fatalf("bad slow consumer event: %s", event.String())
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("timeout waiting for the slow consumer event")
+	}
+	// reported once per stall, an ack starts a new one
+	waitForCond(t, "slow consumer timer", func() bool { return clock.numActiveTimers() == 1 })
+	clock.Advance(10 * time.Second)
+	select {
+	case event := <-eventCh:
+		t.Fatalf("slow consumer reported twice for one stall: %s", event.String())
+	case <-time.After(50 * time.Millisecond):
+	}
+	tm.sendAck(1, 1000)
+	tm.readData(t, 1, 1000)
+	waitForCond(t, "new ack stall", func() bool {
+		fr.CVar.L.Lock()
+		defer fr.CVar.L.Unlock()
+		return fr.AckStallTs.Equal(clock.Now())
+	})
+	waitForCond(t, "slow consumer timer", func() bool { return clock.numActiveTimers() == 1 })
+	clock.Advance(10 * time.Second)
+	select {
+	case event := <-eventCh:
+		if event.Duration != 10*time.Second {
+			t.Fatalf("bad slow consumer event for the second stall: %s", event.String())
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("timeout waiting for the second slow consumer event")
+	}
+}
+
+func TestPtyChildExited(t *testing.T) {
+	tm := makeTestMux()
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		t.Skipf("cannot open pty: %v", err)
+	}
+	// the child side stays open here (as when the embedder keeps it), so the reader never gets an EIO
+	defer tty.Close()
+	cmd := exec.Command("sh", "-c", "printf 'line1\\nline2\\n'; printf 'last'")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	err = cmd.Run()
+	if err != nil {
+		t.Fatalf("error running cmd: %v", err)
+	}
+	tm.M.MakeRawFdReader(1, ptmx, true, true)
+	if err := tm.M.SetPtyChildExited(2); err == nil {
+		t.Fatalf("expected an error for an fd without a reader")
+	}
+	tm.start(false, false, true)
+	defer tm.M.Close()
+	if err := tm.M.SetPtyChildExited(1); err != nil {
+		t.Fatalf("SetPtyChildExited: %v", err)
+	}
+	var output []byte
+	for {
+		pk := tm.waitForPacket(t, isDataPacket(1), nil).(*packet.DataPacketType)
+		if pk.Error != "" {
+			t.Fatalf("expected a clean close, got %s", packet.AsString(pk))
+		}
+		data, _ := pk.GetData()
+		output = append(output, data...)
+		tm.sendAck(1, len(data))
+		if pk.Eof {
+			break
+		}
+	}
+	if string(output) != "line1\r\nline2\r\nlast" {
+		t.Fatalf("expected all of the pty output, got %q", output)
+	}
+	fr, _ := tm.M.getFdReader(1)
+	waitForCond(t, "reader close", fr.isClosed)
+	if reason := fr.getCloseReason(); reason != CloseReasonEof {
+		t.Fatalf("expected close reason %q, got %q", CloseReasonEof, reason)
+	}
+}
+
+func TestMsgpackSession(t *testing.T) {
+	m := makeTestMux().M
+	m.Format = packet.FormatMsgpack
+	m.MaxWirePacketSize = 4096
+	toMuxR, toMuxW := io.Pipe()
+	fromMuxR, fromMuxW := io.Pipe()
+	defer toMuxW.Close()
+	defer fromMuxW.Close()
+	opts := &packet.PacketParserOpts{Format: packet.FormatMsgpack}
+	muxSender, err := packet.MakeFormatPacketSender(fromMuxW, packet.FormatMsgpack, nil)
+	if err != nil {
+		t.Fatalf("error making msgpack sender: %v", err)
+	}
+	clientSender, _ := packet.MakeFormatPacketSender(toMuxW, packet.FormatMsgpack, nil)
+	clientParser := packet.MakePacketParser(fromMuxR, opts)
+	pr, pw := makeTestPipe(t)
+	m.MakeRawFdReader(1, pr, true, false)
+	gw := makeGatedWriter()
+	gw.Release()
+	m.MakeRawFdWriter(0, gw, true, "stdin")
+	doneCh := make(chan *packet.CmdDonePacketType, 1)
+	go func() {
+		doneCh <- m.RunIOAndWait(packet.MakePacketParser(toMuxR, opts), muxSender, true, true, true)
+	}()
+	outData := make([]byte, 200*1024)
+	inData := make([]byte, 100*1024)
+	for i := range outData {
+		outData[i] = byte(i % 251)
+	}
+	for i := range inData {
+		inData[i] = byte(255 - i%256)
+	}
+	go func() {
+		pw.Write(outData)
+		pw.Close()
+	}()
+	for pos := 0; pos < len(inData); pos += 10 * 1024 {
+		dataPk := m.makeDataPacket(0, inData[pos:pos+10*1024], nil)
+		dataPk.Eof = pos+10*1024 == len(inData)
+		clientSender.SendPacket(dataPk)
+	}
+	var received []byte
+	var wireBytes int64
+	gotEof, gotEofAck := false, false
+	timer := time.NewTimer(testTimeout)
+	defer timer.Stop()
+	for !gotEof || !gotEofAck {
+		var pk packet.PacketType
+		select {
+		case pk = <-clientParser.MainCh:
+		case <-timer.C:
+			t.Fatalf("timeout waiting for the session data")
+		}
+		if pk == nil {
+			t.Fatalf("msgpack stream closed early: %v", clientParser.GetErr())
+		}
+		switch pk := pk.(type) {
+		case *packet.DataPacketType:
+			data, err := pk.GetData()
+			if err != nil || pk.FdNum != 1 || pk.Encoding != packet.EncodingBinary {
+				t.Fatalf("bad data packet %s (err=%v)", packet.AsString(pk), err)
+			}
+			frame, _ := packet.MarshalMsgpackPacket(pk)
+			if len(frame) > m.MaxWirePacketSize {
+				t.Fatalf("packet is %d bytes on the wire (max %d)", len(frame), m.MaxWirePacketSize)
+			}
+			wireBytes += int64(len(frame))
+			received = append(received, data...)
+			gotEof = gotEof || pk.Eof
+			if len(data) > 0 {
+				ack := packet.MakeDataAckPacket()
+				ack.CK = m.CK
+				ack.FdNum = 1
+				ack.AckLen = len(data)
+				clientSender.SendPacket(ack)
+			}
+		case *packet.DataAckPacketType:
+			if pk.Error != "" {
+				t.Fatalf("error ack: %s", packet.AsString(pk))
+			}
+			gotEofAck = gotEofAck || (pk.FdNum == 0 && pk.EofAck)
+		}
+	}
+	clientSender.SendPacket(packet.MakeCmdDonePacket(m.CK))
+	select {
+	case <-doneCh:
+	case <-time.After(testTimeout):
+		t.Fatalf("timeout waiting for the session to end")
+	}
+	if !bytes.Equal(received, outData) {
+		t.Fatalf("reader data mismatch over msgpack (received %d bytes, expected %d)", len(received), len(outData))
+	}
+	if written, _ := gw.getData(); !bytes.Equal(written, inData) {
+		t.Fatalf("writer data mismatch over msgpack (wrote %d bytes, expected %d)", len(written), len(inData))
+	}
+	if stats := m.Stats(); stats.WireBytes != wireBytes || stats.OverheadRatio() > 1.1 {
+		t.Fatalf("expected %d wire bytes (no base64 overhead), stats have %d (ratio %.3f)", wireBytes, stats.WireBytes, stats.OverheadRatio())
+	}
+}
+
+func TestTraceId(t *testing.T) {
+	tm := makeTestMux()
+	tm.M = MakeTracedMultiplexer(tm.M.CK, "req-42", nil)
+	var eventStrs []string
+	var eventLock sync.Mutex
+	tm.M.EventHandler = func(event *MuxEvent) {
+		if event.TraceId != "req-42" {
+			t.Errorf("event without the trace id: %s", event.String())
+		}
+		eventLock.Lock()
+		defer eventLock.Unlock()
+		eventStrs = append(eventStrs, event.String())
+	}
+	summaryCh := make(chan *SessionSummary, 1)
+	tm.M.SummaryLogger = func(summary *SessionSummary) {
+		summaryCh <- summary
+	}
+	pr, pw := makeTestPipe(t)
+	tm.M.MakeRawFdReader(1, pr, true, false)
+	gw := makeGatedWriter()
+	gw.Release()
+	tm.M.MakeRawFdWriter(0, gw, true, "stdin")
+	tm.start(true, true, true)
+	pw.Write([]byte("traced"))
+	pw.Close()
+	dataPk := tm.waitForPacket(t, isEofDataPacket(1), nil).(*packet.DataPacketType)
+	if dataPk.TraceId != "req-42" {
+		t.Fatalf("expected the trace id on the data packet, got %s", packet.AsString(dataPk))
+	}
+	tm.sendData(0, []byte("in"), true)
+	ack := tm.waitForPacket(t, isEofAck(0), nil).(*packet.DataAckPacketType)
+	if ack.TraceId != "req-42" {
+		t.Fatalf("expected the trace id on the ack, got %s", packet.AsString(ack))
+	}
+	tm.InputCh <- packet.MakeUrgentPacket(tm.M.CK, "bogus", 1)
+	msg := tm.waitForPacket(t, func(pk packet.PacketType) bool {
+		return pk.GetType() == packet.MessagePacketStr
+	}, nil).(*packet.MessagePacketType)
+	if msg.TraceId != "req-42" {
+		t.Fatalf("expected the trace id on the message packet, got %s", packet.AsString(msg))
+	}
+	tm.sendDone()
+	<-tm.DoneCh
+	summary := <-summaryCh
+	if summary.TraceId != "req-42" || !strings.Contains(summary.String(), "trace=req-42") {
+		t.Fatalf("expected the trace id in the summary, got %s", summary.String())
+	}
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	if len(eventStrs) == 0 || !strings.Contains(eventStrs[0], "trace=req-42") {
+		t.Fatalf("expected the trace id in the event output, got %v", eventStrs)
+	}
+	if prefix := tm.M.debugPrefix("PK-M"); prefix != "PK-M[req-42]>" {
+		t.Fatalf("bad debug prefix %q", prefix)
+	}
+}
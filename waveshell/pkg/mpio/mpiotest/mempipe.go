@@ -0,0 +1,117 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// in-memory pipes for driving mpio readers and writers in tests without real OS pipes
+package mpiotest
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+)
+
+type memPipe struct {
+	CVar         *sync.Cond
+	Buffer       []byte
+	WriterClosed bool
+	WriterErr    error // returned by Read once the buffer is drained (io.EOF for a normal close)
+	ReaderClosed bool
+}
+
+// read end of a MemPipe, pass to MakeRawFdReader (the "process" writes to the PipeWriter)
+type PipeReader struct {
+	p *memPipe
+}
+
+// write end of a MemPipe, pass to MakeRawFdWriter (the "process" reads from the PipeReader)
+type PipeWriter struct {
+	p *memPipe
+}
+
+// returns a buffered in-memory pipe.  writes never block, reads block until data is available
+// or the writer is closed.  like an OS pipe: reads return io.EOF after the writer closes (or the
+// error given to CloseWithError), and writes return EPIPE (errors.Is(err, syscall.EPIPE)) once the
+// reader is closed.
+func MemPipe() (*PipeReader, *PipeWriter) {
+	p := &memPipe{CVar: sync.NewCond(&sync.Mutex{})}
+	return &PipeReader{p: p}, &PipeWriter{p: p}
+}
+
+func (r *PipeReader) Read(buf []byte) (int, error) {
+	p := r.p
+	p.CVar.L.Lock()
+	defer p.CVar.L.Unlock()
+	for len(p.Buffer) == 0 && !p.WriterClosed && !p.ReaderClosed {
+		p.CVar.Wait()
+	}
+	if p.ReaderClosed {
+		return 0, io.ErrClosedPipe
+	}
+	if len(p.Buffer) == 0 {
+		return 0, p.WriterErr
+	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	n := copy(buf, p.Buffer)
+	p.Buffer = p.Buffer[n:]
+	return n, nil
+}
+
+// unblocks any pending Read, further writes fail with EPIPE
+func (r *PipeReader) Close() error {
+	p := r.p
+	p.CVar.L.Lock()
+	defer p.CVar.L.Unlock()
+	p.ReaderClosed = true
+	p.Buffer = nil
+	p.CVar.Broadcast()
+	return nil
+}
+
+// number of bytes written but not yet read
+func (r *PipeReader) Buffered() int {
+	p := r.p
+	p.CVar.L.Lock()
+	defer p.CVar.L.Unlock()
+	return len(p.Buffer)
+}
+
+func (w *PipeWriter) Write(data []byte) (int, error) {
+	p := w.p
+	p.CVar.L.Lock()
+	defer p.CVar.L.Unlock()
+	if p.ReaderClosed {
+		return 0, fmt.Errorf("write to mempipe: %w", syscall.EPIPE)
+	}
+	if p.WriterClosed {
+		return 0, io.ErrClosedPipe
+	}
+	p.Buffer = append(p.Buffer, data...)
+	p.CVar.Broadcast()
+	return len(data), nil
+}
+
+// the reader gets io.EOF once the buffered data is drained
+func (w *PipeWriter) Close() error {
+	return w.CloseWithError(nil)
+}
+
+// the reader gets err (io.EOF if nil) once the buffered data is drained, use to simulate read
+// errors such as EIO from a pty
+func (w *PipeWriter) CloseWithError(err error) error {
+	p := w.p
+	p.CVar.L.Lock()
+	defer p.CVar.L.Unlock()
+	if p.WriterClosed {
+		return nil
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	p.WriterClosed = true
+	p.WriterErr = err
+	p.CVar.Broadcast()
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"time"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
+)
+
+// max time a held ack waits for a data packet before it is sent on its own
+const PiggybackAckDelay = 5 * time.Millisecond
+
+// with PiggybackAcks, a write ack for an fd with an open reader is held for the reader's next data
+// packet.  returns false if the ack should be sent now.
+func (m *Multiplexer) holdPiggybackAck(fdNum int, ackLen int) bool {
+	if !m.PiggybackAcks {
+		return false
+	}
+	m.Lock.Lock()
+	fr := m.FdReaders[fdNum]
+	m.Lock.Unlock()
+	if fr == nil || fr.isClosed() {
+		return false
+	}
+	m.piggyLock.Lock()
+	defer m.piggyLock.Unlock()
+	if m.piggyAcks[fdNum] == 0 {
+		go m.flushPiggybackAck(fdNum)
+	}
+	m.piggyAcks[fdNum] += ackLen
+	return true
+}
+
+func (m *Multiplexer) takePiggybackAck(fdNum int) int {
+	m.piggyLock.Lock()
+	defer m.piggyLock.Unlock()
+	ackLen := m.piggyAcks[fdNum]
+	delete(m.piggyAcks, fdNum)
+	return ackLen
+}
+
+// sends the held ack if no data packet took it within PiggybackAckDelay
+func (m *Multiplexer) flushPiggybackAck(fdNum int) {
+	select {
+	case <-m.Clock.After(PiggybackAckDelay):
+	case <-m.closeCh:
+		return
+	}
+	ackLen := m.takePiggybackAck(fdNum)
+	if ackLen > 0 {
+		m.sendPacket(m.makeDataAckPacket(fdNum, ackLen, nil))
+	}
+}
+
+// a held ack goes out with the next data packet (or ack, so it is never reordered after an eof
+// or error ack) for its fd.  the packet is copied, the caller's packet is not modified.
+func (m *Multiplexer) attachPiggybackAck(p packet.PacketType) packet.PacketType {
+	if !m.PiggybackAcks {
+		return p
+	}
+	switch pk := p.(type) {
+	case *packet.DataPacketType:
+		if ackLen := m.takePiggybackAck(pk.FdNum); ackLen > 0 {
+			pkCopy := *pk
+			pkCopy.AckLen += ackLen
+			return &pkCopy
+		}
+	case *packet.DataAckPacketType:
+		if ackLen := m.takePiggybackAck(pk.FdNum); ackLen > 0 {
+			pkCopy := *pk
+			pkCopy.AckLen += ackLen
+			return &pkCopy
+		}
+	}
+	return p
+}
@@ -0,0 +1,334 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/base"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
+)
+
+// same bounds as shexec
+const MinTermRows = 2
+const MinTermCols = 10
+const MaxTermRows = 1024
+const MaxTermCols = 1024
+
+// FlushPtyReader keeps reading for this long before sending the segment boundary
+const PtyFlushDrainTime = 20 * time.Millisecond
+
+// registers a pty (master) so winsize special-input packets for fdNum resize it.
+// the first pty registered becomes the default pty.
+func (m *Multiplexer) SetPtyFd(fdNum int, ptyFd *os.File) {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	if len(m.PtyFds) == 0 {
+		m.DefaultPtyFdNum = fdNum
+	}
+	m.PtyFds[fdNum] = ptyFd
+}
+
+// process is signaled (SIGWINCH) after its pty is resized
+func (m *Multiplexer) SetCmdProc(proc *os.Process) {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	m.CmdProc = proc
+}
+
+// side metadata for a session, applied by RunIOAndWait before any reader or writer is launched
+// (avoids racing the first resize against the shell drawing its prompt)
+type InitialMeta struct {
+	WinSize *packet.WinSize   // applied to the default pty (or OnWinSizeNoPty)
+	FdNum   *int              // target pty for WinSize (nil for the default pty)
+	Values  map[string]string // other metadata (terminal type, locale, etc.) for the embedder
+}
+
+// set before starting IO
+func (m *Multiplexer) SetInitialMeta(meta *InitialMeta) {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	m.InitialMeta = meta
+}
+
+func (m *Multiplexer) applyInitialMeta() error {
+	m.Lock.Lock()
+	meta := m.InitialMeta
+	hasWinSizeHandler := len(m.PtyFds) > 0 || m.OnWinSizeNoPty != nil
+	m.Lock.Unlock()
+	if meta == nil || meta.WinSize == nil {
+		return nil
+	}
+	if !hasWinSizeHandler {
+		return fmt.Errorf("cannot apply initial winsize, no pty registered")
+	}
+	return m.setWinSize(meta.FdNum, meta.WinSize)
+}
+
+// closes the multiplexer and sends CloseSignal to CmdProc's process group (or just to CmdProc if
+// it is not a group leader) so nothing lingers on the closed fds.  no-op signal if there is no
+// CmdProc or it has already been waited on.
+func (m *Multiplexer) CloseAndSignal() error {
+	m.Close()
+	m.Lock.Lock()
+	proc := m.CmdProc
+	sig := m.CloseSignal
+	m.Lock.Unlock()
+	if proc == nil || sig == 0 {
+		return nil
+	}
+	if err := proc.Signal(syscall.Signal(0)); err != nil {
+		return nil // already exited
+	}
+	pgid, err := syscall.Getpgid(proc.Pid)
+	if err == nil && pgid == proc.Pid {
+		err = syscall.Kill(-pgid, sig)
+		if err == nil {
+			return nil
+		}
+	}
+	err = proc.Signal(sig)
+	if err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return fmt.Errorf("cannot signal cmd (pid:%d): %w", proc.Pid, err)
+	}
+	return nil
+}
+
+// drains the pty output that is currently available and then sends a segment boundary (a
+// DataPacket with SegmentEnd set) without closing the pty, so one pty can be shared by several
+// command segments.  a held partial line (LineBuffered) is sent before the boundary.  blocks until
+// the boundary is sent (or the reader is closed).
+func (m *Multiplexer) FlushPtyReader(fdNum int) error {
+	fr, err := m.getFdReader(fdNum)
+	if err != nil {
+		return err
+	}
+	if _, ok := fr.Fd.(*os.File); !fr.IsPty || !ok {
+		return fmt.Errorf("cannot flush fd:%d, not a pty reader", fdNum)
+	}
+	flushCh := make(chan error, 1)
+	fr.CVar.L.Lock()
+	if fr.Closed {
+		fr.CVar.L.Unlock()
+		return fmt.Errorf("cannot flush fd:%d: %w", fdNum, ErrFdClosed)
+	}
+	fr.FlushReqs = append(fr.FlushReqs, flushCh)
+	if fr.Poller != nil {
+		fr.Poller.wake()
+	}
+	fr.CVar.L.Unlock()
+	return <-flushCh
+}
+
+// for a pty whose child has exited: the reader drains the output still buffered in the pty (until
+// none arrives for PtyFlushDrainTime) and then closes with an EOF (CloseReasonEof), as if it had
+// read EIO.  for when the pty does not close on its own, e.g. the embedder (or a process outside
+// the child's session) still has the child side open.
+func (m *Multiplexer) SetPtyChildExited(fdNum int) error {
+	fr, err := m.getFdReader(fdNum)
+	if err != nil {
+		return err
+	}
+	if _, ok := fr.Fd.(*os.File); !fr.IsPty || !ok {
+		return fmt.Errorf("cannot drain fd:%d, not a pty reader", fdNum)
+	}
+	fr.CVar.L.Lock()
+	defer fr.CVar.L.Unlock()
+	fr.ChildExited = true
+	if fr.Poller != nil {
+		fr.Poller.wake()
+	}
+	return nil
+}
+
+// with ReapCmdProc, RunIOAndWait waits on CmdProc once the IO is done (the embedder must not Wait on
+// it) and returns a done packet with its exit code and signal details, unless a done packet was
+// received.  blocks until the process exits (see CloseAndSignal).
+func (m *Multiplexer) reapCmdProc() *packet.CmdDonePacketType {
+	// the process can only be waited on once (a pty EOF may have reaped it already)
+	m.reapOnce.Do(func() {
+		m.reapPacket = m.waitCmdProc()
+	})
+	return m.reapPacket
+}
+
+func (m *Multiplexer) waitCmdProc() *packet.CmdDonePacketType {
+	m.Lock.Lock()
+	proc := m.CmdProc
+	m.Lock.Unlock()
+	if proc == nil {
+		return nil
+	}
+	donePacket := packet.MakeCmdDonePacket(m.CK)
+	state, err := proc.Wait()
+	donePacket.Ts = m.Clock.Now().UnixMilli()
+	if err != nil {
+		donePacket.ExitCode = -1
+		donePacket.Error = fmt.Sprintf("cannot wait on cmd (pid:%d): %v", proc.Pid, err)
+		return donePacket
+	}
+	donePacket.SetProcessState(state)
+	return donePacket
+}
+
+// the multiplexer only handles winsize changes for ptys registered with SetPtyFd (or with the
+// OnWinSizeNoPty hook when there are no ptys).  returns the packet that should still go to the UPR
+// (or nil), signals (and winsize when neither is set up) are left to the embedder.
+func (m *Multiplexer) processSpecialInputPacket(pk *packet.SpecialInputPacketType) (*packet.SpecialInputPacketType, error) {
+	if pk.WinSize == nil {
+		return pk, nil
+	}
+	m.Lock.Lock()
+	hasWinSizeHandler := len(m.PtyFds) > 0 || m.OnWinSizeNoPty != nil
+	m.Lock.Unlock()
+	if !hasWinSizeHandler {
+		return pk, nil
+	}
+	var fwdPacket *packet.SpecialInputPacketType
+	if pk.SigName != "" {
+		fwdCopy := *pk
+		fwdCopy.WinSize = nil
+		fwdPacket = &fwdCopy
+	}
+	return fwdPacket, m.setWinSize(pk.FdNum, pk.WinSize)
+}
+
+// returns the size of the default pty (TIOCGWINSZ)
+func (m *Multiplexer) GetWinSize() (int, int, error) {
+	m.Lock.Lock()
+	fdNum := m.DefaultPtyFdNum
+	ptyFd := m.PtyFds[fdNum]
+	m.Lock.Unlock()
+	if ptyFd == nil {
+		return 0, 0, fmt.Errorf("cannot get winsize, no pty registered")
+	}
+	ws, err := pty.GetsizeFull(ptyFd)
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot get winsize (fd:%d): %w", fdNum, err)
+	}
+	return int(ws.Rows), int(ws.Cols), nil
+}
+
+// resizes the default pty (or calls OnWinSizeNoPty) and signals CmdProc, same as a winsize
+// special input packet.  rows and cols are bounded to the MinTerm/MaxTerm limits.
+func (m *Multiplexer) SetWinSize(rows int, cols int) error {
+	return m.setWinSize(nil, &packet.WinSize{Rows: rows, Cols: cols})
+}
+
+// fdNum nil for the default pty
+func (m *Multiplexer) setWinSize(fdNumPtr *int, ws *packet.WinSize) error {
+	m.Lock.Lock()
+	noPtyFn := m.OnWinSizeNoPty
+	fdNum := m.DefaultPtyFdNum
+	if fdNumPtr != nil {
+		fdNum = *fdNumPtr
+	}
+	numPtys := len(m.PtyFds)
+	ptyFd := m.PtyFds[fdNum]
+	cmdProc := m.CmdProc
+	m.Lock.Unlock()
+
+	rows := base.BoundInt(ws.Rows, MinTermRows, MaxTermRows)
+	cols := base.BoundInt(ws.Cols, MinTermCols, MaxTermCols)
+	if numPtys == 0 {
+		if noPtyFn == nil {
+			return fmt.Errorf("cannot change winsize, no pty registered")
+		}
+		noPtyFn(rows, cols)
+		return nil
+	}
+	if ptyFd == nil {
+		return fmt.Errorf("cannot change winsize, no pty for fd:%d", fdNum)
+	}
+	winSize := &pty.Winsize{Rows: uint16(rows), Cols: uint16(cols)}
+	err := pty.Setsize(ptyFd, winSize)
+	if err != nil {
+		return fmt.Errorf("cannot change winsize (fd:%d): %w", fdNum, err)
+	}
+	if cmdProc != nil {
+		return m.signalCmdProc(cmdProc, syscall.SIGWINCH)
+	}
+	return nil
+}
+
+// urgent packets skip the data queued ahead of them (when the parser has an UrgentCh), failures
+// are reported as message packets like special input errors
+func (m *Multiplexer) processUrgentPacket(pk *packet.UrgentPacketType) {
+	var err error
+	switch pk.Action {
+	case packet.UrgentActionAbortFd:
+		err = m.closeFd(pk.FdNum, CloseReasonAbort)
+	case packet.UrgentActionFlushFd:
+		// FlushPtyReader waits for the drain, the input loop does not
+		go func() {
+			flushErr := m.FlushPtyReader(pk.FdNum)
+			if flushErr != nil {
+				m.sendUrgentError(pk, flushErr)
+			}
+		}()
+	default:
+		err = fmt.Errorf("unknown action")
+	}
+	if err != nil {
+		m.sendUrgentError(pk, err)
+	}
+}
+
+func (m *Multiplexer) sendUrgentError(pk *packet.UrgentPacketType, err error) {
+	m.sendPacket(m.makeMessagePacket(fmt.Sprintf("urgent %s (fd:%d) failed: %v", pk.Action, pk.FdNum, err)))
+}
+
+// called when a pty reader reaches EOF (EIO once the child side is closed).  with PtyEofDone, EOF on
+// the default pty (or on any pty reader if no pty is registered with SetPtyFd) ends the session
+// without waiting for a CmdDonePacket.
+func (m *Multiplexer) notifyPtyEof(fdNum int) {
+	m.Lock.Lock()
+	isDefault := len(m.PtyFds) == 0 || fdNum == m.DefaultPtyFdNum
+	m.Lock.Unlock()
+	if !m.PtyEofDone || !isDefault {
+		return
+	}
+	m.notifyCmdExit()
+}
+
+// the input loop returns (see makeCmdExitDonePacket) instead of waiting for a CmdDonePacket
+func (m *Multiplexer) notifyCmdExit() {
+	m.cmdExitOnce.Do(func() {
+		close(m.cmdExitCh)
+	})
+}
+
+// with ReapCmdProc, the exit status of CmdProc (the child has closed its pty or is known to have
+// exited), otherwise a plain done packet
+func (m *Multiplexer) makeCmdExitDonePacket() *packet.CmdDonePacketType {
+	var donePacket *packet.CmdDonePacketType
+	if m.ReapCmdProc {
+		donePacket = m.reapCmdProc()
+	}
+	if donePacket == nil {
+		donePacket = packet.MakeCmdDonePacket(m.CK)
+		donePacket.Ts = m.Clock.Now().UnixMilli()
+	}
+	return donePacket
+}
+
+// a failed signal is reported with an EventSignalError.  a process that has already exited (and
+// been waited on) will not write anything more, so the session ends as if it sent its done packet.
+func (m *Multiplexer) signalCmdProc(proc *os.Process, sig syscall.Signal) error {
+	err := proc.Signal(sig)
+	if err == nil {
+		return nil
+	}
+	err = fmt.Errorf("cannot signal cmd (pid:%d) %v: %w", proc.Pid, sig, err)
+	m.emitEvent(&MuxEvent{Type: EventSignalError, FdNum: -1, Error: err})
+	if errors.Is(err, os.ErrProcessDone) || errors.Is(err, syscall.ESRCH) {
+		m.notifyCmdExit()
+	}
+	return err
+}
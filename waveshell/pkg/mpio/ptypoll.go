@@ -0,0 +1,73 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// pty fds are blocking (no read deadlines), so pty readers poll before each read.  the wake pipe
+// lets FlushPtyReader (and Close) interrupt a ReadLoop that is waiting for output.
+type ptyPoller struct {
+	Fd    int
+	WakeR int
+	WakeW int
+}
+
+func makePtyPoller(f *os.File) (*ptyPoller, error) {
+	var fds [2]int
+	err := unix.Pipe(fds[:])
+	if err != nil {
+		return nil, err
+	}
+	for _, fd := range fds {
+		unix.CloseOnExec(fd)
+		unix.SetNonblock(fd, true)
+	}
+	return &ptyPoller{Fd: int(f.Fd()), WakeR: fds[0], WakeW: fds[1]}, nil
+}
+
+// returns (readable, woken).  neither is set on timeout (timeout < 0 waits forever)
+func (p *ptyPoller) wait(timeout time.Duration) (bool, bool, error) {
+	timeoutMs := -1
+	if timeout >= 0 {
+		timeoutMs = int(timeout / time.Millisecond)
+	}
+	pollFds := []unix.PollFd{{Fd: int32(p.Fd), Events: unix.POLLIN}, {Fd: int32(p.WakeR), Events: unix.POLLIN}}
+	for {
+		_, err := unix.Poll(pollFds, timeoutMs)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return false, false, err
+		}
+		break
+	}
+	woken := pollFds[1].Revents != 0
+	if woken {
+		var buf [64]byte
+		for {
+			n, _ := unix.Read(p.WakeR, buf[:])
+			if n <= 0 {
+				break
+			}
+		}
+	}
+	// POLLHUP/POLLERR are "readable", the read returns the error (EIO for a closed pty)
+	return pollFds[0].Revents != 0, woken, nil
+}
+
+func (p *ptyPoller) wake() {
+	unix.Write(p.WakeW, []byte{0})
+}
+
+func (p *ptyPoller) close() {
+	unix.Close(p.WakeR)
+	unix.Close(p.WakeW)
+}
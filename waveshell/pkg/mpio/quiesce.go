@@ -0,0 +1,145 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"context"
+	"fmt"
+)
+
+// stronger than PauseAll: stops the readers, the writers, and the input loop (acks included), and
+// returns once nothing is in flight.  every data packet has been handed to the Sender (with
+// FairScheduling, the dispatcher has sent everything queued and is idle), no write is in progress
+// (a write batch stops after the current write, the rest goes back to the buffer), and input stops
+// between packets.  the bookkeeping does not change until Resume, so a SnapshotState taken in
+// between is consistent.  data fed from inside the process (MakeStreamWriterPipe, splices) is not
+// stopped.  if ctx is done before the session settles, it is resumed and the ctx error returned.
+func (m *Multiplexer) Quiesce(ctx context.Context) error {
+	m.Lock.Lock()
+	started := m.Started
+	dispatcher := m.dispatcher
+	readers := make([]*FdReader, 0, len(m.FdReaders))
+	for _, fr := range m.FdReaders {
+		readers = append(readers, fr)
+	}
+	writers := make([]*FdWriter, 0, len(m.FdWriters))
+	for _, fw := range m.FdWriters {
+		writers = append(writers, fw)
+	}
+	m.Lock.Unlock()
+	if !started {
+		return fmt.Errorf("cannot quiesce, multiplexer is not running")
+	}
+	m.quiesceCVar.L.Lock()
+	if m.quiesced {
+		m.quiesceCVar.L.Unlock()
+		return fmt.Errorf("cannot quiesce, multiplexer is already quiesced")
+	}
+	m.quiesced = true
+	m.quiesceCVar.L.Unlock()
+	for _, fr := range readers {
+		fr.setQuiesced(true)
+	}
+	for _, fw := range writers {
+		fw.setQuiesced(true)
+	}
+	doneCh := ctx.Done()
+	settled := waitCVar(doneCh, m.quiesceCVar, func() bool { return !m.inputBusy })
+	for _, fr := range readers {
+		settled = settled && waitCVar(doneCh, fr.CVar, func() bool { return fr.Closed || !fr.Sending })
+	}
+	if dispatcher != nil {
+		// the readers are stopped, so nothing new is queued once the dispatcher is idle
+		settled = settled && waitCVar(doneCh, dispatcher.CVar, func() bool {
+			return dispatcher.Closed || (!dispatcher.Sending && dispatcher.numQueued() == 0)
+		})
+	}
+	for _, fw := range writers {
+		// a Pending placeholder has no WriteLoop
+		settled = settled && waitCVar(doneCh, fw.CVar, func() bool { return fw.Closed || fw.Pending || (fw.Parked && !fw.Writing) })
+	}
+	if !settled {
+		m.Resume()
+		return fmt.Errorf("cannot quiesce session: %w", ctx.Err())
+	}
+	return nil
+}
+
+// undoes Quiesce (fds paused with SetPaused or PauseAll stay paused)
+func (m *Multiplexer) Resume() {
+	m.quiesceCVar.L.Lock()
+	if !m.quiesced {
+		m.quiesceCVar.L.Unlock()
+		return
+	}
+	m.quiesced = false
+	m.quiesceCVar.Broadcast()
+	m.quiesceCVar.L.Unlock()
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	for _, fr := range m.FdReaders {
+		fr.setQuiesced(false)
+	}
+	for _, fw := range m.FdWriters {
+		fw.setQuiesced(false)
+	}
+}
+
+func (m *Multiplexer) IsQuiesced() bool {
+	m.quiesceCVar.L.Lock()
+	defer m.quiesceCVar.L.Unlock()
+	return m.quiesced
+}
+
+// called by processInputPacket, waits while the session is quiesced (until it closes)
+func (m *Multiplexer) beginInput() {
+	m.quiesceCVar.L.Lock()
+	defer m.quiesceCVar.L.Unlock()
+	for m.quiesced && !m.isClosing() {
+		m.quiesceCVar.Wait()
+	}
+	m.inputBusy = true
+}
+
+func (m *Multiplexer) endInput() {
+	m.quiesceCVar.L.Lock()
+	defer m.quiesceCVar.L.Unlock()
+	m.inputBusy = false
+	m.quiesceCVar.Broadcast()
+}
+
+func (m *Multiplexer) isClosing() bool {
+	select {
+	case <-m.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *FdReader) setQuiesced(quiesced bool) {
+	r.CVar.L.Lock()
+	defer r.CVar.L.Unlock()
+	r.Quiesced = quiesced
+	r.CVar.Broadcast()
+}
+
+func (w *FdWriter) setQuiesced(quiesced bool) {
+	w.CVar.L.Lock()
+	defer w.CVar.L.Unlock()
+	w.Quiesced = quiesced
+	w.CVar.Broadcast()
+}
+
+// called by WriteLoop between the writes of a batch, returns true if the rest of the batch was
+// put back in front of the buffer (it is written after Resume)
+func (w *FdWriter) requeueIfQuiesced(data []byte) bool {
+	w.CVar.L.Lock()
+	defer w.CVar.L.Unlock()
+	if !w.Quiesced || w.Closed {
+		return false
+	}
+	w.Buffer = append(append([]byte(nil), data...), w.Buffer...)
+	return true
+}
@@ -0,0 +1,99 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"fmt"
+	"time"
+)
+
+const DefaultReadSize = 4096 // ReadLoop buffer for readers without an adaptive buffer
+const ReadBufShrinkIdle = 2 * time.Second
+
+// read size hints (see SetFdReadSizeHint), any size from MinReadSizeHint to ReadBufSize works
+const ReadSizeInteractive = 1024
+const ReadSizeBulk = 64 * 1024
+const MinReadSizeHint = 64
+
+// ReadLoop buffer that starts at Min bytes and grows by Growth (up to Max) each time a read
+// fills it.  a short read after ReadBufShrinkIdle without a full read shrinks it back to Min.
+type readBufSizer struct {
+	Min        int
+	Max        int
+	Growth     int
+	Buf        []byte
+	LastFullTs time.Time
+}
+
+// sizeHint (0 for none) is the fixed buffer size, or the initial size (within min/max) of an
+// adaptive buffer
+func makeReadBufSizer(minSize int, maxSize int, growth int, sizeHint int) *readBufSizer {
+	if minSize <= 0 {
+		// fixed size buffer
+		size := DefaultReadSize
+		if sizeHint > 0 {
+			size = sizeHint
+		}
+		return &readBufSizer{Min: size, Max: size, Growth: 1, Buf: make([]byte, size)}
+	}
+	size := minSize
+	if sizeHint > minSize {
+		size = min(sizeHint, maxSize)
+	}
+	return &readBufSizer{Min: minSize, Max: maxSize, Growth: growth, Buf: make([]byte, size)}
+}
+
+// call after each read, the next read uses s.Buf
+func (s *readBufSizer) observe(nr int, now time.Time) {
+	if s.Min == s.Max {
+		return
+	}
+	if nr == len(s.Buf) {
+		s.LastFullTs = now
+		if len(s.Buf) < s.Max {
+			s.Buf = make([]byte, min(len(s.Buf)*s.Growth, s.Max))
+		}
+		return
+	}
+	if len(s.Buf) > s.Min && nr <= len(s.Buf)/s.Growth && now.Sub(s.LastFullTs) >= ReadBufShrinkIdle {
+		s.Buf = make([]byte, s.Min)
+	}
+}
+
+// the reader starts with minSize byte reads, growing by growth (>= 2) up to maxSize when reads fill
+// the buffer, and shrinking back after ReadBufShrinkIdle.  minSize 0 for the default fixed buffer.
+// call before starting IO.
+func (m *Multiplexer) SetFdAdaptiveReadBuf(fdNum int, minSize int, maxSize int, growth int) error {
+	if minSize < 0 || (minSize > 0 && (maxSize < minSize || growth < 2)) {
+		return fmt.Errorf("invalid adaptive read buffer min=%d max=%d growth=%d (fd:%d)", minSize, maxSize, growth, fdNum)
+	}
+	fr, err := m.getFdReader(fdNum)
+	if err != nil {
+		return err
+	}
+	fr.CVar.L.Lock()
+	defer fr.CVar.L.Unlock()
+	fr.ReadBufMin = minSize
+	fr.ReadBufMax = maxSize
+	fr.ReadBufGrowth = growth
+	return nil
+}
+
+// the expected read size for fdNum, e.g. ReadSizeInteractive for small interactive reads or
+// ReadSizeBulk for bulk transfers (fewer read syscalls).  sets the fixed ReadLoop buffer, or the
+// initial buffer of an adaptive reader (see SetFdAdaptiveReadBuf).  0 for the default, call before
+// starting IO.
+func (m *Multiplexer) SetFdReadSizeHint(fdNum int, sizeHint int) error {
+	if sizeHint != 0 && (sizeHint < MinReadSizeHint || sizeHint > ReadBufSize) {
+		return fmt.Errorf("invalid read size hint %d, must be %d-%d (fd:%d)", sizeHint, MinReadSizeHint, ReadBufSize, fdNum)
+	}
+	fr, err := m.getFdReader(fdNum)
+	if err != nil {
+		return err
+	}
+	fr.CVar.L.Lock()
+	defer fr.CVar.L.Unlock()
+	fr.ReadSizeHint = sizeHint
+	return nil
+}
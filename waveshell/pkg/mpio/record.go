@@ -0,0 +1,161 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
+)
+
+const (
+	RecordDirIn  = "in"  // received by the multiplexer (input packets)
+	RecordDirOut = "out" // sent by the multiplexer
+)
+
+// max time a replayed input packet waits for the outputs recorded before it
+const ReplayStepTimeout = 5 * time.Second
+
+// one line (json) of a RecordTo log
+type RecordEntry struct {
+	Ts     int64           `json:"ts"`
+	Dir    string          `json:"dir"`
+	Packet json.RawMessage `json:"packet"`
+}
+
+type packetLog struct {
+	CVar   *sync.Cond
+	W      io.Writer // nil when only replaying
+	NumOut int       // packets sent
+	Err    error     // first write error (stops recording)
+}
+
+func (m *Multiplexer) getPacketLog() *packetLog {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	if m.pktLog == nil {
+		m.pktLog = &packetLog{CVar: sync.NewCond(&sync.Mutex{})}
+	}
+	return m.pktLog
+}
+
+// writes every inbound and outbound packet to w (one RecordEntry per line), set before starting IO.
+// the log can be fed back through a multiplexer with ReplayFrom.
+func (m *Multiplexer) RecordTo(w io.Writer) {
+	pktLog := m.getPacketLog()
+	pktLog.CVar.L.Lock()
+	defer pktLog.CVar.L.Unlock()
+	pktLog.W = w
+}
+
+func (m *Multiplexer) logPacket(dir string, pk packet.PacketType) {
+	m.Lock.Lock()
+	pktLog := m.pktLog
+	m.Lock.Unlock()
+	if pktLog == nil {
+		return
+	}
+	pktLog.CVar.L.Lock()
+	defer pktLog.CVar.L.Unlock()
+	if dir == RecordDirOut {
+		pktLog.NumOut++
+		pktLog.CVar.Broadcast()
+	}
+	if pktLog.W == nil || pktLog.Err != nil {
+		return
+	}
+	pkJson, err := json.Marshal(pk)
+	if err != nil {
+		return
+	}
+	entry := RecordEntry{Ts: m.Clock.Now().UnixMilli(), Dir: dir, Packet: pkJson}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	_, err = pktLog.W.Write(append(line, '\n'))
+	if err != nil {
+		pktLog.Err = err
+	}
+}
+
+// returns true if the count was reached, false on timeout or close
+func (m *Multiplexer) waitForNumOut(pktLog *packetLog, numOut int) bool {
+	expired := false // synchronized (pktLog lock)
+	stopCh := make(chan bool)
+	defer close(stopCh)
+	go func() {
+		timer := m.Clock.NewTimer(ReplayStepTimeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C():
+		case <-m.closeCh:
+		case <-stopCh:
+			return
+		}
+		pktLog.CVar.L.Lock()
+		defer pktLog.CVar.L.Unlock()
+		expired = true
+		pktLog.CVar.Broadcast()
+	}()
+	pktLog.CVar.L.Lock()
+	defer pktLog.CVar.L.Unlock()
+	for !expired && pktLog.NumOut < numOut {
+		pktLog.CVar.Wait()
+	}
+	return pktLog.NumOut >= numOut
+}
+
+// returns a parser (pass to RunIOAndWait) that replays the inbound packets of a RecordTo log.
+// each input packet is held until this multiplexer has sent as many packets as were recorded
+// before it, so the session is reproduced deterministically (up to ReplayStepTimeout per packet).
+func (m *Multiplexer) ReplayFrom(r io.Reader) *packet.PacketParser {
+	pktLog := m.getPacketLog()
+	parser := &packet.PacketParser{
+		Lock:   &sync.Mutex{},
+		MainCh: make(chan packet.PacketType),
+		RpcMap: make(map[string]*packet.RpcEntry),
+	}
+	go func() {
+		defer close(parser.MainCh)
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 10*MaxTotalRunDataSize)
+		wantOut := 0
+		for scanner.Scan() {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			var entry RecordEntry
+			err := json.Unmarshal(scanner.Bytes(), &entry)
+			if err != nil {
+				parser.SetErr(fmt.Errorf("invalid record entry: %w", err))
+				return
+			}
+			if entry.Dir == RecordDirOut {
+				wantOut++
+				continue
+			}
+			pk, err := packet.ParseJsonPacket(entry.Packet)
+			if err != nil {
+				parser.SetErr(fmt.Errorf("invalid recorded packet: %w", err))
+				return
+			}
+			m.waitForNumOut(pktLog, wantOut)
+			select {
+			case parser.MainCh <- pk:
+			case <-m.closeCh:
+				return
+			}
+		}
+		if scanner.Err() != nil {
+			parser.SetErr(scanner.Err())
+		}
+	}()
+	return parser
+}
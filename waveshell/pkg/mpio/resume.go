@@ -0,0 +1,71 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// writer (fdNum) that writes data packets into f.  a data packet can set Offset to resume a
+// transfer after an interruption: the file is truncated at Offset and the data is written there.
+// the offset must not be past the end of the file.  f is closed with the writer.
+func (m *Multiplexer) MakeResumableFileWriter(fdNum int, f *os.File, desc string) error {
+	_, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("cannot make resumable writer fd:%d, file is not seekable: %w", fdNum, err)
+	}
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	fw := MakeFdWriter(m, f, fdNum, true, desc)
+	fw.Resumable = true
+	return m.addFdWriter(fw)
+}
+
+// the buffered data must be flushed before the writer can seek (data is only resumed at
+// packet boundaries)
+func (w *FdWriter) addDataAt(offset int64, data []byte, eof bool) error {
+	w.CVar.L.Lock()
+	if !w.Resumable {
+		w.CVar.L.Unlock()
+		return fmt.Errorf("cannot write at offset %d, %q (fd:%d) is not resumable", offset, w.Desc, w.FdNum)
+	}
+	if offset < 0 {
+		w.CVar.L.Unlock()
+		return fmt.Errorf("invalid offset %d (fd:%d)", offset, w.FdNum)
+	}
+	if len(w.Buffer) > 0 && !w.Closed {
+		w.CVar.L.Unlock()
+		return fmt.Errorf("cannot write at offset %d, %q (fd:%d) has %d bytes buffered", offset, w.Desc, w.FdNum, len(w.Buffer))
+	}
+	if !w.Closed && !w.Eof {
+		w.PendingSeek = &offset
+	}
+	w.CVar.L.Unlock()
+	return w.AddData(data, eof)
+}
+
+func (w *FdWriter) seekTo(offset int64) error {
+	f, ok := w.Fd.(*os.File)
+	if !ok {
+		return fmt.Errorf("cannot seek %q (fd:%d), not a file", w.Desc, w.FdNum)
+	}
+	finfo, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot seek %q (fd:%d): %w", w.Desc, w.FdNum, err)
+	}
+	if offset > finfo.Size() {
+		return fmt.Errorf("cannot resume %q (fd:%d) at offset %d, file size is %d", w.Desc, w.FdNum, offset, finfo.Size())
+	}
+	err = f.Truncate(offset)
+	if err != nil {
+		return fmt.Errorf("cannot truncate %q (fd:%d): %w", w.Desc, w.FdNum, err)
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("cannot seek %q (fd:%d): %w", w.Desc, w.FdNum, err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"fmt"
+)
+
+// a ring reader never blocks ReadLoop on the ack window (live tails, telemetry).  reads go into a
+// buffer of RingSize bytes, the oldest data is discarded when it is full, and ringSendLoop sends
+// from it as the window allows.  the next data packet reports the discarded bytes (Dropped).
+// set before starting IO.
+func (m *Multiplexer) SetFdRingBuffer(fdNum int, ringSize int) error {
+	if ringSize < 0 {
+		return fmt.Errorf("invalid ring size %d (fd:%d)", ringSize, fdNum)
+	}
+	fr, err := m.getFdReader(fdNum)
+	if err != nil {
+		return err
+	}
+	fr.CVar.L.Lock()
+	defer fr.CVar.L.Unlock()
+	fr.RingSize = ringSize
+	return nil
+}
+
+// returns false if the reader is closed
+func (r *FdReader) ringAdd(data []byte, isEof bool) bool {
+	r.CVar.L.Lock()
+	defer r.CVar.L.Unlock()
+	if r.Closed {
+		return false
+	}
+	r.Ring = append(r.Ring, data...)
+	if over := len(r.Ring) - r.RingSize; over > 0 {
+		r.Ring = r.Ring[over:]
+		r.RingDropped += over
+		r.RingDroppedTotal += int64(over)
+	}
+	if isEof {
+		r.RingEof = true
+	}
+	r.CVar.Broadcast()
+	return true
+}
+
+func (r *FdReader) ringSendReady() bool {
+	hasData := len(r.Ring) > 0 || r.RingEof
+	return hasData && r.WindowSize-r.BufSize > 0 && !r.Paused && !r.MemPaused && !r.packetsInFlightFull()
+}
+
+// sends the ring data as the ack window opens, returns (closing doneCh) once the EOF is sent or
+// the reader is closed
+func (r *FdReader) ringSendLoop(doneCh chan bool) {
+	defer close(doneCh)
+	for {
+		r.CVar.L.Lock()
+		for !r.Closed && !r.ringSendReady() {
+			r.CVar.Wait()
+		}
+		if r.Closed {
+			r.CVar.L.Unlock()
+			return
+		}
+		sendLen := min(r.WindowSize-r.BufSize, len(r.Ring))
+		data := append([]byte(nil), r.Ring[0:sendLen]...)
+		r.Ring = r.Ring[sendLen:]
+		isEof := r.RingEof && len(r.Ring) == 0
+		r.CVar.L.Unlock()
+		if !r.WriteWait(data, isEof) || isEof {
+			return
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+// an escape sequence that grows past this is not one we understand, it is sent through unchanged
+const MaxEscapeSeqSize = 4096
+
+const (
+	ansiGround = iota
+	ansiEsc
+	ansiEscInter  // ESC followed by intermediate bytes (0x20-0x2f)
+	ansiCsi       // ESC [
+	ansiString    // OSC, DCS, SOS, PM, APC (terminated by BEL or ST)
+	ansiStringEsc // ESC inside a string, "\" completes the ST
+)
+
+// parser state is kept between calls, so sequences split across reads are handled
+type ansiFilter struct {
+	State       int
+	Seq         []byte // the partial sequence (starting with ESC)
+	TranslateFn func(seq []byte) []byte
+}
+
+// returns a Transform (see SetFdTransform) that passes every complete escape sequence to
+// translateFn and sends what it returns instead (nil translateFn strips them).  seq is only
+// valid during the call.  a sequence split across reads is held until it is complete (an
+// incomplete sequence at EOF is dropped).
+func MakeAnsiFilter(translateFn func(seq []byte) []byte) func([]byte) []byte {
+	filter := &ansiFilter{TranslateFn: translateFn}
+	return filter.filter
+}
+
+// strips (or translates, see MakeAnsiFilter) the escape sequences read from fdNum
+func (m *Multiplexer) SetFdSanitizer(fdNum int, translateFn func(seq []byte) []byte) error {
+	return m.SetFdTransform(fdNum, MakeAnsiFilter(translateFn))
+}
+
+func (f *ansiFilter) filter(data []byte) []byte {
+	var rtn []byte
+	for _, ch := range data {
+		if f.State == ansiGround {
+			if ch == 0x1b {
+				f.Seq = append(f.Seq[:0], ch)
+				f.State = ansiEsc
+				continue
+			}
+			rtn = append(rtn, ch)
+			continue
+		}
+		f.Seq = append(f.Seq, ch)
+		switch f.State {
+		case ansiEsc:
+			switch {
+			case ch == '[':
+				f.State = ansiCsi
+			case ch == ']' || ch == 'P' || ch == 'X' || ch == '^' || ch == '_':
+				f.State = ansiString
+			case ch >= 0x20 && ch <= 0x2f:
+				f.State = ansiEscInter
+			default:
+				rtn = f.endSeq(rtn)
+			}
+		case ansiEscInter:
+			if ch >= 0x30 && ch <= 0x7e {
+				rtn = f.endSeq(rtn)
+			}
+		case ansiCsi:
+			if ch >= 0x40 && ch <= 0x7e {
+				rtn = f.endSeq(rtn)
+			}
+		case ansiString:
+			if ch == 0x07 {
+				rtn = f.endSeq(rtn)
+			} else if ch == 0x1b {
+				f.State = ansiStringEsc
+			}
+		case ansiStringEsc:
+			if ch == '\\' {
+				rtn = f.endSeq(rtn)
+			} else {
+				f.State = ansiString
+			}
+		}
+		if f.State != ansiGround && len(f.Seq) > MaxEscapeSeqSize {
+			rtn = append(rtn, f.Seq...)
+			f.Seq = f.Seq[:0]
+			f.State = ansiGround
+		}
+	}
+	return rtn
+}
+
+func (f *ansiFilter) endSeq(rtn []byte) []byte {
+	if f.TranslateFn != nil {
+		rtn = append(rtn, f.TranslateFn(f.Seq)...)
+	}
+	f.Seq = f.Seq[:0]
+	f.State = ansiGround
+	return rtn
+}
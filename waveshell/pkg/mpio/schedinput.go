@@ -0,0 +1,66 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"fmt"
+	"time"
+)
+
+// one entry for ScheduleInput, Data is written to the writer for FdNum Delay after the previous
+// entry (after IO starts for the first one)
+type ScheduledInput struct {
+	FdNum int
+	Delay time.Duration
+	Data  []byte
+}
+
+// feeds a sequence of inputs to the writers (e.g. "yes\n" to a prompt in a scripted session).
+// inputs scheduled before starting IO begin as IO starts, a later call begins immediately.  the
+// delays use Clock.  an input for an fd without a writer (or a writer that is closed) stops the
+// sequence with an EventScheduledInputError.
+func (m *Multiplexer) ScheduleInput(inputs []ScheduledInput) {
+	m.Lock.Lock()
+	started := m.Started
+	if !started {
+		m.scheduledInputs = append(m.scheduledInputs, inputs...)
+	}
+	m.Lock.Unlock()
+	if started {
+		go m.runScheduledInput(inputs)
+	}
+}
+
+func (m *Multiplexer) startScheduledInput() {
+	m.Lock.Lock()
+	inputs := m.scheduledInputs
+	m.scheduledInputs = nil
+	m.Lock.Unlock()
+	if len(inputs) > 0 {
+		go m.runScheduledInput(inputs)
+	}
+}
+
+func (m *Multiplexer) runScheduledInput(inputs []ScheduledInput) {
+	for idx, input := range inputs {
+		if input.Delay > 0 {
+			timer := m.Clock.NewTimer(input.Delay)
+			select {
+			case <-timer.C():
+			case <-m.closeCh:
+				timer.Stop()
+				return
+			}
+		}
+		fw, err := m.getFdWriter(input.FdNum)
+		if err == nil {
+			err = fw.addDataWait(input.Data, false)
+		}
+		if err != nil {
+			err = fmt.Errorf("scheduled input #%d: %w", idx, err)
+			m.emitEvent(&MuxEvent{Type: EventScheduledInputError, FdNum: input.FdNum, Error: err})
+			return
+		}
+	}
+}
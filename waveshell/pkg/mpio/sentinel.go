@@ -0,0 +1,58 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"bytes"
+)
+
+// for protocols that mark EOF in the stream: once sentinel appears in the data for fdNum, the bytes
+// before it are written and the writer closes as if the packet had Eof set (the sentinel and
+// anything after it are dropped, and not acked).  the sentinel can be split across packets, a
+// trailing partial match is held (unacked) until the next packet decides it.  set before any data
+// arrives for fdNum, nil to disable.
+func (m *Multiplexer) SetFdEofSentinel(fdNum int, sentinel []byte) error {
+	fw, err := m.getFdWriter(fdNum)
+	if err != nil {
+		return err
+	}
+	fw.CVar.L.Lock()
+	defer fw.CVar.L.Unlock()
+	fw.EofSentinel = nil
+	if len(sentinel) > 0 {
+		fw.EofSentinel = append([]byte(nil), sentinel...)
+	}
+	return nil
+}
+
+// returns the data to buffer and whether it ends the stream, must hold lock
+func (w *FdWriter) matchEofSentinel_nolock(data []byte, eof bool) ([]byte, bool) {
+	combined := data
+	if len(w.SentinelHeld) > 0 {
+		combined = append(w.SentinelHeld, data...)
+		w.SentinelHeld = nil
+	}
+	if idx := bytes.Index(combined, w.EofSentinel); idx >= 0 {
+		return combined[:idx], true
+	}
+	if eof {
+		return combined, true // the held bytes were not the sentinel
+	}
+	holdLen := partialSuffixLen(combined, w.EofSentinel)
+	if holdLen > 0 {
+		w.SentinelHeld = append([]byte(nil), combined[len(combined)-holdLen:]...)
+	}
+	return combined[:len(combined)-holdLen], false
+}
+
+// the longest suffix of data that is a (proper) prefix of sentinel
+func partialSuffixLen(data []byte, sentinel []byte) int {
+	maxLen := min(len(data), len(sentinel)-1)
+	for suffixLen := maxLen; suffixLen > 0; suffixLen-- {
+		if bytes.Equal(data[len(data)-suffixLen:], sentinel[:suffixLen]) {
+			return suffixLen
+		}
+	}
+	return 0
+}
@@ -0,0 +1,145 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/base"
+)
+
+const (
+	FdDirReader = "reader" // process output, sent as data packets
+	FdDirWriter = "writer" // process input, received as data packets
+	FdDirSplice = "splice" // reader proxied to a writer (see SpliceFds)
+)
+
+type FdSnapshot struct {
+	FdNum        int    `json:"fdnum"`
+	Dir          string `json:"dir"`
+	Desc         string `json:"desc,omitempty"`
+	IsPty        bool   `json:"ispty,omitempty"`
+	UnackedBytes int    `json:"unackedbytes,omitempty"` // reader: sent but not acked
+	Buffered     []byte `json:"buffered,omitempty"`     // writer: received but not written
+	Eof          bool   `json:"eof,omitempty"`
+	Closed       bool   `json:"closed,omitempty"`
+	CloseReason  string `json:"closereason,omitempty"`
+}
+
+// the multiplexer's bookkeeping (the OS fds themselves cannot be recovered)
+type MuxSnapshot struct {
+	CK  base.CommandKey `json:"ck"`
+	Fds []FdSnapshot    `json:"fds"`
+}
+
+func (snap *MuxSnapshot) GetFd(fdNum int, dir string) *FdSnapshot {
+	for idx := range snap.Fds {
+		if snap.Fds[idx].FdNum == fdNum && snap.Fds[idx].Dir == dir {
+			return &snap.Fds[idx]
+		}
+	}
+	return nil
+}
+
+func (r *FdReader) snapshot() FdSnapshot {
+	r.CVar.L.Lock()
+	defer r.CVar.L.Unlock()
+	return FdSnapshot{
+		FdNum:        r.FdNum,
+		Dir:          FdDirReader,
+		IsPty:        r.IsPty,
+		UnackedBytes: r.BufSize,
+		Closed:       r.Closed,
+		CloseReason:  r.CloseReason,
+	}
+}
+
+func (w *FdWriter) snapshot() FdSnapshot {
+	w.CVar.L.Lock()
+	defer w.CVar.L.Unlock()
+	var buffered []byte
+	if len(w.Buffer) > 0 {
+		buffered = make([]byte, len(w.Buffer))
+		copy(buffered, w.Buffer)
+	}
+	return FdSnapshot{
+		FdNum:       w.FdNum,
+		Dir:         FdDirWriter,
+		Desc:        w.Desc,
+		Buffered:    buffered,
+		Eof:         w.Eof,
+		Closed:      w.Closed,
+		CloseReason: w.CloseReason,
+	}
+}
+
+func (m *Multiplexer) SnapshotState() *MuxSnapshot {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	rtn := &MuxSnapshot{CK: m.CK}
+	for _, fr := range m.FdReaders {
+		rtn.Fds = append(rtn.Fds, fr.snapshot())
+	}
+	for _, fw := range m.FdWriters {
+		rtn.Fds = append(rtn.Fds, fw.snapshot())
+	}
+	sort.Slice(rtn.Fds, func(i int, j int) bool {
+		if rtn.Fds[i].FdNum == rtn.Fds[j].FdNum {
+			return rtn.Fds[i].Dir < rtn.Fds[j].Dir
+		}
+		return rtn.Fds[i].FdNum < rtn.Fds[j].FdNum
+	})
+	return rtn
+}
+
+func restoredCloseReason(fdSnap FdSnapshot) string {
+	if fdSnap.CloseReason == "" {
+		return CloseReasonTeardown
+	}
+	return fdSnap.CloseReason
+}
+
+// restores the bookkeeping from a snapshot onto a (not yet started) multiplexer.  the caller
+// must have already re-created the fds (Make*Pipe / MakeRaw*) for every fd in the snapshot.
+// reader ack windows are restored (so the client can resend acks) and writer buffers are re-queued.
+func (m *Multiplexer) RestoreState(snap *MuxSnapshot) error {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	if m.Started {
+		return fmt.Errorf("cannot restore state, multiplexer is already running")
+	}
+	for _, fdSnap := range snap.Fds {
+		if fdSnap.Dir == FdDirReader && m.FdReaders[fdSnap.FdNum] == nil {
+			return fmt.Errorf("cannot restore reader fd:%d: %w", fdSnap.FdNum, ErrNoSuchFd)
+		}
+		if fdSnap.Dir == FdDirWriter && m.FdWriters[fdSnap.FdNum] == nil {
+			return fmt.Errorf("cannot restore writer fd:%d: %w", fdSnap.FdNum, ErrNoSuchFd)
+		}
+	}
+	for _, fdSnap := range snap.Fds {
+		if fdSnap.Dir == FdDirReader {
+			fr := m.FdReaders[fdSnap.FdNum]
+			fr.CVar.L.Lock()
+			fr.BufSize = fdSnap.UnackedBytes
+			fr.NumAcked = -int64(fdSnap.UnackedBytes) // sent before the restore, not timed
+			fr.CVar.L.Unlock()
+			if fdSnap.Closed {
+				fr.closeWithReason(restoredCloseReason(fdSnap))
+			}
+			continue
+		}
+		fw := m.FdWriters[fdSnap.FdNum]
+		if fdSnap.Closed {
+			fw.closeWithReason(restoredCloseReason(fdSnap))
+			continue
+		}
+		fw.CVar.L.Lock()
+		fw.Buffer = append([]byte(nil), fdSnap.Buffered...)
+		fw.NumAdded = int64(len(fw.Buffer))
+		fw.Eof = fdSnap.Eof
+		fw.CVar.L.Unlock()
+	}
+	return nil
+}
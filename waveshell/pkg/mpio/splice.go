@@ -0,0 +1,67 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"fmt"
+	"sync"
+)
+
+// a reader whose data goes straight to a writer (never sent as packets)
+type fdSplice struct {
+	Src *FdReader
+	Dst *FdWriter
+}
+
+// proxies srcFd (a reader) to dstFd (a writer) locally, on linux with splice(2) when possible.
+// both fds are removed from the packet streams (no data packets or acks), dstFd is closed once
+// srcFd reaches EOF.  call before starting IO.
+func (m *Multiplexer) SpliceFds(srcFd int, dstFd int) error {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	if m.Started {
+		return fmt.Errorf("cannot splice fds, multiplexer is already running")
+	}
+	fr := m.FdReaders[srcFd]
+	if fr == nil {
+		return fmt.Errorf("cannot splice from fd:%d: %w", srcFd, ErrNoSuchFd)
+	}
+	fw := m.FdWriters[dstFd]
+	if fw == nil {
+		return fmt.Errorf("cannot splice to fd:%d: %w", dstFd, ErrNoSuchFd)
+	}
+	delete(m.FdReaders, srcFd)
+	delete(m.FdWriters, dstFd)
+	m.Splices = append(m.Splices, &fdSplice{Src: fr, Dst: fw})
+	return nil
+}
+
+func (s *fdSplice) run(wg *sync.WaitGroup) {
+	if wg != nil {
+		defer wg.Done()
+	}
+	defer s.Src.M.trackLoop(FdDirSplice, s.Src.FdNum)()
+	_, err := spliceCopy(s.Dst.Fd, s.Src.Fd)
+	if err != nil {
+		s.closeWithReason(CloseReasonError)
+		return
+	}
+	s.closeWithReason(CloseReasonEof)
+}
+
+func (s *fdSplice) closeWithReason(reason string) {
+	s.Src.closeWithReason(reason)
+	s.Dst.closeWithReason(reason)
+}
+
+func (m *Multiplexer) launchSplices(wg *sync.WaitGroup) {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	if wg != nil {
+		wg.Add(len(m.Splices))
+	}
+	for _, s := range m.Splices {
+		go s.run(wg)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const maxSpliceSize = 64 * 1024
+
+// moves data in-kernel with splice(2) when both ends are files (one must be a pipe), otherwise
+// (or if splice is not supported for these fds) falls back to a userspace copy
+func spliceCopy(dst io.Writer, src io.Reader) (int64, error) {
+	srcFile, srcOk := src.(*os.File)
+	dstFile, dstOk := dst.(*os.File)
+	if !srcOk || !dstOk {
+		return io.Copy(dst, src)
+	}
+	written, err := spliceFile(dstFile, srcFile)
+	if err == unix.EINVAL && written == 0 {
+		return io.Copy(dst, src)
+	}
+	return written, err
+}
+
+func isWritable(fd uintptr) bool {
+	pollFds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLOUT}}
+	n, err := unix.Poll(pollFds, 0)
+	return err == nil && n > 0
+}
+
+// uses the runtime poller (SyscallConn) to wait for src to be readable / dst to be writable, so
+// closing either file stops the copy
+func spliceFile(dst *os.File, src *os.File) (int64, error) {
+	srcConn, err := src.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	dstConn, err := dst.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var written int64
+	for {
+		var nw int64
+		var spliceErr error
+		readErr := srcConn.Read(func(srcFd uintptr) bool {
+			writeErr := dstConn.Write(func(dstFd uintptr) bool {
+				nw, spliceErr = unix.Splice(int(srcFd), nil, int(dstFd), nil, maxSpliceSize, unix.SPLICE_F_NONBLOCK|unix.SPLICE_F_MOVE)
+				// EAGAIN is either an empty src or a full dst, only wait here for a full dst
+				return spliceErr != unix.EAGAIN || isWritable(dstFd)
+			})
+			if writeErr != nil {
+				spliceErr = writeErr
+				return true
+			}
+			return spliceErr != unix.EAGAIN // src is empty, wait for it to be readable
+		})
+		if readErr != nil {
+			return written, readErr
+		}
+		if spliceErr != nil {
+			return written, spliceErr
+		}
+		if nw == 0 {
+			return written, nil // EOF
+		}
+		written += nw
+	}
+}
@@ -0,0 +1,15 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !linux
+
+package mpio
+
+import (
+	"io"
+)
+
+// splice(2) is linux only, always a userspace copy
+func spliceCopy(dst io.Writer, src io.Reader) (int64, error) {
+	return io.Copy(dst, src)
+}
@@ -0,0 +1,100 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
+)
+
+// session totals for the data packets sent by the multiplexer, see Stats()
+type MuxStats struct {
+	DataPackets int64 // data packets sent
+	RawBytes    int64 // data bytes before encoding (after Transform)
+	WireBytes   int64 // bytes on the wire, the encoded packet (in Format) and its framing
+
+	InDataPackets int64 // data packets received
+	InRawBytes    int64 // decoded data bytes received
+
+	// per reader fd, the moving average from sending a data packet to receiving the ack that
+	// completes it.  an rtt close to the time it takes to fill the window suggests a larger window.
+	AckRtt map[int]time.Duration
+}
+
+// each ack moves AckRtt 1/AckRttSmoothing of the way towards the new sample
+const AckRttSmoothing = 8
+
+// wire bytes per raw byte (~1.33 for base64 with large packets, close to 1 for msgpack), 0 if
+// nothing was sent
+func (s MuxStats) OverheadRatio() float64 {
+	if s.RawBytes == 0 {
+		return 0
+	}
+	return float64(s.WireBytes) / float64(s.RawBytes)
+}
+
+func (m *Multiplexer) Stats() MuxStats {
+	m.statsLock.Lock()
+	defer m.statsLock.Unlock()
+	rtn := m.stats
+	if m.stats.AckRtt != nil {
+		rtn.AckRtt = make(map[int]time.Duration, len(m.stats.AckRtt))
+		for fdNum, rtt := range m.stats.AckRtt {
+			rtn.AckRtt[fdNum] = rtt
+		}
+	}
+	return rtn
+}
+
+// called with the reader lock held (statsLock is only ever taken last)
+func (m *Multiplexer) setAckRtt(fdNum int, rtt time.Duration) {
+	m.statsLock.Lock()
+	defer m.statsLock.Unlock()
+	if m.stats.AckRtt == nil {
+		m.stats.AckRtt = make(map[int]time.Duration)
+	}
+	m.stats.AckRtt[fdNum] = rtt
+}
+
+// size of the packet as written by the sender, for json ("\n##<len><json>\n") the data is
+// marshaled separately (base64 and hex never need json escaping) so the payload is not encoded twice.
+func dataPacketWireSize(format string, pk *packet.DataPacketType) int {
+	if format == packet.FormatMsgpack {
+		outBytes, err := packet.MarshalMsgpackPacket(pk)
+		if err != nil {
+			return pk.DataLen()
+		}
+		return len(outBytes)
+	}
+	if pk.Encoding == packet.EncodingRaw || pk.Encoding == packet.EncodingBinary {
+		jsonBytes, err := json.Marshal(pk)
+		if err != nil {
+			return len(pk.Data64)
+		}
+		return len("\n##") + len(strconv.Itoa(len(jsonBytes))) + len(jsonBytes) + len("\n")
+	}
+	pkCopy := *pk
+	pkCopy.Data64 = ""
+	jsonBytes, err := json.Marshal(&pkCopy)
+	if err != nil {
+		return len(pk.Data64)
+	}
+	jsonLen := len(jsonBytes) + len(pk.Data64)
+	return len("\n##") + len(strconv.Itoa(jsonLen)) + jsonLen + len("\n")
+}
+
+// counted as reader packets are queued (once all fields are set)
+func (m *Multiplexer) addDataPacketStats(pk *packet.DataPacketType) {
+	rawLen := pk.DataLen()
+	wireSize := dataPacketWireSize(m.Format, pk)
+	m.statsLock.Lock()
+	defer m.statsLock.Unlock()
+	m.stats.DataPackets++
+	m.stats.RawBytes += int64(rawLen)
+	m.stats.WireBytes += int64(wireSize)
+	m.fdBytes[fdDirKey{FdNum: pk.FdNum, Dir: FdDirReader}] += int64(rawLen)
+}
@@ -0,0 +1,140 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/base"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
+)
+
+type fdDirKey struct {
+	FdNum int
+	Dir   string
+}
+
+type FdSummary struct {
+	FdNum       int    `json:"fdnum"`
+	Dir         string `json:"dir"`
+	Bytes       int64  `json:"bytes"`                 // reader: data sent, writer: data received
+	CloseReason string `json:"closereason,omitempty"` // empty if the fd was still open
+}
+
+// one end-of-session record (see SummaryLogger)
+type SessionSummary struct {
+	CK          base.CommandKey `json:"ck"`
+	TraceId     string          `json:"traceid,omitempty"`
+	Duration    time.Duration   `json:"duration"`
+	PacketsIn   int64           `json:"packetsin"` // data packets received
+	BytesIn     int64           `json:"bytesin"`
+	PacketsOut  int64           `json:"packetsout"` // data packets sent
+	BytesOut    int64           `json:"bytesout"`
+	WireBytes   int64           `json:"wirebytes"` // sent, including encoding and framing
+	Fds         []FdSummary     `json:"fds"`
+	ExitCode    *int            `json:"exitcode,omitempty"` // nil without a done packet
+	ExitSignal  int             `json:"exitsignal,omitempty"`
+	DoneError   string          `json:"doneerror,omitempty"`
+	SendErr     string          `json:"senderr,omitempty"`
+	ClosedEarly bool            `json:"closedearly,omitempty"` // the session was closed (Close, timeout, transport)
+}
+
+func (s *SessionSummary) String() string {
+	var fdStrs []string
+	for _, fd := range s.Fds {
+		fdStrs = append(fdStrs, fmt.Sprintf("%d:%s:%d:%s", fd.FdNum, fd.Dir, fd.Bytes, fd.CloseReason))
+	}
+	exitStr := "none"
+	if s.ExitCode != nil {
+		exitStr = fmt.Sprintf("%d", *s.ExitCode)
+		if s.ExitSignal != 0 {
+			exitStr += fmt.Sprintf(" sig=%d", s.ExitSignal)
+		}
+	}
+	ckStr := string(s.CK)
+	if s.TraceId != "" {
+		ckStr += " trace=" + s.TraceId
+	}
+	return fmt.Sprintf("summary[%s dur=%v in=%d/%d out=%d/%d wire=%d fds=[%s] exit=%s]", ckStr, s.Duration, s.BytesIn, s.PacketsIn, s.BytesOut, s.PacketsOut, s.WireBytes, strings.Join(fdStrs, " "), exitStr)
+}
+
+func (m *Multiplexer) addInDataStats(fdNum int, dataLen int) {
+	m.statsLock.Lock()
+	defer m.statsLock.Unlock()
+	m.stats.InDataPackets++
+	m.stats.InRawBytes += int64(dataLen)
+	m.fdBytes[fdDirKey{FdNum: fdNum, Dir: FdDirWriter}] += int64(dataLen)
+}
+
+// called as a reader or writer loop exits
+func (m *Multiplexer) recordFdClose(fdNum int, dir string, closeReason string) {
+	m.statsLock.Lock()
+	defer m.statsLock.Unlock()
+	m.fdCloses[fdDirKey{FdNum: fdNum, Dir: dir}] = closeReason
+}
+
+func (m *Multiplexer) makeSessionSummary(donePacket *packet.CmdDonePacketType) *SessionSummary {
+	m.Lock.Lock()
+	openFds := make(map[fdDirKey]string)
+	for fdNum, fr := range m.FdReaders {
+		openFds[fdDirKey{FdNum: fdNum, Dir: FdDirReader}] = fr.getCloseReason()
+	}
+	for fdNum, fw := range m.FdWriters {
+		if !fw.Pending {
+			openFds[fdDirKey{FdNum: fdNum, Dir: FdDirWriter}] = fw.getCloseReason()
+		}
+	}
+	startTs := m.StartTs
+	sendErr := m.SendErr
+	m.Lock.Unlock()
+	summary := &SessionSummary{CK: m.CK, TraceId: m.TraceId, Duration: m.Clock.Now().Sub(startTs)}
+	select {
+	case <-m.closeCh:
+		summary.ClosedEarly = true
+	default:
+	}
+	if sendErr != nil {
+		summary.SendErr = sendErr.Error()
+	}
+	if donePacket != nil {
+		exitCode := donePacket.ExitCode
+		summary.ExitCode = &exitCode
+		summary.ExitSignal = donePacket.ExitSignal
+		summary.DoneError = donePacket.Error
+	}
+	m.statsLock.Lock()
+	summary.PacketsIn = m.stats.InDataPackets
+	summary.BytesIn = m.stats.InRawBytes
+	summary.PacketsOut = m.stats.DataPackets
+	summary.BytesOut = m.stats.RawBytes
+	summary.WireBytes = m.stats.WireBytes
+	fdKeys := make(map[fdDirKey]bool)
+	for key := range m.fdBytes {
+		fdKeys[key] = true
+	}
+	for key := range m.fdCloses {
+		fdKeys[key] = true
+	}
+	for key := range openFds {
+		fdKeys[key] = true
+	}
+	for key := range fdKeys {
+		closeReason, ok := m.fdCloses[key]
+		if !ok {
+			closeReason = openFds[key]
+		}
+		summary.Fds = append(summary.Fds, FdSummary{FdNum: key.FdNum, Dir: key.Dir, Bytes: m.fdBytes[key], CloseReason: closeReason})
+	}
+	m.statsLock.Unlock()
+	sort.Slice(summary.Fds, func(i int, j int) bool {
+		if summary.Fds[i].FdNum == summary.Fds[j].FdNum {
+			return summary.Fds[i].Dir < summary.Fds[j].Dir
+		}
+		return summary.Fds[i].FdNum < summary.Fds[j].FdNum
+	})
+	return summary
+}
@@ -0,0 +1,73 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// a running ReadLoop, WriteLoop, or splice
+type loopInfo struct {
+	Id      int
+	Dir     string // FdDirReader, FdDirWriter, or FdDirSplice
+	FdNum   int
+	StartTs time.Time
+}
+
+// registers a running loop, call the returned func when the loop exits
+func (m *Multiplexer) trackLoop(dir string, fdNum int) func() {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	m.loopCounter++
+	info := &loopInfo{Id: m.loopCounter, Dir: dir, FdNum: fdNum, StartTs: m.Clock.Now()}
+	m.loops[info.Id] = info
+	return func() {
+		m.Lock.Lock()
+		defer m.Lock.Unlock()
+		delete(m.loops, info.Id)
+		if len(m.loops) == 0 && m.loopsDoneCh != nil {
+			close(m.loopsDoneCh)
+			m.loopsDoneCh = nil
+		}
+	}
+}
+
+// run after Close (with LeakCheckTimeout), emits an EventLoopLeak for every loop that has not
+// exited within the timeout (e.g. blocked in a Read that Close cannot interrupt)
+func (m *Multiplexer) checkLoopLeaks() {
+	m.Lock.Lock()
+	if len(m.loops) == 0 {
+		m.Lock.Unlock()
+		return
+	}
+	doneCh := make(chan bool)
+	m.loopsDoneCh = doneCh
+	m.Lock.Unlock()
+	timer := m.Clock.NewTimer(m.LeakCheckTimeout)
+	defer timer.Stop()
+	select {
+	case <-doneCh:
+		return
+	case <-timer.C():
+	}
+	now := m.Clock.Now()
+	for _, info := range m.runningLoops() {
+		err := fmt.Errorf("%s loop for fd:%d did not exit within %v of close", info.Dir, info.FdNum, m.LeakCheckTimeout)
+		m.emitEvent(&MuxEvent{Type: EventLoopLeak, FdNum: info.FdNum, Dir: info.Dir, Duration: now.Sub(info.StartTs), Error: err})
+	}
+}
+
+// sorted by start order
+func (m *Multiplexer) runningLoops() []loopInfo {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	var rtn []loopInfo
+	for _, info := range m.loops {
+		rtn = append(rtn, *info)
+	}
+	sort.Slice(rtn, func(i, j int) bool { return rtn[i].Id < rtn[j].Id })
+	return rtn
+}
@@ -0,0 +1,71 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
+)
+
+// MaxWirePacketSize values below this are raised to it (the packet fields alone take ~100 bytes)
+const MinWirePacketSize = 256
+
+// the most data bytes a packet for r can carry and stay under MaxWirePacketSize once encoded,
+// framed, and given the largest piggybacked ack.  0 for no limit.  must hold r.CVar.L.
+func (r *FdReader) maxWireDataLen() int {
+	maxWireSize := r.M.MaxWirePacketSize
+	if maxWireSize <= 0 {
+		return 0
+	}
+	if maxWireSize < MinWirePacketSize {
+		maxWireSize = MinWirePacketSize
+	}
+	template := packet.MakeDataPacket()
+	template.CK = r.M.CK
+	template.FdNum = r.FdNum
+	template.Eof = true
+	template.Dropped = r.RingDropped
+	template.Encoding = r.Encoding
+	template.TraceId = r.M.TraceId
+	if r.M.PiggybackAcks {
+		template.AckLen = math.MaxInt
+	}
+	if r.M.Format == packet.FormatMsgpack {
+		// one data byte so the bin field is in the template, its header grows to at most 5 bytes (bin32)
+		template.SetData(packet.EncodingBinary, []byte{0})
+		outBytes, err := packet.MarshalMsgpackPacket(template)
+		if err != nil {
+			return 0
+		}
+		dataLen := maxWireSize - (len(outBytes) - 3 + 5)
+		if dataLen < 1 {
+			return 1
+		}
+		return dataLen
+	}
+	jsonBytes, err := json.Marshal(template)
+	if err != nil {
+		return 0
+	}
+	// the length prefix can be no longer than the max size itself
+	budget := maxWireSize - len("\n##") - len(strconv.Itoa(maxWireSize)) - len(jsonBytes) - len("\n")
+	var dataLen int
+	switch r.Encoding {
+	case packet.EncodingHex:
+		dataLen = budget / 2
+	case packet.EncodingRaw:
+		dataLen = budget / 6 // json escapes control characters as \u00XX
+	case packet.EncodingBinary:
+		dataLen = (budget - len(`,"data":""`)) / 4 * 3 // json base64 encodes []byte
+	default:
+		dataLen = budget / 4 * 3
+	}
+	if dataLen < 1 {
+		return 1
+	}
+	return dataLen
+}
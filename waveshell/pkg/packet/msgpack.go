@@ -0,0 +1,103 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// serialization formats for the packet stream (see MakeFormatPacketSender and
+// PacketParserOpts.Format), both ends must use the same one
+const (
+	FormatJson    = "json"    // "##N{...}\n" lines (default)
+	FormatMsgpack = "msgpack" // [uint32 big-endian length][msgpack map] frames
+)
+
+// larger frames are treated as a corrupt stream
+const MaxMsgpackFrameSize = 64 * 1024 * 1024
+
+func IsValidFormat(format string) bool {
+	return format == "" || format == FormatJson || format == FormatMsgpack
+}
+
+// the packet struct is encoded as a msgpack map keyed by its json tags (so a non-go client uses
+// the json schema, omitempty fields are left out the same way).  []byte fields are sent as bin,
+// so a data packet set with EncodingBinary carries its payload as is.  returns the framed packet.
+func MarshalMsgpackPacket(pk PacketType) ([]byte, error) {
+	if pk == nil {
+		return nil, fmt.Errorf("invalid nil packet")
+	}
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 0, 0})
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	err := enc.Encode(pk)
+	if err != nil {
+		return nil, &SendError{IsMarshalError: true, PacketType: pk.GetType(), Err: err}
+	}
+	outBytes := buf.Bytes()
+	binary.BigEndian.PutUint32(outBytes[0:4], uint32(len(outBytes)-4))
+	return outBytes, nil
+}
+
+func makeMsgpackDecoder(r *bytes.Reader) *msgpack.Decoder {
+	dec := msgpack.NewDecoder(r)
+	dec.SetCustomStructTag("json")
+	// numbers in interface{} fields decode to int64/uint64/float64 (not the smallest wire type)
+	dec.UseLooseInterfaceDecoding(true)
+	return dec
+}
+
+// buf is one frame (without the length)
+func ParseMsgpackPacket(buf []byte) (PacketType, error) {
+	var header struct {
+		Type string `json:"type"`
+	}
+	err := makeMsgpackDecoder(bytes.NewReader(buf)).Decode(&header)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := MakePacket(header.Type)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(buf)
+	err = makeMsgpackDecoder(r).Decode(pk)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %q packet: %w", header.Type, err)
+	}
+	if r.Len() > 0 {
+		return nil, fmt.Errorf("invalid msgpack packet, %d trailing bytes", r.Len())
+	}
+	return pk, nil
+}
+
+// io.EOF only at a frame boundary
+func readMsgpackFrame(r *bufio.Reader) ([]byte, error) {
+	var lenBuf [4]byte
+	_, err := io.ReadFull(r, lenBuf[:])
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("truncated msgpack frame length")
+		}
+		return nil, err
+	}
+	frameLen := binary.BigEndian.Uint32(lenBuf[:])
+	if frameLen > MaxMsgpackFrameSize {
+		return nil, fmt.Errorf("msgpack frame too large (%d bytes, max %d)", frameLen, MaxMsgpackFrameSize)
+	}
+	frame := make([]byte, frameLen)
+	_, err = io.ReadFull(r, frame)
+	if err != nil {
+		return nil, fmt.Errorf("truncated msgpack frame: %w", err)
+	}
+	return frame, nil
+}
@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,6 +15,8 @@ import (
 	"os"
 	"reflect"
 	"sync"
+	"syscall"
+	"unicode/utf8"
 
 	"github.com/wavetermdev/waveterm/waveshell/pkg/base"
 )
@@ -59,6 +62,9 @@ const (
 	WriteFileReadyPacketStr = "writefileready" // rpc-response
 	WriteFileDonePacketStr  = "writefiledone"  // rpc-response
 	FileDataPacketStr       = "filedata"
+	KeepAlivePacketStr      = "keepalive" // command, liveness only (carries no data)
+	MuxHelloPacketStr       = "muxhello"  // command, flow-control capabilities (sent first when enabled)
+	UrgentPacketStr         = "urgent"    // command, control handled ahead of queued data (see PacketParser.UrgentCh)
 
 	OpenAIPacketStr   = "openai" // other
 	OpenAICloudReqStr = "openai-cloudreq"
@@ -100,6 +106,9 @@ func init() {
 	TypeStrToFactory[WriteFilePacketStr] = reflect.TypeOf(WriteFilePacketType{})
 	TypeStrToFactory[WriteFileReadyPacketStr] = reflect.TypeOf(WriteFileReadyPacketType{})
 	TypeStrToFactory[WriteFileDonePacketStr] = reflect.TypeOf(WriteFileDonePacketType{})
+	TypeStrToFactory[KeepAlivePacketStr] = reflect.TypeOf(KeepAlivePacketType{})
+	TypeStrToFactory[MuxHelloPacketStr] = reflect.TypeOf(MuxHelloPacketType{})
+	TypeStrToFactory[UrgentPacketStr] = reflect.TypeOf(UrgentPacketType{})
 
 	var _ RpcPacketType = (*RunPacketType)(nil)
 	var _ RpcPacketType = (*GetCmdPacketType)(nil)
@@ -123,6 +132,9 @@ func init() {
 	var _ CommandPacketType = (*CmdDonePacketType)(nil)
 	var _ CommandPacketType = (*SpecialInputPacketType)(nil)
 	var _ CommandPacketType = (*CmdFinalPacketType)(nil)
+	var _ CommandPacketType = (*KeepAlivePacketType)(nil)
+	var _ CommandPacketType = (*MuxHelloPacketType)(nil)
+	var _ CommandPacketType = (*UrgentPacketType)(nil)
 }
 
 func RegisterPacketType(typeStr string, rtype reflect.Type) {
@@ -211,9 +223,25 @@ type DataPacketType struct {
 	Type   string          `json:"type"`
 	CK     base.CommandKey `json:"ck"`
 	FdNum  int             `json:"fdnum"`
-	Data64 string          `json:"data64"` // base64 encoded
+	Data64 string          `json:"data64"`         // base64 encoded (unless Encoding is set)
+	Data   []byte          `json:"data,omitempty"` // with EncodingBinary, the raw bytes (bin in msgpack, base64 in json)
 	Eof    bool            `json:"eof,omitempty"`
 	Error  string          `json:"error,omitempty"`
+	ErrPos int64           `json:"errpos,omitempty"` // with Error, total bytes sent for this fd before the error
+	// segment boundary (no data), all earlier data on the fd belongs to segment number SegmentEnd
+	SegmentEnd int `json:"segmentend,omitempty"`
+	// for a resumable writer, the file offset to write Data at (resume after an interruption)
+	Offset *int64 `json:"offset,omitempty"`
+	// bytes discarded (ring buffer reader) between the previous data packet and this one
+	Dropped int `json:"dropped,omitempty"`
+	// piggybacked ack for the data the sender received on FdNum (same as a DataAckPacket)
+	AckLen int `json:"acklen,omitempty"`
+	// when set, Data64 is compressed with this scheme (negotiated with a MuxHelloPacket)
+	Compression string `json:"compression,omitempty"`
+	// how Data64 is encoded (see SetData), "" is base64
+	Encoding string `json:"encoding,omitempty"`
+	// correlation id of the sending session (for tracing across sessions, not used by the protocol)
+	TraceId string `json:"traceid,omitempty"`
 }
 
 func (*DataPacketType) GetType() string {
@@ -238,16 +266,96 @@ func B64DecodedLen(b64 string) int {
 	return realLen
 }
 
+// data packet encodings
+const (
+	EncodingBase64 = "base64"
+	EncodingHex    = "hex"
+	EncodingRaw    = "raw"
+	EncodingBinary = "binary" // Data instead of Data64, for msgpack streams
+)
+
+func IsValidDataEncoding(enc string) bool {
+	return enc == "" || enc == EncodingBase64 || enc == EncodingHex || enc == EncodingRaw || enc == EncodingBinary
+}
+
+// sets Data64 (or Data for EncodingBinary) using enc ("" is base64).  json strings cannot hold
+// arbitrary bytes, so raw is only used for valid utf-8, other data is sent as base64 (Encoding
+// says which was used).
+func (p *DataPacketType) SetData(enc string, data []byte) {
+	if enc == EncodingRaw && !utf8.Valid(data) {
+		enc = EncodingBase64
+	}
+	p.Data = nil
+	p.Data64 = ""
+	switch enc {
+	case EncodingBinary:
+		p.Data = data
+	case EncodingHex:
+		p.Data64 = hex.EncodeToString(data)
+	case EncodingRaw:
+		p.Data64 = string(data)
+	default:
+		enc = ""
+		p.Data64 = base64.StdEncoding.EncodeToString(data)
+	}
+	p.Encoding = enc
+}
+
+// decodes Data64 according to Encoding
+func (p *DataPacketType) GetData() ([]byte, error) {
+	switch p.Encoding {
+	case EncodingBinary:
+		return p.Data, nil
+	case "", EncodingBase64:
+		return base64.StdEncoding.DecodeString(p.Data64)
+	case EncodingHex:
+		return hex.DecodeString(p.Data64)
+	case EncodingRaw:
+		return []byte(p.Data64), nil
+	default:
+		return nil, fmt.Errorf("unknown data encoding %q", p.Encoding)
+	}
+}
+
+// decoded length of Data64 (without decoding it)
+func (p *DataPacketType) DataLen() int {
+	switch p.Encoding {
+	case EncodingBinary:
+		return len(p.Data)
+	case EncodingHex:
+		return len(p.Data64) / 2
+	case EncodingRaw:
+		return len(p.Data64)
+	default:
+		return B64DecodedLen(p.Data64)
+	}
+}
+
 func (p *DataPacketType) String() string {
-	eofStr := ""
+	extraStr := ""
 	if p.Eof {
-		eofStr = ", eof"
+		extraStr = ", eof"
 	}
 	errStr := ""
 	if p.Error != "" {
-		errStr = fmt.Sprintf(", err=%s", p.Error)
+		errStr = fmt.Sprintf(", err=%s (pos=%d)", p.Error, p.ErrPos)
+	}
+	if p.SegmentEnd > 0 {
+		extraStr += fmt.Sprintf(", segmentend=%d", p.SegmentEnd)
+	}
+	if p.Dropped > 0 {
+		extraStr += fmt.Sprintf(", dropped=%d", p.Dropped)
+	}
+	if p.AckLen > 0 {
+		extraStr += fmt.Sprintf(", acklen=%d", p.AckLen)
+	}
+	if p.Compression != "" {
+		extraStr += fmt.Sprintf(", compression=%s", p.Compression)
+	}
+	if p.Encoding != "" {
+		extraStr += fmt.Sprintf(", encoding=%s", p.Encoding)
 	}
-	return fmt.Sprintf("data[fd=%d, len=%d%s%s]", p.FdNum, B64DecodedLen(p.Data64), eofStr, errStr)
+	return fmt.Sprintf("data[fd=%d, len=%d%s%s]", p.FdNum, p.DataLen(), extraStr, errStr)
 }
 
 func MakeDataPacket() *DataPacketType {
@@ -267,12 +375,87 @@ func (*DataEndPacketType) GetType() string {
 	return DataEndPacketStr
 }
 
+type KeepAlivePacketType struct {
+	Type string          `json:"type"`
+	CK   base.CommandKey `json:"ck"`
+}
+
+func (*KeepAlivePacketType) GetType() string {
+	return KeepAlivePacketStr
+}
+
+func (p *KeepAlivePacketType) GetCK() base.CommandKey {
+	return p.CK
+}
+
+func MakeKeepAlivePacket(ck base.CommandKey) *KeepAlivePacketType {
+	return &KeepAlivePacketType{Type: KeepAlivePacketStr, CK: ck}
+}
+
+// advertises what the sender can receive: the max unacked data bytes per fd, the largest data
+// packet (decoded bytes), and the compression schemes it understands
+type MuxHelloPacketType struct {
+	Type          string          `json:"type"`
+	CK            base.CommandKey `json:"ck"`
+	WindowSize    int             `json:"windowsize,omitempty"`
+	MaxPacketSize int             `json:"maxpacketsize,omitempty"`
+	Compression   []string        `json:"compression,omitempty"`
+}
+
+func (*MuxHelloPacketType) GetType() string {
+	return MuxHelloPacketStr
+}
+
+func (p *MuxHelloPacketType) GetCK() base.CommandKey {
+	return p.CK
+}
+
+func (p *MuxHelloPacketType) String() string {
+	return fmt.Sprintf("muxhello[window=%d maxpacket=%d compression=%v]", p.WindowSize, p.MaxPacketSize, p.Compression)
+}
+
+func MakeMuxHelloPacket(ck base.CommandKey) *MuxHelloPacketType {
+	return &MuxHelloPacketType{Type: MuxHelloPacketStr, CK: ck}
+}
+
+const (
+	UrgentActionAbortFd = "abortfd" // discard the fd's buffered data and close it
+	UrgentActionFlushFd = "flushfd" // send a pty reader's pending output now (see mpio FlushPtyReader)
+)
+
+type UrgentPacketType struct {
+	Type   string          `json:"type"`
+	CK     base.CommandKey `json:"ck"`
+	Action string          `json:"action"`
+	FdNum  int             `json:"fdnum"`
+}
+
+func (*UrgentPacketType) GetType() string {
+	return UrgentPacketStr
+}
+
+func (p *UrgentPacketType) GetCK() base.CommandKey {
+	return p.CK
+}
+
+func (p *UrgentPacketType) String() string {
+	return fmt.Sprintf("urgent[%s fd=%d]", p.Action, p.FdNum)
+}
+
+func MakeUrgentPacket(ck base.CommandKey, action string, fdNum int) *UrgentPacketType {
+	return &UrgentPacketType{Type: UrgentPacketStr, CK: ck, Action: action, FdNum: fdNum}
+}
+
 type DataAckPacketType struct {
 	Type   string          `json:"type"`
 	CK     base.CommandKey `json:"ck"`
 	FdNum  int             `json:"fdnum"`
 	AckLen int             `json:"acklen"`
-	Error  string          `json:"error,omitempty"`
+	EofAck bool            `json:"eofack,omitempty"` // writer flushed all data and closed the fd
+	// the process closed its end of the fd (EPIPE), further data for the fd will be rejected
+	ConsumerClosed bool   `json:"consumerclosed,omitempty"`
+	Error          string `json:"error,omitempty"`
+	TraceId        string `json:"traceid,omitempty"` // see DataPacketType.TraceId
 }
 
 func (*DataAckPacketType) GetType() string {
@@ -288,7 +471,14 @@ func (p *DataAckPacketType) String() string {
 	if p.Error != "" {
 		errStr = fmt.Sprintf(" err=%s", p.Error)
 	}
-	return fmt.Sprintf("ack[fd=%d, acklen=%d%s]", p.FdNum, p.AckLen, errStr)
+	eofStr := ""
+	if p.EofAck {
+		eofStr = " eof"
+	}
+	if p.ConsumerClosed {
+		eofStr += " consumerclosed"
+	}
+	return fmt.Sprintf("ack[fd=%d, acklen=%d%s%s]", p.FdNum, p.AckLen, eofStr, errStr)
 }
 
 func MakeDataAckPacket() *DataAckPacketType {
@@ -307,6 +497,7 @@ type SpecialInputPacketType struct {
 	CK      base.CommandKey `json:"ck"`
 	SigName string          `json:"signame,omitempty"` // passed to unix.SignalNum (needs 'SIG' prefix, e.g. "SIGTERM"), also accepts a number (e.g. "9")
 	WinSize *WinSize        `json:"winsize,omitempty"`
+	FdNum   *int            `json:"fdnum,omitempty"` // target pty for WinSize (nil for the default pty)
 }
 
 func (*SpecialInputPacketType) GetType() string {
@@ -545,6 +736,7 @@ type MessagePacketType struct {
 	Type    string          `json:"type"`
 	CK      base.CommandKey `json:"ck,omitempty"`
 	Message string          `json:"message"`
+	TraceId string          `json:"traceid,omitempty"` // see DataPacketType.TraceId
 }
 
 func (*MessagePacketType) GetType() string {
@@ -635,6 +827,10 @@ type CmdDonePacketType struct {
 	DurationMs     int64           `json:"durationms"`
 	FinalState     *ShellState     `json:"finalstate,omitempty"`
 	FinalStateDiff *ShellStateDiff `json:"finalstatediff,omitempty"`
+	Error          string          `json:"error,omitempty"`      // set when the command ended due to a transport (not process) error
+	Signaled       bool            `json:"signaled,omitempty"`   // the process was terminated by ExitSignal
+	ExitSignal     int             `json:"exitsignal,omitempty"` // signal number
+	CoreDumped     bool            `json:"coredumped,omitempty"`
 }
 
 func (*CmdDonePacketType) GetType() string {
@@ -649,6 +845,21 @@ func MakeCmdDonePacket(ck base.CommandKey) *CmdDonePacketType {
 	return &CmdDonePacketType{Type: CmdDonePacketStr, CK: ck}
 }
 
+// sets ExitCode and the signal details from the state of a waited-on process
+func (pk *CmdDonePacketType) SetProcessState(state *os.ProcessState) {
+	if state == nil {
+		return
+	}
+	pk.ExitCode = state.ExitCode()
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return
+	}
+	pk.Signaled = true
+	pk.ExitSignal = int(ws.Signal())
+	pk.CoreDumped = ws.CoreDump()
+}
+
 type CmdStartPacketType struct {
 	Type      string          `json:"type"`
 	RespId    string          `json:"respid,omitempty"`
@@ -975,10 +1186,20 @@ func MarshalPacket(packet PacketType) ([]byte, error) {
 }
 
 func SendPacket(w io.Writer, packet PacketType) error {
+	return sendFormatPacket(w, FormatJson, packet)
+}
+
+func sendFormatPacket(w io.Writer, format string, packet PacketType) error {
 	if packet == nil {
 		return nil
 	}
-	outBytes, err := MarshalPacket(packet)
+	var outBytes []byte
+	var err error
+	if format == FormatMsgpack {
+		outBytes, err = MarshalMsgpackPacket(packet)
+	} else {
+		outBytes, err = MarshalPacket(packet)
+	}
 	if err != nil {
 		return err
 	}
@@ -1003,9 +1224,23 @@ type PacketSender struct {
 	DoneCh     chan bool
 	ErrHandler func(*PacketSender, PacketType, error)
 	ExitErr    error
+	ChClosed   bool
 }
 
 func MakePacketSender(output io.Writer, errHandler func(*PacketSender, PacketType, error)) *PacketSender {
+	return makeFormatPacketSender(output, FormatJson, errHandler)
+}
+
+// a sender that writes packets in format (FormatJson or FormatMsgpack), the parser on the other end
+// must use the same format (PacketParserOpts.Format)
+func MakeFormatPacketSender(output io.Writer, format string, errHandler func(*PacketSender, PacketType, error)) (*PacketSender, error) {
+	if !IsValidFormat(format) {
+		return nil, fmt.Errorf("invalid packet format %q", format)
+	}
+	return makeFormatPacketSender(output, format, errHandler), nil
+}
+
+func makeFormatPacketSender(output io.Writer, format string, errHandler func(*PacketSender, PacketType, error)) *PacketSender {
 	sender := &PacketSender{
 		Lock:       &sync.Mutex{},
 		SendCh:     make(chan PacketType, PacketSenderQueueSize),
@@ -1013,23 +1248,27 @@ func MakePacketSender(output io.Writer, errHandler func(*PacketSender, PacketTyp
 		ErrHandler: errHandler,
 	}
 	go func() {
-		defer close(sender.DoneCh)
-		defer sender.Close()
 		for pk := range sender.SendCh {
-			err := SendPacket(output, pk)
+			err := sendFormatPacket(output, format, pk)
 			if err != nil {
 				sender.goHandleError(pk, err)
 				if serr, ok := err.(*SendError); ok && serr.IsMarshalError {
 					// marshaler errors are recoverable
 					continue
 				}
-				// write errors are not recoverable
+				// write errors are not recoverable.  mark Done so new packets fail fast (checkStatus),
+				// but do not close SendCh here (a concurrent SendPacket would panic).  in-flight senders
+				// never block, they give up once DoneCh is closed (the queued packets are dropped).
 				sender.Lock.Lock()
 				sender.ExitErr = err
+				sender.Done = true
 				sender.Lock.Unlock()
+				close(sender.DoneCh)
 				return
 			}
 		}
+		sender.Close()
+		close(sender.DoneCh)
 	}()
 	return sender
 }
@@ -1061,10 +1300,11 @@ func MakeChannelPacketSender(packetCh chan PacketType) *PacketSender {
 func (sender *PacketSender) Close() {
 	sender.Lock.Lock()
 	defer sender.Lock.Unlock()
-	if sender.Done {
+	sender.Done = true
+	if sender.ChClosed {
 		return
 	}
-	sender.Done = true
+	sender.ChClosed = true
 	close(sender.SendCh)
 }
 
@@ -1097,6 +1337,8 @@ func (sender *PacketSender) SendPacketCtx(ctx context.Context, pk PacketType) er
 	select {
 	case sender.SendCh <- pk:
 		return nil
+	case <-sender.DoneCh:
+		return sender.checkStatus()
 	case <-ctx.Done():
 		return ctx.Err()
 	}
@@ -1107,8 +1349,13 @@ func (sender *PacketSender) SendPacket(pk PacketType) error {
 	if err != nil {
 		return err
 	}
-	sender.SendCh <- pk
-	return nil
+	select {
+	case sender.SendCh <- pk:
+		return nil
+	case <-sender.DoneCh:
+		// the write loop exited on an error, nothing reads SendCh anymore
+		return sender.checkStatus()
+	}
 }
 
 func (sender *PacketSender) SendCmdError(ck base.CommandKey, err error) error {
@@ -1164,6 +1411,13 @@ func (upr MessageUPR) UnknownPacket(pk PacketType) {
 // todo: clean hanging entries in RunMap when in server mode
 type RunPacketBuilder struct {
 	RunMap map[base.CommandKey]*RunPacketType
+
+	// when > 0, run data past this total (across the pending run packets) is dropped, the
+	// RunData.DataLen check then rejects the run
+	MaxTotalRunData int
+	// optional, called with the new total each time run data is buffered
+	OnRunDataGrow func(total int)
+	totalRunData  int
 }
 
 func MakeRunPacketBuilder() *RunPacketBuilder {
@@ -1172,6 +1426,19 @@ func MakeRunPacketBuilder() *RunPacketBuilder {
 	}
 }
 
+func runDataSize(runPacket *RunPacketType) int {
+	rtn := 0
+	for _, runData := range runPacket.RunData {
+		rtn += len(runData.Data)
+	}
+	return rtn
+}
+
+// total run data buffered for the pending run packets
+func (b *RunPacketBuilder) TotalRunData() int {
+	return b.totalRunData
+}
+
 // returns (consumed, fullRunPacket)
 func (b *RunPacketBuilder) ProcessPacket(pk PacketType) (bool, *RunPacketType) {
 	if pk.GetType() == RunPacketStr {
@@ -1179,13 +1446,20 @@ func (b *RunPacketBuilder) ProcessPacket(pk PacketType) (bool, *RunPacketType) {
 		if len(runPacket.RunData) == 0 {
 			return true, runPacket
 		}
+		if oldPacket := b.RunMap[runPacket.CK]; oldPacket != nil {
+			b.totalRunData -= runDataSize(oldPacket)
+		}
 		b.RunMap[runPacket.CK] = runPacket
+		b.totalRunData += runDataSize(runPacket)
 		return true, nil
 	}
 	if pk.GetType() == DataEndPacketStr {
 		endPacket := pk.(*DataEndPacketType)
 		runPacket := b.RunMap[endPacket.CK] // might be nil
 		delete(b.RunMap, endPacket.CK)
+		if runPacket != nil {
+			b.totalRunData -= runDataSize(runPacket)
+		}
 		return true, runPacket
 	}
 	if pk.GetType() == DataPacketStr {
@@ -1197,9 +1471,16 @@ func (b *RunPacketBuilder) ProcessPacket(pk PacketType) (bool, *RunPacketType) {
 		for idx, runData := range runPacket.RunData {
 			if runData.FdNum == dataPacket.FdNum {
 				// can ignore error, will get caught later with RunData.DataLen check
-				realData, _ := base64.StdEncoding.DecodeString(dataPacket.Data64)
+				realData, _ := dataPacket.GetData()
+				if b.MaxTotalRunData > 0 && b.totalRunData+len(realData) > b.MaxTotalRunData {
+					break
+				}
 				runData.Data = append(runData.Data, realData...)
 				runPacket.RunData[idx] = runData
+				b.totalRunData += len(realData)
+				if b.OnRunDataGrow != nil && len(realData) > 0 {
+					b.OnRunDataGrow(b.totalRunData)
+				}
 				break
 			}
 		}
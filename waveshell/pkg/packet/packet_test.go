@@ -0,0 +1,196 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/base"
+)
+
+func makeRunDataPacket(ck base.CommandKey, fdNum int, data string) *DataPacketType {
+	pk := MakeDataPacket()
+	pk.CK = ck
+	pk.FdNum = fdNum
+	pk.Data64 = base64.StdEncoding.EncodeToString([]byte(data))
+	return pk
+}
+
+func TestRunDataGrow(t *testing.T) {
+	ck := base.MakeCommandKey("testsession", "testcmd")
+	builder := MakeRunPacketBuilder()
+	builder.MaxTotalRunData = 12
+	var totals []int
+	builder.OnRunDataGrow = func(total int) { totals = append(totals, total) }
+	runPacket := MakeRunPacket()
+	runPacket.CK = ck
+	runPacket.RunData = []RunDataType{{FdNum: 3, DataLen: 8}, {FdNum: 4, DataLen: 6}}
+	builder.ProcessPacket(runPacket)
+	for _, pk := range []*DataPacketType{
+		makeRunDataPacket(ck, 3, "abcd"),
+		makeRunDataPacket(ck, 4, "xyz"),
+		makeRunDataPacket(ck, 3, "efgh"),
+		makeRunDataPacket(ck, 4, "uvw"), // over MaxTotalRunData, dropped
+	} {
+		if consumed, _ := builder.ProcessPacket(pk); !consumed {
+			t.Fatalf("run data packet not consumed")
+		}
+	}
+	if len(totals) != 3 || totals[0] != 4 || totals[1] != 7 || totals[2] != 11 {
+		t.Fatalf("expected increasing totals [4 7 11], got %v", totals)
+	}
+	endPacket := MakeDataEndPacket(ck)
+	_, fullPacket := builder.ProcessPacket(endPacket)
+	if fullPacket == nil || string(fullPacket.RunData[0].Data) != "abcdefgh" || string(fullPacket.RunData[1].Data) != "xyz" {
+		t.Fatalf("unexpected run packet %v", fullPacket)
+	}
+	if builder.TotalRunData() != 0 {
+		t.Fatalf("expected no run data buffered after the run packet completed, got %d", builder.TotalRunData())
+	}
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	ck := base.MakeCommandKey("testsession", "testcmd")
+	dataPk := makeRunDataPacket(ck, 1, strings.Repeat("x", 300))
+	dataPk.AckLen = -70000
+	dataPk.Eof = true
+	fdNum := 3
+	sinputPk := MakeSpecialInputPacket()
+	sinputPk.CK = ck
+	sinputPk.WinSize = &WinSize{Rows: 40, Cols: 120}
+	sinputPk.FdNum = &fdNum
+	respPk := MakeResponsePacket("req1", map[string]interface{}{"list": []interface{}{1.5, "two", nil, true}, "big": 1 << 40})
+	var stream bytes.Buffer
+	for _, pk := range []PacketType{dataPk, sinputPk, respPk} {
+		frame, err := MarshalMsgpackPacket(pk)
+		if err != nil {
+			t.Fatalf("error marshaling %s: %v", pk.GetType(), err)
+		}
+		stream.Write(frame)
+	}
+	jsonLen := 0
+	parser := MakePacketParser(bytes.NewReader(stream.Bytes()), &PacketParserOpts{Format: FormatMsgpack})
+	for _, want := range []PacketType{dataPk, sinputPk, respPk} {
+		got := <-parser.MainCh
+		if got == nil {
+			t.Fatalf("parser closed early: %v", parser.GetErr())
+		}
+		wantJson, _ := json.Marshal(want)
+		gotJson, _ := json.Marshal(got)
+		jsonLen += len(wantJson)
+		if !bytes.Equal(wantJson, gotJson) {
+			t.Fatalf("round trip mismatch:\n  sent %s\n  got  %s", wantJson, gotJson)
+		}
+	}
+	if _, ok := <-parser.MainCh; ok || parser.GetErr() != nil {
+		t.Fatalf("expected a clean end of stream, err=%v", parser.GetErr())
+	}
+	if stream.Len() >= jsonLen {
+		t.Fatalf("msgpack (%d bytes) should be smaller than json (%d bytes)", stream.Len(), jsonLen)
+	}
+	// a truncated frame is a parser error
+	parser = MakePacketParser(io.LimitReader(bytes.NewReader(stream.Bytes()), 20), &PacketParserOpts{Format: FormatMsgpack})
+	for range parser.MainCh {
+	}
+	if parser.GetErr() == nil {
+		t.Fatalf("expected an error for a truncated frame")
+	}
+}
+
+func TestMsgpackSize(t *testing.T) {
+	ck := base.MakeCommandKey("testsession", "testcmd")
+	payload := make([]byte, 4096)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	dataPk := MakeDataPacket()
+	dataPk.CK = ck
+	dataPk.FdNum = 1
+	dataPk.SetData(EncodingBinary, payload)
+	hexPk := MakeDataPacket()
+	hexPk.CK = ck
+	hexPk.SetData(EncodingHex, []byte("hex-data"))
+	runPk := MakeRunPacket()
+	runPk.CK = ck
+	runPk.Command = "ls -l"
+	runPk.State = &ShellState{Version: "bash v5.1.0", Cwd: "/tmp", ShellVars: []byte("A=1\x00B=2")}
+	runPk.Fds = []RemoteFd{{FdNum: 0, Read: true}}
+	runPk.RunData = []RunDataType{{FdNum: 3, DataLen: 5}}
+	for _, pk := range []PacketType{dataPk, hexPk, runPk} {
+		frame, err := MarshalMsgpackPacket(pk)
+		if err != nil {
+			t.Fatalf("error marshaling %s: %v", pk.GetType(), err)
+		}
+		got, err := ParseMsgpackPacket(frame[4:])
+		if err != nil {
+			t.Fatalf("error parsing %s: %v", pk.GetType(), err)
+		}
+		wantJson, _ := json.Marshal(pk)
+		gotJson, _ := json.Marshal(got)
+		if !bytes.Equal(wantJson, gotJson) {
+			t.Fatalf("round trip mismatch:\n  sent %s\n  got  %s", wantJson, gotJson)
+		}
+	}
+	// the payload is sent as bin, not as its base64 text
+	frame, _ := MarshalMsgpackPacket(dataPk)
+	jsonFrame, _ := MarshalPacket(dataPk)
+	if !bytes.Contains(frame, payload) || len(frame) > len(payload)+100 {
+		t.Fatalf("msgpack data packet is %d bytes (json %d) for a %d byte payload", len(frame), len(jsonFrame), len(payload))
+	}
+	// a binary data packet still round trips over json (Data is base64 there)
+	parser := MakePacketParser(bytes.NewReader(jsonFrame), nil)
+	jsonPk, ok := (<-parser.MainCh).(*DataPacketType)
+	if !ok {
+		t.Fatalf("expected a data packet over json, err=%v", parser.GetErr())
+	}
+	if data, _ := jsonPk.GetData(); !bytes.Equal(data, payload) {
+		t.Fatalf("binary data packet mismatch over json (got %d bytes)", len(data))
+	}
+	ackPk := MakeDataAckPacket()
+	ackPk.CK = ck
+	ackPk.FdNum = 1
+	ackPk.AckLen = 65536
+	frame, _ = MarshalMsgpackPacket(ackPk)
+	jsonFrame, _ = MarshalPacket(ackPk)
+	if len(frame) >= len(jsonFrame) {
+		t.Fatalf("msgpack ack packet is %d bytes, json %d", len(frame), len(jsonFrame))
+	}
+}
+
+type failWriter struct{}
+
+func (failWriter) Write(data []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func TestSenderWriteErrorNoLeak(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		sender := MakePacketSender(failWriter{}, nil)
+		sender.SendPacket(MakeMessagePacket("first"))
+		if err := sender.WaitForDone(); err == nil {
+			t.Fatalf("expected a write error from WaitForDone")
+		}
+		// more than the queue holds, none may block (Close is never called)
+		for j := 0; j < PacketSenderQueueSize+10; j++ {
+			if err := sender.SendPacket(MakeMessagePacket("after")); err == nil {
+				t.Fatalf("send after a write error should fail")
+			}
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			t.Fatalf("sender goroutines leaked, %d running (baseline %d)", runtime.NumGoroutine(), baseline)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
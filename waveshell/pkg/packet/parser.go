@@ -6,6 +6,7 @@ package packet
 import (
 	"bufio"
 	"context"
+	"fmt"
 	"io"
 	"strconv"
 	"strings"
@@ -15,6 +16,7 @@ import (
 type PacketParser struct {
 	Lock       *sync.Mutex
 	MainCh     chan PacketType
+	UrgentCh   chan PacketType // nil unless enabled (PacketParserOpts.UrgentQueueSize), UrgentPackets skip MainCh
 	RpcMap     map[string]*RpcEntry
 	RpcHandler bool
 	Err        error
@@ -46,6 +48,26 @@ func CombinePacketParsers(p1 *PacketParser, p2 *PacketParser, rpcHandler bool) *
 		RpcMap:     make(map[string]*RpcEntry),
 		RpcHandler: rpcHandler,
 	}
+	if p1.UrgentCh != nil || p2.UrgentCh != nil {
+		rtnParser.UrgentCh = make(chan PacketType, cap(p1.UrgentCh)+cap(p2.UrgentCh))
+		var urgentWg sync.WaitGroup
+		for _, urgentCh := range []chan PacketType{p1.UrgentCh, p2.UrgentCh} {
+			if urgentCh == nil {
+				continue
+			}
+			urgentWg.Add(1)
+			go func(urgentCh chan PacketType) {
+				defer urgentWg.Done()
+				for pk := range urgentCh {
+					rtnParser.UrgentCh <- pk
+				}
+			}(urgentCh)
+		}
+		go func() {
+			urgentWg.Wait()
+			close(rtnParser.UrgentCh)
+		}()
+	}
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
@@ -180,6 +202,11 @@ func (p *PacketParser) SetErr(err error) {
 type PacketParserOpts struct {
 	RpcHandler       bool
 	IgnoreUntilValid bool
+	ReadAhead        int // MainCh buffer, packets parsed ahead of the consumer (an UrgentPacket can pass them)
+	UrgentQueueSize  int // when > 0, UrgentPackets are sent on UrgentCh instead of MainCh
+
+	// FormatJson (default) or FormatMsgpack, must match the sender (see MakeFormatPacketSender)
+	Format string
 }
 
 func MakePacketParser(input io.Reader, opts *PacketParserOpts) *PacketParser {
@@ -188,16 +215,30 @@ func MakePacketParser(input io.Reader, opts *PacketParserOpts) *PacketParser {
 	}
 	parser := &PacketParser{
 		Lock:       &sync.Mutex{},
-		MainCh:     make(chan PacketType),
+		MainCh:     make(chan PacketType, opts.ReadAhead),
 		RpcMap:     make(map[string]*RpcEntry),
 		RpcHandler: opts.RpcHandler,
 	}
+	if opts.UrgentQueueSize > 0 {
+		parser.UrgentCh = make(chan PacketType, opts.UrgentQueueSize)
+	}
 	ignoreUntilValid := opts.IgnoreUntilValid
 	bufReader := bufio.NewReader(input)
 	go func() {
 		defer func() {
 			close(parser.MainCh)
+			if parser.UrgentCh != nil {
+				close(parser.UrgentCh)
+			}
 		}()
+		if !IsValidFormat(opts.Format) {
+			parser.SetErr(fmt.Errorf("invalid packet format %q", opts.Format))
+			return
+		}
+		if opts.Format == FormatMsgpack {
+			parser.readMsgpackPackets(bufReader)
+			return
+		}
 		for {
 			line, err := bufReader.ReadString('\n')
 			if err == io.EOF {
@@ -235,20 +276,54 @@ func MakePacketParser(input io.Reader, opts *PacketParserOpts) *PacketParser {
 				parser.MainCh <- MakeRawPacket(line[:len(line)-1])
 				continue
 			}
-			if pk.GetType() == DonePacketStr {
+			if !parser.dispatchPacket(pk) {
 				return
 			}
-			if pk.GetType() == PingPacketStr {
-				continue
-			}
-			if parser.RpcHandler {
-				sent := parser.trySendRpcResponse(pk)
-				if sent {
-					continue
-				}
-			}
-			parser.MainCh <- pk
 		}
 	}()
 	return parser
 }
+
+// msgpack frames carry no text, a frame that cannot be read or parsed ends the stream (SetErr)
+func (p *PacketParser) readMsgpackPackets(r *bufio.Reader) {
+	for {
+		frame, err := readMsgpackFrame(r)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			p.SetErr(err)
+			return
+		}
+		pk, err := ParseMsgpackPacket(frame)
+		if err != nil {
+			p.SetErr(fmt.Errorf("invalid msgpack packet: %w", err))
+			return
+		}
+		if !p.dispatchPacket(pk) {
+			return
+		}
+	}
+}
+
+// returns false for a done packet (the stream is over)
+func (p *PacketParser) dispatchPacket(pk PacketType) bool {
+	if pk.GetType() == DonePacketStr {
+		return false
+	}
+	if pk.GetType() == PingPacketStr {
+		return true
+	}
+	if p.RpcHandler {
+		sent := p.trySendRpcResponse(pk)
+		if sent {
+			return true
+		}
+	}
+	if p.UrgentCh != nil && pk.GetType() == UrgentPacketStr {
+		p.UrgentCh <- pk
+		return true
+	}
+	p.MainCh <- pk
+	return true
+}
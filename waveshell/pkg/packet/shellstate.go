@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/vmihailenco/msgpack/v5"
 	"github.com/wavetermdev/waveterm/waveshell/pkg/binpack"
 	"github.com/wavetermdev/waveterm/waveshell/pkg/statediff"
 	"golang.org/x/mod/semver"
@@ -82,6 +83,12 @@ func (state ShellState) MarshalJSON() ([]byte, error) {
 	return json.Marshal(encodedBytes)
 }
 
+// msgpack streams carry the same encoding as bin (see MarshalMsgpackPacket)
+func (state ShellState) EncodeMsgpack(enc *msgpack.Encoder) error {
+	_, encodedBytes := state.EncodeAndHash()
+	return enc.EncodeBytes(encodedBytes)
+}
+
 // caches HashVal in struct
 func (state *ShellState) GetHashVal(force bool) string {
 	if state.HashVal == "" || force {
@@ -116,6 +123,14 @@ func (state *ShellState) UnmarshalJSON(jsonBytes []byte) error {
 	return state.DecodeShellState(barr)
 }
 
+func (state *ShellState) DecodeMsgpack(dec *msgpack.Decoder) error {
+	barr, err := dec.DecodeBytes()
+	if err != nil {
+		return err
+	}
+	return state.DecodeShellState(barr)
+}
+
 func (sdiff ShellStateDiff) EncodeAndHash() (string, []byte) {
 	var buf bytes.Buffer
 	binpack.PackInt(&buf, ShellStateDiffPackVersion)
@@ -163,6 +178,19 @@ func (sdiff *ShellStateDiff) UnmarshalJSON(jsonBytes []byte) error {
 	return sdiff.DecodeShellStateDiff(barr)
 }
 
+func (sdiff ShellStateDiff) EncodeMsgpack(enc *msgpack.Encoder) error {
+	_, encodedBytes := sdiff.EncodeAndHash()
+	return enc.EncodeBytes(encodedBytes)
+}
+
+func (sdiff *ShellStateDiff) DecodeMsgpack(dec *msgpack.Decoder) error {
+	barr, err := dec.DecodeBytes()
+	if err != nil {
+		return err
+	}
+	return sdiff.DecodeShellStateDiff(barr)
+}
+
 // caches HashVal in struct
 func (sdiff *ShellStateDiff) GetHashVal(force bool) string {
 	if sdiff.HashVal == "" || force {
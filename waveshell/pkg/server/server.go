@@ -662,6 +662,7 @@ func (m *MServer) packetSenderErrorHandler(sender *packet.PacketSender, pk packe
 
 func (server *MServer) runReadLoop() {
 	builder := packet.MakeRunPacketBuilder()
+	builder.MaxTotalRunData = shexec.MaxTotalRunDataSize
 	for pk := range server.MainInput.MainCh {
 		if server.Debug {
 			fmt.Printf("PK> %s\n", packet.AsString(pk))
@@ -1470,6 +1470,7 @@ func (c *ShExecType) WaitForCommand() *packet.CmdDonePacketType {
 	cmdDuration := endTs.Sub(c.StartTs)
 	donePacket.Ts = endTs.UnixMilli()
 	donePacket.ExitCode = GetExitCode(exitErr)
+	donePacket.SetProcessState(c.Cmd.ProcessState)
 	donePacket.DurationMs = int64(cmdDuration / time.Millisecond)
 	if c.FileNames != nil {
 		os.Remove(c.FileNames.StdinFifo) // best effort (no need to check error)
@@ -94,9 +94,12 @@ func init() {
 var GlobalStore *Store
 
 type Store struct {
-	Lock       *sync.Mutex
-	Map        map[string]*MShellProc // key=remoteid
-	CmdWaitMap map[base.CommandKey][]func()
+	Lock        *sync.Mutex
+	Map         map[string]*MShellProc // key=remoteid
+	CmdWaitMap  map[base.CommandKey]*cmdWaitQueue
+	CmdDrainMap map[base.CommandKey]*cmdDrain // cks with an active runCmdWaitFns drain
+	CmdWaitInfo map[base.CommandKey]*cmdWaitInfo
+	UpdateStats UpdateQueueStats // see GetUpdateQueueStats
 }
 
 type pendingStateKey struct {
@@ -242,9 +245,11 @@ func (state RemoteRuntimeState) GetDisplayName(rptr *sstore.RemotePtrType) strin
 
 func LoadRemotes(ctx context.Context) error {
 	GlobalStore = &Store{
-		Lock:       &sync.Mutex{},
-		Map:        make(map[string]*MShellProc),
-		CmdWaitMap: make(map[base.CommandKey][]func()),
+		Lock:        &sync.Mutex{},
+		Map:         make(map[string]*MShellProc),
+		CmdWaitMap:  make(map[base.CommandKey]*cmdWaitQueue),
+		CmdDrainMap: make(map[base.CommandKey]*cmdDrain),
+		CmdWaitInfo: make(map[base.CommandKey]*cmdWaitInfo),
 	}
 	allRemotes, err := sstore.GetAllRemotes(ctx)
 	if err != nil {
@@ -1491,7 +1496,7 @@ func RunCommand(ctx context.Context, sessionId string, screenId string, remotePt
 		}
 		return nil, nil, fmt.Errorf("cannot run command while a stateful command (linenum=%d) is still running", line.LineNum)
 	}
-	startCmdWait(runPacket.CK)
+	startCmdWait(runPacket.CK, CmdWaitTimeout)
 	defer func() {
 		if rtnErr != nil {
 			removeCmdWait(runPacket.CK)
@@ -1812,7 +1817,7 @@ func (msh *MShellProc) handleCmdErrorPacket(errPk *packet.CmdErrorPacketType) {
 }
 
 func (msh *MShellProc) handleDataPacket(dataPk *packet.DataPacketType, dataPosMap map[base.CommandKey]int64) {
-	realData, err := base64.StdEncoding.DecodeString(dataPk.Data64)
+	realData, err := dataPk.GetData()
 	if err != nil {
 		ack := makeDataAckPacket(dataPk.CK, dataPk.FdNum, 0, err)
 		msh.ServerProc.Input.SendPacket(ack)
@@ -4,35 +4,179 @@
 package remote
 
 import (
+	"log"
+	"sort"
+	"time"
+
 	"github.com/wavetermdev/waveterm/waveshell/pkg/base"
 )
 
-func startCmdWait(ck base.CommandKey) {
+// the update wait RunCommand starts for a command expires after this long (a safety valve, a
+// wait that is never removed would hold the command's updates forever).  an expired wait runs the
+// queued fns with a logged warning.  0 turns the timeout off.
+var CmdWaitTimeout time.Duration = 5 * time.Minute
+
+type cmdWaitInfo struct {
+	StartTs time.Time
+	Timer   *time.Timer // nil without a timeout
+}
+
+// updates for ck are queued (see runCmdUpdateFn) until removeCmdWait, or until timeout expires
+// (timeout <= 0 for no limit).  on timeout the queued fns are run with a logged warning.
+func startCmdWait(ck base.CommandKey, timeout time.Duration) {
 	GlobalStore.Lock.Lock()
 	defer GlobalStore.Lock.Unlock()
 	GlobalStore.CmdWaitMap[ck] = nil
+	if oldInfo := GlobalStore.CmdWaitInfo[ck]; oldInfo != nil && oldInfo.Timer != nil {
+		oldInfo.Timer.Stop()
+	}
+	waitInfo := &cmdWaitInfo{StartTs: time.Now()}
+	if timeout > 0 {
+		waitInfo.Timer = time.AfterFunc(timeout, func() { expireCmdWait(ck, waitInfo, timeout) })
+	}
+	GlobalStore.CmdWaitInfo[ck] = waitInfo
+}
+
+func expireCmdWait(ck base.CommandKey, waitInfo *cmdWaitInfo, timeout time.Duration) {
+	GlobalStore.Lock.Lock()
+	if GlobalStore.CmdWaitInfo[ck] != waitInfo {
+		// the wait was already removed (or restarted)
+		GlobalStore.Lock.Unlock()
+		return
+	}
+	numFns := GlobalStore.CmdWaitMap[ck].Len()
+	GlobalStore.Lock.Unlock()
+	log.Printf("[warning] cmd %s still waiting after %v, running %d queued update fns\n", ck, timeout, numFns)
+	removeCmdWaitSync(ck)
 }
 
-func pushCmdWaitIfRequired(ck base.CommandKey, fn func()) bool {
+// queued fns run highest priority first, FIFO within a priority
+const (
+	CmdUpdatePriorityLow    = -1
+	CmdUpdatePriorityNormal = 0
+	CmdUpdatePriorityHigh   = 1
+)
+
+// across all command keys, synchronized (GlobalStore.Lock)
+type UpdateQueueStats struct {
+	NumQueued     int64 // fns queued while their command was waiting
+	NumRunInline  int64 // fns run immediately (not waiting)
+	NumRunQueued  int64 // queued fns run by a drain
+	NumDiscarded  int64 // not queued by runCmdUpdateFnIfWaiting (not waiting)
+	NumDrains     int64
+	MaxQueueDepth int64 // most fns queued for one command at once
+}
+
+func GetUpdateQueueStats() UpdateQueueStats {
 	GlobalStore.Lock.Lock()
 	defer GlobalStore.Lock.Unlock()
-	fns, ok := GlobalStore.CmdWaitMap[ck]
+	return GlobalStore.UpdateStats
+}
+
+// the fns queued for one command, a FIFO per priority level.  nil is an empty queue.
+type cmdWaitQueue struct {
+	Levels   map[int][]func()
+	PriorArr []int // the levels in Levels (all non-empty), highest first
+	NumFns   int
+}
+
+func (q *cmdWaitQueue) Len() int {
+	if q == nil {
+		return 0
+	}
+	return q.NumFns
+}
+
+func (q *cmdWaitQueue) push(fn func(), priority int) {
+	if _, ok := q.Levels[priority]; !ok {
+		pos := sort.Search(len(q.PriorArr), func(i int) bool { return q.PriorArr[i] < priority })
+		q.PriorArr = append(q.PriorArr, 0)
+		copy(q.PriorArr[pos+1:], q.PriorArr[pos:])
+		q.PriorArr[pos] = priority
+	}
+	q.Levels[priority] = append(q.Levels[priority], fn)
+	q.NumFns++
+}
+
+// the first fn with the highest priority, nil if the queue is empty
+func (q *cmdWaitQueue) pop() func() {
+	if q.Len() == 0 {
+		return nil
+	}
+	priority := q.PriorArr[0]
+	fns := q.Levels[priority]
+	fn := fns[0]
+	fns[0] = nil
+	if len(fns) == 1 {
+		delete(q.Levels, priority)
+		q.PriorArr = q.PriorArr[1:]
+	} else {
+		q.Levels[priority] = fns[1:]
+	}
+	q.NumFns--
+	return fn
+}
+
+// when ck is not waiting the caller either runs fn inline or discards it (and counts which, see
+// incUpdateStat)
+func pushCmdWaitIfRequired(ck base.CommandKey, fn func(), priority int) bool {
+	GlobalStore.Lock.Lock()
+	defer GlobalStore.Lock.Unlock()
+	queue, ok := GlobalStore.CmdWaitMap[ck]
 	if !ok {
 		return false
 	}
-	fns = append(fns, fn)
-	GlobalStore.CmdWaitMap[ck] = fns
+	if queue == nil {
+		queue = &cmdWaitQueue{Levels: make(map[int][]func())}
+		GlobalStore.CmdWaitMap[ck] = queue
+	}
+	queue.push(fn, priority)
+	GlobalStore.UpdateStats.NumQueued++
+	if int64(queue.Len()) > GlobalStore.UpdateStats.MaxQueueDepth {
+		GlobalStore.UpdateStats.MaxQueueDepth = int64(queue.Len())
+	}
 	return true
 }
 
+func incUpdateStat(stat *int64) {
+	GlobalStore.Lock.Lock()
+	defer GlobalStore.Lock.Unlock()
+	*stat++
+}
+
 func runCmdUpdateFn(ck base.CommandKey, fn func()) {
-	pushed := pushCmdWaitIfRequired(ck, fn)
+	runCmdUpdateFnWithPriority(ck, CmdUpdatePriorityNormal, fn)
+}
+
+// priority only matters if fn is queued (it is run inline when ck is not waiting)
+func runCmdUpdateFnWithPriority(ck base.CommandKey, priority int, fn func()) {
+	pushed := pushCmdWaitIfRequired(ck, fn, priority)
 	if pushed {
 		return
 	}
+	incUpdateStat(&GlobalStore.UpdateStats.NumRunInline)
 	fn()
 }
 
+// queues fn only if ck is waiting, otherwise fn is discarded (never run inline, e.g. it would apply
+// stale state after the command completed).  returns true if fn was queued.
+func runCmdUpdateFnIfWaiting(ck base.CommandKey, fn func()) bool {
+	pushed := pushCmdWaitIfRequired(ck, fn, CmdUpdatePriorityNormal)
+	if !pushed {
+		incUpdateStat(&GlobalStore.UpdateStats.NumDiscarded)
+	}
+	return pushed
+}
+
+type cmdDrain struct {
+	DoneCh chan bool // closed when the drain finishes
+}
+
+// reentrancy: fns are never run while holding GlobalStore.Lock, and ck stays in CmdWaitMap
+// until the drain finishes.  so a running fn that calls runCmdUpdateFn for the same ck has
+// its fn appended and run by this same loop (after the current fn returns, never inline).
+// the drain is registered by endCmdWait, a removeCmdWait while it runs is a no-op (the active
+// drain will run everything that is queued).
 func runCmdWaitFns(ck base.CommandKey) {
 	for {
 		fn := removeFirstCmdWaitFn(ck)
@@ -47,24 +191,80 @@ func removeFirstCmdWaitFn(ck base.CommandKey) func() {
 	GlobalStore.Lock.Lock()
 	defer GlobalStore.Lock.Unlock()
 
-	fns := GlobalStore.CmdWaitMap[ck]
-	if len(fns) == 0 {
+	fn := GlobalStore.CmdWaitMap[ck].pop()
+	if fn == nil {
 		delete(GlobalStore.CmdWaitMap, ck)
+		if drain := GlobalStore.CmdDrainMap[ck]; drain != nil {
+			close(drain.DoneCh)
+			delete(GlobalStore.CmdDrainMap, ck)
+		}
 		return nil
 	}
-	fn := fns[0]
-	GlobalStore.CmdWaitMap[ck] = fns[1:]
+	GlobalStore.UpdateStats.NumRunQueued++
 	return fn
 }
 
-func removeCmdWait(ck base.CommandKey) {
+// returns true if the caller must run the queued fns (the drain is registered for it), or the
+// drain already running them (the ck stays in the map until the drain finishes so new fns keep
+// queueing in order)
+func endCmdWait(ck base.CommandKey) (bool, *cmdDrain) {
 	GlobalStore.Lock.Lock()
 	defer GlobalStore.Lock.Unlock()
-
-	fns := GlobalStore.CmdWaitMap[ck]
-	if len(fns) == 0 {
+	if waitInfo := GlobalStore.CmdWaitInfo[ck]; waitInfo != nil {
+		if waitInfo.Timer != nil {
+			waitInfo.Timer.Stop()
+		}
+		delete(GlobalStore.CmdWaitInfo, ck)
+	}
+	if drain := GlobalStore.CmdDrainMap[ck]; drain != nil {
+		return false, drain
+	}
+	if GlobalStore.CmdWaitMap[ck].Len() == 0 {
 		delete(GlobalStore.CmdWaitMap, ck)
-		return
+		return false, nil
+	}
+	GlobalStore.CmdDrainMap[ck] = &cmdDrain{DoneCh: make(chan bool)}
+	GlobalStore.UpdateStats.NumDrains++
+	return true, nil
+}
+
+// drains the queued fns in a new goroutine (fire-and-forget), safe to call from a queued fn
+func removeCmdWait(ck base.CommandKey) {
+	if startDrain, _ := endCmdWait(ck); startDrain {
+		go runCmdWaitFns(ck)
+	}
+}
+
+// drains the queued fns inline, all queued fns have run by the time this returns (if a drain is
+// already running, e.g. the wait timeout, this waits for it).  must not be called from a queued fn
+// for ck (it would wait on its own drain), use removeCmdWait there.
+func removeCmdWaitSync(ck base.CommandKey) {
+	startDrain, drain := endCmdWait(ck)
+	if startDrain {
+		runCmdWaitFns(ck)
+	} else if drain != nil {
+		<-drain.DoneCh
+	}
+}
+
+type CmdWaitStatus struct {
+	NumFns   int           // queued update fns
+	WaitTime time.Duration // since startCmdWait (0 once the wait was removed and the fns are draining)
+	Draining bool
+}
+
+// snapshot of the queued updates (for debugging stalled updates), no fns are run
+func DumpCmdWaitMap() map[base.CommandKey]CmdWaitStatus {
+	GlobalStore.Lock.Lock()
+	defer GlobalStore.Lock.Unlock()
+	now := time.Now()
+	rtn := make(map[base.CommandKey]CmdWaitStatus, len(GlobalStore.CmdWaitMap))
+	for ck, queue := range GlobalStore.CmdWaitMap {
+		status := CmdWaitStatus{NumFns: queue.Len(), Draining: GlobalStore.CmdDrainMap[ck] != nil}
+		if waitInfo := GlobalStore.CmdWaitInfo[ck]; waitInfo != nil {
+			status.WaitTime = now.Sub(waitInfo.StartTs)
+		}
+		rtn[ck] = status
 	}
-	go runCmdWaitFns(ck)
+	return rtn
 }
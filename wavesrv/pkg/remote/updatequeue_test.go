@@ -0,0 +1,283 @@
+// Copyright 2023, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package remote
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/base"
+)
+
+func setupTestStore() {
+	GlobalStore = &Store{
+		Lock:        &sync.Mutex{},
+		Map:         make(map[string]*MShellProc),
+		CmdWaitMap:  make(map[base.CommandKey]*cmdWaitQueue),
+		CmdDrainMap: make(map[base.CommandKey]*cmdDrain),
+		CmdWaitInfo: make(map[base.CommandKey]*cmdWaitInfo),
+	}
+}
+
+func TestRemoveCmdWaitSync(t *testing.T) {
+	setupTestStore()
+	ck := base.MakeCommandKey("screen1", "cmd1")
+	startCmdWait(ck, 0)
+	var order []int
+	for i := 0; i < 5; i++ {
+		idx := i
+		runCmdUpdateFn(ck, func() { order = append(order, idx) })
+	}
+	if len(order) != 0 {
+		t.Fatalf("fns should be queued while waiting, ran %d", len(order))
+	}
+	removeCmdWaitSync(ck)
+	if len(order) != 5 {
+		t.Fatalf("expected all 5 fns to have run, got %d", len(order))
+	}
+	for i, v := range order {
+		if v != i {
+			t.Fatalf("fns ran out of order: %v", order)
+		}
+	}
+	if _, ok := GlobalStore.CmdWaitMap[ck]; ok {
+		t.Fatalf("ck should be removed from CmdWaitMap after drain")
+	}
+	// no longer waiting, should run inline
+	ran := false
+	runCmdUpdateFn(ck, func() { ran = true })
+	if !ran {
+		t.Fatalf("fn should run inline after wait is removed")
+	}
+}
+
+func TestRemoveCmdWaitSyncEmpty(t *testing.T) {
+	setupTestStore()
+	ck := base.MakeCommandKey("screen1", "cmd2")
+	startCmdWait(ck, 0)
+	removeCmdWaitSync(ck)
+	if _, ok := GlobalStore.CmdWaitMap[ck]; ok {
+		t.Fatalf("ck should be removed from CmdWaitMap")
+	}
+}
+
+func TestReentrantCmdUpdateFn(t *testing.T) {
+	setupTestStore()
+	ck := base.MakeCommandKey("screen1", "cmd3")
+	startCmdWait(ck, 0)
+	var order []string
+	runCmdUpdateFn(ck, func() {
+		order = append(order, "a-start")
+		runCmdUpdateFn(ck, func() { order = append(order, "reentrant") })
+		// nested drain must not run the reentrant fn inline
+		removeCmdWait(ck)
+		order = append(order, "a-end")
+	})
+	runCmdUpdateFn(ck, func() { order = append(order, "b") })
+	removeCmdWaitSync(ck)
+	expected := []string{"a-start", "a-end", "b", "reentrant"}
+	if len(order) != len(expected) {
+		t.Fatalf("bad order, expected %v got %v", expected, order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("bad order, expected %v got %v", expected, order)
+		}
+	}
+	if _, ok := GlobalStore.CmdWaitMap[ck]; ok {
+		t.Fatalf("ck should be removed from CmdWaitMap after drain")
+	}
+	if GlobalStore.CmdDrainMap[ck] != nil {
+		t.Fatalf("ck should be removed from CmdDrainMap after drain")
+	}
+}
+
+func TestTimeoutDrainRace(t *testing.T) {
+	setupTestStore()
+	ck := base.MakeCommandKey("screen1", "cmd9")
+	startCmdWait(ck, 10*time.Millisecond)
+	startedCh := make(chan bool)
+	releaseCh := make(chan bool)
+	runCmdUpdateFn(ck, func() {
+		close(startedCh)
+		<-releaseCh
+	})
+	lastRan := false
+	runCmdUpdateFn(ck, func() { lastRan = true })
+	// the timer drain is now running the first fn
+	select {
+	case <-startedCh:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the wait timeout did not start a drain")
+	}
+	removedCh := make(chan bool)
+	go func() {
+		removeCmdWaitSync(ck)
+		close(removedCh)
+	}()
+	select {
+	case <-removedCh:
+		t.Fatalf("removeCmdWaitSync returned while the timer drain was still running")
+	case <-time.After(30 * time.Millisecond):
+	}
+	close(releaseCh)
+	select {
+	case <-removedCh:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("removeCmdWaitSync did not return after the timer drain finished")
+	}
+	if !lastRan {
+		t.Fatalf("removeCmdWaitSync returned before all queued fns ran")
+	}
+	GlobalStore.Lock.Lock()
+	defer GlobalStore.Lock.Unlock()
+	if _, ok := GlobalStore.CmdWaitMap[ck]; ok || GlobalStore.CmdDrainMap[ck] != nil {
+		t.Fatalf("ck should be removed after the drain")
+	}
+}
+
+func TestCmdWaitTimeout(t *testing.T) {
+	setupTestStore()
+	ck := base.MakeCommandKey("screen1", "cmd4")
+	startCmdWait(ck, 20*time.Millisecond)
+	doneCh := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		idx := i
+		runCmdUpdateFn(ck, func() { doneCh <- idx })
+	}
+	// removeCmdWait is never called, the timeout drains the queue
+	for i := 0; i < 3; i++ {
+		select {
+		case idx := <-doneCh:
+			if idx != i {
+				t.Fatalf("fns ran out of order, got %d expected %d", idx, i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("queued fns did not run after the wait timeout")
+		}
+	}
+	GlobalStore.Lock.Lock()
+	_, waiting := GlobalStore.CmdWaitMap[ck]
+	_, hasInfo := GlobalStore.CmdWaitInfo[ck]
+	GlobalStore.Lock.Unlock()
+	if waiting || hasInfo {
+		t.Fatalf("ck should be removed after the timeout drain")
+	}
+	// a late removeCmdWait is a no-op, and a removed wait does not expire
+	removeCmdWaitSync(ck)
+	startCmdWait(ck, 20*time.Millisecond)
+	removeCmdWaitSync(ck)
+	startCmdWait(ck, 0)
+	ran := false
+	runCmdUpdateFn(ck, func() { ran = true })
+	time.Sleep(50 * time.Millisecond)
+	if ran {
+		t.Fatalf("a stale timer drained the new wait")
+	}
+	removeCmdWaitSync(ck)
+	if !ran {
+		t.Fatalf("fn should have run on removeCmdWait")
+	}
+}
+
+func TestDumpCmdWaitMap(t *testing.T) {
+	setupTestStore()
+	ck1 := base.MakeCommandKey("screen1", "cmd5")
+	ck2 := base.MakeCommandKey("screen1", "cmd6")
+	startCmdWait(ck1, 0)
+	startCmdWait(ck2, 0)
+	numRun := 0
+	for i := 0; i < 3; i++ {
+		runCmdUpdateFn(ck1, func() { numRun++ })
+	}
+	time.Sleep(5 * time.Millisecond)
+	dump := DumpCmdWaitMap()
+	if len(dump) != 2 || dump[ck1].NumFns != 3 || dump[ck2].NumFns != 0 {
+		t.Fatalf("bad dump %v", dump)
+	}
+	if dump[ck1].WaitTime < 5*time.Millisecond || dump[ck1].Draining {
+		t.Fatalf("bad wait status %+v", dump[ck1])
+	}
+	if numRun != 0 {
+		t.Fatalf("dump should not run any fns, ran %d", numRun)
+	}
+	removeCmdWaitSync(ck1)
+	dump = DumpCmdWaitMap()
+	if _, ok := dump[ck1]; ok || len(dump) != 1 || numRun != 3 {
+		t.Fatalf("bad dump after drain %v (ran %d)", dump, numRun)
+	}
+}
+
+func TestCmdUpdateFnPriority(t *testing.T) {
+	setupTestStore()
+	ck := base.MakeCommandKey("screen1", "cmd7")
+	startCmdWait(ck, 0)
+	var order []string
+	queue := func(name string, priority int) {
+		runCmdUpdateFnWithPriority(ck, priority, func() { order = append(order, name) })
+	}
+	queue("data1", CmdUpdatePriorityNormal)
+	queue("low", CmdUpdatePriorityLow)
+	queue("done", CmdUpdatePriorityHigh)
+	queue("data2", CmdUpdatePriorityNormal)
+	queue("final", CmdUpdatePriorityHigh)
+	runCmdUpdateFn(ck, func() { order = append(order, "data3") })
+	removeCmdWaitSync(ck)
+	expected := []string{"done", "final", "data1", "data2", "data3", "low"}
+	if len(order) != len(expected) {
+		t.Fatalf("bad order, expected %v got %v", expected, order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("bad order, expected %v got %v", expected, order)
+		}
+	}
+}
+
+func TestUpdateQueueStats(t *testing.T) {
+	setupTestStore()
+	ck := base.MakeCommandKey("screen1", "cmd8")
+	runCmdUpdateFn(ck, func() {})
+	startCmdWait(ck, 0)
+	for i := 0; i < 3; i++ {
+		runCmdUpdateFn(ck, func() {})
+	}
+	removeCmdWaitSync(ck)
+	startCmdWait(ck, 0)
+	runCmdUpdateFn(ck, func() {})
+	removeCmdWaitSync(ck)
+	// an empty wait does not drain
+	startCmdWait(ck, 0)
+	removeCmdWaitSync(ck)
+	runCmdUpdateFn(ck, func() {})
+	stats := GetUpdateQueueStats()
+	expected := UpdateQueueStats{NumQueued: 4, NumRunInline: 2, NumRunQueued: 4, NumDrains: 2, MaxQueueDepth: 3}
+	if stats != expected {
+		t.Fatalf("bad stats, expected %+v got %+v", expected, stats)
+	}
+}
+
+func TestRunCmdUpdateFnIfWaiting(t *testing.T) {
+	setupTestStore()
+	ck := base.MakeCommandKey("screen1", "cmd9")
+	numRun := 0
+	if runCmdUpdateFnIfWaiting(ck, func() { numRun++ }) || numRun != 0 {
+		t.Fatalf("fn should be discarded when not waiting (ran %d)", numRun)
+	}
+	startCmdWait(ck, 0)
+	if !runCmdUpdateFnIfWaiting(ck, func() { numRun++ }) || numRun != 0 {
+		t.Fatalf("fn should be queued while waiting (ran %d)", numRun)
+	}
+	removeCmdWaitSync(ck)
+	if numRun != 1 {
+		t.Fatalf("queued fn should run on removeCmdWait, ran %d", numRun)
+	}
+	if runCmdUpdateFnIfWaiting(ck, func() { numRun++ }) || numRun != 1 {
+		t.Fatalf("fn should be discarded after the wait (ran %d)", numRun)
+	}
+	if stats := GetUpdateQueueStats(); stats.NumDiscarded != 2 || stats.NumRunInline != 0 {
+		t.Fatalf("bad stats %+v", stats)
+	}
+}